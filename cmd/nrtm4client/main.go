@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/cli"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
@@ -11,6 +12,18 @@ import (
 const mandatorySourceMessage = "Source name must be provided with the -source flag"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		// validate only talks to the server, so it doesn't need the database or file path
+		cli.Exec(cli.InitializeRemoteCommandProcessor(service.AppConfig{}))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		// migrate can't wait for the startup check, which refuses to run on an old schema
+		if !cli.Migrate(os.Getenv("PG_DATABASE_URL"), os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
 	envVars := []string{"PG_DATABASE_URL", "NRTM4_FILE_PATH"}
 	for _, ev := range envVars {
 		if len(os.Getenv(ev)) <= 0 {
@@ -20,10 +33,18 @@ func main() {
 	dbURL := os.Getenv("PG_DATABASE_URL")
 	boltDBPath := os.Getenv("BOLT_DATABASE_PATH")
 	nrtmFilePath := os.Getenv("NRTM4_FILE_PATH")
+	deltaWorkers := 0
+	if dw := os.Getenv("NRTM4_DELTA_DOWNLOAD_WORKERS"); len(dw) > 0 {
+		var err error
+		if deltaWorkers, err = strconv.Atoi(dw); err != nil || deltaWorkers < 1 {
+			log.Fatalln("NRTM4_DELTA_DOWNLOAD_WORKERS must be a positive number: ", dw)
+		}
+	}
 	config := service.AppConfig{
-		NRTMFilePath:     nrtmFilePath,
-		PgDatabaseURL:    dbURL,
-		BoltDatabasePath: boltDBPath,
+		NRTMFilePath:         nrtmFilePath,
+		PgDatabaseURL:        dbURL,
+		BoltDatabasePath:     boltDBPath,
+		DeltaDownloadWorkers: deltaWorkers,
 	}
 	commander := cli.InitializeCommandProcessor(config)
 	cli.Exec(commander)
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 
+	"github.com/petchells/nrtm4tools/internal/nrtm4/cli"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
 	"github.com/petchells/nrtm4tools/internal/nrtm4serve"
 )
@@ -17,6 +19,13 @@ var rpcURL = flag.String("rpcurl", "", "JSON RPC endpoint URL, defaults to http:
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "migrate" {
+		// migrate can't wait for the startup check, which refuses to run on an old schema
+		if !cli.Migrate(os.Getenv("PG_DATABASE_URL"), flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
 	envVars := []string{"PG_DATABASE_URL", "NRTM4_FILE_PATH"}
 	for _, ev := range envVars {
 		if len(os.Getenv(ev)) <= 0 {
@@ -44,12 +53,20 @@ func main() {
 	dbURL := os.Getenv("PG_DATABASE_URL")
 	boltDBPath := os.Getenv("BOLT_DATABASE_PATH")
 	nrtmFilePath := os.Getenv("NRTM4_FILE_PATH")
+	deltaWorkers := 0
+	if dw := os.Getenv("NRTM4_DELTA_DOWNLOAD_WORKERS"); len(dw) > 0 {
+		var err error
+		if deltaWorkers, err = strconv.Atoi(dw); err != nil || deltaWorkers < 1 {
+			log.Fatalln("NRTM4_DELTA_DOWNLOAD_WORKERS must be a positive number: ", dw)
+		}
+	}
 	config := service.AppConfig{
-		NRTMFilePath:     nrtmFilePath,
-		PgDatabaseURL:    dbURL,
-		BoltDatabasePath: boltDBPath,
-		WebSocketURL:     *wsURL,
-		RPCEndpoint:      *rpcURL,
+		NRTMFilePath:         nrtmFilePath,
+		PgDatabaseURL:        dbURL,
+		BoltDatabasePath:     boltDBPath,
+		DeltaDownloadWorkers: deltaWorkers,
+		WebSocketURL:         *wsURL,
+		RPCEndpoint:          *rpcURL,
 	}
 	nrtm4serve.Launch(config, *port, *webdir)
 }
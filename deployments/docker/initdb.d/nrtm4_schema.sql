@@ -50,11 +50,18 @@ CREATE FUNCTION public.store_rpslobject_history() RETURNS trigger
     AS $$
     DECLARE
         _seq bigint;
+        _superseded integer;
     BEGIN
         set timezone to 'UTC'; -- it should be anyway, but just in case
         SELECT nextval('_history_seq') INTO _seq;
+        IF TG_OP = 'UPDATE' THEN
+            _superseded := NEW.version;
+        ELSE
+            -- Set by the delta transaction before it deletes objects
+            _superseded := NULLIF(current_setting('nrtm4.delta_version', true), '')::integer;
+        END IF;
         INSERT INTO nrtm_rpslobject_history
-            (id, seq, stamp, original_id, object_type, primary_key, source_id, version, rpsl)
+            (id, seq, stamp, original_id, object_type, primary_key, source_id, version, rpsl, superseded_version)
         VALUES (
             id_generator(),
             _seq,
@@ -64,7 +71,8 @@ CREATE FUNCTION public.store_rpslobject_history() RETURNS trigger
             OLD.primary_key,
             OLD.source_id,
             OLD.version,
-            OLD.rpsl
+            OLD.rpsl,
+            _superseded
         );
         RETURN NEW;
     END;
@@ -97,6 +105,23 @@ CREATE SEQUENCE public._seq
 
 SET default_table_access_method = heap;
 
+--
+-- Name: nrtm_invalid_object; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.nrtm_invalid_object (
+    id bigint NOT NULL,
+    source_id bigint NOT NULL,
+    object_type character varying(255) NOT NULL,
+    primary_key character varying(255) NOT NULL,
+    version integer NOT NULL,
+    rejected boolean NOT NULL,
+    findings jsonb NOT NULL,
+    rpsl text NOT NULL,
+    created timestamp without time zone NOT NULL
+);
+
+
 --
 -- Name: nrtm_notification; Type: TABLE; Schema: public; Owner: -
 --
@@ -137,7 +162,52 @@ CREATE TABLE public.nrtm_rpslobject_history (
     primary_key character varying(255) NOT NULL,
     source_id bigint NOT NULL,
     version integer NOT NULL,
-    rpsl text NOT NULL
+    rpsl text NOT NULL,
+    superseded_version integer
+);
+
+
+--
+-- Name: nrtm_signing_key; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.nrtm_signing_key (
+    id bigint NOT NULL,
+    source character varying(255) NOT NULL,
+    notification_url text NOT NULL,
+    pem text NOT NULL,
+    fingerprint character varying(255) NOT NULL,
+    status character varying(255) DEFAULT 'active'::character varying NOT NULL,
+    created timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: nrtm_signing_key_event; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.nrtm_signing_key_event (
+    id bigint NOT NULL,
+    key_id bigint NOT NULL,
+    source character varying(255) NOT NULL,
+    notification_url text NOT NULL,
+    fingerprint character varying(255) NOT NULL,
+    event character varying(255) NOT NULL,
+    created timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: nrtm_snapshot_checkpoint; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.nrtm_snapshot_checkpoint (
+    id bigint NOT NULL,
+    source_id bigint NOT NULL,
+    version integer NOT NULL,
+    record_offset bigint NOT NULL,
+    object_count bigint NOT NULL,
+    updated timestamp without time zone NOT NULL
 );
 
 
@@ -167,6 +237,22 @@ CREATE TABLE public.schema_version (
 );
 
 
+--
+-- Name: nrtm_invalid_object nrtm_invalid_object__pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_invalid_object
+    ADD CONSTRAINT nrtm_invalid_object__pk PRIMARY KEY (id);
+
+
+--
+-- Name: nrtm_invalid_object nrtm_invalid_object__source__type__key__uid; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_invalid_object
+    ADD CONSTRAINT nrtm_invalid_object__source__type__key__uid UNIQUE (source_id, object_type, primary_key);
+
+
 --
 -- Name: nrtm_notification nrtm_notification__pk; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -183,6 +269,38 @@ ALTER TABLE ONLY public.nrtm_rpslobject_history
     ADD CONSTRAINT nrtm_rpslobject_history_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: nrtm_signing_key nrtm_signing_key__pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_signing_key
+    ADD CONSTRAINT nrtm_signing_key__pk PRIMARY KEY (id);
+
+
+--
+-- Name: nrtm_signing_key_event nrtm_signing_key_event__pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_signing_key_event
+    ADD CONSTRAINT nrtm_signing_key_event__pk PRIMARY KEY (id);
+
+
+--
+-- Name: nrtm_snapshot_checkpoint nrtm_snapshot_checkpoint__pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_snapshot_checkpoint
+    ADD CONSTRAINT nrtm_snapshot_checkpoint__pk PRIMARY KEY (id);
+
+
+--
+-- Name: nrtm_snapshot_checkpoint nrtm_snapshot_checkpoint__source__uid; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_snapshot_checkpoint
+    ADD CONSTRAINT nrtm_snapshot_checkpoint__source__uid UNIQUE (source_id);
+
+
 --
 -- Name: nrtm_source nrtm_source__pk; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -265,6 +383,22 @@ ALTER TABLE ONLY public.nrtm_notification
     ADD CONSTRAINT nrtm_notification__nrtm_source__fk FOREIGN KEY (source_id) REFERENCES public.nrtm_source(id);
 
 
+--
+-- Name: nrtm_invalid_object nrtm_invalid_object__nrtm_source__fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_invalid_object
+    ADD CONSTRAINT nrtm_invalid_object__nrtm_source__fk FOREIGN KEY (source_id) REFERENCES public.nrtm_source(id);
+
+
+--
+-- Name: nrtm_snapshot_checkpoint nrtm_snapshot_checkpoint__nrtm_source__fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.nrtm_snapshot_checkpoint
+    ADD CONSTRAINT nrtm_snapshot_checkpoint__nrtm_source__fk FOREIGN KEY (source_id) REFERENCES public.nrtm_source(id);
+
+
 --
 -- Name: nrtm_rpslobject rpslobject__nrtm_source__fk; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -277,3 +411,9 @@ ALTER TABLE ONLY public.nrtm_rpslobject
 -- PostgreSQL database dump complete
 --
 
+
+--
+-- Data for Name: schema_version; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+INSERT INTO public.schema_version VALUES (8);
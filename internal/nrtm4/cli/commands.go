@@ -1,18 +1,46 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
 )
 
 // ExecutionProcessor top-level processing for app functions
 type ExecutionProcessor interface {
-	Connect(string, string) error
-	Update(string, string) (*persist.NRTMSource, error)
+	Connect(context.Context, string, string) error
+	ResumeConnect(context.Context, string, string) error
+	Update(context.Context, string, string) (*persist.NRTMSource, error)
 	ListSources() ([]persist.NRTMSourceDetails, error)
 	ReplaceLabel(string, string, string) (*persist.NRTMSource, error)
-	RemoveSource(string, string) error
+	RemoveSource(context.Context, string, string) error
+	PlanConnect(context.Context, string, string) (service.UpdatePlan, error)
+	PlanUpdate(context.Context, string, string) (service.UpdatePlan, error)
+	AddSigningKey(string, string, string) (persist.SigningKey, error)
+	ListSigningKeys() ([]persist.SigningKey, error)
+	RemoveSigningKey(uint64) error
+	ListSigningKeyEvents(string) ([]persist.SigningKeyEvent, error)
+	SetSignaturePolicy(string, string, bool) (*persist.NRTMSource, error)
+	SetRetentionPolicy(string, string, persist.RetentionPolicy) (*persist.NRTMSource, error)
+	CollectGarbage(context.Context, bool, bool) (service.GarbageReport, error)
+	ValidateServer(context.Context, string, []string) (service.ValidationReport, error)
+	Verify(context.Context, string, string) (service.VerifyReport, error)
+	ObjectsAt(context.Context, string, string, uint32, time.Time, []string, func(rpsl.Rpsl) error) (uint32, error)
+	GetObjectHistory(string, string, string, string) (service.ObjectHistory, error)
+	Diff(context.Context, string, string, uint32, uint32, int) (service.ChangeSet, error)
+	SetValidationMode(string, string, persist.ValidationMode) (*persist.NRTMSource, error)
+	InvalidObjects(string, string) (service.InvalidObjectReport, error)
+	ExpandSet(context.Context, string, service.ExpandOptions) (service.SetExpansion, error)
 }
 
 // CommandExecutor invokes processor and outputs responses to command line input
@@ -27,7 +55,9 @@ func NewCommandProcessor(processor ExecutionProcessor) CommandExecutor {
 
 // Connect establishes a new connection to a NRTM source server
 func (ce CommandExecutor) Connect(notificationURL string, label string) {
-	err := ce.processor.Connect(notificationURL, label)
+	ctx, stop := interruptContext()
+	defer stop()
+	err := ce.processor.Connect(ctx, notificationURL, label)
 	if err != nil {
 		logger.Error("Failed to Connect", "url", notificationURL, "error", err)
 		return
@@ -35,16 +65,82 @@ func (ce CommandExecutor) Connect(notificationURL string, label string) {
 	logger.Info("Connect successful", "url", notificationURL)
 }
 
+// ResumeConnect continues loading the snapshot of a source that failed to Connect
+func (ce CommandExecutor) ResumeConnect(notificationURL string, label string) {
+	ctx, stop := interruptContext()
+	defer stop()
+	err := ce.processor.ResumeConnect(ctx, notificationURL, label)
+	if err != nil {
+		logger.Error("Failed to resume Connect", "url", notificationURL, "error", err)
+		return
+	}
+	logger.Info("Connect successful", "url", notificationURL)
+}
+
 // Update brings local mirror up to date
 func (ce CommandExecutor) Update(source string, label string) {
-	_, err := ce.processor.Update(source, label)
-	if err != nil {
+	ctx, stop := interruptContext()
+	defer stop()
+	_, err := ce.processor.Update(ctx, source, label)
+	var hashErr service.ErrDeltaHashChanged
+	if errors.As(err, &hashErr) {
+		logger.Error("Server changed a delta file it published before. Update rejected", "version", hashErr.Version, "error", err)
+	} else if err != nil {
 		logger.Warn("Error occurred during update", "error", err)
 	} else {
 		logger.Info("Update finished successfully")
 	}
 }
 
+// PlanConnect reports what Connect would do without changing the repo
+func (ce CommandExecutor) PlanConnect(notificationURL string, label string) {
+	ctx, stop := interruptContext()
+	defer stop()
+	plan, err := ce.processor.PlanConnect(ctx, notificationURL, label)
+	if err != nil {
+		logger.Error("Failed to plan Connect", "url", notificationURL, "error", err)
+		return
+	}
+	printPlan(plan)
+	logger.Info("Dry run finished. The repo was not changed")
+}
+
+// PlanUpdate reports what Update would do without changing the repo
+func (ce CommandExecutor) PlanUpdate(source string, label string) {
+	ctx, stop := interruptContext()
+	defer stop()
+	plan, err := ce.processor.PlanUpdate(ctx, source, label)
+	if err != nil {
+		logger.Warn("Error occurred when planning update", "error", err)
+		return
+	}
+	printPlan(plan)
+	logger.Info("Dry run finished. The repo was not changed")
+}
+
+func printPlan(plan service.UpdatePlan) {
+	snapshot := "no"
+	if plan.SnapshotRequired && plan.Snapshot != nil {
+		snapshot = fmt.Sprintf("yes, version %v", plan.Snapshot.Version)
+	}
+	deltas := "none"
+	if len(plan.Deltas) > 0 {
+		deltas = fmt.Sprintf("%v to %v (%d files)", plan.Deltas[0].Version, plan.Deltas[len(plan.Deltas)-1].Version, len(plan.Deltas))
+	}
+	fmt.Printf(`		Source          : %v
+		Label           : %v
+		Session         : %v
+		Version         : %v -> %v
+		Session restart : %v
+		Snapshot needed : %v
+		Deltas to apply : %v
+		Too far behind  : %v
+		Download bytes  : %v
+
+`, plan.Source, plan.Label, plan.SessionID, plan.FromVersion, plan.ToVersion, plan.SessionRestarted,
+		snapshot, deltas, plan.TooFarBehind, plan.DownloadBytes)
+}
+
 // ListSources shows all sources in db
 func (ce CommandExecutor) ListSources(src, label string) {
 	// Not doing anything with these args for now", "src", src, "label", label
@@ -83,9 +179,427 @@ func (ce CommandExecutor) ReplaceLabel(src, fromLabel, toLabel string) {
 
 // RemoveSource removes a source matching src, label
 func (ce CommandExecutor) RemoveSource(src, label string) {
-	if err := ce.processor.RemoveSource(src, label); err != nil {
+	ctx, stop := interruptContext()
+	defer stop()
+	if err := ce.processor.RemoveSource(ctx, src, label); err != nil {
 		logger.Error("RemoveSource failed with error", "error", err)
 		return
 	}
 	logger.Info("Removed source")
 }
+
+// AddSigningKey adds the public key in keyFile to the trust store
+func (ce CommandExecutor) AddSigningKey(src, notificationURL, keyFile string) {
+	pemBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		logger.Error("Cannot read key file", "file", keyFile, "error", err)
+		return
+	}
+	key, err := ce.processor.AddSigningKey(src, notificationURL, string(pemBytes))
+	if err != nil {
+		logger.Error("AddSigningKey failed with error", "error", err)
+		return
+	}
+	logger.Info("Added signing key", "id", key.ID)
+}
+
+// ListSigningKeys shows all keys in the trust store
+func (ce CommandExecutor) ListSigningKeys() {
+	keys, err := ce.processor.ListSigningKeys()
+	if err != nil {
+		logger.Warn("Error occurred when listing signing keys", "error", err)
+		return
+	}
+	for _, key := range keys {
+		fmt.Printf(`		ID          : %v
+		Source      : %v
+		URL         : %v
+		Status      : %v
+		Fingerprint : %v
+		Created     : %v
+%v
+
+`, key.ID, key.Source, key.NotificationURL, key.Status, key.Fingerprint, key.Created, key.PEM)
+	}
+	logger.Info("List finished successfully")
+}
+
+// ListSigningKeyEvents shows the audit trail of key changes for a source, or all sources
+func (ce CommandExecutor) ListSigningKeyEvents(src string) {
+	events, err := ce.processor.ListSigningKeyEvents(src)
+	if err != nil {
+		logger.Warn("Error occurred when listing signing key history", "error", err)
+		return
+	}
+	for _, ev := range events {
+		fmt.Printf("%v  %-9v  key %v  %v  %v %v\n",
+			ev.Created.Format(time.RFC3339), ev.Event, ev.KeyID, ev.Fingerprint, ev.Source, ev.NotificationURL)
+	}
+	logger.Info("List finished successfully")
+}
+
+// RemoveSigningKey removes a key from the trust store
+func (ce CommandExecutor) RemoveSigningKey(id uint64) {
+	if err := ce.processor.RemoveSigningKey(id); err != nil {
+		logger.Error("RemoveSigningKey failed with error", "error", err)
+		return
+	}
+	logger.Info("Removed signing key", "id", id)
+}
+
+// SetSignaturePolicy sets whether unsigned notifications are rejected for a source
+func (ce CommandExecutor) SetSignaturePolicy(src, label string, require bool) {
+	if _, err := ce.processor.SetSignaturePolicy(src, label, require); err != nil {
+		logger.Error("SetSignaturePolicy failed with error", "error", err)
+		return
+	}
+	logger.Info("Signature policy saved", "source", src, "label", label, "require", require)
+}
+
+// SetValidationMode sets how objects are checked against their class templates for a source
+func (ce CommandExecutor) SetValidationMode(src, label string, mode persist.ValidationMode) {
+	if _, err := ce.processor.SetValidationMode(src, label, mode); err != nil {
+		logger.Error("SetValidationMode failed with error", "error", err)
+		return
+	}
+	logger.Info("Validation mode saved", "source", src, "label", label, "mode", mode.String())
+}
+
+// SetRetentionPolicy sets which downloaded files are kept for a source
+func (ce CommandExecutor) SetRetentionPolicy(src, label string, policy persist.RetentionPolicy) {
+	if _, err := ce.processor.SetRetentionPolicy(src, label, policy); err != nil {
+		logger.Error("SetRetentionPolicy failed with error", "error", err)
+		return
+	}
+	logger.Info("Retention policy saved", "source", src, "label", label,
+		"keepDeltas", policy.KeepDeltas, "maxAgeDays", policy.MaxAgeDays, "currentSnapshotOnly", policy.CurrentSnapshotOnly)
+}
+
+// CollectGarbage removes downloaded files which are no longer needed, and shows how much space
+// was freed. Session directories of removed sources are only removed when removeOrphans is true.
+func (ce CommandExecutor) CollectGarbage(dryRun, removeOrphans bool) {
+	ctx, stop := interruptContext()
+	defer stop()
+	report, err := ce.processor.CollectGarbage(ctx, dryRun, removeOrphans)
+	if err != nil {
+		logger.Error("CollectGarbage failed with error", "error", err)
+		return
+	}
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	for _, path := range report.Removed {
+		fmt.Printf("%v %v\n", verb, path)
+	}
+	fmt.Printf("%v %v files and directories, %v\n", verb, len(report.Removed), formatBytes(report.BytesFreed))
+	for _, path := range report.Orphans {
+		fmt.Printf("Kept %v, use -orphans to remove it\n", path)
+	}
+}
+
+// ValidateServer checks a server and every file it lists, and writes the report as JSON, or as
+// text, to outFile or stdout. Returns false if the server could not be checked or has
+// violations.
+func (ce CommandExecutor) ValidateServer(notificationURL, keyFile, outFile string, asText bool) bool {
+	keys := []string{}
+	if len(keyFile) > 0 {
+		pemBytes, err := os.ReadFile(keyFile)
+		if err != nil {
+			logger.Error("Cannot read key file", "file", keyFile, "error", err)
+			return false
+		}
+		keys = append(keys, string(pemBytes))
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	report, err := ce.processor.ValidateServer(ctx, notificationURL, keys)
+	if err != nil {
+		logger.Error("ValidateServer failed with error", "error", err)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if !asText {
+		writeJSONReport(out, report)
+		return report.Valid
+	}
+	fmt.Fprintf(out, "%v %v version %v, signature %v, %v files checked, %v violations\n",
+		report.NotificationURL, report.Source, report.Version, report.Signature, report.FilesChecked, len(report.Violations))
+	for _, v := range report.Violations {
+		fmt.Fprintf(out, "%-12v %v", v.Check, v.URL)
+		if v.Record > 0 {
+			fmt.Fprintf(out, " record %v", v.Record)
+		}
+		fmt.Fprintf(out, ": %v\n", v.Message)
+	}
+	return report.Valid
+}
+
+// Verify compares the server's snapshot with the repo, and writes the differences as text, or
+// as JSON, to outFile or stdout. Returns false if the source could not be verified or differs
+// from the snapshot.
+func (ce CommandExecutor) Verify(src, label, outFile string, asJSON bool) bool {
+	ctx, stop := interruptContext()
+	defer stop()
+	report, err := ce.processor.Verify(ctx, src, label)
+	if err != nil {
+		logger.Error("Verify failed with error", "error", err)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if asJSON {
+		writeJSONReport(out, report)
+		return report.Consistent
+	}
+	fmt.Fprintf(out, "%v %v snapshot version %v, repo version %v: %v matched, %v missing, %v extra, %v different\n",
+		report.Source, report.Label, report.Version, report.RepoVersion, report.Matched, report.MissingCount, report.ExtraCount, report.DifferentCount)
+	lists := []struct {
+		name  string
+		keys  []service.ObjectKey
+		count int
+	}{
+		{"missing", report.Missing, report.MissingCount},
+		{"extra", report.Extra, report.ExtraCount},
+		{"different", report.Different, report.DifferentCount},
+	}
+	for _, list := range lists {
+		for _, key := range list.keys {
+			fmt.Fprintf(out, "%-10v %v %v\n", list.name, key.ObjectType, key.PrimaryKey)
+		}
+		if list.count > len(list.keys) {
+			fmt.Fprintf(out, "%-10v ...and %v more\n", list.name, list.count-len(list.keys))
+		}
+	}
+	return report.Consistent
+}
+
+// Objects writes the RPSL objects of a source as they were at a version, or at a time, to
+// outFile or stdout, separated by blank lines. The time is RFC 3339 or a date. With neither, the
+// current objects are written. Returns false if the objects could not be written.
+func (ce CommandExecutor) Objects(src, label string, version uint32, at string, objectTypes []string, outFile string) bool {
+	var ts time.Time
+	if len(at) > 0 {
+		var err error
+		if ts, err = service.ParseTimestamp(at); err != nil {
+			logger.Error("Cannot parse time", "time", at, "error", err)
+			return false
+		}
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	count := 0
+	version, err = ce.processor.ObjectsAt(ctx, src, label, version, ts, objectTypes, func(obj rpsl.Rpsl) error {
+		count++
+		_, err := fmt.Fprintf(out, "%v\n\n", strings.TrimRight(obj.Payload, "\n"))
+		return err
+	})
+	if err != nil {
+		logger.Error("Cannot read objects", "source", src, "label", label, "error", err)
+		return false
+	}
+	// The log goes to stdout, so it's only written when the objects aren't
+	if len(outFile) > 0 {
+		logger.Info("Objects written", "file", outFile, "version", version, "count", count)
+	}
+	return true
+}
+
+// ObjectHistory writes every revision of an object as text, or as JSON, to outFile or stdout.
+// Returns false if the history could not be read, or the object has never been in the source.
+func (ce CommandExecutor) ObjectHistory(src, label, objectType, primaryKey, outFile string, asJSON bool) bool {
+	history, err := ce.processor.GetObjectHistory(src, label, objectType, primaryKey)
+	if err != nil {
+		logger.Error("Cannot read object history", "source", src, "label", label, "error", err)
+		return false
+	}
+	if len(history.Revisions) == 0 {
+		logger.Warn("Object has no history in the source", "source", src, "label", label, "type", history.ObjectType, "key", history.PrimaryKey)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if asJSON {
+		writeJSONReport(out, history)
+		return true
+	}
+	for _, rev := range history.Revisions {
+		ts := "unknown time"
+		if rev.Timestamp != nil {
+			ts = rev.Timestamp.UTC().Format(time.RFC3339)
+		}
+		version := "unknown version"
+		if rev.Version > 0 {
+			version = fmt.Sprintf("version %v", rev.Version)
+		}
+		if rev.Deleted {
+			fmt.Fprintf(out, "%% %v, %v: deleted\n\n", version, ts)
+			continue
+		}
+		fmt.Fprintf(out, "%% %v, %v\n%v\n\n", version, ts, strings.TrimRight(rev.RPSL, "\n"))
+	}
+	return true
+}
+
+// Diff writes the objects which changed between two versions of a source as text, or as JSON,
+// to outFile or stdout. The text shows the lines of each payload before the change prefixed
+// with -, and after it with +. Returns false if the change set could not be made.
+func (ce CommandExecutor) Diff(src, label string, fromVersion, toVersion uint32, outFile string, asJSON bool) bool {
+	ctx, stop := interruptContext()
+	defer stop()
+	changes, err := ce.processor.Diff(ctx, src, label, fromVersion, toVersion, 0)
+	if err != nil {
+		logger.Error("Cannot compare versions", "source", src, "label", label, "from", fromVersion, "to", toVersion, "error", err)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if asJSON {
+		writeJSONReport(out, changes)
+		return true
+	}
+	fmt.Fprintf(out, "%v %v version %v to %v: %v added, %v modified, %v deleted\n",
+		changes.Source, changes.Label, changes.FromVersion, changes.ToVersion, changes.Added, changes.Modified, changes.Deleted)
+	for _, change := range changes.Changes {
+		fmt.Fprintf(out, "\n%v %v %v\n", change.Action, change.ObjectType, change.PrimaryKey)
+		writePrefixedLines(out, "- ", change.Before)
+		writePrefixedLines(out, "+ ", change.After)
+	}
+	return true
+}
+
+// Expand writes the AS numbers of an as-set, or the prefixes of a route-set, one per line,
+// or the whole expansion as JSON, to outFile or stdout. Sets which are missing, in a cycle or
+// nested too deeply are listed after them as comments. Returns false if the set can't be expanded.
+func (ce CommandExecutor) Expand(name string, opts service.ExpandOptions, outFile string, asJSON bool) bool {
+	ctx, stop := interruptContext()
+	defer stop()
+	exp, err := ce.processor.ExpandSet(ctx, name, opts)
+	if err != nil {
+		logger.Error("Cannot expand set", "set", name, "sources", opts.Sources, "error", err)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if asJSON {
+		writeJSONReport(out, exp)
+		return true
+	}
+	members := exp.ASNs
+	if exp.ObjectType == "ROUTE-SET" {
+		members = exp.Prefixes
+	}
+	fmt.Fprintf(out, "%% %v %v from %v: %v members, %v sets\n",
+		exp.ObjectType, exp.Name, strings.Join(exp.Sources, ","), len(members), len(exp.Sets))
+	for _, member := range members {
+		fmt.Fprintln(out, member)
+	}
+	for _, set := range exp.Missing {
+		fmt.Fprintf(out, "%% missing: %v\n", set)
+	}
+	for _, cycle := range exp.Cycles {
+		fmt.Fprintf(out, "%% cycle: %v\n", cycle)
+	}
+	for _, set := range exp.DepthLimited {
+		fmt.Fprintf(out, "%% too deep: %v\n", set)
+	}
+	return true
+}
+
+func writePrefixedLines(out io.Writer, prefix, text string) {
+	if len(text) == 0 {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		fmt.Fprintf(out, "%v%v\n", prefix, line)
+	}
+}
+
+// stdoutReport writes a report to stdout, which is not closed afterwards
+type stdoutReport struct {
+	io.Writer
+}
+
+func (stdoutReport) Close() error {
+	return nil
+}
+
+// createReportFile creates outFile, or returns stdout if it's empty
+func createReportFile(outFile string) (io.WriteCloser, error) {
+	if len(outFile) == 0 {
+		return stdoutReport{os.Stdout}, nil
+	}
+	out, err := os.Create(outFile)
+	if err != nil {
+		logger.Error("Cannot create report file", "file", outFile, "error", err)
+	}
+	return out, err
+}
+
+func writeJSONReport(out io.Writer, report any) {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logger.Error("Cannot write report", "error", err)
+	}
+}
+
+// interruptContext is cancelled when the user presses Ctrl-C, so that downloads and database
+// transactions are stopped cleanly
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// InvalidObjects writes the report of a source's invalid objects as text, or as JSON, to
+// outFile or stdout. The text lists each object with its findings. Returns false if the report
+// could not be made.
+func (ce CommandExecutor) InvalidObjects(src, label, outFile string, asJSON bool) bool {
+	report, err := ce.processor.InvalidObjects(src, label)
+	if err != nil {
+		logger.Error("Cannot list invalid objects", "source", src, "label", label, "error", err)
+		return false
+	}
+	out, err := createReportFile(outFile)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if asJSON {
+		writeJSONReport(out, report)
+		return true
+	}
+	fmt.Fprintf(out, "%v %v validation %v: %v invalid objects, %v rejected\n",
+		report.Source, report.Label, report.Validation, len(report.Objects), report.Rejected)
+	for _, obj := range report.Objects {
+		status := "saved"
+		if obj.Rejected {
+			status = "rejected"
+		}
+		fmt.Fprintf(out, "\n%v %v version %v, %v\n", obj.ObjectType, obj.PrimaryKey, obj.Version, status)
+		for _, finding := range obj.Findings {
+			fmt.Fprintf(out, "  %v\n", finding)
+		}
+	}
+	return true
+}
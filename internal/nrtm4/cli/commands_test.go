@@ -1,19 +1,26 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
 )
 
 type ProcessorStub struct{}
 
-func (ps ProcessorStub) Connect(url, label string) error {
+func (ps ProcessorStub) Connect(ctx context.Context, url, label string) error {
 	return errors.New("test error")
 }
 
-func (ps ProcessorStub) Update(srcName, label string) (*persist.NRTMSource, error) {
+func (ps ProcessorStub) Update(ctx context.Context, srcName, label string) (*persist.NRTMSource, error) {
 	return new(persist.NRTMSource), nil
 }
 
@@ -25,10 +32,312 @@ func (ps ProcessorStub) ReplaceLabel(src, fromLabel, toLabel string) (*persist.N
 	return nil, nil
 }
 
-func (ps ProcessorStub) RemoveSource(src, label string) error {
+func (ps ProcessorStub) RemoveSource(ctx context.Context, src, label string) error {
 	return nil
 }
 
+func (ps ProcessorStub) ResumeConnect(ctx context.Context, url, label string) error {
+	return nil
+}
+
+func (ps ProcessorStub) PlanConnect(ctx context.Context, url, label string) (service.UpdatePlan, error) {
+	return service.UpdatePlan{SnapshotRequired: true, Snapshot: &service.PlannedDownload{Version: 2}}, nil
+}
+
+func (ps ProcessorStub) PlanUpdate(ctx context.Context, srcName, label string) (service.UpdatePlan, error) {
+	return service.UpdatePlan{}, errors.New("test error")
+}
+
+func (ps ProcessorStub) AddSigningKey(src, url, pem string) (persist.SigningKey, error) {
+	return persist.SigningKey{}, errors.New("test error")
+}
+
+func (ps ProcessorStub) ListSigningKeys() ([]persist.SigningKey, error) {
+	return []persist.SigningKey{{ID: 1, Source: "TEST"}}, nil
+}
+
+func (ps ProcessorStub) ListSigningKeyEvents(src string) ([]persist.SigningKeyEvent, error) {
+	return []persist.SigningKeyEvent{{KeyID: 1, Event: persist.SigningKeyAdded}}, nil
+}
+
+func (ps ProcessorStub) RemoveSigningKey(id uint64) error {
+	return nil
+}
+
+func (ps ProcessorStub) SetSignaturePolicy(src, label string, require bool) (*persist.NRTMSource, error) {
+	return new(persist.NRTMSource), nil
+}
+
+func (ps ProcessorStub) SetRetentionPolicy(src, label string, policy persist.RetentionPolicy) (*persist.NRTMSource, error) {
+	return new(persist.NRTMSource), nil
+}
+
+func (ps ProcessorStub) CollectGarbage(ctx context.Context, dryRun, removeOrphans bool) (service.GarbageReport, error) {
+	return service.GarbageReport{Removed: []string{"/tmp/nrtm4/TEST/session"}, BytesFreed: 2048, DryRun: dryRun}, nil
+}
+
+func (ps ProcessorStub) ValidateServer(ctx context.Context, url string, keys []string) (service.ValidationReport, error) {
+	return service.ValidationReport{
+		NotificationURL: url,
+		Violations:      []service.Violation{{Check: service.CheckHash, URL: url, Message: "hash does not match"}},
+	}, nil
+}
+
+func (ps ProcessorStub) Verify(ctx context.Context, src, label string) (service.VerifyReport, error) {
+	return service.VerifyReport{
+		Source:       src,
+		Label:        label,
+		Matched:      10,
+		Missing:      []service.ObjectKey{{ObjectType: "MNTNER", PrimaryKey: "TEST-MNT"}},
+		MissingCount: 2,
+	}, nil
+}
+
+func (ps ProcessorStub) ObjectsAt(ctx context.Context, src, label string, version uint32, at time.Time, objectTypes []string, fn func(rpsl.Rpsl) error) (uint32, error) {
+	if version > 10 {
+		return version, service.ErrVersionNotHeld
+	}
+	objects := []rpsl.Rpsl{
+		{ObjectType: "ROUTE", PrimaryKey: "192.0.2.0/24AS64500", Payload: "route: 192.0.2.0/24\norigin: AS64500\nsource: TEST\n"},
+		{ObjectType: "ROUTE", PrimaryKey: "198.51.100.0/24AS64500", Payload: "route: 198.51.100.0/24\norigin: AS64500\nsource: TEST"},
+	}
+	for _, obj := range objects {
+		if err := fn(obj); err != nil {
+			return version, err
+		}
+	}
+	return 10, nil
+}
+
+func (ps ProcessorStub) GetObjectHistory(src, label, objectType, primaryKey string) (service.ObjectHistory, error) {
+	history := service.ObjectHistory{Source: src, Label: label, ObjectType: "MNTNER", PrimaryKey: primaryKey, Revisions: []persist.ObjectRevision{}}
+	if primaryKey != "TEST-MNT" {
+		return history, nil
+	}
+	ts := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	history.Revisions = []persist.ObjectRevision{
+		{Version: 3, Timestamp: &ts, RPSL: "mntner: TEST-MNT\nsource: TEST\n"},
+		{Version: 4, Deleted: true},
+	}
+	return history, nil
+}
+
+func TestCommandExecutorObjectHistory(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "history.txt")
+	if !ce.ObjectHistory("TEST", "", "mntner", "TEST-MNT", out, false) {
+		t.Fatal("History should be written")
+	}
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal("Cannot read history file", err)
+	}
+	expected := "% version 3, 2024-01-02T10:00:00Z\nmntner: TEST-MNT\nsource: TEST\n\n% version 4, unknown time: deleted\n\n"
+	if string(bytes) != expected {
+		t.Errorf("Unexpected history:\n%q", string(bytes))
+	}
+	if ce.ObjectHistory("TEST", "", "mntner", "NOPE-MNT", out, true) {
+		t.Error("History should fail for an object which was never in the source")
+	}
+}
+
+func (ps ProcessorStub) Diff(ctx context.Context, src, label string, fromVersion, toVersion uint32, limit int) (service.ChangeSet, error) {
+	if fromVersion >= toVersion {
+		return service.ChangeSet{}, service.ErrInvalidVersionRange
+	}
+	return service.ChangeSet{
+		Source:      src,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+		Modified:    1,
+		Deleted:     1,
+		Changes: []persist.ObjectChange{
+			{ObjectType: "MNTNER", PrimaryKey: "TEST-MNT", Action: persist.ObjectModified, Before: "mntner: TEST-MNT\nsource: TEST\n", After: "mntner: TEST-MNT\nremarks: changed\nsource: TEST\n"},
+			{ObjectType: "PERSON", PrimaryKey: "TP1-TEST", Action: persist.ObjectDeleted, Before: "person: Test Person\nnic-hdl: TP1-TEST"},
+		},
+	}, nil
+}
+
+func TestCommandExecutorDiff(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "diff.txt")
+	if !ce.Diff("TEST", "", 3, 5, out, false) {
+		t.Fatal("Diff should be written")
+	}
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal("Cannot read diff file", err)
+	}
+	expected := `TEST  version 3 to 5: 0 added, 1 modified, 1 deleted
+
+modified MNTNER TEST-MNT
+- mntner: TEST-MNT
+- source: TEST
++ mntner: TEST-MNT
++ remarks: changed
++ source: TEST
+
+deleted PERSON TP1-TEST
+- person: Test Person
+- nic-hdl: TP1-TEST
+`
+	if string(bytes) != expected {
+		t.Errorf("Unexpected diff:\n%v", string(bytes))
+	}
+	if ce.Diff("TEST", "", 5, 3, out, true) {
+		t.Error("Diff should fail when the versions are the wrong way round")
+	}
+}
+
+func (ps ProcessorStub) SetValidationMode(src, label string, mode persist.ValidationMode) (*persist.NRTMSource, error) {
+	return new(persist.NRTMSource), nil
+}
+
+func (ps ProcessorStub) InvalidObjects(src, label string) (service.InvalidObjectReport, error) {
+	if src != "TEST" {
+		return service.InvalidObjectReport{}, service.ErrSourceNotFound
+	}
+	return service.InvalidObjectReport{
+		Source:     src,
+		Validation: "strict",
+		Rejected:   1,
+		Objects: []persist.InvalidObject{
+			{ObjectType: "AS-SET", PrimaryKey: "AS-BROKEN", Version: 4, Rejected: true, Findings: []rpsl.Finding{
+				{Attribute: "mnt-by", Message: "mandatory attribute is missing"},
+			}},
+		},
+	}, nil
+}
+
+func TestCommandExecutorInvalidObjects(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "invalid.txt")
+	if !ce.InvalidObjects("TEST", "", out, false) {
+		t.Fatal("Report should be written")
+	}
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal("Cannot read report file", err)
+	}
+	expected := `TEST  validation strict: 1 invalid objects, 1 rejected
+
+AS-SET AS-BROKEN version 4, rejected
+  mnt-by: mandatory attribute is missing
+`
+	if string(bytes) != expected {
+		t.Errorf("Unexpected report:\n%v", string(bytes))
+	}
+	if ce.InvalidObjects("NOPE", "", out, true) {
+		t.Error("Report should fail for an unknown source")
+	}
+}
+
+func (ps ProcessorStub) ExpandSet(ctx context.Context, name string, opts service.ExpandOptions) (service.SetExpansion, error) {
+	if name != "AS-TEST" {
+		return service.SetExpansion{}, service.ErrSetNotFound
+	}
+	return service.SetExpansion{
+		Name:         name,
+		ObjectType:   "AS-SET",
+		Sources:      []string{"TEST", "OTHER"},
+		ASNs:         []string{"AS1", "AS64500"},
+		Prefixes:     []string{},
+		Sets:         []service.ExpandedSet{{Name: "AS-TEST", Source: "TEST"}, {Name: "AS-NESTED", Source: "OTHER", Depth: 1}},
+		Missing:      []string{"AS-MISSING"},
+		Cycles:       []string{"AS-TEST > AS-NESTED > AS-TEST"},
+		DepthLimited: []string{},
+	}, nil
+}
+
+func TestCommandExecutorExpand(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "expand.txt")
+	if !ce.Expand("AS-TEST", service.ExpandOptions{}, out, false) {
+		t.Fatal("Expansion should be written")
+	}
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal("Cannot read expansion file", err)
+	}
+	expected := `% AS-SET AS-TEST from TEST,OTHER: 2 members, 2 sets
+AS1
+AS64500
+% missing: AS-MISSING
+% cycle: AS-TEST > AS-NESTED > AS-TEST
+`
+	if string(bytes) != expected {
+		t.Errorf("Unexpected expansion:\n%v", string(bytes))
+	}
+	if ce.Expand("AS-NOPE", service.ExpandOptions{}, out, true) {
+		t.Error("Expansion should fail for an unknown set")
+	}
+}
+
+func TestCommandExecutorObjects(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "objects.rpsl")
+	if !ce.Objects("TEST", "", 0, "2024-01-02", []string{"route"}, out) {
+		t.Fatal("Objects should be written")
+	}
+	bytes, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal("Cannot read objects file", err)
+	}
+	expected := "route: 192.0.2.0/24\norigin: AS64500\nsource: TEST\n\nroute: 198.51.100.0/24\norigin: AS64500\nsource: TEST\n\n"
+	if string(bytes) != expected {
+		t.Errorf("Objects are not separated by blank lines:\n%q", string(bytes))
+	}
+	if ce.Objects("TEST", "", 11, "", nil, out) {
+		t.Error("Objects should fail when the version is not held")
+	}
+	if ce.Objects("TEST", "", 0, "last tuesday", nil, out) {
+		t.Error("Objects should fail when the time cannot be parsed")
+	}
+}
+
+func TestCommandExecutorVerify(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "verify.json")
+	if ce.Verify("TEST", "", out, true) {
+		t.Error("Report with missing objects should not be consistent")
+	}
+	report := service.VerifyReport{}
+	if bytes, err := os.ReadFile(out); err != nil || json.Unmarshal(bytes, &report) != nil {
+		t.Fatal("Report should be written as JSON", err)
+	}
+	if report.MissingCount != 2 || len(report.Missing) != 1 {
+		t.Error("Report has wrong missing objects", report.Missing, report.MissingCount)
+	}
+	if ce.Verify("TEST", "", "", false) {
+		t.Error("Report with missing objects should not be consistent")
+	}
+}
+
+func TestCommandExecutorValidateServer(t *testing.T) {
+	ce := NewCommandProcessor(ProcessorStub{})
+
+	out := filepath.Join(t.TempDir(), "report.json")
+	if ce.ValidateServer("https://example.com/notification.json", "", out, false) {
+		t.Error("Report with violations should not be valid")
+	}
+	report := service.ValidationReport{}
+	if bytes, err := os.ReadFile(out); err != nil || json.Unmarshal(bytes, &report) != nil {
+		t.Fatal("Report should be written as JSON", err)
+	}
+	if len(report.Violations) != 1 || report.Violations[0].Check != service.CheckHash {
+		t.Error("Report has wrong violations", report.Violations)
+	}
+	if ce.ValidateServer("https://example.com/notification.json", "", "", true) {
+		t.Error("Report with violations should not be valid")
+	}
+}
+
 func TestCommandExecutorConnect(t *testing.T) {
 	ce := CommandExecutor{ProcessorStub{}}
 	ce.Connect("url", "label")
@@ -43,3 +352,22 @@ func TestCommandExecutorRename(t *testing.T) {
 	ce := CommandExecutor{ProcessorStub{}}
 	ce.ReplaceLabel("srcName", "label", "to")
 }
+
+func TestCommandExecutorPlan(t *testing.T) {
+	ce := CommandExecutor{ProcessorStub{}}
+	ce.ResumeConnect("url", "label")
+	ce.PlanConnect("url", "label")
+	ce.PlanUpdate("srcName", "label")
+}
+
+func TestCommandExecutorSigningKeys(t *testing.T) {
+	ce := CommandExecutor{ProcessorStub{}}
+	ce.AddSigningKey("TEST", "", "no-such-file.pem")
+	ce.ListSigningKeys()
+	ce.ListSigningKeyEvents("TEST")
+	ce.RemoveSigningKey(1)
+	ce.SetSignaturePolicy("TEST", "", true)
+	ce.SetValidationMode("TEST", "", persist.ValidationLenient)
+	ce.SetRetentionPolicy("TEST", "", persist.RetentionPolicy{KeepDeltas: 10})
+	ce.CollectGarbage(true, false)
+}
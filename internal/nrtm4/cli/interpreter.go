@@ -6,6 +6,10 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
 )
 
 var (
@@ -20,8 +24,10 @@ func Exec(commander CommandExecutor) {
 
 	connectCommand := func(args []string) {
 		fs := flag.NewFlagSet("connect", flag.ExitOnError)
-		notificationURL := fs.String("url", "", "URL to notification JSON")
+		notificationURL := fs.String("url", "", "URL to notification JSON, or a local file or directory")
 		sourceLabel := fs.String("label", "", "The label for the source. Can be empty.")
+		dryRun := fs.Bool("dry-run", false, "Report what would be done without changing the repo")
+		resume := fs.Bool("resume", false, "Continue loading a snapshot from the last saved checkpoint")
 		if err := fs.Parse(args); err != nil {
 			fmt.Printf("error: %s", err)
 			return
@@ -29,6 +35,14 @@ func Exec(commander CommandExecutor) {
 		if len(*notificationURL) == 0 {
 			log.Fatal("URL must be provided")
 		}
+		if *dryRun {
+			commander.PlanConnect(*notificationURL, *sourceLabel)
+			return
+		}
+		if *resume {
+			commander.ResumeConnect(*notificationURL, *sourceLabel)
+			return
+		}
 		commander.Connect(*notificationURL, *sourceLabel)
 	}
 
@@ -36,6 +50,7 @@ func Exec(commander CommandExecutor) {
 		fs := flag.NewFlagSet("update", flag.ExitOnError)
 		src := fs.String("source", "", "The name of the source")
 		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		dryRun := fs.Bool("dry-run", false, "Report what would be done without changing the repo")
 		if err := fs.Parse(args); err != nil {
 			fmt.Printf("error: %s", err)
 			return
@@ -43,6 +58,10 @@ func Exec(commander CommandExecutor) {
 		if len(*src) == 0 {
 			log.Fatal(mandatorySourceMessage)
 		}
+		if *dryRun {
+			commander.PlanUpdate(*src, *lbl)
+			return
+		}
 		commander.Update(*src, *lbl)
 	}
 
@@ -89,6 +108,293 @@ func Exec(commander CommandExecutor) {
 		commander.RemoveSource(*src, *lbl)
 	}
 
+	keyCommand := func(args []string) {
+		if len(args) == 0 {
+			log.Fatal("key command must be one of add, list, history, remove or policy")
+		}
+		subArgs := args[1:]
+		switch args[0] {
+		case "add":
+			fs := flag.NewFlagSet("key add", flag.ExitOnError)
+			src := fs.String("source", "", "The name of the source the key signs")
+			notificationURL := fs.String("url", "", "URL of the notification file the key signs")
+			keyFile := fs.String("file", "", "Path to a PEM encoded public key")
+			if err := fs.Parse(subArgs); err != nil {
+				fmt.Printf("error: %s", err)
+				return
+			}
+			if len(*src) == 0 && len(*notificationURL) == 0 {
+				log.Fatal("At least -source or -url must be specified")
+			}
+			if len(*keyFile) == 0 {
+				log.Fatal("Key file must be provided with the -file flag")
+			}
+			commander.AddSigningKey(*src, *notificationURL, *keyFile)
+		case "list":
+			commander.ListSigningKeys()
+		case "history":
+			fs := flag.NewFlagSet("key history", flag.ExitOnError)
+			src := fs.String("source", "", "Only show changes to keys for this source")
+			if err := fs.Parse(subArgs); err != nil {
+				fmt.Printf("error: %s", err)
+				return
+			}
+			commander.ListSigningKeyEvents(*src)
+		case "remove":
+			fs := flag.NewFlagSet("key remove", flag.ExitOnError)
+			id := fs.Uint64("id", 0, "The ID of the key, as shown by key list")
+			if err := fs.Parse(subArgs); err != nil {
+				fmt.Printf("error: %s", err)
+				return
+			}
+			if *id == 0 {
+				log.Fatal("Key ID must be provided with the -id flag")
+			}
+			commander.RemoveSigningKey(*id)
+		case "policy":
+			fs := flag.NewFlagSet("key policy", flag.ExitOnError)
+			src := fs.String("source", "", "The name of the source")
+			lbl := fs.String("label", "", "The label for the source. Can be empty.")
+			require := fs.Bool("require", true, "Reject notification files which are not signed with a trusted key")
+			if err := fs.Parse(subArgs); err != nil {
+				fmt.Printf("error: %s", err)
+				return
+			}
+			if len(*src) == 0 {
+				log.Fatal(mandatorySourceMessage)
+			}
+			commander.SetSignaturePolicy(*src, *lbl, *require)
+		default:
+			log.Fatal("key command must be one of add, list, history, remove or policy")
+		}
+	}
+
+	retentionCommand := func(args []string) {
+		fs := flag.NewFlagSet("retention", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		keepDeltas := fs.Int("keep-deltas", 0, "Number of most recent delta files to keep. 0 keeps all")
+		maxAge := fs.Int("max-age-days", 0, "Remove files downloaded more than this many days ago. 0 keeps all")
+		currentSnapshot := fs.Bool("current-snapshot-only", false, "Remove snapshot files other than the current one")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		commander.SetRetentionPolicy(*src, *lbl, persist.RetentionPolicy{
+			KeepDeltas:          *keepDeltas,
+			MaxAgeDays:          *maxAge,
+			CurrentSnapshotOnly: *currentSnapshot,
+		})
+	}
+
+	gcCommand := func(args []string) {
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "Report what would be removed without removing it")
+		orphans := fs.Bool("orphans", false, "Also remove the session directories of sources which were removed")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		commander.CollectGarbage(*dryRun, *orphans)
+	}
+
+	validateCommand := func(args []string) {
+		fs := flag.NewFlagSet("validate", flag.ExitOnError)
+		notificationURL := fs.String("url", "", "URL to notification JSON, or a local file or directory")
+		keyFile := fs.String("key", "", "Path to a PEM encoded public key which signs the notification file")
+		format := fs.String("format", "json", "Report format: json or text")
+		outFile := fs.String("o", "", "Write the report to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*notificationURL) == 0 {
+			log.Fatal("URL must be provided")
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		if !commander.ValidateServer(*notificationURL, *keyFile, *outFile, *format == "text") {
+			os.Exit(1)
+		}
+	}
+
+	verifyCommand := func(args []string) {
+		fs := flag.NewFlagSet("verify", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		format := fs.String("format", "text", "Report format: text or json")
+		outFile := fs.String("o", "", "Write the report to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		if !commander.Verify(*src, *lbl, *outFile, *format == "json") {
+			os.Exit(1)
+		}
+	}
+
+	objectsCommand := func(args []string) {
+		fs := flag.NewFlagSet("objects", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		version := fs.Uint("version", 0, "Write the objects as they were at this version")
+		at := fs.String("at", "", "Write the objects as they were at this time, RFC 3339 or a date, e.g. 2024-01-02")
+		types := fs.String("type", "", "Comma separated object types to write, e.g. route,route6. Defaults to all types")
+		outFile := fs.String("o", "", "Write the objects to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		if *version > 0 && len(*at) > 0 {
+			log.Fatal("Only one of -version or -at can be given")
+		}
+		objectTypes := []string{}
+		for _, t := range strings.Split(*types, ",") {
+			if t = strings.TrimSpace(t); len(t) > 0 {
+				objectTypes = append(objectTypes, t)
+			}
+		}
+		if !commander.Objects(*src, *lbl, uint32(*version), *at, objectTypes, *outFile) {
+			os.Exit(1)
+		}
+	}
+
+	historyCommand := func(args []string) {
+		fs := flag.NewFlagSet("history", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		objectType := fs.String("type", "", "The object type, e.g. aut-num")
+		key := fs.String("key", "", "The primary key of the object, e.g. AS64500")
+		format := fs.String("format", "text", "Output format: text or json")
+		outFile := fs.String("o", "", "Write the history to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		if len(*objectType) == 0 || len(*key) == 0 {
+			log.Fatal("Object type and primary key must be provided with the -type and -key flags")
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		if !commander.ObjectHistory(*src, *lbl, *objectType, *key, *outFile, *format == "json") {
+			os.Exit(1)
+		}
+	}
+
+	diffCommand := func(args []string) {
+		fs := flag.NewFlagSet("diff", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		from := fs.Uint("from", 0, "The version to compare from")
+		to := fs.Uint("to", 0, "The version to compare to. Defaults to the current version")
+		format := fs.String("format", "text", "Output format: text or json")
+		outFile := fs.String("o", "", "Write the changes to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		if *from == 0 {
+			log.Fatal("Version to compare from must be provided with the -from flag")
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		if !commander.Diff(*src, *lbl, uint32(*from), uint32(*to), *outFile, *format == "json") {
+			os.Exit(1)
+		}
+	}
+
+	validationCommand := func(args []string) {
+		fs := flag.NewFlagSet("validation", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		modeName := fs.String("mode", "", "none, lenient or strict")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		mode, err := persist.ParseValidationMode(*modeName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		commander.SetValidationMode(*src, *lbl, mode)
+	}
+
+	invalidCommand := func(args []string) {
+		fs := flag.NewFlagSet("invalid", flag.ExitOnError)
+		src := fs.String("source", "", "The name of the source")
+		lbl := fs.String("label", "", "The label for the source. Can be empty.")
+		format := fs.String("format", "text", "Output format: text or json")
+		outFile := fs.String("o", "", "Write the report to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*src) == 0 {
+			log.Fatal(mandatorySourceMessage)
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		if !commander.InvalidObjects(*src, *lbl, *outFile, *format == "json") {
+			os.Exit(1)
+		}
+	}
+
+	expandCommand := func(args []string) {
+		fs := flag.NewFlagSet("expand", flag.ExitOnError)
+		set := fs.String("set", "", "The name of the as-set or route-set, e.g. AS-EXAMPLE")
+		sources := fs.String("sources", "", "Comma separated sources to look for sets in, in order of priority. Defaults to all sources without a label")
+		depth := fs.Int("depth", service.DefaultExpandDepth, "The maximum depth of nested sets to expand")
+		format := fs.String("format", "text", "Output format: text or json")
+		outFile := fs.String("o", "", "Write the members to this file instead of stdout")
+		if err := fs.Parse(args); err != nil {
+			fmt.Printf("error: %s", err)
+			return
+		}
+		if len(*set) == 0 {
+			log.Fatal("Set name must be provided with the -set flag")
+		}
+		if *depth < 1 {
+			log.Fatal("Depth must be at least 1")
+		}
+		if *format != "json" && *format != "text" {
+			log.Fatal("Format must be json or text")
+		}
+		opts := service.ExpandOptions{Sources: []string{}, MaxDepth: *depth}
+		for _, s := range strings.Split(*sources, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				opts.Sources = append(opts.Sources, s)
+			}
+		}
+		if !commander.Expand(*set, opts, *outFile, *format == "json") {
+			os.Exit(1)
+		}
+	}
+
 	runCmd := func(args []string) {
 		if len(args) >= 2 {
 			subArgs := args[2:]
@@ -103,6 +409,28 @@ func Exec(commander CommandExecutor) {
 				replaceLabelCommand(subArgs)
 			case "remove":
 				removeCommand(subArgs)
+			case "key":
+				keyCommand(subArgs)
+			case "retention":
+				retentionCommand(subArgs)
+			case "gc":
+				gcCommand(subArgs)
+			case "validate":
+				validateCommand(subArgs)
+			case "verify":
+				verifyCommand(subArgs)
+			case "objects":
+				objectsCommand(subArgs)
+			case "history":
+				historyCommand(subArgs)
+			case "diff":
+				diffCommand(subArgs)
+			case "validation":
+				validationCommand(subArgs)
+			case "invalid":
+				invalidCommand(subArgs)
+			case "expand":
+				expandCommand(subArgs)
 			default:
 				log.Print(usage(args[0]))
 				flag.Usage()
@@ -139,7 +467,7 @@ func usage(cmd string) string {
 	return fmt.Sprintf(`
 	%v <command> OPTIONS
 
-	command: [connect|update]
+	command: [connect|update|list|rename|remove|key|retention|gc|validate|verify|objects|history|diff|validation|invalid|expand|migrate]
 
 	The client reads two properties from environment variables, which must be set:
 
@@ -151,7 +479,12 @@ func usage(cmd string) string {
 	The path where downloaded NRTMv4 snapshot and delta files will be written. If
 	the directory does not exist it will be created. The files are only needed
 	during updates; when the update is complete the files can be removed.
-	...Which is probably a good idea, there's a lot of files.
+	...Which is probably a good idea, there's a lot of files. Use retention and gc to
+	remove the ones which aren't needed.
+
+	NRTM4_DELTA_DOWNLOAD_WORKERS (optional)
+	The number of delta files downloaded in parallel, ahead of the one being
+	applied. Defaults to 4.
 
 
 	E.g.
@@ -164,5 +497,120 @@ func usage(cmd string) string {
 	env ${envvars} nrtm4client list
 
 	env ${envvars} nrtm4client update -source EXAMPLE
+
+	Add -dry-run to connect or update to see what would be done, without doing it.
+
+	env ${envvars} nrtm4client update -source EXAMPLE -dry-run
+
+	If connect is interrupted while loading the snapshot, add -resume to continue
+	from the last saved checkpoint.
+
+	env ${envvars} nrtm4client connect -url https://nrtm4.example.zz/notification.json -resume
+
+	A source can be connected from files on disk, e.g. a mirror of the server's
+	files. The url is a file URL or a directory with an update-notification-file.jose.
+	Updates then read new files from the same directory.
+
+	env ${envvars} nrtm4client connect -url file:///var/mirror/nrtm4/EXAMPLE/update-notification-file.jose
+
+	env ${envvars} nrtm4client connect -url /var/mirror/nrtm4/EXAMPLE
+
+	Notification files are verified with keys from the trust store. Keys are added
+	for a source name or a notification URL. Use key policy to reject notification
+	files which are not signed with a trusted key.
+
+	env ${envvars} nrtm4client key add -source EXAMPLE -file example.pem
+
+	env ${envvars} nrtm4client key list
+
+	Keys announced by a server in next_signing_key are added as pending keys, and
+	replace the old keys when the server starts using them. Every change is recorded.
+
+	env ${envvars} nrtm4client key history -source EXAMPLE
+
+	env ${envvars} nrtm4client key remove -id 123456
+
+	env ${envvars} nrtm4client key policy -source EXAMPLE -require=true
+
+	Downloaded files are kept until a retention policy says otherwise. The policy
+	is applied after each update. gc also removes the files of sources which were
+	removed, and shows how much space was freed.
+
+	env ${envvars} nrtm4client retention -source EXAMPLE -keep-deltas 1000 -current-snapshot-only
+
+	env ${envvars} nrtm4client gc -dry-run
+
+	validate checks a server's notification file, signature and every snapshot
+	and delta file it lists, and writes a JSON report of all violations. It
+	doesn't need a database or any environment variables. The exit status is 1
+	if there are violations.
+
+	nrtm4client validate -url https://nrtm4.example.zz/notification.json -format text
+
+	nrtm4client validate -url https://nrtm4.example.zz/notification.json -o report.json
+
+	verify downloads the server's current snapshot and compares it with the repo at
+	the same version, which is rebuilt from history if the repo is ahead of it.
+	It lists objects which are missing from the repo, extra in the repo, or have a
+	different payload. The exit status is 1 if there are differences.
+
+	env ${envvars} nrtm4client verify -source EXAMPLE
+
+	env ${envvars} nrtm4client verify -source EXAMPLE -format json -o verify.json
+
+	objects writes the RPSL objects of a source as they were at a -version, or at
+	a time given with -at, which is RFC 3339 or a date (midnight UTC). Earlier
+	versions are rebuilt from history. With neither, the current objects are
+	written. Use -type to only write some object types.
+
+	env ${envvars} nrtm4client objects -source EXAMPLE -at 2024-01-02 -type route,route6
+
+	env ${envvars} nrtm4client objects -source EXAMPLE -version 1234 -o example.1234.rpsl
+
+	history lists every revision of an object, with the version and time it was
+	published, and shows when it was deleted.
+
+	env ${envvars} nrtm4client history -source EXAMPLE -type aut-num -key AS64500
+
+	env ${envvars} nrtm4client history -source EXAMPLE -type mntner -key EXAMPLE-MNT -format json
+
+	diff lists the objects which were added, modified or deleted between two
+	versions, with their payloads before and after. -to defaults to the current
+	version.
+
+	env ${envvars} nrtm4client diff -source EXAMPLE -from 10500 -to 10720
+
+	env ${envvars} nrtm4client diff -source EXAMPLE -from 10500 -format json -o changes.json
+
+	Objects can be checked against the templates of their classes when snapshots
+	and deltas are loaded. In lenient mode invalid objects are saved, in strict
+	mode they're rejected. Either way they're recorded with their findings, and
+	invalid lists them.
+
+	env ${envvars} nrtm4client validation -source EXAMPLE -mode strict
+
+	env ${envvars} nrtm4client invalid -source EXAMPLE -format json -o invalid.json
+
+	expand resolves an as-set to its AS numbers, or a route-set to its prefixes,
+	following nested sets and member-of. Sets are looked for in -sources in order,
+	or in all sources without a label. Missing sets and cycles are listed after
+	the members.
+
+	env ${envvars} nrtm4client expand -set AS-EXAMPLE -sources EXAMPLE,OTHER
+
+	env ${envvars} nrtm4client expand -set RS-EXAMPLE -depth 5 -format json -o rs-example.json
+
+	The database schema migrations are built in. The client refuses to run if the
+	schema is older or newer than the version it uses. migrate upgrades the schema
+	to the latest version, or -to a given version. Only PG_DATABASE_URL is needed.
+
+	env ${envvars} nrtm4client migrate -status
+
+	env ${envvars} nrtm4client migrate
+
+	A database created from nrtm4_schema.sql before it recorded the schema version
+	needs the version to be recorded once.
+
+	env ${envvars} nrtm4client migrate -baseline <VERSION>
 	`, cmd)
 }
@@ -11,10 +11,10 @@ import (
 
 // InitializeCommandProcessor starts a db connection pool
 func InitializeCommandProcessor(config service.AppConfig) CommandExecutor {
-	var httpClient service.HTTPClient
+	httpClient := service.NewHTTPClient(service.DefaultHTTPClientConfig(), nil)
 	repo := pg.PostgresRepository{}
 	if err := repo.Initialize(config.PgDatabaseURL); err != nil {
-		log.Fatal("Failed to initialize repository")
+		log.Fatal("Failed to initialize repository: ", err)
 	}
 	defer repo.Close()
 	service.UserLogger = slog.New(
@@ -26,6 +26,24 @@ func InitializeCommandProcessor(config service.AppConfig) CommandExecutor {
 			},
 		),
 	)
+	service.ProgressHandler = newProgressBar(os.Stderr).Handle
 	processor := service.NewNRTMProcessor(config, repo, httpClient)
 	return NewCommandProcessor(processor)
 }
+
+// InitializeRemoteCommandProcessor creates a CommandExecutor without a repository, for commands
+// which only talk to a server
+func InitializeRemoteCommandProcessor(config service.AppConfig) CommandExecutor {
+	httpClient := service.NewHTTPClient(service.DefaultHTTPClientConfig(), nil)
+	service.UserLogger = slog.New(
+		slog.NewTextHandler(
+			os.Stderr,
+			&slog.HandlerOptions{
+				AddSource: false,
+				Level:     slog.LevelInfo,
+			},
+		),
+	)
+	processor := service.NewNRTMProcessor(config, nil, httpClient)
+	return NewCommandProcessor(processor)
+}
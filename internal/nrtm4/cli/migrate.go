@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg"
+)
+
+// Migrate runs the migrate command for nrtm4client and nrtm4serve. It connects to the database
+// without checking the schema version, so it must be called instead of initializing a
+// CommandExecutor. Returns false if the schema could not be migrated.
+func Migrate(dbURL string, args []string) bool {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	target := fs.Int("to", -1, "Schema version to upgrade or downgrade to. Defaults to the latest version")
+	status := fs.Bool("status", false, "Show the schema version without changing it")
+	baseline := fs.Int("baseline", -1, "Record the version of a schema created from nrtm4_schema.sql, without changing it")
+	if err := fs.Parse(args); err != nil {
+		fmt.Printf("error: %s", err)
+		return false
+	}
+	if len(dbURL) == 0 {
+		log.Fatalln("Environment variable not set: ", "PG_DATABASE_URL")
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	switch {
+	case *status:
+		current, latest, err := pg.SchemaStatus(ctx, dbURL)
+		if err != nil {
+			logger.Error("Cannot read the schema version", "error", err)
+			return false
+		}
+		fmt.Printf("Schema version %d, this build uses version %d\n", current, latest)
+		return true
+	case *baseline >= 0:
+		if err := pg.BaselineSchema(ctx, dbURL, *baseline); err != nil {
+			logger.Error("Cannot record the schema version", "error", err)
+			return false
+		}
+		fmt.Printf("Schema version recorded as %d\n", *baseline)
+		return true
+	}
+	result, err := pg.MigrateSchema(ctx, dbURL, *target)
+	for _, name := range result.Applied {
+		fmt.Printf("Applied %v\n", name)
+	}
+	if err != nil {
+		logger.Error("Migration failed", "error", err)
+		return false
+	}
+	if len(result.Applied) == 0 {
+		fmt.Printf("Schema is already at version %d\n", result.From)
+		return true
+	}
+	fmt.Printf("Schema migrated from version %d to %d\n", result.From, result.To)
+	return true
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws service.ProgressEvents as a one-line progress bar
+type progressBar struct {
+	mu  sync.Mutex
+	out io.Writer
+	// drawing is true when the last thing written is an unfinished bar
+	drawing bool
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out}
+}
+
+// Handle implements service.ProgressHandler
+func (pb *progressBar) Handle(ev service.ProgressEvent) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	switch ev.Kind {
+	case service.ProgressStarted, service.ProgressUpdated:
+		fmt.Fprintf(pb.out, "\r%v\033[K", progressLine(ev))
+		pb.drawing = true
+	case service.ProgressFinished:
+		fmt.Fprintf(pb.out, "\r%v\033[K\n", progressLine(ev))
+		pb.drawing = false
+	case service.ProgressFailed:
+		if pb.drawing {
+			fmt.Fprintln(pb.out)
+		}
+		fmt.Fprintf(pb.out, "%v failed: %v\n", phaseName(ev), ev.Error)
+		pb.drawing = false
+	}
+}
+
+func progressLine(ev service.ProgressEvent) string {
+	name := phaseName(ev)
+	count := progressCount(ev.Phase, ev.Current)
+	if ev.Total <= 0 {
+		return fmt.Sprintf("%-24v %v", name, count)
+	}
+	current := min(ev.Current, ev.Total)
+	filled := int(current * progressBarWidth / ev.Total)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	pct := current * 100 / ev.Total
+	return fmt.Sprintf("%-24v [%v] %3d%% %v / %v", name, bar, pct, count, progressCount(ev.Phase, ev.Total))
+}
+
+func phaseName(ev service.ProgressEvent) string {
+	switch ev.Phase {
+	case service.PhaseDownload:
+		return "Download " + path.Base(ev.URL)
+	case service.PhaseSnapshot:
+		return fmt.Sprintf("Snapshot %v", ev.Version)
+	case service.PhaseDeltas:
+		return "Deltas"
+	}
+	return string(ev.Phase)
+}
+
+func progressCount(phase service.ProgressPhase, n int64) string {
+	switch phase {
+	case service.PhaseDownload:
+		return formatBytes(n)
+	case service.PhaseSnapshot:
+		return fmt.Sprintf("%d objects", n)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
+)
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	pb := newProgressBar(&out)
+
+	pb.Handle(service.ProgressEvent{Phase: service.PhaseDownload, Kind: service.ProgressStarted, Total: 2048, URL: "https://example.com/snapshot.json.gz"})
+	pb.Handle(service.ProgressEvent{Phase: service.PhaseDownload, Kind: service.ProgressUpdated, Current: 1024, Total: 2048, URL: "https://example.com/snapshot.json.gz"})
+	pb.Handle(service.ProgressEvent{Phase: service.PhaseDownload, Kind: service.ProgressFinished, Current: 2048, Total: 2048, URL: "https://example.com/snapshot.json.gz"})
+
+	s := out.String()
+	if !strings.Contains(s, "Download snapshot.json.gz") {
+		t.Error("Expected file name in output", s)
+	}
+	if !strings.Contains(s, " 50% 1.0 KiB / 2.0 KiB") {
+		t.Error("Expected half way progress in output", s)
+	}
+	if !strings.HasSuffix(s, "100% 2.0 KiB / 2.0 KiB\033[K\n") {
+		t.Error("Expected finished bar at end of output", s)
+	}
+}
+
+func TestProgressBarFailure(t *testing.T) {
+	var out bytes.Buffer
+	pb := newProgressBar(&out)
+
+	pb.Handle(service.ProgressEvent{Phase: service.PhaseDeltas, Kind: service.ProgressStarted, Total: 3})
+	pb.Handle(service.ProgressEvent{Phase: service.PhaseDeltas, Kind: service.ProgressFailed, Total: -1, Error: "test error"})
+
+	if !strings.HasSuffix(out.String(), "\nDeltas failed: test error\n") {
+		t.Error("Expected failure on a new line", out.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if s := formatBytes(n); s != expected {
+			t.Error("Expected", expected, "but was", s)
+		}
+	}
+}
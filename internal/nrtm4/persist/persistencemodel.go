@@ -4,6 +4,8 @@ import (
 	"errors"
 	"strings"
 	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
 )
 
 // NRTMSource holds information about a remote NRTM source
@@ -23,6 +25,28 @@ type NRTMSource struct {
 type SourceProperties struct {
 	UpdateMode         UpdateMode
 	AutoUpdateInterval int
+	// RequireSignature rejects notification files which are not signed with a trusted key
+	RequireSignature bool
+	// Retention limits the files kept in NRTM4_FILE_PATH for the source
+	Retention RetentionPolicy
+	// Validation says what happens to objects which don't match their class template
+	Validation ValidationMode
+}
+
+// RetentionPolicy says which downloaded files are kept for a source. The zero value keeps
+// everything.
+type RetentionPolicy struct {
+	// KeepDeltas is the number of most recent delta files to keep
+	KeepDeltas int
+	// MaxAgeDays removes files downloaded more than this many days ago
+	MaxAgeDays int
+	// CurrentSnapshotOnly removes snapshot files other than the one in the latest notification
+	CurrentSnapshotOnly bool
+}
+
+// IsZero is true when the policy keeps all files
+func (rp RetentionPolicy) IsZero() bool {
+	return rp == RetentionPolicy{}
 }
 
 // UpdateMode what to do when a mirror is re-synced from a snapshot
@@ -34,8 +58,47 @@ const (
 	UpdateModePreserve UpdateMode = iota
 	// UpdateModeReplace when a repo loses sync delete it then reinitialize from snapshot
 	UpdateModeReplace
+	// UpdateModeStage when a repo loses sync, load the snapshot under a staging label then swap
+	// it with the repo when it's ready. The old repo can be queried until the swap.
+	UpdateModeStage
 )
 
+// ValidationMode says how objects are checked against their class templates when snapshots and
+// deltas are loaded
+type ValidationMode int
+
+const (
+	// ValidationNone objects are not checked
+	ValidationNone ValidationMode = iota
+	// ValidationLenient invalid objects are saved, and recorded with their findings
+	ValidationLenient
+	// ValidationStrict invalid objects are not saved, and are recorded as rejected with their
+	// findings
+	ValidationStrict
+)
+
+var validationModeNames = []string{"none", "lenient", "strict"}
+
+// ErrInvalidValidationMode the name is not a validation mode
+var ErrInvalidValidationMode = errors.New("validation mode must be one of none, lenient or strict")
+
+func (m ValidationMode) String() string {
+	if m < 0 || int(m) >= len(validationModeNames) {
+		return "unknown"
+	}
+	return validationModeNames[m]
+}
+
+// ParseValidationMode returns the mode with the name: none, lenient or strict
+func ParseValidationMode(name string) (ValidationMode, error) {
+	for i, n := range validationModeNames {
+		if strings.EqualFold(n, strings.TrimSpace(name)) {
+			return ValidationMode(i), nil
+		}
+	}
+	return ValidationNone, ErrInvalidValidationMode
+}
+
 // NRTMSourceDetails is a source with notification objects
 type NRTMSourceDetails struct {
 	NRTMSource
@@ -63,6 +126,120 @@ type Notification struct {
 	Created  time.Time
 }
 
+// ObjectRevision is an RPSL object as it was from Version until the next revision
+type ObjectRevision struct {
+	// Version is the NRTM version which added, changed or deleted the object. It's 0 for
+	// deletions which were recorded before the version was saved with the history.
+	Version uint32
+	// Timestamp is when the server first published Version, according to the notification
+	// files saved for the source. Nil if it isn't known.
+	Timestamp *time.Time
+	// Deleted is true when the object was deleted at Version. RPSL is empty.
+	Deleted bool
+	RPSL    string
+}
+
+// InvalidObject is an object which didn't match its class template when it was loaded
+type InvalidObject struct {
+	ObjectType string
+	PrimaryKey string
+	// Version is the snapshot or delta version which had the object
+	Version uint32
+	// Rejected is true when the object was not saved, because the source uses strict validation
+	Rejected bool
+	Findings []rpsl.Finding
+	RPSL     string
+	Created  time.Time
+}
+
+// ObjectChangeAction says how an object changed between two versions
+type ObjectChangeAction string
+
+const (
+	// ObjectAdded the object was not in the source at the first version
+	ObjectAdded ObjectChangeAction = "added"
+	// ObjectModified the object has a different payload at the second version
+	ObjectModified ObjectChangeAction = "modified"
+	// ObjectDeleted the object is not in the source at the second version
+	ObjectDeleted ObjectChangeAction = "deleted"
+)
+
+// ObjectChange is the difference in an object between two versions of a source. Before is
+// empty when it was added, and After is empty when it was deleted.
+type ObjectChange struct {
+	ObjectType string
+	PrimaryKey string
+	Action     ObjectChangeAction
+	Before     string
+	After      string
+}
+
+// SnapshotCheckpoint records how far a snapshot load has progressed
+type SnapshotCheckpoint struct {
+	SourceID uint64 `json:",string"`
+	// Version is the snapshot version
+	Version uint32
+	// RecordOffset is the number of object records, after the header, which have been committed
+	RecordOffset int64
+	// ObjectCount is the number of objects saved in the repo
+	ObjectCount int64
+	Updated     time.Time
+}
+
+// SigningKey is a public key which is trusted to sign notification files. It applies to a
+// source name, a notification URL, or both.
+type SigningKey struct {
+	ID              uint64 `json:",string"`
+	Source          string
+	NotificationURL string
+	// PEM is the public key in PEM format
+	PEM string
+	// Fingerprint is the hex encoded SHA-256 of the DER encoded key
+	Fingerprint string
+	Status      SigningKeyStatus
+	Created     time.Time
+}
+
+// SigningKeyStatus where a key is in its rotation lifecycle
+type SigningKeyStatus string
+
+const (
+	// SigningKeyActive the key verifies notification files
+	SigningKeyActive SigningKeyStatus = "active"
+	// SigningKeyPending the key was announced in next_signing_key. It verifies notification
+	// files, and becomes active when the server first uses it.
+	SigningKeyPending SigningKeyStatus = "pending"
+	// SigningKeyRetired the key was replaced by a newer one and is no longer trusted
+	SigningKeyRetired SigningKeyStatus = "retired"
+)
+
+// SigningKeyEventType is the kind of change recorded in the signing key audit trail
+type SigningKeyEventType string
+
+const (
+	// SigningKeyAdded a key was added to the trust store
+	SigningKeyAdded SigningKeyEventType = "added"
+	// SigningKeyAnnounced a verified notification file announced the key as its next signing key
+	SigningKeyAnnounced SigningKeyEventType = "announced"
+	// SigningKeyActivated a pending key was used by the server for the first time
+	SigningKeyActivated SigningKeyEventType = "activated"
+	// SigningKeyRetiredEvent a key was replaced by the key which was activated
+	SigningKeyRetiredEvent SigningKeyEventType = "retired"
+	// SigningKeyRemoved a key was removed from the trust store
+	SigningKeyRemoved SigningKeyEventType = "removed"
+)
+
+// SigningKeyEvent is an entry in the signing key audit trail
+type SigningKeyEvent struct {
+	ID              uint64 `json:",string"`
+	KeyID           uint64 `json:",string"`
+	Source          string
+	NotificationURL string
+	Fingerprint     string
+	Event           SigningKeyEventType
+	Created         time.Time
+}
+
 // NRTMFile describes a downloaded NRTM file
 type NRTMFile struct {
 	ID           uint64 `json:",string"`
@@ -1,18 +1,80 @@
 package persist
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
 )
 
+// ErrVersionNotAvailable the objects at a version cannot be found in the repo, because the
+// version is newer than the source, or older than the snapshot it was loaded from
+var ErrVersionNotAvailable = errors.New("version is not available in the repository")
+
 // Repository defines the functions for NRTMClient's persistent storage
 type Repository interface {
 	Initialize(string) error
 	SaveSource(NRTMSource, *NotificationJSON) (NRTMSource, error)
-	RemoveSource(NRTMSource) error
+	RemoveSource(context.Context, NRTMSource) error
+	// ReplaceSource atomically gives the staged source the label of the current one, and the
+	// current source the label of the staged one. Only the IDs of the sources are used, they are
+	// read again when they are swapped. Returns the promoted source.
+	ReplaceSource(current NRTMSource, staged NRTMSource) (NRTMSource, error)
 	ListSources() ([]NRTMSource, error)
 	GetNotificationHistory(NRTMSource, uint32, uint32) ([]Notification, error)
-	SaveSnapshotObjects(NRTMSource, []rpsl.Rpsl, NrtmFileJSON) error
-	AddModifyObject(NRTMSource, rpsl.Rpsl, NrtmFileJSON) error
-	DeleteObject(NRTMSource, string, string, NrtmFileJSON) error
+	// SaveSnapshotObjects saves a batch of snapshot objects, and the invalid objects found in it,
+	// with the checkpoint
+	SaveSnapshotObjects(context.Context, NRTMSource, []rpsl.Rpsl, []InvalidObject, NrtmFileJSON, SnapshotCheckpoint) error
+	GetSnapshotCheckpoint(NRTMSource) (*SnapshotCheckpoint, error)
+	RemoveSnapshotCheckpoint(NRTMSource) error
+	BeginDelta(context.Context, NRTMSource) (DeltaTransaction, error)
+	// ObjectsAtVersion calls fn with each object of the source as it was at the version, which
+	// is rebuilt from history when the source has a later version. Objects are ordered by type
+	// and primary key, and only objects of the given types are included, unless there are none.
+	// Returns ErrVersionNotAvailable when the version is not held.
+	ObjectsAtVersion(ctx context.Context, source NRTMSource, version uint32, objectTypes []string, fn func(rpsl.Rpsl) error) error
+	// ObjectChanges calls fn with each object which is different at toVersion than it was at
+	// fromVersion, ordered by type and primary key. Returns ErrVersionNotAvailable when either
+	// version is not held.
+	ObjectChanges(ctx context.Context, source NRTMSource, fromVersion, toVersion uint32, fn func(ObjectChange) error) error
+	// VersionAtTime returns the latest version published by the server at or before the time,
+	// according to the notification files saved for the source. Returns ErrVersionNotAvailable
+	// if there isn't one.
+	VersionAtTime(source NRTMSource, t time.Time) (uint32, error)
+	// ObjectHistory returns every revision of an object, oldest first, including deletions
+	ObjectHistory(source NRTMSource, objectType, primaryKey string) ([]ObjectRevision, error)
+	// GetObject returns the current object of the type with the primary key, which must be
+	// normalized, or nil if the source doesn't have it
+	GetObject(source NRTMSource, objectType, primaryKey string) (*rpsl.Rpsl, error)
+	// ObjectsWithMemberOf calls fn with each current object of the types which has a member-of
+	// attribute and mentions the set name. Callers check the member-of values.
+	ObjectsWithMemberOf(ctx context.Context, source NRTMSource, objectTypes []string, setName string, fn func(rpsl.Rpsl) error) error
+	// RoutesByOrigin calls fn with each current route and route6 object whose origin is one of
+	// the AS numbers, e.g. AS64500
+	RoutesByOrigin(ctx context.Context, source NRTMSource, origins []string, fn func(rpsl.Rpsl) error) error
+	// ListInvalidObjects returns the source's objects which were invalid when they were last
+	// loaded, ordered by type and primary key
+	ListInvalidObjects(NRTMSource) ([]InvalidObject, error)
+	// SaveSigningKeys creates keys which have no ID and updates the status of the others. Each
+	// change is recorded in the signing key audit trail.
+	SaveSigningKeys([]SigningKey) ([]SigningKey, error)
+	ListSigningKeys() ([]SigningKey, error)
+	RemoveSigningKey(uint64) error
+	ListSigningKeyEvents(source string) ([]SigningKeyEvent, error)
 	Close() error
 }
+
+// DeltaTransaction is a unit of work which applies all changes in a delta file, or none of them
+//
+// Either Commit or Rollback must be called when the delta has been read.
+type DeltaTransaction interface {
+	AddModifyObject(rpsl.Rpsl, NrtmFileJSON) error
+	DeleteObject(string, string, NrtmFileJSON) error
+	// SaveInvalidObject records an invalid object, replacing what was recorded for it before.
+	// AddModifyObject and DeleteObject remove the record.
+	SaveInvalidObject(InvalidObject) error
+	// Commit saves the source, which should have the delta's version, and commits all changes
+	Commit(NRTMSource) (NRTMSource, error)
+	Rollback() error
+}
@@ -30,12 +30,18 @@ func InitializeConnectionPool(url string) error {
 
 // WithTransaction executes a function within a transaction
 func WithTransaction(fn TxFn) error {
+	return WithTransactionContext(context.Background(), fn)
+}
+
+// WithTransactionContext executes a function within a transaction which is rolled back if ctx
+// is cancelled before it's committed
+func WithTransactionContext(ctx context.Context, fn TxFn) error {
 	var err error
 	var tx pgx.Tx
 	if pool == nil {
 		return errors.New("connection pool is nil. see db.InitializeConnectionPool(connectionURL)")
 	}
-	if tx, err = pool.Begin(context.Background()); err != nil {
+	if tx, err = pool.Begin(ctx); err != nil {
 		if cerr, ok := err.(*pgconn.ConnectError); ok {
 			logger.Error("No connection to PostgreSQL database.", "error", cerr)
 			log.Println("ERROR: No connection to PostgreSQL database")
@@ -50,7 +56,7 @@ func WithTransaction(fn TxFn) error {
 		} else if err != nil {
 			tx.Rollback(context.Background())
 		} else {
-			err = tx.Commit(context.Background())
+			err = tx.Commit(ctx)
 			if err != nil {
 				logger.Error("WithTransaction Commit", "error", err)
 			}
@@ -60,6 +66,14 @@ func WithTransaction(fn TxFn) error {
 	return err
 }
 
+// BeginTransaction starts a transaction which the caller must commit or roll back
+func BeginTransaction(ctx context.Context) (pgx.Tx, error) {
+	if pool == nil {
+		return nil, errors.New("connection pool is nil. see db.InitializeConnectionPool(connectionURL)")
+	}
+	return pool.Begin(ctx)
+}
+
 // NextID gets a new id from the pg sequence generator
 func NextID() uint64 {
 	if pool == nil {
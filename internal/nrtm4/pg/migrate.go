@@ -0,0 +1,205 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg/db"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg/migrations"
+)
+
+// migrationLockID is the advisory lock held while a migration runs, so two migrate commands
+// can't run at the same time
+const migrationLockID = 4_004_004
+
+// ErrSchemaVersionUnknown schema_version exists but has no version in it, which happens when the
+// schema was created from an nrtm4_schema.sql which didn't record it
+var ErrSchemaVersionUnknown = errors.New("schema_version table is empty. If the schema is up to date, record its version with: migrate -baseline <VERSION>")
+
+// SchemaVersionError is returned by Initialize when the database schema is not the version used
+// by this build
+type SchemaVersionError struct {
+	Found    int
+	Expected int
+}
+
+func (e SchemaVersionError) Error() string {
+	if e.Found < e.Expected {
+		return fmt.Sprintf("database schema is version %d but this build needs version %d. Run the migrate command to upgrade it", e.Found, e.Expected)
+	}
+	return fmt.Sprintf("database schema is version %d, which is newer than version %d used by this build. Use a newer build, or downgrade the schema with migrate -to %d", e.Found, e.Expected, e.Expected)
+}
+
+// SchemaMigration describes what MigrateSchema did
+type SchemaMigration struct {
+	From int
+	To   int
+	// Applied are the migrations which were run, in the order they were run
+	Applied []string
+}
+
+// SchemaStatus returns the version of the database schema and the version used by this build
+func SchemaStatus(ctx context.Context, dbURL string) (int, int, error) {
+	if err := db.InitializeConnectionPool(dbURL); err != nil {
+		return 0, 0, err
+	}
+	version, err := currentSchemaVersion(ctx)
+	return version, migrations.LatestVersion(), err
+}
+
+// MigrateSchema upgrades or downgrades the database schema to the target version, with one
+// transaction for each migration. A negative target is the latest version. The schema_version
+// table is created if the database is empty.
+func MigrateSchema(ctx context.Context, dbURL string, target int) (SchemaMigration, error) {
+	result := SchemaMigration{Applied: []string{}}
+	if err := db.InitializeConnectionPool(dbURL); err != nil {
+		return result, err
+	}
+	all, err := migrations.All()
+	if err != nil {
+		return result, err
+	}
+	if target < 0 {
+		target = len(all)
+	} else if target > len(all) {
+		return result, fmt.Errorf("cannot migrate to version %d, the latest version is %d", target, len(all))
+	}
+	if err = createSchemaVersionTable(ctx); err != nil {
+		return result, err
+	}
+	if result.From, err = currentSchemaVersion(ctx); err != nil {
+		return result, err
+	}
+	if result.From > len(all) {
+		return result, SchemaVersionError{Found: result.From, Expected: len(all)}
+	}
+	version := result.From
+	for version != target {
+		var m migrations.Migration
+		var sql string
+		var next int
+		if version < target {
+			m, sql, next = all[version], all[version].Up, version+1
+		} else {
+			m, sql, next = all[version-1], all[version-1].Down, version-1
+		}
+		if err = runMigration(ctx, version, next, sql); err != nil {
+			return result, fmt.Errorf("migration %03d_%v failed: %w", m.Version, m.Name, err)
+		}
+		logger.Info("Migrated schema", "from", version, "to", next, "migration", m.Name)
+		result.Applied = append(result.Applied, fmt.Sprintf("%03d_%v", m.Version, m.Name))
+		version = next
+	}
+	result.To = version
+	return result, nil
+}
+
+// BaselineSchema records the version of a schema which wasn't created by migrations, without
+// changing it
+func BaselineSchema(ctx context.Context, dbURL string, version int) error {
+	if err := db.InitializeConnectionPool(dbURL); err != nil {
+		return err
+	}
+	if version < 0 || version > migrations.LatestVersion() {
+		return fmt.Errorf("baseline version must be between 0 and %d", migrations.LatestVersion())
+	}
+	if err := createSchemaVersionTable(ctx); err != nil {
+		return err
+	}
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM schema_version`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO schema_version (version) VALUES ($1)`, version)
+		return err
+	})
+}
+
+// checkSchemaVersion returns a SchemaVersionError if the schema is not the version used by this
+// build
+func checkSchemaVersion(ctx context.Context) error {
+	version, err := currentSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if expected := migrations.LatestVersion(); version != expected {
+		return SchemaVersionError{Found: version, Expected: expected}
+	}
+	return nil
+}
+
+// currentSchemaVersion returns the version in schema_version, or 0 if there is no such table
+func currentSchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		var err error
+		version, err = readSchemaVersion(ctx, tx)
+		return err
+	})
+	return version, err
+}
+
+func readSchemaVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err := tx.QueryRow(ctx, `SELECT version FROM schema_version`).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return 0, ErrSchemaVersionUnknown
+	}
+	return version, err
+}
+
+// createSchemaVersionTable creates schema_version at version 0, in the same way as tern, if it
+// doesn't exist
+func createSchemaVersionTable(ctx context.Context) error {
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT to_regclass('schema_version') IS NOT NULL`).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE schema_version (version integer NOT NULL)`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO schema_version (version) VALUES (0)`)
+		return err
+	})
+}
+
+// runMigration runs the SQL which takes the schema from one version to the next, and records
+// the new version, in one transaction
+func runMigration(ctx context.Context, from, to int, sql string) error {
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		version, err := readSchemaVersion(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if version != from {
+			return fmt.Errorf("schema version changed from %d to %d while migrating", from, version)
+		}
+		if _, err = tx.Exec(ctx, sql); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE schema_version SET version = $1`, to)
+		return err
+	})
+}
@@ -0,0 +1,17 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaVersionErrorMessage(t *testing.T) {
+	older := SchemaVersionError{Found: 3, Expected: 6}.Error()
+	if !strings.Contains(older, "version 3") || !strings.Contains(older, "migrate") {
+		t.Error("Message for an older schema should say to migrate:", older)
+	}
+	newer := SchemaVersionError{Found: 7, Expected: 6}.Error()
+	if !strings.Contains(newer, "newer") || !strings.Contains(newer, "-to 6") {
+		t.Error("Message for a newer schema should say it's newer:", newer)
+	}
+}
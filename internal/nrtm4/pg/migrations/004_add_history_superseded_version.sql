@@ -0,0 +1,83 @@
+ALTER TABLE nrtm_rpslobject_history
+	ADD COLUMN IF NOT EXISTS superseded_version integer
+	;
+
+-- Updates were superseded by the next version of the same object, or by the current one.
+-- Done in one pass over the history, which has no index on original_id.
+UPDATE nrtm_rpslobject_history h
+	SET superseded_version = n.superseded_version
+	FROM (
+		SELECT
+			hh.id,
+			COALESCE(LEAD(hh.version) OVER (PARTITION BY hh.original_id ORDER BY hh.seq), o.version) AS superseded_version
+		FROM nrtm_rpslobject_history hh
+		LEFT JOIN nrtm_rpslobject o ON o.id = hh.original_id
+	) n
+	WHERE n.id = h.id
+	;
+
+CREATE OR REPLACE FUNCTION store_rpslobject_history() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+    DECLARE
+        _seq bigint;
+        _superseded integer;
+    BEGIN
+        set timezone to 'UTC'; -- it should be anyway, but just in case
+        SELECT nextval('_history_seq') INTO _seq;
+        IF TG_OP = 'UPDATE' THEN
+            _superseded := NEW.version;
+        ELSE
+            -- Set by the delta transaction before it deletes objects
+            _superseded := NULLIF(current_setting('nrtm4.delta_version', true), '')::integer;
+        END IF;
+        INSERT INTO nrtm_rpslobject_history
+            (id, seq, stamp, original_id, object_type, primary_key, source_id, version, rpsl, superseded_version)
+        VALUES (
+            id_generator(),
+            _seq,
+            now(),
+            OLD.id,
+            OLD.object_type,
+            OLD.primary_key,
+            OLD.source_id,
+            OLD.version,
+            OLD.rpsl,
+            _superseded
+        );
+        RETURN NEW;
+    END;
+$$;
+
+-----------------------------------
+---- create above / drop below ----
+-----------------------------------
+
+CREATE OR REPLACE FUNCTION store_rpslobject_history() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+    DECLARE
+        _seq bigint;
+    BEGIN
+        set timezone to 'UTC'; -- it should be anyway, but just in case
+        SELECT nextval('_history_seq') INTO _seq;
+        INSERT INTO nrtm_rpslobject_history
+            (id, seq, stamp, original_id, object_type, primary_key, source_id, version, rpsl)
+        VALUES (
+            id_generator(),
+            _seq,
+            now(),
+            OLD.id,
+            OLD.object_type,
+            OLD.primary_key,
+            OLD.source_id,
+            OLD.version,
+            OLD.rpsl
+        );
+        RETURN NEW;
+    END;
+$$;
+
+ALTER TABLE nrtm_rpslobject_history
+	DROP COLUMN superseded_version
+	;
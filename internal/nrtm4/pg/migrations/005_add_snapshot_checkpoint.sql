@@ -0,0 +1,18 @@
+-- Databases created from nrtm4_schema.sql may already have the table
+CREATE TABLE IF NOT EXISTS nrtm_snapshot_checkpoint (
+	id BIGINT NOT NULL,
+	source_id BIGINT NOT NULL,
+	VERSION INTEGER NOT NULL,
+	record_offset BIGINT NOT NULL,
+	object_count BIGINT NOT NULL,
+	updated TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+	CONSTRAINT nrtm_snapshot_checkpoint__pk PRIMARY KEY (id),
+	CONSTRAINT nrtm_snapshot_checkpoint__source__uid UNIQUE (source_id),
+	CONSTRAINT nrtm_snapshot_checkpoint__nrtm_source__fk FOREIGN key (source_id) REFERENCES nrtm_source (id)
+);
+
+-----------------------------------
+---- create above / drop below ----
+-----------------------------------
+
+DROP TABLE nrtm_snapshot_checkpoint;
@@ -0,0 +1,15 @@
+-- Databases created from nrtm4_schema.sql may already have the table
+CREATE TABLE IF NOT EXISTS nrtm_signing_key (
+	id BIGINT NOT NULL,
+	source VARCHAR(255) NOT NULL,
+	notification_url TEXT NOT NULL,
+	pem TEXT NOT NULL,
+	created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+	CONSTRAINT nrtm_signing_key__pk PRIMARY KEY (id)
+);
+
+-----------------------------------
+---- create above / drop below ----
+-----------------------------------
+
+DROP TABLE nrtm_signing_key;
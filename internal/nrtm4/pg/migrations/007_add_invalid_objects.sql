@@ -0,0 +1,20 @@
+CREATE TABLE nrtm_invalid_object (
+	id BIGINT NOT NULL,
+	source_id BIGINT NOT NULL,
+	object_type VARCHAR(255) NOT NULL,
+	primary_key VARCHAR(255) NOT NULL,
+	VERSION INTEGER NOT NULL,
+	rejected BOOLEAN NOT NULL,
+	findings jsonb NOT NULL,
+	rpsl TEXT NOT NULL,
+	created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+	CONSTRAINT nrtm_invalid_object__pk PRIMARY KEY (id),
+	CONSTRAINT nrtm_invalid_object__source__type__key__uid UNIQUE (source_id, object_type, primary_key),
+	CONSTRAINT nrtm_invalid_object__nrtm_source__fk FOREIGN key (source_id) REFERENCES nrtm_source (id)
+);
+
+-----------------------------------
+---- create above / drop below ----
+-----------------------------------
+
+DROP TABLE nrtm_invalid_object;
@@ -0,0 +1,38 @@
+ALTER TABLE nrtm_signing_key
+	ADD COLUMN IF NOT EXISTS fingerprint VARCHAR(255) NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS status VARCHAR(255) NOT NULL DEFAULT 'active'
+	;
+
+-- Keys added before fingerprints were recorded. The fingerprint is the SHA-256 of the DER
+-- encoded key, which is the base64 text between the PEM header and footer.
+UPDATE nrtm_signing_key
+	SET fingerprint = encode(sha256(decode(regexp_replace(pem, '-----[^-]*-----|\s', '', 'g'), 'base64')), 'hex')
+	WHERE fingerprint = ''
+	;
+
+ALTER TABLE nrtm_signing_key
+	ALTER COLUMN fingerprint DROP DEFAULT
+	;
+
+-- Databases created from nrtm4_schema.sql may already have the table
+CREATE TABLE IF NOT EXISTS nrtm_signing_key_event (
+	id BIGINT NOT NULL,
+	key_id BIGINT NOT NULL,
+	source VARCHAR(255) NOT NULL,
+	notification_url TEXT NOT NULL,
+	fingerprint VARCHAR(255) NOT NULL,
+	event VARCHAR(255) NOT NULL,
+	created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+	CONSTRAINT nrtm_signing_key_event__pk PRIMARY KEY (id)
+);
+
+-----------------------------------
+---- create above / drop below ----
+-----------------------------------
+
+DROP TABLE nrtm_signing_key_event;
+
+ALTER TABLE nrtm_signing_key
+	DROP COLUMN status,
+	DROP COLUMN fingerprint
+	;
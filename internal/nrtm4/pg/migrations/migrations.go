@@ -0,0 +1,87 @@
+/*
+Package migrations embeds the database schema migrations in the binaries
+
+Each file is a tern migration named <version>_<description>.sql, so the directory can also be
+used with tern. The SQL above the separator line upgrades the schema to the file's version, and
+the SQL below it downgrades it to the previous version.
+
+A migration's version never changes once it's committed, because databases record the version
+they're at. New migrations are added after the last one.
+*/
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// separator is the line tern uses between the up and down SQL
+const separator = "---- create above / drop below ----"
+
+var fileNameRegex = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// Migration changes the schema from the previous version to Version, or back again
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// All returns every migration in version order. The versions must start at 1 with no gaps.
+func All() ([]Migration, error) {
+	return parse(files)
+}
+
+// LatestVersion is the schema version used by this build
+func LatestVersion() int {
+	all, err := All()
+	if err != nil {
+		panic(err)
+	}
+	return len(all)
+}
+
+func parse(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(names))
+	for _, name := range names {
+		match := fileNameRegex.FindStringSubmatch(name)
+		if match == nil {
+			return nil, fmt.Errorf("migration file name is not <version>_<description>.sql: %v", name)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		up, down, found := strings.Cut(string(bytes), separator)
+		if !found {
+			return nil, fmt.Errorf("migration has no '%v' line: %v", separator, name)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: match[2], Up: up, Down: down})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration version %v is missing or duplicated", i+1)
+		}
+	}
+	return migrations, nil
+}
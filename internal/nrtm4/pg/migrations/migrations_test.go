@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	all, err := All()
+	if err != nil {
+		t.Fatal("Embedded migrations should parse", err)
+	}
+	if len(all) == 0 || LatestVersion() != len(all) {
+		t.Fatal("Latest version should be the number of migrations", LatestVersion(), len(all))
+	}
+	for _, m := range all {
+		if len(strings.TrimSpace(m.Up)) == 0 || len(strings.TrimSpace(m.Down)) == 0 {
+			t.Error("Migration should have up and down SQL", m.Version, m.Name)
+		}
+	}
+}
+
+func TestParseMigrations(t *testing.T) {
+	file := func(sql string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(sql)}
+	}
+	fsys := fstest.MapFS{
+		"002_add_column.sql": file("ALTER TABLE t ADD COLUMN c int;\n---- create above / drop below ----\nALTER TABLE t DROP COLUMN c;"),
+		"001_create.sql":     file("CREATE TABLE t (id int);\n---- create above / drop below ----\nDROP TABLE t;"),
+	}
+
+	migrations, err := parse(fsys)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Name != "add_column" {
+		t.Fatal("Migrations are not in version order", migrations)
+	}
+	if strings.TrimSpace(migrations[0].Down) != "DROP TABLE t;" {
+		t.Error("Down SQL is wrong", migrations[0].Down)
+	}
+}
+
+func TestParseRejectsBadMigrations(t *testing.T) {
+	sql := &fstest.MapFile{Data: []byte("SELECT 1;\n---- create above / drop below ----\nSELECT 1;")}
+	for name, fsys := range map[string]fstest.MapFS{
+		"gap":          {"001_a.sql": sql, "003_c.sql": sql},
+		"duplicate":    {"001_a.sql": sql, "1_b.sql": sql},
+		"bad name":     {"001-a.sql": sql},
+		"no separator": {"001_a.sql": &fstest.MapFile{Data: []byte("SELECT 1;")}},
+	} {
+		if _, err := parse(fsys); err == nil {
+			t.Error("Expected an error for", name)
+		}
+	}
+}
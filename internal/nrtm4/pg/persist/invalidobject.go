@@ -0,0 +1,36 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg/db"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// InvalidObject pg database mapping for nrtm_invalid_object
+type InvalidObject struct {
+	db.EntityManaged `em:"nrtm_invalid_object inv"`
+	ID               uint64         `em:"-"`
+	SourceID         uint64         `em:"-"`
+	ObjectType       string         `em:"-"`
+	PrimaryKey       string         `em:"-"`
+	Version          uint32         `em:"-"`
+	Rejected         bool           `em:"-"`
+	Findings         []rpsl.Finding `em:"-"`
+	RPSL             string         `em:"-"`
+	Created          time.Time      `em:"-"`
+}
+
+// AsInvalidObject returns this row as an app-level invalid object
+func (o *InvalidObject) AsInvalidObject() persist.InvalidObject {
+	return persist.InvalidObject{
+		ObjectType: o.ObjectType,
+		PrimaryKey: o.PrimaryKey,
+		Version:    o.Version,
+		Rejected:   o.Rejected,
+		Findings:   o.Findings,
+		RPSL:       o.RPSL,
+		Created:    o.Created,
+	}
+}
@@ -0,0 +1,89 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg/db"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// SigningKey pg database mapping for nrtm_signing_key
+type SigningKey struct {
+	db.EntityManaged `em:"nrtm_signing_key sk"`
+	ID               uint64    `em:"-"`
+	Source           string    `em:"-"`
+	NotificationURL  string    `em:"-"`
+	PEM              string    `em:"-"`
+	Fingerprint      string    `em:"-"`
+	Status           string    `em:"-"`
+	Created          time.Time `em:"-"`
+}
+
+// NewSigningKey prepares a new key for storage
+func NewSigningKey(key persist.SigningKey) SigningKey {
+	status := key.Status
+	if len(status) == 0 {
+		status = persist.SigningKeyActive
+	}
+	return SigningKey{
+		ID:              db.NextID(),
+		Source:          key.Source,
+		NotificationURL: key.NotificationURL,
+		PEM:             key.PEM,
+		Fingerprint:     key.Fingerprint,
+		Status:          string(status),
+		Created:         util.AppClock.Now(),
+	}
+}
+
+// AsSigningKey returns this row as an app-level key
+func (k *SigningKey) AsSigningKey() persist.SigningKey {
+	return persist.SigningKey{
+		ID:              k.ID,
+		Source:          k.Source,
+		NotificationURL: k.NotificationURL,
+		PEM:             k.PEM,
+		Fingerprint:     k.Fingerprint,
+		Status:          persist.SigningKeyStatus(k.Status),
+		Created:         k.Created,
+	}
+}
+
+// SigningKeyEvent pg database mapping for nrtm_signing_key_event
+type SigningKeyEvent struct {
+	db.EntityManaged `em:"nrtm_signing_key_event ske"`
+	ID               uint64    `em:"-"`
+	KeyID            uint64    `em:"-"`
+	Source           string    `em:"-"`
+	NotificationURL  string    `em:"-"`
+	Fingerprint      string    `em:"-"`
+	Event            string    `em:"-"`
+	Created          time.Time `em:"-"`
+}
+
+// NewSigningKeyEvent prepares an audit trail entry for a change to a key
+func NewSigningKeyEvent(key SigningKey, event persist.SigningKeyEventType) SigningKeyEvent {
+	return SigningKeyEvent{
+		ID:              db.NextID(),
+		KeyID:           key.ID,
+		Source:          key.Source,
+		NotificationURL: key.NotificationURL,
+		Fingerprint:     key.Fingerprint,
+		Event:           string(event),
+		Created:         util.AppClock.Now(),
+	}
+}
+
+// AsSigningKeyEvent returns this row as an app-level event
+func (e *SigningKeyEvent) AsSigningKeyEvent() persist.SigningKeyEvent {
+	return persist.SigningKeyEvent{
+		ID:              e.ID,
+		KeyID:           e.KeyID,
+		Source:          e.Source,
+		NotificationURL: e.NotificationURL,
+		Fingerprint:     e.Fingerprint,
+		Event:           persist.SigningKeyEventType(e.Event),
+		Created:         e.Created,
+	}
+}
@@ -0,0 +1,30 @@
+package persist
+
+import (
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/pg/db"
+)
+
+// SnapshotCheckpoint pg database mapping for nrtm_snapshot_checkpoint
+type SnapshotCheckpoint struct {
+	db.EntityManaged `em:"nrtm_snapshot_checkpoint scp"`
+	ID               uint64    `em:"-"`
+	SourceID         uint64    `em:"-"`
+	Version          uint32    `em:"-"`
+	RecordOffset     int64     `em:"-"`
+	ObjectCount      int64     `em:"-"`
+	Updated          time.Time `em:"-"`
+}
+
+// AsSnapshotCheckpoint returns this row as an app-level checkpoint
+func (c *SnapshotCheckpoint) AsSnapshotCheckpoint() persist.SnapshotCheckpoint {
+	return persist.SnapshotCheckpoint{
+		SourceID:     c.SourceID,
+		Version:      c.Version,
+		RecordOffset: c.RecordOffset,
+		ObjectCount:  c.ObjectCount,
+		Updated:      c.Updated,
+	}
+}
@@ -3,6 +3,9 @@ package pg
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
@@ -16,9 +19,13 @@ import (
 type PostgresRepository struct {
 }
 
-// Initialize implementation of the Repository interface
+// Initialize connects to the database and checks that the schema is the version used by this
+// build. Returns a SchemaVersionError if it isn't.
 func (repo PostgresRepository) Initialize(dbURL string) error {
-	return db.InitializeConnectionPool(dbURL)
+	if err := db.InitializeConnectionPool(dbURL); err != nil {
+		return err
+	}
+	return checkSchemaVersion(context.Background())
 }
 
 // ListSources returns a list of all sources
@@ -44,8 +51,8 @@ func (repo PostgresRepository) ListSources() ([]persist.NRTMSource, error) {
 //
 // A lock is put on table `nrtm_rpslobject` before deletions happen, so this might slow down
 // updates to other sources when this is running.
-func (repo PostgresRepository) RemoveSource(source persist.NRTMSource) error {
-	err := db.WithTransaction(func(tx pgx.Tx) error {
+func (repo PostgresRepository) RemoveSource(ctx context.Context, source persist.NRTMSource) error {
+	err := db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
 		type pgcmd struct {
 			sql  string
 			args []any
@@ -62,6 +69,16 @@ func (repo PostgresRepository) RemoveSource(source persist.NRTMSource) error {
 			WHERE source_id = $1
 			`, []any{source.ID},
 			}, {`
+			DELETE FROM
+				nrtm_snapshot_checkpoint
+			WHERE source_id = $1
+			`, []any{source.ID},
+			}, {`
+			DELETE FROM
+				nrtm_invalid_object
+			WHERE source_id = $1
+			`, []any{source.ID},
+			}, {`
 			LOCK TABLE nrtm_rpslobject IN SHARE MODE
 			`, []any{},
 			}, {`
@@ -87,7 +104,7 @@ func (repo PostgresRepository) RemoveSource(source persist.NRTMSource) error {
 			},
 		}
 		for _, cmd := range cmds {
-			_, err := tx.Exec(context.Background(), cmd.sql, cmd.args...)
+			_, err := tx.Exec(ctx, cmd.sql, cmd.args...)
 			if err != nil {
 				return err
 			}
@@ -101,6 +118,69 @@ func (repo PostgresRepository) RemoveSource(source persist.NRTMSource) error {
 	return nil
 }
 
+// ReplaceSource swaps the labels of the current and staged sources in one transaction, and
+// gives the staged source the current source's properties. Both sources are read again and
+// locked in the transaction, so changes made since they were passed in are kept. Queries by
+// label see the current source's objects until the transaction is committed, then the staged
+// source's.
+func (repo PostgresRepository) ReplaceSource(current, staged persist.NRTMSource) (persist.NRTMSource, error) {
+	var pgSource pgpersist.NRTMSource
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		ctx := context.Background()
+		locked, err := selectSourceForUpdate(ctx, tx, current.ID)
+		if err != nil {
+			return err
+		}
+		promoted, err := selectSourceForUpdate(ctx, tx, staged.ID)
+		if err != nil {
+			return err
+		}
+		// Label must be unique per notification URL, so move the current source out of the way first
+		tmpLabel := fmt.Sprintf("%v :REPLACED:%d", promoted.Label, locked.ID)
+		if err = updateSourceLabel(ctx, tx, locked.ID, tmpLabel); err != nil {
+			return err
+		}
+		stagedLabel := promoted.Label
+		promoted.Label = locked.Label
+		promoted.Properties = locked.Properties
+		pgSource = pgpersist.FromNRTMSource(promoted)
+		if err = db.Update(tx, &pgSource); err != nil {
+			return err
+		}
+		return updateSourceLabel(ctx, tx, locked.ID, stagedLabel)
+	})
+	if err != nil {
+		logger.Error("Error in ReplaceSource", "error", err)
+		return staged, err
+	}
+	return pgSource.AsNRTMSource(), nil
+}
+
+func selectSourceForUpdate(ctx context.Context, tx pgx.Tx, id uint64) (persist.NRTMSource, error) {
+	pgSource := new(pgpersist.NRTMSource)
+	desc := db.GetDescriptor(pgSource)
+	sql := fmt.Sprintf(`
+		SELECT %v
+		FROM %v
+		WHERE id = $1
+		FOR UPDATE
+		`,
+		desc.ColumnNamesCommaSeparated(),
+		desc.TableName(),
+	)
+	if err := tx.QueryRow(ctx, sql, id).Scan(db.ValuesForSelect(pgSource)...); err != nil {
+		return persist.NRTMSource{}, err
+	}
+	return pgSource.AsNRTMSource(), nil
+}
+
+func updateSourceLabel(ctx context.Context, tx pgx.Tx, id uint64, label string) error {
+	desc := db.GetDescriptor(&pgpersist.NRTMSource{})
+	sql := fmt.Sprintf(`UPDATE %v SET label = $1 WHERE id = $2`, desc.TableName())
+	_, err := tx.Exec(ctx, sql, label, id)
+	return err
+}
+
 // GetNotificationHistory gets the last 100 notification versions
 func (repo PostgresRepository) GetNotificationHistory(source persist.NRTMSource, fromVersion, toVersion uint32) ([]persist.Notification, error) {
 	if toVersion < fromVersion {
@@ -168,114 +248,843 @@ func (repo PostgresRepository) Close() error {
 	return nil
 }
 
-// SaveSnapshotObjects saves a list of rpsl object in a go routine
+// SaveSnapshotObjects saves a list of rpsl objects, the invalid objects found among them and
+// the checkpoint in one transaction
 func (repo PostgresRepository) SaveSnapshotObjects(
+	ctx context.Context,
 	source persist.NRTMSource,
 	rpslObjects []rpsl.Rpsl,
+	invalidObjects []persist.InvalidObject,
 	file persist.NrtmFileJSON,
+	checkpoint persist.SnapshotCheckpoint,
 ) error {
-	if len(rpslObjects) == 0 {
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if err := copySnapshotObjects(ctx, tx, source, rpslObjects, file); err != nil {
+			return err
+		}
+		for _, obj := range invalidObjects {
+			if err := saveInvalidObject(ctx, tx, source, obj); err != nil {
+				return err
+			}
+		}
+		return saveSnapshotCheckpoint(ctx, tx, source, checkpoint)
+	})
+}
+
+// GetObject returns the current object of the type with the primary key, or nil if the source
+// doesn't have it
+func (repo PostgresRepository) GetObject(source persist.NRTMSource, objectType, primaryKey string) (*rpsl.Rpsl, error) {
+	var obj *rpsl.Rpsl
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		row := new(pgpersist.RPSLObject)
+		err := tx.QueryRow(context.Background(), selectCurrentObjectQuery(), source.ID, primaryKey, objectType).Scan(db.ValuesForSelect(row)...)
+		if err == pgx.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		obj = &rpsl.Rpsl{ObjectType: row.ObjectType, PrimaryKey: row.PrimaryKey, Source: source.Source, Payload: row.RPSL}
 		return nil
+	})
+	return obj, err
+}
+
+// ObjectsWithMemberOf streams the current objects of the types which have a member-of
+// attribute and mention the set name anywhere in their payload
+func (repo PostgresRepository) ObjectsWithMemberOf(
+	ctx context.Context,
+	source persist.NRTMSource,
+	objectTypes []string,
+	setName string,
+	fn func(rpsl.Rpsl) error,
+) error {
+	types := make([]string, len(objectTypes))
+	for i, t := range objectTypes {
+		types[i] = strings.ToUpper(t)
 	}
-	return db.WithTransaction(func(tx pgx.Tx) error {
-		inputRows := make([][]any, len(rpslObjects))
-		ids := make([]uint64, len(rpslObjects))
+	desc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	sql := fmt.Sprintf(`
+		SELECT object_type, primary_key, rpsl
+		FROM %v
+		WHERE source_id = $1
+		AND object_type = ANY($2)
+		AND rpsl ~* '(^|\n)member-of:'
+		AND STRPOS(UPPER(rpsl), UPPER($3)) > 0
+		ORDER BY object_type, primary_key
+		`,
+		desc.TableName(),
+	)
+	return streamObjects(ctx, source, fn, sql, source.ID, types, setName)
+}
+
+// RoutesByOrigin streams the current route and route6 objects originated by the AS numbers.
+// The origin is the end of a route's primary key.
+func (repo PostgresRepository) RoutesByOrigin(
+	ctx context.Context,
+	source persist.NRTMSource,
+	origins []string,
+	fn func(rpsl.Rpsl) error,
+) error {
+	asns := make([]string, len(origins))
+	for i, o := range origins {
+		asns[i] = strings.ToUpper(o)
+	}
+	desc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	sql := fmt.Sprintf(`
+		SELECT object_type, primary_key, rpsl
+		FROM %v
+		WHERE source_id = $1
+		AND object_type IN ('ROUTE', 'ROUTE6')
+		AND SUBSTRING(primary_key FROM 'AS[0-9]+$') = ANY($2)
+		ORDER BY object_type, primary_key
+		`,
+		desc.TableName(),
+	)
+	return streamObjects(ctx, source, fn, sql, source.ID, asns)
+}
 
-		rows, err := tx.Conn().Query(context.Background(), fmt.Sprintf("select id_generator() from generate_series(1, %v)", len(rpslObjects)))
+// streamObjects calls fn with each object selected by the query, which returns the type,
+// primary key and payload
+func streamObjects(ctx context.Context, source persist.NRTMSource, fn func(rpsl.Rpsl) error, sql string, args ...any) error {
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, sql, args...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
-		for i := 0; rows.Next(); i++ {
-			id := new(uint64)
-			err = rows.Scan(id)
-			if err != nil {
+		for rows.Next() {
+			obj := rpsl.Rpsl{Source: source.Source}
+			if err = rows.Scan(&obj.ObjectType, &obj.PrimaryKey, &obj.Payload); err != nil {
 				return err
 			}
-			ids[i] = *id
-		}
-		for i, rpslObject := range rpslObjects {
-			inputRow := []any{
-				ids[i],
-				rpslObject.ObjectType,
-				rpslObject.PrimaryKey,
-				source.ID,
-				file.Version,
-				rpslObject.Payload,
+			if err = fn(obj); err != nil {
+				return err
 			}
-			inputRows[i] = inputRow
-		}
-		rpslDescriptor := db.GetDescriptor(&pgpersist.RPSLObject{})
-		_, err = tx.CopyFrom(
-			context.Background(),
-			pgx.Identifier{rpslDescriptor.TableName()},
-			rpslDescriptor.ColumnNames(),
-			pgx.CopyFromRows(inputRows),
-		)
+		}
+		return rows.Err()
+	})
+}
+
+// ListInvalidObjects returns the objects which were invalid when they were last loaded into the
+// source, ordered by type and primary key
+func (repo PostgresRepository) ListInvalidObjects(source persist.NRTMSource) ([]persist.InvalidObject, error) {
+	invalid := new(pgpersist.InvalidObject)
+	desc := db.GetDescriptor(invalid)
+	sql := fmt.Sprintf(`
+		SELECT %v
+		FROM %v
+		WHERE source_id = $1
+		ORDER BY object_type, primary_key
+		`,
+		desc.ColumnNamesCommaSeparated(),
+		desc.TableName(),
+	)
+	objects := []persist.InvalidObject{}
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		rows, err := tx.Query(context.Background(), sql, source.ID)
 		if err != nil {
-			types := util.NewSet[string]()
-			for _, obj := range rpslObjects {
-				types.Add(obj.ObjectType)
-				logger.Debug("Possible failure", "type", obj.ObjectType, "primaryKey", obj.PrimaryKey)
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ent := *invalid
+			if err = rows.Scan(db.ValuesForSelect(&ent)...); err != nil {
+				return err
 			}
-			logger.Warn("Failed to save objects", "types", types.String(), "error", err)
+			objects = append(objects, ent.AsInvalidObject())
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		logger.Error("Error in ListInvalidObjects", "error", err)
+		return nil, err
+	}
+	return objects, nil
+}
+
+// GetSnapshotCheckpoint returns the last checkpoint saved for the source, or nil if there isn't one
+func (repo PostgresRepository) GetSnapshotCheckpoint(source persist.NRTMSource) (*persist.SnapshotCheckpoint, error) {
+	var checkpoint *persist.SnapshotCheckpoint
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		row := new(pgpersist.SnapshotCheckpoint)
+		err := db.GetByColumn(tx, "source_id", source.ID, row)
+		if err == pgx.ErrNoRows {
+			return nil
+		} else if err != nil {
 			return err
 		}
+		cp := row.AsSnapshotCheckpoint()
+		checkpoint = &cp
 		return nil
 	})
+	return checkpoint, err
+}
+
+// RemoveSnapshotCheckpoint removes the checkpoint for the source, when the snapshot is fully loaded
+func (repo PostgresRepository) RemoveSnapshotCheckpoint(source persist.NRTMSource) error {
+	return db.WithTransaction(func(tx pgx.Tx) error {
+		desc := db.GetDescriptor(&pgpersist.SnapshotCheckpoint{})
+		sql := fmt.Sprintf(`DELETE FROM %v WHERE source_id = $1`, desc.TableName())
+		_, err := tx.Exec(context.Background(), sql, source.ID)
+		return err
+	})
 }
 
-// AddModifyObject updates an RPSL finding the current matching pk then updating or adding
-func (repo PostgresRepository) AddModifyObject(
+// ObjectsAtVersion streams the objects of a source at a version. Current objects are used when
+// they haven't changed since the version, otherwise the row in nrtm_rpslobject_history which
+// was superseded after it. Deletions recorded before history rows had superseded_version are
+// not known, so those objects are missing from earlier versions.
+func (repo PostgresRepository) ObjectsAtVersion(
+	ctx context.Context,
 	source persist.NRTMSource,
-	rpsl rpsl.Rpsl,
-	file persist.NrtmFileJSON,
+	version uint32,
+	objectTypes []string,
+	fn func(rpsl.Rpsl) error,
 ) error {
-	newRow := &pgpersist.RPSLObject{
-		ObjectType: rpsl.ObjectType,
-		PrimaryKey: rpsl.PrimaryKey,
-		SourceID:   source.ID,
-		Version:    uint32(file.Version),
-		RPSL:       rpsl.Payload,
+	rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if err := checkVersionHeld(ctx, tx, source, version); err != nil {
+			return err
+		}
+		args := []any{source.ID, version}
+		typeFilter := ""
+		if len(objectTypes) > 0 {
+			types := make([]string, len(objectTypes))
+			for i, t := range objectTypes {
+				types[i] = strings.ToUpper(t)
+			}
+			args = append(args, types)
+			typeFilter = "AND object_type = ANY($3)"
+		}
+		sql := fmt.Sprintf(`
+			SELECT object_type, primary_key, rpsl
+			FROM %v
+			WHERE source_id = $1
+			AND version <= $2
+			%v
+			UNION ALL
+			SELECT object_type, primary_key, rpsl
+			FROM nrtm_rpslobject_history
+			WHERE source_id = $1
+			AND version <= $2
+			AND superseded_version > $2
+			%v
+			ORDER BY object_type, primary_key
+			`,
+			rpslObjectDesc.TableName(),
+			typeFilter,
+			typeFilter,
+		)
+		rows, err := tx.Query(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			obj := rpsl.Rpsl{Source: source.Source}
+			if err = rows.Scan(&obj.ObjectType, &obj.PrimaryKey, &obj.Payload); err != nil {
+				return err
+			}
+			if err = fn(obj); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// ObjectChanges finds the objects which have a revision, or were superseded, after the from
+// version and up to the to version. Each one is compared at both versions in the same way as
+// ObjectsAtVersion, and skipped if it ended up the same as it started.
+func (repo PostgresRepository) ObjectChanges(
+	ctx context.Context,
+	source persist.NRTMSource,
+	fromVersion, toVersion uint32,
+	fn func(persist.ObjectChange) error,
+) error {
+	rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	return db.WithTransactionContext(ctx, func(tx pgx.Tx) error {
+		if err := checkVersionHeld(ctx, tx, source, fromVersion); err != nil {
+			return err
+		}
+		if err := checkVersionHeld(ctx, tx, source, toVersion); err != nil {
+			return err
+		}
+		sql := fmt.Sprintf(`
+			WITH revision AS (
+				SELECT object_type, primary_key, version, NULL::integer AS superseded_version, rpsl
+				FROM %v
+				WHERE source_id = $1
+				UNION ALL
+				SELECT object_type, primary_key, version, superseded_version, rpsl
+				FROM nrtm_rpslobject_history
+				WHERE source_id = $1
+				AND superseded_version IS NOT NULL
+			), changed AS (
+				SELECT DISTINCT object_type, primary_key
+				FROM revision
+				WHERE version > $2 AND version <= $3
+				OR superseded_version > $2 AND superseded_version <= $3
+			)
+			SELECT c.object_type, c.primary_key, b.rpsl, a.rpsl
+			FROM changed c
+			LEFT JOIN revision b
+				ON b.object_type = c.object_type
+				AND b.primary_key = c.primary_key
+				AND b.version <= $2
+				AND (b.superseded_version IS NULL OR b.superseded_version > $2)
+			LEFT JOIN revision a
+				ON a.object_type = c.object_type
+				AND a.primary_key = c.primary_key
+				AND a.version <= $3
+				AND (a.superseded_version IS NULL OR a.superseded_version > $3)
+			WHERE b.rpsl IS DISTINCT FROM a.rpsl
+			ORDER BY c.object_type, c.primary_key
+			`,
+			rpslObjectDesc.TableName(),
+		)
+		rows, err := tx.Query(ctx, sql, source.ID, fromVersion, toVersion)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var before, after *string
+			change := persist.ObjectChange{}
+			if err = rows.Scan(&change.ObjectType, &change.PrimaryKey, &before, &after); err != nil {
+				return err
+			}
+			switch {
+			case before == nil:
+				change.Action, change.After = persist.ObjectAdded, *after
+			case after == nil:
+				change.Action, change.Before = persist.ObjectDeleted, *before
+			default:
+				change.Action, change.Before, change.After = persist.ObjectModified, *before, *after
+			}
+			if err = fn(change); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// checkVersionHeld returns ErrVersionNotAvailable if the objects at the version can't be
+// rebuilt, because it's newer than the source or older than its earliest object
+func checkVersionHeld(ctx context.Context, tx pgx.Tx, source persist.NRTMSource, version uint32) error {
+	if version > source.Version {
+		return persist.ErrVersionNotAvailable
 	}
-	return db.WithTransaction(func(tx pgx.Tx) error {
+	rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	var earliest *int64
+	sql := fmt.Sprintf(`
+		SELECT LEAST(
+			(SELECT MIN(version) FROM %v WHERE source_id = $1),
+			(SELECT MIN(version) FROM nrtm_rpslobject_history WHERE source_id = $1)
+		)`,
+		rpslObjectDesc.TableName(),
+	)
+	if err := tx.QueryRow(ctx, sql, source.ID).Scan(&earliest); err != nil {
+		return err
+	}
+	if earliest == nil && version != source.Version || earliest != nil && int64(version) < *earliest {
+		return persist.ErrVersionNotAvailable
+	}
+	return nil
+}
 
-		var err error
+// VersionAtTime finds the notification with the highest version whose timestamp is not after t
+func (repo PostgresRepository) VersionAtTime(source persist.NRTMSource, t time.Time) (uint32, error) {
+	notifDesc := db.GetDescriptor(&pgpersist.Notification{})
+	sql := fmt.Sprintf(`
+		SELECT MAX(version)
+		FROM %v
+		WHERE source_id = $1
+		AND (payload->>'timestamp')::timestamptz <= $2
+		`,
+		notifDesc.TableName(),
+	)
+	var version *uint32
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		return tx.QueryRow(context.Background(), sql, source.ID, t).Scan(&version)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if version == nil {
+		return 0, persist.ErrVersionNotAvailable
+	}
+	return *version, nil
+}
 
-		sql := selectCurrentObjectQuery()
-		rpslObject := new(pgpersist.RPSLObject)
-		err = tx.QueryRow(context.Background(), sql, source.ID, rpsl.PrimaryKey, rpsl.ObjectType).Scan(db.ValuesForSelect(rpslObject)...)
+// ObjectHistory reads the object's rows in nrtm_rpslobject_history in the order they were
+// archived, followed by the current row. A deletion is added after a history row when the object
+// didn't come back at the version which superseded it.
+func (repo PostgresRepository) ObjectHistory(source persist.NRTMSource, objectType, primaryKey string) ([]persist.ObjectRevision, error) {
+	objectType, primaryKey = strings.ToUpper(objectType), strings.ToUpper(primaryKey)
+	rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	revisions := []persist.ObjectRevision{}
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		ctx := context.Background()
+		sql := `
+			SELECT version, superseded_version, rpsl
+			FROM nrtm_rpslobject_history
+			WHERE object_type = $1
+			AND primary_key = $2
+			AND source_id = $3
+			ORDER BY seq
+			`
+		rows, err := tx.Query(ctx, sql, objectType, primaryKey, source.ID)
+		if err != nil {
+			return err
+		}
+		superseded := []*uint32{}
+		for rows.Next() {
+			var rev persist.ObjectRevision
+			var supersededVersion *uint32
+			if err = rows.Scan(&rev.Version, &supersededVersion, &rev.RPSL); err != nil {
+				rows.Close()
+				return err
+			}
+			revisions = append(revisions, rev)
+			superseded = append(superseded, supersededVersion)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		current := persist.ObjectRevision{}
+		sql = fmt.Sprintf(`
+			SELECT version, rpsl
+			FROM %v
+			WHERE object_type = $1
+			AND primary_key = $2
+			AND source_id = $3
+			`,
+			rpslObjectDesc.TableName(),
+		)
+		err = tx.QueryRow(ctx, sql, objectType, primaryKey, source.ID).Scan(&current.Version, &current.RPSL)
 		if err != nil && err != pgx.ErrNoRows {
 			return err
 		}
-		if err == pgx.ErrNoRows {
-			newRow.ID = db.NextID()
-			return db.Create(tx, newRow)
+		if err == nil {
+			revisions = append(revisions, current)
+		}
+		revisions = withDeletedRevisions(revisions, superseded)
+		return addRevisionTimestamps(ctx, tx, source, revisions)
+	})
+	return revisions, err
+}
+
+// withDeletedRevisions adds a deletion after each of the first len(superseded) revisions which
+// is not followed by a revision at the version which superseded it
+func withDeletedRevisions(revisions []persist.ObjectRevision, superseded []*uint32) []persist.ObjectRevision {
+	result := make([]persist.ObjectRevision, 0, len(revisions)+len(superseded))
+	for i, rev := range revisions {
+		result = append(result, rev)
+		if i >= len(superseded) {
+			continue
+		}
+		if superseded[i] == nil {
+			result = append(result, persist.ObjectRevision{Deleted: true})
+		} else if i+1 == len(revisions) || revisions[i+1].Version != *superseded[i] {
+			result = append(result, persist.ObjectRevision{Version: *superseded[i], Deleted: true})
+		}
+	}
+	return result
+}
+
+// addRevisionTimestamps sets the timestamp of each revision to the earliest notification which
+// has its version
+func addRevisionTimestamps(ctx context.Context, tx pgx.Tx, source persist.NRTMSource, revisions []persist.ObjectRevision) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+	notifDesc := db.GetDescriptor(&pgpersist.Notification{})
+	versions := make([]int64, len(revisions))
+	for i, rev := range revisions {
+		versions[i] = int64(rev.Version)
+	}
+	sql := fmt.Sprintf(`
+		SELECT (
+			SELECT MIN((payload->>'timestamp')::timestamptz)
+			FROM %v
+			WHERE source_id = $1
+			AND version >= v.version
+		)
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS v(version, n)
+		ORDER BY v.n
+		`,
+		notifDesc.TableName(),
+	)
+	rows, err := tx.Query(ctx, sql, source.ID, versions)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		if err = rows.Scan(&revisions[i].Timestamp); err != nil {
+			return err
+		}
+		if revisions[i].Version == 0 {
+			revisions[i].Timestamp = nil
+		}
+	}
+	return rows.Err()
+}
+
+// SaveSigningKeys creates keys which have no ID and updates the status of the others, in one
+// transaction. Each change is recorded in nrtm_signing_key_event.
+func (repo PostgresRepository) SaveSigningKeys(keys []persist.SigningKey) ([]persist.SigningKey, error) {
+	saved := make([]persist.SigningKey, 0, len(keys))
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		for _, key := range keys {
+			var pgkey pgpersist.SigningKey
+			var event persist.SigningKeyEventType
+			if key.ID == 0 {
+				pgkey = pgpersist.NewSigningKey(key)
+				if err := db.Create(tx, &pgkey); err != nil {
+					return err
+				}
+				switch pgkey.Status {
+				case string(persist.SigningKeyPending):
+					event = persist.SigningKeyAnnounced
+				case string(persist.SigningKeyRetired):
+					event = persist.SigningKeyRetiredEvent
+				default:
+					event = persist.SigningKeyAdded
+				}
+			} else {
+				if err := db.GetByID(tx, int64(key.ID), &pgkey); err != nil {
+					return err
+				}
+				pgkey.Status = string(key.Status)
+				if err := db.Update(tx, &pgkey); err != nil {
+					return err
+				}
+				switch key.Status {
+				case persist.SigningKeyActive:
+					event = persist.SigningKeyActivated
+				case persist.SigningKeyRetired:
+					event = persist.SigningKeyRetiredEvent
+				default:
+					event = persist.SigningKeyAnnounced
+				}
+			}
+			pgevent := pgpersist.NewSigningKeyEvent(pgkey, event)
+			if err := db.Create(tx, &pgevent); err != nil {
+				return err
+			}
+			saved = append(saved, pgkey.AsSigningKey())
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Error in SaveSigningKeys", "error", err)
+		return nil, err
+	}
+	return saved, nil
+}
+
+// ListSigningKeys returns all trusted signing keys
+func (repo PostgresRepository) ListSigningKeys() ([]persist.SigningKey, error) {
+	keys := []persist.SigningKey{}
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		_, err := db.GetAll(tx, pgpersist.SigningKey{}, func(k pgpersist.SigningKey) {
+			keys = append(keys, k.AsSigningKey())
+		})
+		return err
+	})
+	return keys, err
+}
+
+// RemoveSigningKey removes a signing key and records it in the audit trail. Returns
+// pgx.ErrNoRows if there is no key with the ID.
+func (repo PostgresRepository) RemoveSigningKey(id uint64) error {
+	return db.WithTransaction(func(tx pgx.Tx) error {
+		var pgkey pgpersist.SigningKey
+		if err := db.GetByID(tx, int64(id), &pgkey); err != nil {
+			return err
+		}
+		desc := db.GetDescriptor(&pgkey)
+		sql := fmt.Sprintf(`DELETE FROM %v WHERE id = $1`, desc.TableName())
+		if _, err := tx.Exec(context.Background(), sql, id); err != nil {
+			return err
 		}
-		newRow.ID = rpslObject.ID
-		return db.Update(tx, newRow)
+		pgevent := pgpersist.NewSigningKeyEvent(pgkey, persist.SigningKeyRemoved)
+		return db.Create(tx, &pgevent)
 	})
 }
 
-// DeleteObject removes a row matching the params
-func (repo PostgresRepository) DeleteObject(
+// ListSigningKeyEvents returns the signing key audit trail for a source, oldest first. All
+// events are returned when source is empty.
+func (repo PostgresRepository) ListSigningKeyEvents(source string) ([]persist.SigningKeyEvent, error) {
+	event := new(pgpersist.SigningKeyEvent)
+	desc := db.GetDescriptor(event)
+	sql := fmt.Sprintf(`
+		SELECT %v
+		FROM %v
+		WHERE $1 = '' OR UPPER(source) = UPPER($1)
+		ORDER BY created, id
+		`,
+		desc.ColumnNamesCommaSeparated(),
+		desc.TableName(),
+	)
+	events := []persist.SigningKeyEvent{}
+	err := db.WithTransaction(func(tx pgx.Tx) error {
+		rows, err := tx.Query(context.Background(), sql, source)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			ent := *event
+			if err = rows.Scan(db.ValuesForSelect(&ent)...); err != nil {
+				return err
+			}
+			events = append(events, ent.AsSigningKeyEvent())
+		}
+		return rows.Err()
+	})
+	return events, err
+}
+
+func saveSnapshotCheckpoint(ctx context.Context, tx pgx.Tx, source persist.NRTMSource, checkpoint persist.SnapshotCheckpoint) error {
+	desc := db.GetDescriptor(&pgpersist.SnapshotCheckpoint{})
+	sql := fmt.Sprintf(`
+		INSERT INTO %v (%v)
+		VALUES (id_generator(), $1, $2, $3, $4, $5)
+		ON CONFLICT (source_id) DO UPDATE
+		SET
+			version = EXCLUDED.version,
+			record_offset = EXCLUDED.record_offset,
+			object_count = EXCLUDED.object_count,
+			updated = EXCLUDED.updated
+		`,
+		desc.TableName(),
+		desc.ColumnNamesCommaSeparated(),
+	)
+	_, err := tx.Exec(
+		ctx,
+		sql,
+		source.ID,
+		checkpoint.Version,
+		checkpoint.RecordOffset,
+		checkpoint.ObjectCount,
+		util.AppClock.Now(),
+	)
+	return err
+}
+
+// saveInvalidObject records an invalid object, replacing the record from an earlier version
+func saveInvalidObject(ctx context.Context, tx pgx.Tx, source persist.NRTMSource, obj persist.InvalidObject) error {
+	desc := db.GetDescriptor(&pgpersist.InvalidObject{})
+	sql := fmt.Sprintf(`
+		INSERT INTO %v (%v)
+		VALUES (id_generator(), $1, UPPER($2), UPPER($3), $4, $5, $6, $7, $8)
+		ON CONFLICT (source_id, object_type, primary_key) DO UPDATE
+		SET
+			version = EXCLUDED.version,
+			rejected = EXCLUDED.rejected,
+			findings = EXCLUDED.findings,
+			rpsl = EXCLUDED.rpsl,
+			created = EXCLUDED.created
+		`,
+		desc.TableName(),
+		desc.ColumnNamesCommaSeparated(),
+	)
+	_, err := tx.Exec(
+		ctx,
+		sql,
+		source.ID,
+		obj.ObjectType,
+		obj.PrimaryKey,
+		obj.Version,
+		obj.Rejected,
+		obj.Findings,
+		obj.RPSL,
+		util.AppClock.Now(),
+	)
+	return err
+}
+
+// removeInvalidObject removes the record of an invalid object, when a valid version of it is
+// saved or it's deleted
+func removeInvalidObject(ctx context.Context, tx pgx.Tx, source persist.NRTMSource, objectType, primaryKey string) error {
+	desc := db.GetDescriptor(&pgpersist.InvalidObject{})
+	sql := fmt.Sprintf(`
+		DELETE FROM %v
+		WHERE
+			source_id = $1
+			AND object_type = UPPER($2)
+			AND primary_key = UPPER($3)
+		`,
+		desc.TableName(),
+	)
+	_, err := tx.Exec(ctx, sql, source.ID, objectType, primaryKey)
+	return err
+}
+
+func copySnapshotObjects(
+	ctx context.Context,
+	tx pgx.Tx,
 	source persist.NRTMSource,
-	objectType string,
-	primaryKey string,
+	rpslObjects []rpsl.Rpsl,
 	file persist.NrtmFileJSON,
 ) error {
-	return db.WithTransaction(func(tx pgx.Tx) error {
-		sql := selectCurrentObjectQuery()
-		rpslObject := new(pgpersist.RPSLObject)
-		err := tx.QueryRow(context.Background(), sql, source.ID, primaryKey, objectType).Scan(db.ValuesForSelect(rpslObject)...)
+	if len(rpslObjects) == 0 {
+		return nil
+	}
+	inputRows := make([][]any, len(rpslObjects))
+	ids := make([]uint64, len(rpslObjects))
+
+	rows, err := tx.Conn().Query(ctx, fmt.Sprintf("select id_generator() from generate_series(1, %v)", len(rpslObjects)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		id := new(uint64)
+		err = rows.Scan(id)
 		if err != nil {
 			return err
 		}
-		rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
-		sql = fmt.Sprintf(`DELETE FROM %v WHERE id=$1`, rpslObjectDesc.TableName())
-		_, err = tx.Exec(context.Background(), sql, rpslObject.ID)
+		ids[i] = *id
+	}
+	for i, rpslObject := range rpslObjects {
+		inputRow := []any{
+			ids[i],
+			rpslObject.ObjectType,
+			rpslObject.PrimaryKey,
+			source.ID,
+			file.Version,
+			rpslObject.Payload,
+		}
+		inputRows[i] = inputRow
+	}
+	rpslDescriptor := db.GetDescriptor(&pgpersist.RPSLObject{})
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{rpslDescriptor.TableName()},
+		rpslDescriptor.ColumnNames(),
+		pgx.CopyFromRows(inputRows),
+	)
+	if err != nil {
+		types := util.NewSet[string]()
+		for _, obj := range rpslObjects {
+			types.Add(obj.ObjectType)
+			logger.Debug("Possible failure", "type", obj.ObjectType, "primaryKey", obj.PrimaryKey)
+		}
+		logger.Warn("Failed to save objects", "types", types.String(), "error", err)
 		return err
-	})
+	}
+	return nil
+}
+
+// BeginDelta starts a transaction in which all the changes from a delta file are made
+//
+// The context applies to every statement in the transaction, except Rollback.
+func (repo PostgresRepository) BeginDelta(ctx context.Context, source persist.NRTMSource) (persist.DeltaTransaction, error) {
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		logger.Error("BeginDelta failed to start a transaction", "error", err)
+		return nil, err
+	}
+	return &deltaTransaction{ctx: ctx, tx: tx, source: source}, nil
+}
+
+type deltaTransaction struct {
+	ctx    context.Context
+	tx     pgx.Tx
+	source persist.NRTMSource
+	// deleteVersion is the version given to the history trigger for deletions
+	deleteVersion int64
+}
+
+// AddModifyObject updates an RPSL finding the current matching pk then updating or adding. An
+// object saved before keys were normalized is found by its key as it was written, and is
+// updated with the normalized key.
+func (dtx *deltaTransaction) AddModifyObject(rpsl rpsl.Rpsl, file persist.NrtmFileJSON) error {
+	newRow := &pgpersist.RPSLObject{
+		ObjectType: rpsl.ObjectType,
+		PrimaryKey: rpsl.PrimaryKey,
+		SourceID:   dtx.source.ID,
+		Version:    uint32(file.Version),
+		RPSL:       rpsl.Payload,
+	}
+	if err := removeInvalidObject(dtx.ctx, dtx.tx, dtx.source, rpsl.ObjectType, rpsl.PrimaryKey); err != nil {
+		return err
+	}
+	sql := selectCurrentObjectQuery()
+	rpslObject := new(pgpersist.RPSLObject)
+	err := dtx.tx.QueryRow(dtx.ctx, sql, dtx.source.ID, rpsl.PrimaryKey, rpsl.ObjectType).Scan(db.ValuesForSelect(rpslObject)...)
+	if unnormalized := rpsl.UnnormalizedPrimaryKey(); err == pgx.ErrNoRows && unnormalized != rpsl.PrimaryKey {
+		err = dtx.tx.QueryRow(dtx.ctx, sql, dtx.source.ID, unnormalized, rpsl.ObjectType).Scan(db.ValuesForSelect(rpslObject)...)
+	}
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	if err == pgx.ErrNoRows {
+		newRow.ID = db.NextID()
+		return db.Create(dtx.tx, newRow)
+	}
+	newRow.ID = rpslObject.ID
+	return db.Update(dtx.tx, newRow)
+}
+
+// DeleteObject removes a row matching the params. The primary key is normalized, so it matches
+// the object's key even when the delta writes it differently.
+func (dtx *deltaTransaction) DeleteObject(objectType string, primaryKey string, file persist.NrtmFileJSON) error {
+	if err := removeInvalidObject(dtx.ctx, dtx.tx, dtx.source, objectType, rpsl.NormalizePrimaryKey(objectType, primaryKey)); err != nil {
+		return err
+	}
+	sql := selectCurrentObjectQuery()
+	rpslObject := new(pgpersist.RPSLObject)
+	err := dtx.tx.QueryRow(dtx.ctx, sql, dtx.source.ID, rpsl.NormalizePrimaryKey(objectType, primaryKey), objectType).Scan(db.ValuesForSelect(rpslObject)...)
+	if unnormalized := rpsl.UnnormalizedKey(primaryKey); err == pgx.ErrNoRows && unnormalized != rpsl.NormalizePrimaryKey(objectType, primaryKey) {
+		// Objects saved before keys were normalized have the key as it was written, in upper case
+		err = dtx.tx.QueryRow(dtx.ctx, sql, dtx.source.ID, unnormalized, objectType).Scan(db.ValuesForSelect(rpslObject)...)
+	}
+	if err != nil {
+		return err
+	}
+	if dtx.deleteVersion != file.Version {
+		// The history trigger records the deletion version as the superseded_version
+		sql = `SELECT set_config('nrtm4.delta_version', $1, true)`
+		if _, err = dtx.tx.Exec(dtx.ctx, sql, strconv.FormatInt(file.Version, 10)); err != nil {
+			return err
+		}
+		dtx.deleteVersion = file.Version
+	}
+	rpslObjectDesc := db.GetDescriptor(&pgpersist.RPSLObject{})
+	sql = fmt.Sprintf(`DELETE FROM %v WHERE id=$1`, rpslObjectDesc.TableName())
+	_, err = dtx.tx.Exec(dtx.ctx, sql, rpslObject.ID)
+	return err
+}
+
+// SaveInvalidObject records an invalid object found in a delta
+func (dtx *deltaTransaction) SaveInvalidObject(obj persist.InvalidObject) error {
+	return saveInvalidObject(dtx.ctx, dtx.tx, dtx.source, obj)
+}
+
+// Commit saves the source with its new version and commits the transaction
+func (dtx *deltaTransaction) Commit(source persist.NRTMSource) (persist.NRTMSource, error) {
+	pgSource := pgpersist.FromNRTMSource(source)
+	if err := db.Update(dtx.tx, &pgSource); err != nil {
+		dtx.Rollback()
+		return dtx.source, err
+	}
+	if err := dtx.tx.Commit(dtx.ctx); err != nil {
+		logger.Error("Failed to commit delta", "source", source.Source, "version", source.Version, "error", err)
+		return dtx.source, err
+	}
+	return pgSource.AsNRTMSource(), nil
+}
+
+// Rollback discards all changes made in the transaction
+func (dtx *deltaTransaction) Rollback() error {
+	return dtx.tx.Rollback(context.Background())
 }
 
 func selectCurrentObjectQuery() string {
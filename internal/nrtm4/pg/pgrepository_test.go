@@ -1,9 +1,12 @@
 package pg
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 	"unicode"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 )
 
 func TestGetSources(t *testing.T) {
@@ -33,6 +36,35 @@ func TestSelectObjectSQL(t *testing.T) {
 	}
 }
 
+func TestWithDeletedRevisions(t *testing.T) {
+	v := func(n uint32) *uint32 { return &n }
+	revisions := []persist.ObjectRevision{
+		{Version: 1, RPSL: "first"},
+		{Version: 3, RPSL: "changed"},
+		{Version: 7, RPSL: "added again"},
+		{Version: 9, RPSL: "current"},
+	}
+	// Changed at 3, deleted at 5, added at 7, changed at 9
+	got := withDeletedRevisions(revisions, []*uint32{v(3), v(5), v(9)})
+
+	expected := []persist.ObjectRevision{
+		{Version: 1, RPSL: "first"},
+		{Version: 3, RPSL: "changed"},
+		{Version: 5, Deleted: true},
+		{Version: 7, RPSL: "added again"},
+		{Version: 9, RPSL: "current"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got unexpected revisions\n%v\nbut wanted\n%v", got, expected)
+	}
+
+	// Deleted before superseded versions were recorded, and not added again
+	got = withDeletedRevisions([]persist.ObjectRevision{{Version: 2, RPSL: "old"}}, []*uint32{nil})
+	if len(got) != 2 || !got[1].Deleted || got[1].Version != 0 {
+		t.Error("Deletion with an unknown version should be added", got)
+	}
+}
+
 func TestReduceWhiteSpace(t *testing.T) {
 	input := [...]string{
 		"How now     brown      cow",
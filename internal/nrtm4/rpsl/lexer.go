@@ -0,0 +1,99 @@
+package rpsl
+
+import (
+	"regexp"
+	"strings"
+)
+
+// attributeNameRegex is an RFC 2622 attribute name: letters, digits, '_' and '-', starting with
+// a letter and ending with a letter or digit
+var attributeNameRegex = regexp.MustCompile(`^[A-Za-z](?:[A-Za-z0-9_-]*[A-Za-z0-9])?$`)
+
+// Attribute is an attribute of an RPSL object
+type Attribute struct {
+	// Name is in lower case
+	Name string
+	// Value has the continuation lines folded into it, separated by a space, with comments and
+	// surrounding white space removed
+	Value string
+	// Comments are the end-of-line comments from the attribute's lines, without the '#'
+	Comments []string `json:",omitempty"`
+}
+
+// ParseAttributes splits an RPSL object into its attributes, in the order they appear, as
+// described in RFC 2622 section 2. The name is separated from the value at the first colon, so
+// values can contain colons. Lines starting with a space, a tab or '+' continue the value of the
+// attribute before them. Blank lines, comment lines, and lines which are not attributes are
+// skipped.
+func ParseAttributes(str string) []Attribute {
+	lines := strings.Split(strings.ReplaceAll(str, "\r\n", "\n"), "\n")
+	attributes := []Attribute{}
+	var values []string
+	fold := func() {
+		if len(attributes) > 0 {
+			attributes[len(attributes)-1].Value = strings.Join(values, " ")
+		}
+	}
+	for _, line := range lines {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		text, continuation := splitContinuation(line)
+		if continuation {
+			if len(attributes) == 0 {
+				logger.Debug("RPSL continuation line has no attribute", "line", line)
+				continue
+			}
+			value, comment := splitComment(text)
+			if len(value) > 0 {
+				values = append(values, value)
+			}
+			if len(comment) > 0 {
+				last := &attributes[len(attributes)-1]
+				last.Comments = append(last.Comments, comment)
+			}
+			continue
+		}
+		if text[0] == '#' {
+			continue
+		}
+		name, rest, found := strings.Cut(text, ":")
+		name = strings.TrimSpace(name)
+		if !found || !attributeNameRegex.MatchString(name) {
+			logger.Debug("RPSL line is not an attribute", "line", line)
+			continue
+		}
+		fold()
+		value, comment := splitComment(rest)
+		attr := Attribute{Name: strings.ToLower(name)}
+		if len(comment) > 0 {
+			attr.Comments = []string{comment}
+		}
+		attributes = append(attributes, attr)
+		values = values[:0]
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	fold()
+	return attributes
+}
+
+// splitContinuation returns the text of a line without its continuation character, and
+// whether it continues the attribute before it
+func splitContinuation(line string) (string, bool) {
+	switch line[0] {
+	case ' ', '\t', '+':
+		return line[1:], true
+	}
+	return line, false
+}
+
+// splitComment separates a value from the comment which follows it
+func splitComment(str string) (string, string) {
+	value, comment, found := strings.Cut(str, "#")
+	if !found {
+		return strings.TrimSpace(str), ""
+	}
+	return strings.TrimSpace(value), strings.TrimSpace(comment)
+}
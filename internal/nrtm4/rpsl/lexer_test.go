@@ -0,0 +1,94 @@
+package rpsl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAttributesSplitsOnFirstColon(t *testing.T) {
+	str := "route6:     2001:db8::/32\n" +
+		"origin:     AS64500\n" +
+		"remarks:    See https://example.com:8080/policy\n" +
+		"mp-import:  afi ipv6.unicast from AS64501 accept ANY\n" +
+		"source:     TEST"
+
+	attributes := ParseAttributes(str)
+
+	expected := []Attribute{
+		{Name: "route6", Value: "2001:db8::/32"},
+		{Name: "origin", Value: "AS64500"},
+		{Name: "remarks", Value: "See https://example.com:8080/policy"},
+		{Name: "mp-import", Value: "afi ipv6.unicast from AS64501 accept ANY"},
+		{Name: "source", Value: "TEST"},
+	}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("Got unexpected attributes\n%v\nbut wanted\n%v", attributes, expected)
+	}
+}
+
+func TestParseAttributesFoldsContinuations(t *testing.T) {
+	str := "aut-num:    AS64500\n" +
+		"import:     from AS64501 # first peer\n" +
+		"            accept AS64501\n" +
+		"\taction pref=100; # tab continuation\n" +
+		"+\n" +
+		"+           AND NOT AS64502\n" +
+		"remarks:    one\n" +
+		"remarks:    two\n" +
+		"# A comment line\n" +
+		"source:     TEST"
+
+	obj, err := parseString(str)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(obj.Attributes) != 5 {
+		t.Fatal("Expected 5 attributes, got", obj.Attributes)
+	}
+	imp := obj.Attributes[1]
+	if imp.Value != "from AS64501 accept AS64501 action pref=100; AND NOT AS64502" {
+		t.Error("Continuation lines were not folded", imp.Value)
+	}
+	if !reflect.DeepEqual(imp.Comments, []string{"first peer", "tab continuation"}) {
+		t.Error("Comments were not kept", imp.Comments)
+	}
+	if values := obj.Values("REMARKS"); !reflect.DeepEqual(values, []string{"one", "two"}) {
+		t.Error("Multi-valued attribute is wrong", values)
+	}
+	if obj.Value("source") != "TEST" || obj.Value("descr") != "" {
+		t.Error("Value returns the wrong attribute")
+	}
+}
+
+func TestParseAttributesContinuationWithColon(t *testing.T) {
+	for str, expected := range map[string][]Attribute{
+		"remarks: see\n  http://x.example/a": {
+			{Name: "remarks", Value: "see http://x.example/a"},
+		},
+		"route: 192.0.2.0/24\n origin: AS1": {
+			{Name: "route", Value: "192.0.2.0/24 origin: AS1"},
+		},
+		"remarks:     Peering policy at\n             http://example.net/policy\n+            mailto:noc@example.net\nsource:      TEST": {
+			{Name: "remarks", Value: "Peering policy at http://example.net/policy mailto:noc@example.net"},
+			{Name: "source", Value: "TEST"},
+		},
+	} {
+		if attributes := ParseAttributes(str); !reflect.DeepEqual(attributes, expected) {
+			t.Errorf("Got unexpected attributes for %q\n%v\nbut wanted\n%v", str, attributes, expected)
+		}
+	}
+}
+
+func TestRpslParseRoute6(t *testing.T) {
+	str := "route6: 2001:DB8::/32\norigin: AS64500\nsource: TEST"
+
+	obj, err := parseString(str)
+
+	if err != nil {
+		t.Fatal("route6 should parse", err)
+	}
+	if obj.PrimaryKey != "2001:DB8::/32AS64500" {
+		t.Error("Unexpected primary key", obj.PrimaryKey)
+	}
+}
@@ -2,94 +2,62 @@ package rpsl
 
 import (
 	"errors"
-	"regexp"
 	"strings"
 )
 
 // ErrCannotParseRPSL is returned when the parser can't make sense of the RPSL
 var ErrCannotParseRPSL = errors.New("invalid RPSL")
 
-var trimHashChar = regexp.MustCompile("[^#]*")
-
 // Rpsl is a data structure used for processing
 type Rpsl struct {
 	PrimaryKey string
 	Source     string
 	ObjectType string
 	Payload    string
+	// Attributes are in the order they appear in the payload. They're only set when the object
+	// is parsed.
+	Attributes []Attribute `json:",omitempty"`
 }
 
-// ParseFromJSONString parses a string and returns it as an RPSL object
-func ParseFromJSONString(str string) (Rpsl, error) {
-	return parseString(str)
-}
-
-func parseString(str string) (Rpsl, error) {
-	lines := strings.Split(str, "\n")
-	var source, objectType string
-	var primaryKey []string
-	for _, rawLine := range lines {
-		line := stripComment(rawLine)
-		if len(line) == 0 {
-			continue
-		}
-		if len(objectType) == 0 {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) != 2 {
-				logger.Warn("Cannot determine ObjectType")
-				return Rpsl{}, ErrCannotParseRPSL
-			}
-			objectType = trimToUpper(parts[0])
-			if isPrimaryKeyAttribute(objectType, objectType) {
-				primaryKey = append(primaryKey, trimToUpper(parts[1]))
-			}
-		} else {
-			parts := strings.Split(line, ":")
-			if len(parts) != 2 {
-				continue
-			}
-			attributeName := trimToLower(parts[0])
-			if attributeName == "source" {
-				source = trimToUpper(parts[1])
-			} else if isPrimaryKeyAttribute(objectType, attributeName) {
-				primaryKey = append(primaryKey, trimToUpper(parts[1]))
-			}
+// Values returns the values of every attribute with the name, in order
+func (r Rpsl) Values(name string) []string {
+	values := []string{}
+	for _, attr := range r.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			values = append(values, attr.Value)
 		}
 	}
-	rpsl := Rpsl{PrimaryKey: strings.Join(primaryKey, ""), Source: source, ObjectType: objectType, Payload: str}
-	if len(primaryKey) == 0 || len(source) == 0 || len(objectType) == 0 || ((objectType == "route" || objectType == "route6") && len(primaryKey) != 2) {
-		return rpsl, ErrCannotParseRPSL
-	}
-	return rpsl, nil
+	return values
 }
 
-func trimToLower(str string) string {
-	return strings.ToLower(strings.TrimSpace(str))
+// Value returns the value of the first attribute with the name, or an empty string if there
+// isn't one
+func (r Rpsl) Value(name string) string {
+	for _, attr := range r.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr.Value
+		}
+	}
+	return ""
 }
 
-func trimToUpper(str string) string {
-	return strings.ToUpper(strings.TrimSpace(str))
+// ParseFromJSONString parses a string and returns it as an RPSL object
+func ParseFromJSONString(str string) (Rpsl, error) {
+	return parseString(str)
 }
 
-func isPrimaryKeyAttribute(objectType string, attributeName string) bool {
-	if objectType == "PERSON" || objectType == "ROLE" {
-		return attributeName == "nic-hdl"
-	}
-	if objectType == "ROUTE" || objectType == "ROUTE6" {
-		return strings.EqualFold(attributeName, objectType) || attributeName == "origin"
+func parseString(str string) (Rpsl, error) {
+	attributes := ParseAttributes(str)
+	if len(attributes) == 0 {
+		logger.Warn("Cannot determine ObjectType")
+		return Rpsl{}, ErrCannotParseRPSL
 	}
-	return strings.EqualFold(attributeName, objectType)
-}
-
-func stripComment(str string) string {
-	var b strings.Builder
-	b.Grow(len(str))
-	for _, ch := range str {
-		if ch != '#' {
-			b.WriteRune(ch)
-		} else {
-			break
-		}
+	objectType := strings.ToUpper(attributes[0].Name)
+	source := strings.ToUpper(Rpsl{Attributes: attributes}.Value("source"))
+	key := primaryKey(objectType, attributes)
+	rpsl := Rpsl{PrimaryKey: key, Source: source, ObjectType: objectType, Payload: str, Attributes: attributes}
+	if len(key) == 0 || len(source) == 0 {
+		return rpsl, ErrCannotParseRPSL
 	}
-	return strings.TrimSpace(b.String())
+	return rpsl, nil
 }
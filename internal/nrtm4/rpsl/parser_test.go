@@ -1,6 +1,9 @@
 package rpsl
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 /*
 
@@ -10,6 +13,16 @@ What about multi-line strings like address -- how is the second line distinguish
 
 */
 
+// unindent removes the indentation of an object written in a raw string in the test source,
+// which would otherwise make every line a continuation line
+func unindent(str string) string {
+	lines := strings.Split(str, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimLeft(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
 func TestErrorThrownForBadRPSL(t *testing.T) {
 
 	var err error
@@ -64,7 +77,7 @@ func TestRpslParsePerson(t *testing.T) {
 	source := "RIPE"
 	primaryKey := "DK58"
 
-	obj, err := ParseFromJSONString(str)
+	obj, err := ParseFromJSONString(unindent(str))
 
 	if err != nil {
 		t.Error("Parser doesn't work", err)
@@ -93,7 +106,7 @@ func TestRpslParseRoute(t *testing.T) {
 	source := "RIPE"
 	primaryKey := "37.37.37.0/24AS9876"
 
-	obj, err := parseString(str)
+	obj, err := parseString(unindent(str))
 
 	if err != nil {
 		t.Error("Parser doesn't work", err)
@@ -122,7 +135,7 @@ func TestRpslParseASBlock(t *testing.T) {
 	source := "RIPE"
 	primaryKey := "AS3209 - AS3353"
 
-	obj, err := parseString(str)
+	obj, err := parseString(unindent(str))
 
 	if err != nil {
 		t.Error("Parser doesn't work", err)
@@ -0,0 +1,323 @@
+package policy
+
+import (
+	"strings"
+)
+
+// Policy is a parsed import, export, mp-import, mp-export, default or mp-default attribute
+type Policy struct {
+	// Attribute is the name of the attribute, in lower case
+	Attribute string
+	// Protocol is the protocol the routes are exchanged with, if it's given
+	Protocol string `json:",omitempty"`
+	// Into is the protocol the routes are imported into, or exported from, if it's given
+	Into string `json:",omitempty"`
+	// Expression is set for import and export policies
+	Expression *Expression `json:",omitempty"`
+	// Default is set for default policies
+	Default *Default `json:",omitempty"`
+}
+
+// IsExport is true for export and mp-export policies
+func (p Policy) IsExport() bool {
+	return p.Attribute == "export" || p.Attribute == "mp-export"
+}
+
+// IsMultiProtocol is true for the mp- attributes defined in RFC 4012
+func (p Policy) IsMultiProtocol() bool {
+	return strings.HasPrefix(p.Attribute, "mp-")
+}
+
+// String returns the policy in a canonical form, which parses to the same policy
+func (p Policy) String() string {
+	var b strings.Builder
+	if len(p.Protocol) > 0 {
+		b.WriteString("protocol " + p.Protocol + " ")
+	}
+	if len(p.Into) > 0 {
+		b.WriteString("into " + p.Into + " ")
+	}
+	if p.Expression != nil {
+		peer, filter := "from", "accept"
+		if p.IsExport() {
+			peer, filter = "to", "announce"
+		}
+		p.Expression.write(&b, peer, filter)
+	}
+	if p.Default != nil {
+		p.Default.write(&b)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Expression is a policy term, which may be refined by, or have exceptions in, the expression
+// which follows it
+type Expression struct {
+	// AFI is the address families the expression applies to. It's only in mp- attributes, where
+	// it defaults to any.
+	AFI  []string `json:",omitempty"`
+	Term Term
+	// Operator is EXCEPT or REFINE when there's a Next expression
+	Operator string      `json:",omitempty"`
+	Next     *Expression `json:",omitempty"`
+}
+
+func (e Expression) write(b *strings.Builder, peer, filter string) {
+	if len(e.AFI) > 0 {
+		b.WriteString("afi " + strings.Join(e.AFI, ", ") + " ")
+	}
+	e.Term.write(b, peer, filter)
+	if e.Next != nil {
+		b.WriteString(" " + e.Operator + " ")
+		e.Next.write(b, peer, filter)
+	}
+}
+
+// Term is one or more policy factors. A term with more than one factor is written in braces,
+// and the first factor which matches a route applies.
+type Term struct {
+	Factors []Factor
+	// Braces is true when the factors were written in braces
+	Braces bool `json:",omitempty"`
+}
+
+func (t Term) write(b *strings.Builder, peer, filter string) {
+	if !t.Braces {
+		t.Factors[0].write(b, peer, filter)
+		return
+	}
+	b.WriteString("{ ")
+	for _, f := range t.Factors {
+		f.write(b, peer, filter)
+		b.WriteString("; ")
+	}
+	b.WriteString("}")
+}
+
+// Factor is the peerings routes are exchanged with, and the filter which selects the routes
+type Factor struct {
+	Peerings []PeeringAction
+	Filter   Filter
+}
+
+func (f Factor) write(b *strings.Builder, peer, filter string) {
+	for _, pa := range f.Peerings {
+		b.WriteString(peer + " " + pa.Peering.String() + " ")
+		writeActions(b, pa.Actions)
+	}
+	b.WriteString(filter + " " + f.Filter.String())
+}
+
+// PeeringAction is a peering with the actions applied to the routes exchanged with it
+type PeeringAction struct {
+	Peering Peering
+	Actions []Action `json:",omitempty"`
+}
+
+func writeActions(b *strings.Builder, actions []Action) {
+	if len(actions) == 0 {
+		return
+	}
+	b.WriteString("action ")
+	for _, a := range actions {
+		b.WriteString(a.String() + "; ")
+	}
+}
+
+// Peering is the ASes, and optionally the routers, routes are exchanged with. It's either an
+// AS expression, or the name of a peering-set.
+type Peering struct {
+	AS SetExpression `json:",omitempty"`
+	// Router is the peer's routers
+	Router SetExpression `json:",omitempty"`
+	// At is the local routers
+	At         SetExpression `json:",omitempty"`
+	PeeringSet string        `json:",omitempty"`
+}
+
+func (p Peering) String() string {
+	if len(p.PeeringSet) > 0 {
+		return p.PeeringSet
+	}
+	str := p.AS.String()
+	if p.Router != nil {
+		str += " " + p.Router.String()
+	}
+	if p.At != nil {
+		str += " at " + p.At.String()
+	}
+	return str
+}
+
+// Default is a default or mp-default policy
+type Default struct {
+	AFI     []string `json:",omitempty"`
+	Peering Peering
+	Actions []Action `json:",omitempty"`
+	// Networks selects the routes used as defaults. It's nil when any route can be used.
+	Networks Filter `json:",omitempty"`
+}
+
+func (d Default) write(b *strings.Builder) {
+	if len(d.AFI) > 0 {
+		b.WriteString("afi " + strings.Join(d.AFI, ", ") + " ")
+	}
+	b.WriteString("to " + d.Peering.String())
+	if len(d.Actions) > 0 {
+		b.WriteString(" ")
+		writeActions(b, d.Actions)
+	}
+	if d.Networks != nil {
+		if len(d.Actions) == 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString("networks " + d.Networks.String())
+	}
+}
+
+// Action is an operation on a route attribute, e.g. pref = 10, community.append(65000:1) or,
+// in a filter, community == {65000:1}
+type Action struct {
+	Attribute string
+	// Method is set when a method of the attribute is called, e.g. append
+	Method string `json:",omitempty"`
+	// Operator and Value are set when the attribute is assigned or compared
+	Operator string `json:",omitempty"`
+	Value    string `json:",omitempty"`
+	// Args are the arguments of a method call
+	Args []string `json:",omitempty"`
+}
+
+func (a Action) String() string {
+	if len(a.Operator) > 0 {
+		return a.Attribute + " " + a.Operator + " " + a.Value
+	}
+	name := a.Attribute
+	if len(a.Method) > 0 {
+		name += "." + a.Method
+	}
+	return name + "(" + strings.Join(a.Args, ", ") + ")"
+}
+
+// SetExpression is an AS or router expression: the names of ASes, routers and sets, combined
+// with AND, OR and EXCEPT
+type SetExpression interface {
+	String() string
+	setExpression()
+}
+
+// SetMember is an AS number, an as-set, an IP address, an inet-rtr, or an rtr-set
+type SetMember struct {
+	Name string
+}
+
+// SetOperation combines two set expressions with AND, OR or EXCEPT
+type SetOperation struct {
+	Operator    string
+	Left, Right SetExpression
+}
+
+func (m SetMember) String() string { return m.Name }
+
+func (o SetOperation) String() string {
+	return operand(o.Left, o.Operator) + " " + o.Operator + " " + operand(o.Right, o.Operator)
+}
+
+func (SetMember) setExpression()    {}
+func (SetOperation) setExpression() {}
+
+func operand(e SetExpression, operator string) string {
+	if op, ok := e.(SetOperation); ok && op.Operator != operator {
+		return "(" + op.String() + ")"
+	}
+	return e.String()
+}
+
+// Filter is a filter expression, which selects routes
+type Filter interface {
+	String() string
+	filter()
+}
+
+// FilterName matches the routes of an AS, an as-set, a route-set or a filter-set, or the
+// keywords ANY and PeerAS, with an optional range operator, e.g. AS-EXAMPLE^+
+type FilterName struct {
+	Name    string
+	RangeOp string `json:",omitempty"`
+}
+
+// FilterPrefixSet matches the prefixes in braces, e.g. { 192.0.2.0/24^+, 2001:db8::/32 }
+type FilterPrefixSet struct {
+	Prefixes []PrefixRange
+	// RangeOp applies to every prefix in the set
+	RangeOp string `json:",omitempty"`
+}
+
+// PrefixRange is an address prefix with an optional range operator: ^-, ^+, ^n or ^n-m
+type PrefixRange struct {
+	Prefix  string
+	RangeOp string `json:",omitempty"`
+}
+
+// FilterASPath matches routes whose AS path matches the regular expression
+type FilterASPath struct {
+	Regex string
+}
+
+// FilterAttribute matches routes by one of their attributes, e.g. community(65000:1)
+type FilterAttribute struct {
+	Action
+}
+
+// FilterNot matches routes which the filter doesn't match
+type FilterNot struct {
+	Filter Filter
+}
+
+// FilterOperation combines two filters with AND or OR
+type FilterOperation struct {
+	Operator    string
+	Left, Right Filter
+}
+
+func (f FilterName) String() string { return f.Name + f.RangeOp }
+
+func (f FilterPrefixSet) String() string {
+	prefixes := make([]string, len(f.Prefixes))
+	for i, p := range f.Prefixes {
+		prefixes[i] = p.String()
+	}
+	if len(prefixes) == 0 {
+		return "{}" + f.RangeOp
+	}
+	return "{ " + strings.Join(prefixes, ", ") + " }" + f.RangeOp
+}
+
+func (p PrefixRange) String() string { return p.Prefix + p.RangeOp }
+
+func (f FilterASPath) String() string { return "<" + f.Regex + ">" }
+
+func (f FilterNot) String() string {
+	if _, ok := f.Filter.(FilterOperation); ok {
+		return "NOT (" + f.Filter.String() + ")"
+	}
+	return "NOT " + f.Filter.String()
+}
+
+func (f FilterOperation) String() string {
+	return filterOperand(f.Left, f.Operator) + " " + f.Operator + " " + filterOperand(f.Right, f.Operator)
+}
+
+func filterOperand(f Filter, operator string) string {
+	if op, ok := f.(FilterOperation); ok && op.Operator != operator {
+		return "(" + op.String() + ")"
+	}
+	return f.String()
+}
+
+func (FilterName) filter()      {}
+func (FilterPrefixSet) filter() {}
+func (FilterASPath) filter()    {}
+func (FilterAttribute) filter() {}
+func (FilterNot) filter()       {}
+func (FilterOperation) filter() {}
@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	// tokenWord is a keyword, a name, a number, an address or a prefix
+	tokenWord
+	// tokenPunct is one of ; { } ( ) ,
+	tokenPunct
+	// tokenOperator is an action or comparison operator, e.g. = .= += ==
+	tokenOperator
+	// tokenRegex is an AS-path regular expression, without the angle brackets
+	tokenRegex
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// offset is the position of the token in the value
+	offset int
+}
+
+// is reports whether a word token is the keyword, which is not case sensitive
+func (t token) is(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (t token) isPunct(p string) bool {
+	return t.kind == tokenPunct && t.text == p
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of value"
+	case tokenRegex:
+		return "<" + t.text + ">"
+	}
+	return "'" + t.text + "'"
+}
+
+const (
+	punctuation = ";{}(),"
+	// wordEnd are the characters which end a word
+	wordEnd = punctuation + "<>=!"
+)
+
+// tokenize splits a policy into tokens. Words are separated by white space, punctuation and
+// operators. An AS-path regular expression is everything between '<' and the next '>'.
+func tokenize(value string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(value); {
+		c := value[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '<':
+			end := strings.IndexByte(value[i:], '>')
+			if end < 0 {
+				return nil, newParseError(i, "AS-path regular expression has no closing '>'")
+			}
+			tokens = append(tokens, token{tokenRegex, strings.TrimSpace(value[i+1 : i+end]), i})
+			i += end + 1
+		case strings.IndexByte(punctuation, c) >= 0:
+			tokens = append(tokens, token{tokenPunct, string(c), i})
+			i++
+		case isOperatorStart(value[i:]):
+			n := 1
+			if i+1 < len(value) && value[i+1] == '=' {
+				n = 2
+			}
+			tokens = append(tokens, token{tokenOperator, value[i : i+n], i})
+			i += n
+		default:
+			start := i
+			for i < len(value) && !isSpace(value[i]) && strings.IndexByte(wordEnd, value[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, value[start:i], start})
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(value)}), nil
+}
+
+// isOperatorStart is true for = == != > >= and the assignments .= += -= *= /=
+func isOperatorStart(str string) bool {
+	switch str[0] {
+	case '=', '!', '>':
+		return true
+	case '.', '+', '-', '*', '/':
+		return len(str) > 1 && str[1] == '='
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
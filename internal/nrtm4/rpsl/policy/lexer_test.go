@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize("from AS1 action pref=100; community .= {65000:1}; accept <^AS1 .*$> AND {10.0.0.0/8^+}^-")
+	if err != nil {
+		t.Fatal("Cannot tokenize", err)
+	}
+	expected := []token{
+		{tokenWord, "from", 0},
+		{tokenWord, "AS1", 5},
+		{tokenWord, "action", 9},
+		{tokenWord, "pref", 16},
+		{tokenOperator, "=", 20},
+		{tokenWord, "100", 21},
+		{tokenPunct, ";", 24},
+		{tokenWord, "community", 26},
+		{tokenOperator, ".=", 36},
+		{tokenPunct, "{", 39},
+		{tokenWord, "65000:1", 40},
+		{tokenPunct, "}", 47},
+		{tokenPunct, ";", 48},
+		{tokenWord, "accept", 50},
+		{tokenRegex, "^AS1 .*$", 57},
+		{tokenWord, "AND", 68},
+		{tokenPunct, "{", 72},
+		{tokenWord, "10.0.0.0/8^+", 73},
+		{tokenPunct, "}", 85},
+		{tokenWord, "^-", 86},
+		{tokenEOF, "", 88},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatal("Expected", len(expected), "tokens but was", len(tokens), tokens)
+	}
+	for i, tok := range tokens {
+		if tok != expected[i] {
+			t.Error("Expected", expected[i], "but was", tok)
+		}
+	}
+}
+
+func TestTokenizeOperators(t *testing.T) {
+	tokens, _ := tokenize("a==b != c >= d += e -= f *= g /= h > i")
+	ops := []string{}
+	for _, tok := range tokens {
+		if tok.kind == tokenOperator {
+			ops = append(ops, tok.text)
+		}
+	}
+	expected := []string{"==", "!=", ">=", "+=", "-=", "*=", "/=", ">"}
+	if len(ops) != len(expected) {
+		t.Fatal("Unexpected operators", ops)
+	}
+	for i, op := range ops {
+		if op != expected[i] {
+			t.Error("Expected", expected[i], "but was", op)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+// Package policy parses the routing policy attributes of aut-num objects, import, export and
+// default, as described in RFC 2622, and their multi-protocol forms from RFC 4012.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// Attributes are the names of the attributes which can be parsed
+var Attributes = []string{"import", "export", "mp-import", "mp-export", "default", "mp-default"}
+
+// ErrNotAPolicyAttribute the attribute is not one of Attributes
+var ErrNotAPolicyAttribute = errors.New("attribute is not a routing policy")
+
+// ParseError says where a policy can't be parsed
+type ParseError struct {
+	Attribute string
+	Value     string
+	// Offset is the position in the value where the error was found
+	Offset  int
+	Message string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%v: %v at offset %d", e.Attribute, e.Message, e.Offset)
+}
+
+func newParseError(offset int, format string, args ...any) ParseError {
+	return ParseError{Offset: offset, Message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	afiValues = map[string]bool{
+		"any": true, "any.unicast": true, "any.multicast": true,
+		"ipv4": true, "ipv4.unicast": true, "ipv4.multicast": true,
+		"ipv6": true, "ipv6.unicast": true, "ipv6.multicast": true,
+	}
+	rangeOpRegex = regexp.MustCompile(`^\^(-|\+|\d+|\d+-\d+)$`)
+)
+
+// Parse parses the value of a routing policy attribute. The attribute name is not case
+// sensitive. Returns a ParseError if the value can't be parsed, or ErrNotAPolicyAttribute.
+func Parse(attribute, value string) (Policy, error) {
+	attribute = strings.ToLower(strings.TrimSpace(attribute))
+	policy := Policy{Attribute: attribute}
+	known := false
+	for _, name := range Attributes {
+		known = known || name == attribute
+	}
+	if !known {
+		return policy, ErrNotAPolicyAttribute
+	}
+	tokens, err := tokenize(value)
+	if err != nil {
+		return policy, withAttribute(err, attribute, value)
+	}
+	p := &parser{tokens: tokens, mp: policy.IsMultiProtocol()}
+	if err = p.parsePolicy(&policy); err != nil {
+		return policy, withAttribute(err, attribute, value)
+	}
+	return policy, nil
+}
+
+// ParseObject parses every routing policy attribute of an object, in the order they appear.
+// Attributes which can't be parsed are left out, and their errors are joined.
+func ParseObject(obj rpsl.Rpsl) ([]Policy, error) {
+	policies := []Policy{}
+	var errs []error
+	for _, attr := range obj.Attributes {
+		policy, err := Parse(attr.Name, attr.Value)
+		if err == ErrNotAPolicyAttribute {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+		} else {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, errors.Join(errs...)
+}
+
+func withAttribute(err error, attribute, value string) error {
+	if pe, ok := err.(ParseError); ok {
+		pe.Attribute = attribute
+		pe.Value = value
+		return pe
+	}
+	return err
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// mp allows afi lists and IPv6 prefixes
+	mp bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's the keyword
+func (p *parser) accept(keyword string) bool {
+	if p.peek().is(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptPunct(punct string) bool {
+	if p.peek().isPunct(punct) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(keyword string) error {
+	if !p.accept(keyword) {
+		return p.unexpected("expected '%v'", keyword)
+	}
+	return nil
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if !p.acceptPunct(punct) {
+		return p.unexpected("expected '%v'", punct)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(format string, args ...any) error {
+	t := p.peek()
+	return newParseError(t.offset, "%v, found %v", fmt.Sprintf(format, args...), t)
+}
+
+// isKeyword is true for the words which end peerings, actions and filters
+func isKeyword(t token) bool {
+	for _, k := range []string{"from", "to", "action", "accept", "announce", "networks", "except", "refine", "at", "afi"} {
+		if t.is(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parsePolicy(policy *Policy) error {
+	if p.accept("protocol") {
+		if policy.Protocol = p.next().text; len(policy.Protocol) == 0 {
+			return p.unexpected("expected a protocol name")
+		}
+	}
+	if p.accept("into") {
+		if policy.Into = p.next().text; len(policy.Into) == 0 {
+			return p.unexpected("expected a protocol name")
+		}
+	}
+	var err error
+	if policy.Attribute == "default" || policy.Attribute == "mp-default" {
+		policy.Default, err = p.parseDefault()
+	} else {
+		peer, filter := "from", "accept"
+		if policy.IsExport() {
+			peer, filter = "to", "announce"
+		}
+		policy.Expression, err = p.parseExpression(peer, filter)
+	}
+	if err != nil {
+		return err
+	}
+	// A single factor is sometimes written with a ';' at the end
+	p.acceptPunct(";")
+	if p.peek().kind != tokenEOF {
+		return p.unexpected("expected end of value")
+	}
+	return nil
+}
+
+// parseExpression parses [afi <afi-list>] <term> [EXCEPT|REFINE <expression>]
+func (p *parser) parseExpression(peer, filter string) (*Expression, error) {
+	expr := new(Expression)
+	var err error
+	if expr.AFI, err = p.parseAFI(); err != nil {
+		return nil, err
+	}
+	if expr.Term, err = p.parseTerm(peer, filter); err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"EXCEPT", "REFINE"} {
+		if p.accept(op) {
+			expr.Operator = op
+			expr.Next, err = p.parseExpression(peer, filter)
+			return expr, err
+		}
+	}
+	return expr, nil
+}
+
+// parseAFI parses an optional afi list, which is only allowed in mp- attributes
+func (p *parser) parseAFI() ([]string, error) {
+	if !p.peek().is("afi") {
+		return nil, nil
+	}
+	if !p.mp {
+		return nil, p.unexpected("afi is only allowed in mp- attributes")
+	}
+	p.next()
+	afis := []string{}
+	for {
+		t := p.next()
+		afi := strings.ToLower(t.text)
+		if t.kind != tokenWord || !afiValues[afi] {
+			return nil, newParseError(t.offset, "%v is not an address family", t)
+		}
+		afis = append(afis, afi)
+		if !p.acceptPunct(",") {
+			return afis, nil
+		}
+	}
+}
+
+// parseTerm parses a factor, or factors in braces separated by ';'
+func (p *parser) parseTerm(peer, filter string) (Term, error) {
+	if !p.acceptPunct("{") {
+		factor, err := p.parseFactor(peer, filter)
+		return Term{Factors: []Factor{factor}}, err
+	}
+	term := Term{Factors: []Factor{}, Braces: true}
+	for !p.acceptPunct("}") {
+		factor, err := p.parseFactor(peer, filter)
+		if err != nil {
+			return term, err
+		}
+		term.Factors = append(term.Factors, factor)
+		if !p.acceptPunct(";") && !p.peek().isPunct("}") {
+			return term, p.unexpected("expected ';' or '}'")
+		}
+	}
+	if len(term.Factors) == 0 {
+		return term, p.unexpected("expected a policy in braces")
+	}
+	return term, nil
+}
+
+// parseFactor parses <peer> <peering> [action <actions>] ... <filter-keyword> <filter>
+func (p *parser) parseFactor(peer, filter string) (Factor, error) {
+	factor := Factor{Peerings: []PeeringAction{}}
+	for p.accept(peer) {
+		peering, err := p.parsePeering()
+		if err != nil {
+			return factor, err
+		}
+		pa := PeeringAction{Peering: peering}
+		if p.accept("action") {
+			if pa.Actions, err = p.parseActions(); err != nil {
+				return factor, err
+			}
+		}
+		factor.Peerings = append(factor.Peerings, pa)
+	}
+	if len(factor.Peerings) == 0 {
+		return factor, p.unexpected("expected '%v'", peer)
+	}
+	if err := p.expect(filter); err != nil {
+		return factor, err
+	}
+	var err error
+	factor.Filter, err = p.parseFilter()
+	return factor, err
+}
+
+// parseDefault parses [afi <afi-list>] to <peering> [action <actions>] [networks <filter>]
+func (p *parser) parseDefault() (*Default, error) {
+	def := new(Default)
+	var err error
+	if def.AFI, err = p.parseAFI(); err != nil {
+		return nil, err
+	}
+	if err = p.expect("to"); err != nil {
+		return nil, err
+	}
+	if def.Peering, err = p.parsePeering(); err != nil {
+		return nil, err
+	}
+	if p.accept("action") {
+		if def.Actions, err = p.parseActions(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("networks") {
+		if def.Networks, err = p.parseFilter(); err != nil {
+			return nil, err
+		}
+	}
+	return def, nil
+}
+
+// parsePeering parses <as-expression> [<router-expression>] [at <router-expression>], or a
+// peering-set name
+func (p *parser) parsePeering() (Peering, error) {
+	peering := Peering{}
+	t := p.peek()
+	if t.kind == tokenWord && isPeeringSetName(t.text) {
+		p.next()
+		peering.PeeringSet = t.text
+		return peering, nil
+	}
+	var err error
+	if peering.AS, err = p.parseSetExpression("an AS expression"); err != nil {
+		return peering, err
+	}
+	if t = p.peek(); (t.kind == tokenWord && !isKeyword(t)) || t.isPunct("(") {
+		if peering.Router, err = p.parseSetExpression("a router expression"); err != nil {
+			return peering, err
+		}
+	}
+	if p.accept("at") {
+		if peering.At, err = p.parseSetExpression("a router expression"); err != nil {
+			return peering, err
+		}
+	}
+	return peering, nil
+}
+
+// isPeeringSetName is true for names whose last component starts with PRNG-
+func isPeeringSetName(name string) bool {
+	parts := strings.Split(name, ":")
+	return strings.HasPrefix(strings.ToUpper(parts[len(parts)-1]), "PRNG-")
+}
+
+// parseSetExpression parses names combined with OR, AND and EXCEPT. AND and EXCEPT bind more
+// tightly than OR.
+func (p *parser) parseSetExpression(what string) (SetExpression, error) {
+	left, err := p.parseSetConjunction(what)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("OR") {
+		right, err := p.parseSetConjunction(what)
+		if err != nil {
+			return nil, err
+		}
+		left = SetOperation{"OR", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseSetConjunction(what string) (SetExpression, error) {
+	left, err := p.parseSetMember(what)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.accept("AND"):
+			op = "AND"
+		case p.isSetExcept():
+			p.next()
+			op = "EXCEPT"
+		default:
+			return left, nil
+		}
+		right, err := p.parseSetMember(what)
+		if err != nil {
+			return nil, err
+		}
+		left = SetOperation{op, left, right}
+	}
+}
+
+// isSetExcept is true when EXCEPT is followed by a set member rather than a policy, which
+// starts with afi, a peering keyword, or a brace
+func (p *parser) isSetExcept() bool {
+	if !p.peek().is("EXCEPT") {
+		return false
+	}
+	after := p.tokens[p.pos+1]
+	return after.isPunct("(") || (after.kind == tokenWord && !isKeyword(after))
+}
+
+func (p *parser) parseSetMember(what string) (SetExpression, error) {
+	if p.acceptPunct("(") {
+		expr, err := p.parseSetExpression(what)
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectPunct(")")
+	}
+	t := p.peek()
+	if t.kind != tokenWord || isKeyword(t) || t.is("AND") || t.is("OR") {
+		return nil, p.unexpected("expected %v", what)
+	}
+	p.next()
+	return SetMember{t.text}, nil
+}
+
+// parseActions parses actions separated by ';', which end at a keyword or the end of the value
+func (p *parser) parseActions() ([]Action, error) {
+	actions := []Action{}
+	for {
+		t := p.peek()
+		if t.kind == tokenEOF || isKeyword(t) || t.isPunct("}") {
+			break
+		}
+		action, err := p.parseAction()
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+		if !p.acceptPunct(";") {
+			break
+		}
+	}
+	if len(actions) == 0 {
+		return nil, p.unexpected("expected an action")
+	}
+	return actions, nil
+}
+
+// parseAction parses <attribute> <operator> <value>, or <attribute>[.<method>](<args>)
+func (p *parser) parseAction() (Action, error) {
+	t := p.next()
+	if t.kind != tokenWord {
+		return Action{}, newParseError(t.offset, "expected a route attribute, found %v", t)
+	}
+	action := Action{Attribute: t.text}
+	if p.peek().kind == tokenOperator {
+		action.Operator = p.next().text
+		value, err := p.parseValue()
+		action.Value = value
+		return action, err
+	}
+	if attr, method, found := strings.Cut(t.text, "."); found {
+		action.Attribute, action.Method = attr, method
+	}
+	if !p.peek().isPunct("(") {
+		return action, p.unexpected("expected an operator or '(' after %v", t)
+	}
+	var err error
+	action.Args, err = p.parseArgs()
+	return action, err
+}
+
+// parseValue parses a word, or a list in braces
+func (p *parser) parseValue() (string, error) {
+	if p.peek().isPunct("{") {
+		values, err := p.parseList("{", "}")
+		texts := make([]string, len(values))
+		for i, v := range values {
+			texts[i] = v.text
+		}
+		return "{" + strings.Join(texts, ", ") + "}", err
+	}
+	t := p.next()
+	if t.kind != tokenWord {
+		return "", newParseError(t.offset, "expected a value, found %v", t)
+	}
+	return t.text, nil
+}
+
+// parseArgs parses method arguments in parentheses. An argument can be a list in braces.
+func (p *parser) parseArgs() ([]string, error) {
+	p.next()
+	args := []string{}
+	if p.acceptPunct(")") {
+		return args, nil
+	}
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+		if p.acceptPunct(")") {
+			return args, nil
+		}
+		if err = p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseList parses words separated by commas between the open and close punctuation
+func (p *parser) parseList(open, close string) ([]token, error) {
+	if err := p.expectPunct(open); err != nil {
+		return nil, err
+	}
+	values := []token{}
+	if p.acceptPunct(close) {
+		return values, nil
+	}
+	for {
+		t := p.next()
+		if t.kind != tokenWord {
+			return nil, newParseError(t.offset, "expected a value, found %v", t)
+		}
+		values = append(values, t)
+		if p.acceptPunct(close) {
+			return values, nil
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseFilter parses filter terms combined with OR, AND and NOT, in increasing order of
+// precedence. Terms which follow each other without an operator are combined with OR.
+func (p *parser) parseFilter() (Filter, error) {
+	left, err := p.parseFilterConjunction()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !p.accept("OR") && !p.startsFilterTerm() {
+			return left, nil
+		}
+		right, err := p.parseFilterConjunction()
+		if err != nil {
+			return nil, err
+		}
+		left = FilterOperation{"OR", left, right}
+	}
+}
+
+// startsFilterTerm is true when the next token can start a filter term
+func (p *parser) startsFilterTerm() bool {
+	t := p.peek()
+	switch t.kind {
+	case tokenRegex:
+		return true
+	case tokenPunct:
+		return t.text == "(" || t.text == "{"
+	case tokenWord:
+		return !isKeyword(t) && !t.is("AND") && !t.is("OR")
+	}
+	return false
+}
+
+func (p *parser) parseFilterConjunction() (Filter, error) {
+	left, err := p.parseFilterFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("AND") {
+		right, err := p.parseFilterFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = FilterOperation{"AND", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseFilterFactor() (Filter, error) {
+	if p.accept("NOT") {
+		f, err := p.parseFilterFactor()
+		return FilterNot{f}, err
+	}
+	t := p.peek()
+	switch {
+	case t.isPunct("("):
+		p.next()
+		f, err := p.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expectPunct(")")
+	case t.isPunct("{"):
+		return p.parsePrefixSet()
+	case t.kind == tokenRegex:
+		p.next()
+		return FilterASPath{t.text}, nil
+	case t.kind != tokenWord || isKeyword(t) || t.is("AND") || t.is("OR"):
+		return nil, p.unexpected("expected a filter")
+	}
+	p.next()
+	if after := p.peek(); after.kind == tokenOperator || after.isPunct("(") {
+		p.pos--
+		action, err := p.parseAction()
+		return FilterAttribute{action}, err
+	}
+	name, rangeOp, err := splitRangeOp(t)
+	return FilterName{name, rangeOp}, err
+}
+
+// parsePrefixSet parses prefixes in braces, with an optional range operator after the brace
+func (p *parser) parsePrefixSet() (Filter, error) {
+	values, err := p.parseList("{", "}")
+	if err != nil {
+		return nil, err
+	}
+	set := FilterPrefixSet{Prefixes: []PrefixRange{}}
+	for _, v := range values {
+		prefix, rangeOp, err := splitRangeOp(v)
+		if err != nil {
+			return nil, err
+		}
+		parsed, perr := netip.ParsePrefix(prefix)
+		if perr != nil {
+			return nil, newParseError(v.offset, "'%v' is not a prefix", prefix)
+		}
+		if parsed.Addr().Is6() && !p.mp {
+			return nil, newParseError(v.offset, "IPv6 prefix '%v' is only allowed in mp- attributes", prefix)
+		}
+		set.Prefixes = append(set.Prefixes, PrefixRange{prefix, rangeOp})
+	}
+	if t := p.peek(); t.kind == tokenWord && strings.HasPrefix(t.text, "^") {
+		p.next()
+		if !rangeOpRegex.MatchString(t.text) {
+			return nil, newParseError(t.offset, "%v is not a range operator", t)
+		}
+		set.RangeOp = t.text
+	}
+	return set, nil
+}
+
+// splitRangeOp separates a name or prefix from the range operator after it
+func splitRangeOp(t token) (string, string, error) {
+	i := strings.IndexByte(t.text, '^')
+	if i < 0 {
+		return t.text, "", nil
+	}
+	if i == 0 || !rangeOpRegex.MatchString(t.text[i:]) {
+		return "", "", newParseError(t.offset, "%v has an invalid range operator", t)
+	}
+	return t.text[:i], t.text[i:], nil
+}
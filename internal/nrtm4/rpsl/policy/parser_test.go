@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+func TestParseCanonicalForm(t *testing.T) {
+	for _, tc := range []struct {
+		attribute, value, expected string
+	}{
+		{"import", "from AS1 accept ANY", ""},
+		{"export", "to AS1 announce AS2 AS3", "to AS1 announce AS2 OR AS3"},
+		{"import", "from AS1 action pref=100; med = igp_cost; accept AS-FOO^+", "from AS1 action pref = 100; med = igp_cost; accept AS-FOO^+"},
+		{"import", "from AS1 192.0.2.1 at 192.0.2.2 action community.append(65000:1, 65000:2); accept PeerAS", ""},
+		{"import", "from AS1 from AS2 action pref = 10; accept AS1 AND NOT AS2", "from AS1 from AS2 action pref = 10; accept AS1 AND NOT AS2"},
+		{"import", "from AS-FOO EXCEPT (AS1 OR AS2) accept ANY", ""},
+		{"import", "from AS1:PRNG-FOO accept <^AS1 .* AS2$>", ""},
+		{"import", "protocol BGP4 into OSPF from AS1 accept { 192.0.2.0/24^+, 198.51.100.0/24^24-28 }^-", ""},
+		{"import", "from AS1 accept community(65000:1) AND community.contains(65000:2)", ""},
+		{"import", "from AS1 accept community == {65000:1, 65000:2}", ""},
+		{"import", "from AS1 accept (AS1 OR AS2) AND NOT fltr-martian", ""},
+		{"import", "{ from AS1 accept AS1; from AS2 accept AS2 }", "{ from AS1 accept AS1; from AS2 accept AS2; }"},
+		{"import", "{ from AS-ANY action pref = 1; accept community(65000:1); } refine { from AS1 accept AS1; } except from AS2 accept AS2", "{ from AS-ANY action pref = 1; accept community(65000:1); } REFINE { from AS1 accept AS1; } EXCEPT from AS2 accept AS2"},
+		{"mp-import", "afi ipv6.unicast from AS1 accept { 2001:db8::/32^48 }", ""},
+		{"mp-export", "afi ipv4.unicast, ipv6.unicast to AS1 2001:db8::1 at 2001:db8::2 announce AS-FOO", ""},
+		{"mp-import", "afi any.unicast from AS1 accept ANY refine afi ipv6 from AS1 accept AS1", "afi any.unicast from AS1 accept ANY REFINE afi ipv6 from AS1 accept AS1"},
+		{"default", "to AS1 action pref = 100; networks ANY", ""},
+		{"default", "to AS1", ""},
+		{"mp-default", "afi ipv6.unicast to AS1 networks { 2001:db8::/32 }", ""},
+		{"import", "from AS1 accept ANY;", "from AS1 accept ANY"},
+	} {
+		policy, err := Parse(tc.attribute, tc.value)
+		if err != nil {
+			t.Error("Cannot parse", tc.value, err)
+			continue
+		}
+		expected := tc.expected
+		if len(expected) == 0 {
+			expected = tc.value
+		}
+		if policy.String() != expected {
+			t.Errorf("Expected %q but was %q", expected, policy.String())
+		}
+		again, err := Parse(tc.attribute, policy.String())
+		if err != nil || again.String() != policy.String() {
+			t.Error("Canonical form should parse to the same policy", policy.String(), err)
+		}
+	}
+}
+
+func TestParseAST(t *testing.T) {
+	policy, err := Parse("MP-IMPORT", "afi ipv6.unicast from AS1 192.0.2.1 at 192.0.2.2 action pref = 10; community.append(65000:1); accept AS-FOO^+ AND <AS1+$> EXCEPT from AS2 accept ANY")
+	if err != nil {
+		t.Fatal("Cannot parse policy", err)
+	}
+	expr := policy.Expression
+	if policy.Attribute != "mp-import" || !policy.IsMultiProtocol() || policy.IsExport() || expr == nil {
+		t.Fatal("Unexpected policy", policy)
+	}
+	if len(expr.AFI) != 1 || expr.AFI[0] != "ipv6.unicast" || expr.Operator != "EXCEPT" || expr.Next == nil {
+		t.Error("Unexpected expression", expr)
+	}
+	factor := expr.Term.Factors[0]
+	pa := factor.Peerings[0]
+	if pa.Peering.AS != (SetMember{"AS1"}) || pa.Peering.Router != (SetMember{"192.0.2.1"}) || pa.Peering.At != (SetMember{"192.0.2.2"}) {
+		t.Error("Unexpected peering", pa.Peering)
+	}
+	if len(pa.Actions) != 2 ||
+		pa.Actions[0].String() != "pref = 10" ||
+		pa.Actions[1].Attribute != "community" || pa.Actions[1].Method != "append" || pa.Actions[1].Args[0] != "65000:1" {
+		t.Error("Unexpected actions", pa.Actions)
+	}
+	filter, ok := factor.Filter.(FilterOperation)
+	if !ok || filter.Operator != "AND" || filter.Left != (FilterName{"AS-FOO", "^+"}) || filter.Right != (FilterASPath{"AS1+$"}) {
+		t.Error("Unexpected filter", factor.Filter)
+	}
+	if expr.Next.Term.Factors[0].Filter != (FilterName{Name: "ANY"}) {
+		t.Error("Unexpected exception", expr.Next)
+	}
+}
+
+func TestParsePeeringSet(t *testing.T) {
+	policy, err := Parse("export", "to prng-example announce ANY")
+	if err != nil {
+		t.Fatal("Cannot parse policy", err)
+	}
+	peering := policy.Expression.Term.Factors[0].Peerings[0].Peering
+	if peering.PeeringSet != "prng-example" || peering.AS != nil {
+		t.Error("Expected a peering set", peering)
+	}
+}
+
+func TestParseFilterPrecedence(t *testing.T) {
+	policy, err := Parse("import", "from AS1 accept AS1 OR AS2 AND AS3")
+	if err != nil {
+		t.Fatal("Cannot parse policy", err)
+	}
+	filter := policy.Expression.Term.Factors[0].Filter.(FilterOperation)
+	if filter.Operator != "OR" || filter.Right.(FilterOperation).Operator != "AND" {
+		t.Error("AND should bind more tightly than OR", filter)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		attribute, value, message string
+	}{
+		{"import", "to AS1 accept ANY", "expected 'from'"},
+		{"import", "from AS1 announce ANY", "expected 'accept'"},
+		{"import", "from AS1 accept", "expected a filter"},
+		{"import", "afi ipv4 from AS1 accept ANY", "afi is only allowed in mp- attributes"},
+		{"mp-import", "afi ipv5 from AS1 accept ANY", "is not an address family"},
+		{"import", "from AS1 accept { 2001:db8::/32 }", "only allowed in mp- attributes"},
+		{"import", "from AS1 accept { 192.0.2.0/33 }", "is not a prefix"},
+		{"import", "from AS1 accept AS-FOO^x", "invalid range operator"},
+		{"import", "from AS1 accept <^AS1", "no closing '>'"},
+		{"import", "from AS1 action pref; accept ANY", "expected an operator"},
+		{"import", "{ from AS1 accept ANY from AS2 accept ANY }", "expected ';' or '}'"},
+		{"import", "from AS1 accept ANY )", "expected end of value"},
+	} {
+		_, err := Parse(tc.attribute, tc.value)
+		pe, ok := err.(ParseError)
+		if !ok || !strings.Contains(pe.Message, tc.message) || pe.Attribute != tc.attribute {
+			t.Errorf("Expected %q parsing %q, but was %v", tc.message, tc.value, err)
+		}
+	}
+	if _, err := Parse("remarks", "from AS1 accept ANY"); err != ErrNotAPolicyAttribute {
+		t.Error("Expected ErrNotAPolicyAttribute", err)
+	}
+}
+
+func TestParseObject(t *testing.T) {
+	obj, err := rpsl.ParseFromJSONString(`aut-num:        AS64500
+as-name:        EXAMPLE
+import:         from AS64501 action pref=100; accept AS64501
+mp-import:      afi ipv6.unicast from AS64501
+                accept AS64501 # customers
+export:         to AS64501 announce
+default:        to AS64502
+mnt-by:         EXAMPLE-MNT
+source:         TEST`)
+	if err != nil {
+		t.Fatal("Cannot parse object", err)
+	}
+	policies, err := ParseObject(obj)
+	if len(policies) != 3 {
+		t.Fatal("Expected 3 policies but was", len(policies))
+	}
+	if policies[1].String() != "afi ipv6.unicast from AS64501 accept AS64501" || policies[2].Default == nil {
+		t.Error("Unexpected policies", policies)
+	}
+	if err == nil || !strings.Contains(err.Error(), "export: expected a filter") {
+		t.Error("Expected an error for the export attribute", err)
+	}
+}
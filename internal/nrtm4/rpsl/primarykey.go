@@ -0,0 +1,142 @@
+package rpsl
+
+import (
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// primaryKeyRule says how the primary key of an object class is made
+type primaryKeyRule struct {
+	// attributes are the names of the attributes whose values make up the key, in order
+	attributes []string
+	// normalize returns the canonical form of a key. The values of the attributes are joined
+	// without a separator before they're normalized.
+	normalize func(string) string
+}
+
+var (
+	whiteSpaceRegex = regexp.MustCompile(`\s+`)
+	// routeKeyRegex splits a route key into its prefix and origin. An IPv6 prefix can't contain
+	// an 'S', so the origin starts at the last "AS".
+	routeKeyRegex = regexp.MustCompile(`(?i)^(.*?)\s*(AS\d+)$`)
+)
+
+// primaryKeyRules are the classes whose key is not the attribute named after the class in upper
+// case
+var primaryKeyRules = map[string]primaryKeyRule{
+	"AS-BLOCK":    {[]string{"as-block"}, normalizeRange(strings.ToUpper)},
+	"AS-SET":      {[]string{"as-set"}, normalizeSetName},
+	"DOMAIN":      {[]string{"domain"}, normalizeDomain},
+	"FILTER-SET":  {[]string{"filter-set"}, normalizeSetName},
+	"INET6NUM":    {[]string{"inet6num"}, normalizePrefix},
+	"INETNUM":     {[]string{"inetnum"}, normalizeRange(normalizeAddress)},
+	"PEERING-SET": {[]string{"peering-set"}, normalizeSetName},
+	"PERSON":      {[]string{"nic-hdl"}, normalizeName},
+	"ROLE":        {[]string{"nic-hdl"}, normalizeName},
+	"ROUTE":       {[]string{"route", "origin"}, normalizeRoute},
+	"ROUTE-SET":   {[]string{"route-set"}, normalizeSetName},
+	"ROUTE6":      {[]string{"route6", "origin"}, normalizeRoute},
+	"RTR-SET":     {[]string{"rtr-set"}, normalizeSetName},
+}
+
+func primaryKeyRuleFor(objectType string) primaryKeyRule {
+	objectType = strings.ToUpper(strings.TrimSpace(objectType))
+	if rule, ok := primaryKeyRules[objectType]; ok {
+		return rule
+	}
+	return primaryKeyRule{[]string{strings.ToLower(objectType)}, normalizeName}
+}
+
+// NormalizePrimaryKey returns the canonical form of a primary key of an object class, so that
+// keys written in different ways can be matched. Keys are in upper case, with IP addresses and
+// prefixes in their shortest form, and ranges separated by " - ".
+func NormalizePrimaryKey(objectType, primaryKey string) string {
+	return primaryKeyRuleFor(objectType).normalize(primaryKey)
+}
+
+// primaryKey derives the key of an object from its attributes. Returns an empty string if any
+// of the attributes is missing or empty.
+func primaryKey(objectType string, attributes []Attribute) string {
+	rule := primaryKeyRuleFor(objectType)
+	var b strings.Builder
+	for _, name := range rule.attributes {
+		value := Rpsl{Attributes: attributes}.Value(name)
+		if len(value) == 0 {
+			return ""
+		}
+		b.WriteString(value)
+	}
+	return rule.normalize(b.String())
+}
+
+// UnnormalizedPrimaryKey returns the key of an object as it was saved before keys were
+// normalized: the values of its key attributes joined, in upper case
+func (r Rpsl) UnnormalizedPrimaryKey() string {
+	var b strings.Builder
+	for _, name := range primaryKeyRuleFor(r.ObjectType).attributes {
+		b.WriteString(strings.ToUpper(r.Value(name)))
+	}
+	return b.String()
+}
+
+// UnnormalizedKey returns a primary key from a delete record as it was saved before keys were
+// normalized
+func UnnormalizedKey(primaryKey string) string {
+	return strings.ToUpper(strings.TrimSpace(primaryKey))
+}
+
+func normalizeName(key string) string {
+	return strings.ToUpper(whiteSpaceRegex.ReplaceAllString(strings.TrimSpace(key), " "))
+}
+
+// normalizeSetName removes white space from hierarchical set names, e.g. AS64500:AS-CUSTOMERS
+func normalizeSetName(key string) string {
+	return strings.ToUpper(whiteSpaceRegex.ReplaceAllString(key, ""))
+}
+
+// normalizeDomain domain names are not case sensitive, and the trailing dot is optional
+func normalizeDomain(key string) string {
+	return strings.TrimRight(normalizeName(key), ".")
+}
+
+// normalizeAddress returns an IP address in its shortest form, or the key in upper case if it
+// isn't an address
+func normalizeAddress(key string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(key))
+	if err != nil {
+		return normalizeName(key)
+	}
+	return strings.ToUpper(addr.String())
+}
+
+// normalizePrefix returns a prefix in its shortest form, or the key in upper case if it isn't a
+// prefix
+func normalizePrefix(key string) string {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(key))
+	if err != nil {
+		return normalizeName(key)
+	}
+	return strings.ToUpper(prefix.String())
+}
+
+// normalizeRoute a route key is its prefix followed by its origin, without a separator
+func normalizeRoute(key string) string {
+	match := routeKeyRegex.FindStringSubmatch(strings.TrimSpace(key))
+	if match == nil {
+		return normalizeName(key)
+	}
+	return normalizePrefix(match[1]) + strings.ToUpper(match[2])
+}
+
+// normalizeRange normalizes both ends of a range, which are separated by " - ". A key which
+// isn't a range is normalized as a prefix, as an inetnum can be written as one.
+func normalizeRange(normalizeEnd func(string) string) func(string) string {
+	return func(key string) string {
+		from, to, found := strings.Cut(key, "-")
+		if !found {
+			return normalizePrefix(key)
+		}
+		return normalizeEnd(strings.TrimSpace(from)) + " - " + normalizeEnd(strings.TrimSpace(to))
+	}
+}
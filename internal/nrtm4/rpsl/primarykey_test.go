@@ -0,0 +1,72 @@
+package rpsl
+
+import "testing"
+
+func TestPrimaryKeyFromObject(t *testing.T) {
+	for str, expected := range map[string]string{
+		"inetnum: 192.0.2.0-192.0.2.255\nsource: TEST":           "192.0.2.0 - 192.0.2.255",
+		"inet6num: 2001:0DB8:0000::/48\nsource: TEST":            "2001:DB8::/48",
+		"route6: 2001:db8:0::/32\norigin: as64500\nsource: TEST": "2001:DB8::/32AS64500",
+		"route: 192.0.2.0/24\norigin: AS64500\nsource: TEST":     "192.0.2.0/24AS64500",
+		"domain: 2.0.192.in-addr.arpa.\nsource: TEST":            "2.0.192.IN-ADDR.ARPA",
+		"as-set: AS64500 : AS-Customers\nsource: TEST":           "AS64500:AS-CUSTOMERS",
+		"role: Test Role\nnic-hdl: tr1-test\nsource: TEST":       "TR1-TEST",
+		"mntner: test-mnt\nsource: TEST":                         "TEST-MNT",
+	} {
+		obj, err := parseString(str)
+		if err != nil {
+			t.Error("Object should parse", str, err)
+		} else if obj.PrimaryKey != expected {
+			t.Errorf("Expected primary key %q but was %q", expected, obj.PrimaryKey)
+		}
+	}
+	if _, err := parseString("route: 192.0.2.0/24\nsource: TEST"); err != ErrCannotParseRPSL {
+		t.Error("Route without an origin should not parse", err)
+	}
+}
+
+func TestNormalizePrimaryKey(t *testing.T) {
+	for _, tc := range []struct{ objectType, key, expected string }{
+		{"inetnum", "192.0.2.0   -   192.0.2.255", "192.0.2.0 - 192.0.2.255"},
+		{"INETNUM", "192.0.2.0/24", "192.0.2.0/24"},
+		{"inet6num", "2001:db8:0:0::/64", "2001:DB8::/64"},
+		{"route6", "2001:DB8:0000::/32 AS64500", "2001:DB8::/32AS64500"},
+		{"route", "192.0.2.0/24as64500", "192.0.2.0/24AS64500"},
+		{"domain", "Example.Net.", "EXAMPLE.NET"},
+		{"as-block", "as64496-as64511", "AS64496 - AS64511"},
+		{"route-set", "as64500:rs-test", "AS64500:RS-TEST"},
+		{"person", " tp1-test ", "TP1-TEST"},
+		{"inetnum", "not an address", "NOT AN ADDRESS"},
+	} {
+		if got := NormalizePrimaryKey(tc.objectType, tc.key); got != tc.expected {
+			t.Errorf("%v %q: expected %q but was %q", tc.objectType, tc.key, tc.expected, got)
+		}
+	}
+}
+
+func TestUnnormalizedKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"2001:db8:0::/32as64500":  "2001:DB8:0::/32AS64500",
+		" 2.0.192.in-addr.arpa. ": "2.0.192.IN-ADDR.ARPA.",
+		"as64500:as-customers":    "AS64500:AS-CUSTOMERS",
+	} {
+		if got := UnnormalizedKey(key); got != expected {
+			t.Errorf("%q: expected %q but was %q", key, expected, got)
+		}
+	}
+}
+
+func TestUnnormalizedPrimaryKey(t *testing.T) {
+	for str, expected := range map[string]string{
+		"inet6num: 2001:0DB8:0000::/48\nsource: TEST":            "2001:0DB8:0000::/48",
+		"route6: 2001:db8:0::/32\norigin: as64500\nsource: TEST": "2001:DB8:0::/32AS64500",
+		"domain: 2.0.192.in-addr.arpa.\nsource: TEST":            "2.0.192.IN-ADDR.ARPA.",
+	} {
+		obj, err := parseString(str)
+		if err != nil {
+			t.Error("Object should parse", str, err)
+		} else if obj.UnnormalizedPrimaryKey() != expected {
+			t.Errorf("Expected primary key %q but was %q", expected, obj.UnnormalizedPrimaryKey())
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package rpsl
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syntax checks the value of an attribute
+type Syntax struct {
+	// Name describes the syntax in findings
+	Name  string
+	valid func(string) bool
+}
+
+// Valid is true if the value has the syntax
+func (s Syntax) Valid(value string) bool {
+	return s.valid(value)
+}
+
+// AttributeTemplate describes an attribute of an object class
+type AttributeTemplate struct {
+	Name      string
+	Mandatory bool
+	// Multiple is true when the attribute can appear more than once
+	Multiple bool
+	Syntax   Syntax
+}
+
+// ClassTemplate describes the attributes of an object class. The first attribute is the class
+// attribute.
+type ClassTemplate struct {
+	Class      string
+	Attributes []AttributeTemplate
+}
+
+// Finding is a problem found when an object is validated against its class template
+type Finding struct {
+	// Attribute is empty when the finding is about the whole object
+	Attribute string `json:",omitempty"`
+	Message   string
+}
+
+func (f Finding) String() string {
+	if len(f.Attribute) == 0 {
+		return f.Message
+	}
+	return f.Attribute + ": " + f.Message
+}
+
+var (
+	nameRegex      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	nicHandleRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	asNumberRegex  = regexp.MustCompile(`(?i)^AS(\d+)$`)
+	sourceRegex    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	countryRegex   = regexp.MustCompile(`^[A-Za-z]{2}$`)
+	domainRegex    = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*\.?$`)
+	// rangeOperatorRegex is an RFC 2622 prefix range operator, e.g. ^+, ^-, ^24 or ^24-32
+	rangeOperatorRegex = regexp.MustCompile(`^\^(\+|-|\d+|\d+-\d+)$`)
+	setComponentRegex  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Value syntaxes used in the templates
+var (
+	SyntaxFreeForm    = Syntax{"free form", func(string) bool { return true }}
+	SyntaxObjectName  = Syntax{"object name", nameRegex.MatchString}
+	SyntaxNameList    = Syntax{"list of object names", listOf(nameRegex.MatchString)}
+	SyntaxNicHandle   = Syntax{"NIC handle", nicHandleRegex.MatchString}
+	SyntaxASNumber    = Syntax{"AS number", isASNumber}
+	SyntaxASRange     = Syntax{"AS number range", isASRange}
+	SyntaxEmail       = Syntax{"e-mail address", isEmail}
+	SyntaxTimestamp   = Syntax{"RFC 3339 timestamp", isTimestamp}
+	SyntaxSource      = Syntax{"source name", sourceRegex.MatchString}
+	SyntaxCountry     = Syntax{"ISO 3166 country code", countryRegex.MatchString}
+	SyntaxDomainName  = Syntax{"domain name", domainRegex.MatchString}
+	SyntaxIPv4Prefix  = Syntax{"IPv4 prefix", isPrefix(netip.Addr.Is4)}
+	SyntaxIPv6Prefix  = Syntax{"IPv6 prefix", isPrefix(netip.Addr.Is6)}
+	SyntaxIPv4Range   = Syntax{"IPv4 address range", isIPv4Range}
+	SyntaxPrefixList  = Syntax{"list of prefixes", listOf(isPrefix(nil))}
+	SyntaxASSetName   = Syntax{"as-set name", isSetName("AS-")}
+	SyntaxRouteSet    = Syntax{"route-set name", isSetName("RS-")}
+	SyntaxRtrSetName  = Syntax{"rtr-set name", isSetName("RTRS-")}
+	SyntaxFilterSet   = Syntax{"filter-set name", isSetName("FLTR-")}
+	SyntaxPeeringSet  = Syntax{"peering-set name", isSetName("PRNG-")}
+	SyntaxASSetList   = Syntax{"list of as-set names", listOf(isSetName("AS-"))}
+	SyntaxRouteSetRef = Syntax{"list of route-set names", listOf(isSetName("RS-"))}
+	SyntaxRtrSetList  = Syntax{"list of rtr-set names", listOf(isSetName("RTRS-"))}
+	SyntaxMbrsByRef   = Syntax{"list of mntner names or ANY", listOf(nameRegex.MatchString)}
+	SyntaxASMembers   = Syntax{"list of AS numbers and as-set names", listOf(isASMember)}
+	SyntaxRouteMember = Syntax{"list of prefixes, AS numbers and set names", listOf(isRouteSetMember)}
+	SyntaxRtrMembers  = Syntax{"list of routers and rtr-set names", listOf(isRtrSetMember)}
+)
+
+func isASNumber(value string) bool {
+	match := asNumberRegex.FindStringSubmatch(value)
+	if match == nil {
+		return false
+	}
+	_, err := strconv.ParseUint(match[1], 10, 32)
+	return err == nil
+}
+
+func asNumber(value string) uint64 {
+	n, _ := strconv.ParseUint(asNumberRegex.FindStringSubmatch(value)[1], 10, 32)
+	return n
+}
+
+func isASRange(value string) bool {
+	from, to, found := strings.Cut(value, "-")
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	return found && isASNumber(from) && isASNumber(to) && asNumber(from) <= asNumber(to)
+}
+
+func isEmail(value string) bool {
+	local, domain, found := strings.Cut(value, "@")
+	return found && len(local) > 0 && len(domain) > 0 && !strings.ContainsAny(domain, "@ \t")
+}
+
+func isTimestamp(value string) bool {
+	_, err := time.Parse(time.RFC3339, value)
+	return err == nil
+}
+
+// isPrefix checks for a prefix of the address family, or any prefix if is is nil
+func isPrefix(is func(netip.Addr) bool) func(string) bool {
+	return func(value string) bool {
+		prefix, err := netip.ParsePrefix(value)
+		return err == nil && (is == nil || is(prefix.Addr()))
+	}
+}
+
+func isIPv4Range(value string) bool {
+	from, to, found := strings.Cut(value, "-")
+	if !found {
+		return isPrefix(netip.Addr.Is4)(value)
+	}
+	first, ferr := netip.ParseAddr(strings.TrimSpace(from))
+	last, lerr := netip.ParseAddr(strings.TrimSpace(to))
+	return ferr == nil && lerr == nil && first.Is4() && last.Is4() && first.Compare(last) <= 0
+}
+
+// isSetName checks for an RFC 2622 set name. It can be hierarchical, e.g. AS64500:AS-CUSTOMERS,
+// when each component is an AS number or a set name, and at least one is a set name.
+func isSetName(prefix string) func(string) bool {
+	return func(value string) bool {
+		hasSetName := false
+		for _, component := range strings.Split(value, ":") {
+			component = strings.TrimSpace(component)
+			switch {
+			case isASNumber(component):
+			case len(component) > len(prefix) && strings.EqualFold(component[:len(prefix)], prefix) && setComponentRegex.MatchString(component):
+				hasSetName = true
+			default:
+				return false
+			}
+		}
+		return hasSetName
+	}
+}
+
+// listOf checks a comma separated list. An empty list is valid.
+func listOf(valid func(string) bool) func(string) bool {
+	return func(value string) bool {
+		if len(strings.TrimSpace(value)) == 0 {
+			return true
+		}
+		for _, item := range strings.Split(value, ",") {
+			if !valid(strings.TrimSpace(item)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func isASMember(value string) bool {
+	return isASNumber(value) || isSetName("AS-")(value)
+}
+
+// isRouteSetMember checks a route-set member, which can have a range operator
+func isRouteSetMember(value string) bool {
+	if i := strings.LastIndex(value, "^"); i > 0 {
+		if !rangeOperatorRegex.MatchString(value[i:]) {
+			return false
+		}
+		value = value[:i]
+	}
+	return isPrefix(nil)(value) || isASMember(value) || isSetName("RS-")(value)
+}
+
+func isRtrSetMember(value string) bool {
+	if _, err := netip.ParseAddr(value); err == nil {
+		return true
+	}
+	return domainRegex.MatchString(value) || isSetName("RTRS-")(value)
+}
+
+// Attribute template helpers
+func mandatory(name string, syntax Syntax) AttributeTemplate {
+	return AttributeTemplate{Name: name, Mandatory: true, Syntax: syntax}
+}
+
+func mandatoryMulti(name string, syntax Syntax) AttributeTemplate {
+	return AttributeTemplate{Name: name, Mandatory: true, Multiple: true, Syntax: syntax}
+}
+
+func optional(name string, syntax Syntax) AttributeTemplate {
+	return AttributeTemplate{Name: name, Syntax: syntax}
+}
+
+func optionalMulti(name string, syntax Syntax) AttributeTemplate {
+	return AttributeTemplate{Name: name, Multiple: true, Syntax: syntax}
+}
+
+// classTemplate makes a template from the class attribute, the class's own attributes and the
+// attributes which every class has
+func classTemplate(class AttributeTemplate, attributes ...AttributeTemplate) ClassTemplate {
+	common := []AttributeTemplate{
+		optionalMulti("descr", SyntaxFreeForm),
+		optionalMulti("remarks", SyntaxFreeForm),
+		optionalMulti("notify", SyntaxEmail),
+		mandatoryMulti("mnt-by", SyntaxNameList),
+		optional("created", SyntaxTimestamp),
+		optional("last-modified", SyntaxTimestamp),
+		optionalMulti("changed", SyntaxFreeForm),
+		mandatory("source", SyntaxSource),
+	}
+	all := append([]AttributeTemplate{class}, attributes...)
+	for _, attr := range common {
+		found := false
+		for _, a := range all {
+			found = found || a.Name == attr.Name
+		}
+		if !found {
+			all = append(all, attr)
+		}
+	}
+	return ClassTemplate{Class: class.Name, Attributes: all}
+}
+
+var (
+	adminC    = mandatoryMulti("admin-c", SyntaxNicHandle)
+	techC     = mandatoryMulti("tech-c", SyntaxNicHandle)
+	org       = optional("org", SyntaxObjectName)
+	abuseC    = optional("abuse-c", SyntaxNicHandle)
+	mntLower  = optionalMulti("mnt-lower", SyntaxNameList)
+	mntRoutes = optionalMulti("mnt-routes", SyntaxFreeForm)
+	mbrsByRef = optionalMulti("mbrs-by-ref", SyntaxMbrsByRef)
+	policy    = func() []AttributeTemplate {
+		attrs := []AttributeTemplate{}
+		for _, name := range []string{"import", "export", "mp-import", "mp-export", "default", "mp-default", "import-via", "export-via"} {
+			attrs = append(attrs, optionalMulti(name, SyntaxFreeForm))
+		}
+		return attrs
+	}()
+	routeOptions = []AttributeTemplate{
+		optionalMulti("holes", SyntaxPrefixList),
+		optionalMulti("inject", SyntaxFreeForm),
+		optional("aggr-mtd", SyntaxFreeForm),
+		optional("aggr-bndry", SyntaxFreeForm),
+		optional("export-comps", SyntaxFreeForm),
+		optional("components", SyntaxFreeForm),
+		optionalMulti("pingable", SyntaxFreeForm),
+		optionalMulti("ping-hdl", SyntaxNicHandle),
+		optionalMulti("member-of", SyntaxRouteSetRef),
+		optionalMulti("mnt-lower", SyntaxNameList),
+		mntRoutes,
+		org,
+		optional("geoidx", SyntaxFreeForm),
+		optional("roa-uri", SyntaxFreeForm),
+	}
+	networkOptions = []AttributeTemplate{
+		adminC,
+		techC,
+		abuseC,
+		org,
+		mntLower,
+		mntRoutes,
+		optionalMulti("mnt-domains", SyntaxNameList),
+		optionalMulti("mnt-irt", SyntaxNameList),
+		optional("sponsoring-org", SyntaxObjectName),
+		optional("geoloc", SyntaxFreeForm),
+		optionalMulti("language", SyntaxFreeForm),
+		optional("assignment-size", SyntaxFreeForm),
+	}
+)
+
+func concat(lists ...[]AttributeTemplate) []AttributeTemplate {
+	all := []AttributeTemplate{}
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// templates are the RIPE and IRRd object classes, by class name in lower case
+var templates = func() map[string]ClassTemplate {
+	members := func(syntax Syntax) []AttributeTemplate {
+		return []AttributeTemplate{
+			optionalMulti("members", syntax),
+			optionalMulti("mp-members", syntax),
+			mbrsByRef,
+			adminC,
+			techC,
+			org,
+			mntLower,
+		}
+	}
+	list := []ClassTemplate{
+		classTemplate(mandatory("aut-num", SyntaxASNumber), concat([]AttributeTemplate{
+			mandatory("as-name", SyntaxObjectName),
+			optionalMulti("member-of", SyntaxASSetList),
+			adminC, techC, abuseC, org, mntLower, mntRoutes,
+			optional("sponsoring-org", SyntaxObjectName),
+			optional("status", SyntaxFreeForm),
+		}, policy)...),
+		classTemplate(mandatory("as-set", SyntaxASSetName), members(SyntaxASMembers)...),
+		classTemplate(mandatory("route-set", SyntaxRouteSet), members(SyntaxRouteMember)...),
+		classTemplate(mandatory("rtr-set", SyntaxRtrSetName), members(SyntaxRtrMembers)...),
+		classTemplate(mandatory("filter-set", SyntaxFilterSet),
+			optional("filter", SyntaxFreeForm), optional("mp-filter", SyntaxFreeForm), adminC, techC, org, mntLower),
+		classTemplate(mandatory("peering-set", SyntaxPeeringSet),
+			optionalMulti("peering", SyntaxFreeForm), optionalMulti("mp-peering", SyntaxFreeForm), adminC, techC, org, mntLower),
+		classTemplate(mandatory("route", SyntaxIPv4Prefix), concat([]AttributeTemplate{mandatory("origin", SyntaxASNumber)}, routeOptions)...),
+		classTemplate(mandatory("route6", SyntaxIPv6Prefix), concat([]AttributeTemplate{mandatory("origin", SyntaxASNumber)}, routeOptions)...),
+		classTemplate(mandatory("inetnum", SyntaxIPv4Range), concat([]AttributeTemplate{
+			mandatory("netname", SyntaxObjectName),
+			mandatoryMulti("country", SyntaxCountry),
+			mandatory("status", SyntaxFreeForm),
+		}, networkOptions)...),
+		classTemplate(mandatory("inet6num", SyntaxIPv6Prefix), concat([]AttributeTemplate{
+			mandatory("netname", SyntaxObjectName),
+			mandatoryMulti("country", SyntaxCountry),
+			mandatory("status", SyntaxFreeForm),
+		}, networkOptions)...),
+		classTemplate(mandatory("as-block", SyntaxASRange), org, mntLower),
+		classTemplate(mandatory("mntner", SyntaxObjectName),
+			mandatoryMulti("upd-to", SyntaxEmail),
+			optionalMulti("mnt-nfy", SyntaxEmail),
+			mandatoryMulti("auth", SyntaxFreeForm),
+			adminC,
+			optionalMulti("tech-c", SyntaxNicHandle),
+			optional("referral-by", SyntaxObjectName),
+			org,
+			abuseC),
+		classTemplate(mandatory("person", SyntaxFreeForm),
+			mandatoryMulti("address", SyntaxFreeForm),
+			mandatoryMulti("phone", SyntaxFreeForm),
+			optionalMulti("fax-no", SyntaxFreeForm),
+			optionalMulti("e-mail", SyntaxEmail),
+			mandatory("nic-hdl", SyntaxNicHandle),
+			optionalMulti("org", SyntaxObjectName)),
+		classTemplate(mandatory("role", SyntaxFreeForm),
+			mandatoryMulti("address", SyntaxFreeForm),
+			optionalMulti("phone", SyntaxFreeForm),
+			optionalMulti("fax-no", SyntaxFreeForm),
+			mandatoryMulti("e-mail", SyntaxEmail),
+			optionalMulti("admin-c", SyntaxNicHandle),
+			optionalMulti("tech-c", SyntaxNicHandle),
+			mandatory("nic-hdl", SyntaxNicHandle),
+			optional("abuse-mailbox", SyntaxEmail),
+			optionalMulti("org", SyntaxObjectName)),
+		classTemplate(mandatory("organisation", SyntaxObjectName),
+			mandatory("org-name", SyntaxFreeForm),
+			mandatory("org-type", SyntaxFreeForm),
+			mandatoryMulti("address", SyntaxFreeForm),
+			optional("country", SyntaxCountry),
+			optionalMulti("phone", SyntaxFreeForm),
+			optionalMulti("fax-no", SyntaxFreeForm),
+			mandatoryMulti("e-mail", SyntaxEmail),
+			optionalMulti("admin-c", SyntaxNicHandle),
+			optionalMulti("tech-c", SyntaxNicHandle),
+			abuseC,
+			optionalMulti("ref-nfy", SyntaxEmail),
+			optionalMulti("mnt-ref", SyntaxNameList),
+			optionalMulti("org", SyntaxObjectName),
+			optional("geoloc", SyntaxFreeForm),
+			optionalMulti("language", SyntaxFreeForm)),
+		classTemplate(mandatory("domain", SyntaxDomainName),
+			adminC,
+			techC,
+			mandatoryMulti("zone-c", SyntaxNicHandle),
+			optionalMulti("nserver", SyntaxFreeForm),
+			optionalMulti("ds-rdata", SyntaxFreeForm),
+			org),
+		classTemplate(mandatory("inet-rtr", SyntaxDomainName),
+			optionalMulti("alias", SyntaxDomainName),
+			mandatory("local-as", SyntaxASNumber),
+			mandatoryMulti("ifaddr", SyntaxFreeForm),
+			optionalMulti("interface", SyntaxFreeForm),
+			optionalMulti("peer", SyntaxFreeForm),
+			optionalMulti("mp-peer", SyntaxFreeForm),
+			optionalMulti("member-of", SyntaxRtrSetList),
+			adminC, techC, org),
+		classTemplate(mandatory("irt", SyntaxObjectName),
+			mandatoryMulti("address", SyntaxFreeForm),
+			optionalMulti("phone", SyntaxFreeForm),
+			optionalMulti("fax-no", SyntaxFreeForm),
+			mandatoryMulti("e-mail", SyntaxEmail),
+			mandatory("abuse-mailbox", SyntaxEmail),
+			optionalMulti("signature", SyntaxFreeForm),
+			optionalMulti("encryption", SyntaxFreeForm),
+			mandatoryMulti("auth", SyntaxFreeForm),
+			optionalMulti("irt-nfy", SyntaxEmail),
+			adminC, techC, org),
+		classTemplate(mandatory("key-cert", SyntaxObjectName),
+			optional("method", SyntaxFreeForm),
+			optionalMulti("owner", SyntaxFreeForm),
+			optional("fingerpr", SyntaxFreeForm),
+			mandatoryMulti("certif", SyntaxFreeForm),
+			optionalMulti("admin-c", SyntaxNicHandle),
+			optionalMulti("tech-c", SyntaxNicHandle),
+			org),
+	}
+	byClass := map[string]ClassTemplate{}
+	for _, t := range list {
+		byClass[t.Class] = t
+	}
+	return byClass
+}()
+
+// Template returns the template of an object class
+func Template(objectType string) (ClassTemplate, bool) {
+	t, ok := templates[strings.ToLower(strings.TrimSpace(objectType))]
+	return t, ok
+}
+
+// Validate checks an object against the template of its class. It returns no findings when the
+// object is valid, or when its class has no template.
+func Validate(obj Rpsl) []Finding {
+	findings := []Finding{}
+	if len(obj.Attributes) == 0 {
+		return append(findings, Finding{Message: "object has no attributes"})
+	}
+	template, ok := Template(obj.Attributes[0].Name)
+	if !ok {
+		return findings
+	}
+	counts := map[string]int{}
+	for _, attr := range obj.Attributes {
+		counts[attr.Name]++
+	}
+	for _, at := range template.Attributes {
+		count := counts[at.Name]
+		delete(counts, at.Name)
+		switch {
+		case at.Mandatory && count == 0:
+			findings = append(findings, Finding{at.Name, "mandatory attribute is missing"})
+		case !at.Multiple && count > 1:
+			findings = append(findings, Finding{at.Name, fmt.Sprintf("attribute can only appear once, but appears %d times", count)})
+		}
+	}
+	for _, attr := range obj.Attributes {
+		if _, unknown := counts[attr.Name]; unknown {
+			findings = append(findings, Finding{attr.Name, "attribute is not in the " + template.Class + " template"})
+			delete(counts, attr.Name)
+		}
+	}
+	for _, attr := range obj.Attributes {
+		for _, at := range template.Attributes {
+			if at.Name != attr.Name {
+				continue
+			}
+			if len(attr.Value) == 0 && at.Mandatory {
+				findings = append(findings, Finding{attr.Name, "mandatory attribute has no value"})
+			} else if !at.Syntax.Valid(attr.Value) {
+				findings = append(findings, Finding{attr.Name, fmt.Sprintf("value %q is not a valid %v", attr.Value, at.Syntax.Name)})
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,92 @@
+package rpsl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateValidObjects(t *testing.T) {
+	for _, str := range []string{
+		`aut-num:        AS64500
+as-name:        EXAMPLE-AS
+member-of:      AS-TEST, AS64500:AS-CUSTOMERS
+import:         from AS64501 accept ANY
+mp-import:      afi ipv6.unicast from AS64501 accept ANY
+admin-c:        TP1-TEST
+tech-c:         TP1-TEST
+mnt-by:         TEST-MNT
+created:        2021-02-22T04:30:00Z
+source:         TEST`,
+		`route6:         2001:db8::/32
+origin:         AS64500
+member-of:      RS-TEST
+mnt-by:         TEST-MNT
+source:         TEST`,
+		`route-set:      AS64500:RS-CUSTOMERS
+members:        192.0.2.0/24^+, RS-OTHER, AS64501
+mp-members:     2001:db8::/32^48-56
+mbrs-by-ref:    ANY
+admin-c:        TP1-TEST
+tech-c:         TP1-TEST
+mnt-by:         TEST-MNT
+source:         TEST`,
+		`inetnum:        192.0.2.0 - 192.0.2.255
+netname:        TEST-NET
+country:        NL
+status:         ASSIGNED PA
+admin-c:        TP1-TEST
+tech-c:         TP1-TEST
+mnt-by:         TEST-MNT
+source:         TEST`,
+		`unknown-class:  anything
+source:         TEST`,
+	} {
+		obj, _ := parseString(str)
+		if findings := Validate(obj); len(findings) != 0 {
+			t.Error("Object should be valid", obj.ObjectType, findings)
+		}
+	}
+}
+
+func TestValidateInvalidObject(t *testing.T) {
+	str := `as-set:         AS-TEST
+members:        AS64500, not-a-member
+remarks:        one
+favourite-colour: blue
+mnt-by:         TEST-MNT
+source:         TEST
+source:         TEST`
+	obj, _ := parseString(str)
+
+	findings := Validate(obj)
+
+	expected := map[string]string{
+		"admin-c":          "mandatory attribute is missing",
+		"tech-c":           "mandatory attribute is missing",
+		"source":           "attribute can only appear once",
+		"favourite-colour": "attribute is not in the as-set template",
+		"members":          "is not a valid list of AS numbers and as-set names",
+	}
+	if len(findings) != len(expected) {
+		t.Error("Expected", len(expected), "findings but got", findings)
+	}
+	for _, f := range findings {
+		if msg, ok := expected[f.Attribute]; !ok || !strings.Contains(f.Message, msg) {
+			t.Error("Unexpected finding", f)
+		}
+	}
+}
+
+func TestTemplateCoversClasses(t *testing.T) {
+	for _, class := range []string{"aut-num", "as-set", "route", "route6", "mntner", "inetnum", "inet6num", "person", "role",
+		"organisation", "route-set", "filter-set", "peering-set", "rtr-set", "as-block", "domain", "inet-rtr", "irt", "key-cert"} {
+		template, ok := Template(class)
+		if !ok {
+			t.Error("No template for", class)
+			continue
+		}
+		if template.Attributes[0].Name != class || !template.Attributes[0].Mandatory {
+			t.Error("First attribute should be the mandatory class attribute", class)
+		}
+	}
+}
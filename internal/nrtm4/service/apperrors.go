@@ -11,6 +11,33 @@ var (
 	// ErrSnapshotInsertFailed snapshot insertion failed
 	ErrSnapshotInsertFailed = errors.New("snapshot was not inserted into the repository")
 
+	// ErrNoSnapshotToResume the source does not have an unfinished snapshot
+	ErrNoSnapshotToResume = errors.New("source does not have an unfinished snapshot to resume")
+
+	// ErrInvalidRetentionPolicy retention policy has a negative number of deltas or days
+	ErrInvalidRetentionPolicy = errors.New("retention policy cannot have negative values")
+
+	// ErrFileRefNotAllowed notification file references a local file, but is not a local file
+	// itself, or the file is outside its directory
+	ErrFileRefNotAllowed = errors.New("file reference is not allowed outside a local notification file's directory")
+
+	// Signature errors
+
+	// ErrNotificationUnsigned notification file is not signed with a trusted key, and the source requires it
+	ErrNotificationUnsigned = errors.New("notification file is not signed with a trusted key")
+
+	// ErrNotificationSignatureInvalid notification file signature does not match any trusted key
+	ErrNotificationSignatureInvalid = errors.New("notification file signature does not match any trusted key")
+
+	// ErrInvalidSigningKey signing key is not a PEM encoded public key
+	ErrInvalidSigningKey = errors.New("signing key is not a PEM encoded public key")
+
+	// ErrSigningKeyNeedsSource signing key must be added for a source or a notification URL
+	ErrSigningKeyNeedsSource = errors.New("signing key must have a source or notification URL")
+
+	// ErrSigningKeyNotFound no signing key has the given ID
+	ErrSigningKeyNotFound = errors.New("signing key not found")
+
 	// Repo errors
 
 	// ErrSessionRestarted server has started a new session
@@ -28,6 +55,24 @@ var (
 	// ErrSourceNotFound a source with the given label is not in the repo
 	ErrSourceNotFound = errors.New("cannot find source with given name and label")
 
+	// ErrSnapshotVersionNotHeld the server's snapshot version is not in the repo and cannot be rebuilt from history
+	ErrSnapshotVersionNotHeld = errors.New("snapshot version is not held in the repository")
+
+	// ErrVersionNotHeld the version is not in the repository and cannot be rebuilt from history
+	ErrVersionNotHeld = errors.New("version is not held in the repository")
+
+	// ErrInvalidVersionRange the version to compare from is not lower than the version to compare to
+	ErrInvalidVersionRange = errors.New("from version must be lower than the to version")
+
+	// ErrInvalidTimestamp time is not RFC 3339 or a date
+	ErrInvalidTimestamp = errors.New("time must be RFC 3339, e.g. 2024-01-02T15:04:05Z, or a date, e.g. 2024-01-02")
+
+	// ErrInvalidSetName name is not an as-set or a route-set
+	ErrInvalidSetName = errors.New("set name must be an as-set or a route-set, e.g. AS-EXAMPLE or RS-EXAMPLE")
+
+	// ErrSetNotFound the set is not in any of the sources
+	ErrSetNotFound = errors.New("set is not in any of the sources")
+
 	// ErrNextConsecutiveDeltaUnavaliable cannot find the next consecutive delta to apply to our repo
 	ErrNextConsecutiveDeltaUnavaliable = errors.New("repository is too old to update from the server")
 )
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -187,7 +188,7 @@ func (u *AutoUpdater) doUpdateWithReconnectOnFail() {
 	}
 	// Do an update
 	logger.Info("AutoUpdater will update", "src.Source", src.Source, "src.Label", src.Label)
-	_, err := u.p.Update(src.Source, src.Label)
+	_, err := u.p.Update(context.Background(), src.Source, src.Label)
 	if err == nil {
 		logger.Info("AutoUpdater finished updating", "src.Source", src.Source, "src.Label", src.Label)
 		return
@@ -195,9 +196,15 @@ func (u *AutoUpdater) doUpdateWithReconnectOnFail() {
 	// There was en error with the update; delete or rename repo
 	logger.Info("AutoUpdater failed to update, reconnecting...", "src.Source", src.Source, "src.Label", src.Label)
 	label := src.Label // preserve original label in case of rename
+	if src.Properties.UpdateMode == persist.UpdateModeStage {
+		u.t.Stop()
+		_, err = u.p.ResyncStaged(context.Background(), src.Source, label)
+		u.ch <- err
+		return
+	}
 	switch src.Properties.UpdateMode {
 	case persist.UpdateModeReplace:
-		err = u.p.RemoveSource(src.Source, src.Label)
+		err = u.p.RemoveSource(context.Background(), src.Source, src.Label)
 	case persist.UpdateModePreserve:
 		err = relabelAutoUpdateFailure(u.p, src)
 	}
@@ -208,7 +215,7 @@ func (u *AutoUpdater) doUpdateWithReconnectOnFail() {
 	}
 	u.t.Stop()
 	// Connect to source
-	err = u.p.Connect(src.NotificationURL, label)
+	err = u.p.Connect(context.Background(), src.NotificationURL, label)
 	u.ch <- err
 	// srcs, err := u.p.ListSources()
 	// if err != nil {
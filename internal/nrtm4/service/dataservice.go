@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"log"
 	"strings"
 
@@ -40,17 +41,17 @@ func (ds NrtmDataService) getSourceByNameAndLabel(name string, label string) *pe
 	return nil
 }
 
-func (ds NrtmDataService) deleteSource(source persist.NRTMSource) error {
-	return ds.Repository.RemoveSource(source)
+func (ds NrtmDataService) deleteSource(ctx context.Context, source persist.NRTMSource) error {
+	return ds.Repository.RemoveSource(ctx, source)
 }
 
 func (ds NrtmDataService) listSources() ([]persist.NRTMSource, error) {
 	return ds.Repository.ListSources()
 }
 
-// func (ds NrtmDataService) getNotifications(src persist.NRTMSource, from, to uint32) ([]persist.Notification, error) {
-// 	return ds.Repository.GetNotificationHistory(src, from, to)
-// }
+func (ds NrtmDataService) getNotifications(src persist.NRTMSource, from, to uint32) ([]persist.Notification, error) {
+	return ds.Repository.GetNotificationHistory(src, from, to)
+}
 
 func (ds NrtmDataService) saveSourceWithNotification(source persist.NRTMSource, notification persist.NotificationJSON) (persist.NRTMSource, error) {
 	return ds.Repository.SaveSource(source, &notification)
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+// ChangeSet lists the objects which were added, modified or deleted between two versions of a
+// source
+type ChangeSet struct {
+	Source      string
+	Label       string
+	FromVersion uint32
+	ToVersion   uint32
+	Added       int
+	Modified    int
+	Deleted     int
+	// Changes are ordered by object type and primary key
+	Changes []persist.ObjectChange
+	// Truncated is true when there were more changes than were asked for. The counts include
+	// all of them.
+	Truncated bool
+}
+
+// Diff compares the objects of a source at two versions, which are rebuilt from history. A
+// toVersion of 0 is the current version. No more than limit changes are listed, unless it's 0
+// or less.
+func (p NRTMProcessor) Diff(ctx context.Context, sourceName, label string, fromVersion, toVersion uint32, limit int) (ChangeSet, error) {
+	changes := ChangeSet{Source: sourceName, Label: label, FromVersion: fromVersion, ToVersion: toVersion, Changes: []persist.ObjectChange{}}
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return changes, ErrSourceNotFound
+	}
+	changes.Source = source.Source
+	if isSnapshotUnfinished(source.Status) {
+		return changes, ErrVersionNotHeld
+	}
+	if toVersion == 0 {
+		changes.ToVersion = source.Version
+	}
+	if changes.FromVersion >= changes.ToVersion {
+		return changes, ErrInvalidVersionRange
+	}
+	err := p.repo.ObjectChanges(ctx, *source, changes.FromVersion, changes.ToVersion, func(change persist.ObjectChange) error {
+		switch change.Action {
+		case persist.ObjectAdded:
+			changes.Added++
+		case persist.ObjectModified:
+			changes.Modified++
+		case persist.ObjectDeleted:
+			changes.Deleted++
+		}
+		if limit > 0 && len(changes.Changes) == limit {
+			changes.Truncated = true
+			return nil
+		}
+		changes.Changes = append(changes.Changes, change)
+		return nil
+	})
+	if err == persist.ErrVersionNotAvailable {
+		return changes, ErrVersionNotHeld
+	}
+	return changes, err
+}
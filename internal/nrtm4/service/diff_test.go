@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func TestDiff(t *testing.T) {
+	repo := mockRepo{
+		sources:     []persist.NRTMSource{verifyTestSource()},
+		changesFrom: 3,
+		changes: []persist.ObjectChange{
+			{ObjectType: "AS-SET", PrimaryKey: "AS-TEST", Action: persist.ObjectAdded, After: "as-set: AS-TEST\nsource: TEST"},
+			{ObjectType: "MNTNER", PrimaryKey: "TEST-MNT", Action: persist.ObjectModified, Before: "mntner: TEST-MNT\nsource: TEST", After: "mntner: TEST-MNT\nremarks: changed\nsource: TEST"},
+			{ObjectType: "PERSON", PrimaryKey: "TP1-TEST", Action: persist.ObjectDeleted, Before: "person: Test Person\nnic-hdl: TP1-TEST\nsource: TEST"},
+		},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, fileMapClient{})
+	ctx := context.Background()
+
+	changes, err := p.Diff(ctx, "TEST", "", 3, 0, 2)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if changes.ToVersion != 5 {
+		t.Error("To version should default to the current version", changes.ToVersion)
+	}
+	if changes.Added != 1 || changes.Modified != 1 || changes.Deleted != 1 {
+		t.Error("All changes should be counted", changes)
+	}
+	if len(changes.Changes) != 2 || !changes.Truncated {
+		t.Error("Changes should be truncated at the limit", changes.Changes)
+	}
+
+	if _, err = p.Diff(ctx, "TEST", "", 4, 4, 0); err != ErrInvalidVersionRange {
+		t.Error("Expected ErrInvalidVersionRange", err)
+	}
+	if _, err = p.Diff(ctx, "TEST", "", 2, 4, 0); err != ErrVersionNotHeld {
+		t.Error("Expected ErrVersionNotHeld", err)
+	}
+	if _, err = p.Diff(ctx, "NOPE", "", 3, 4, 0); err != ErrSourceNotFound {
+		t.Error("Expected ErrSourceNotFound", err)
+	}
+}
@@ -0,0 +1,609 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// DefaultExpandDepth is the number of levels of nested sets which are expanded, when no depth
+// is given
+const DefaultExpandDepth = 20
+
+var (
+	asNumberRegex = regexp.MustCompile(`(?i)^AS\d+$`)
+	rangeOpRegex  = regexp.MustCompile(`\^(-|\+|\d+|\d+-\d+)$`)
+)
+
+// ExpandOptions says where sets are looked up, and how deep they're expanded
+type ExpandOptions struct {
+	// Sources are the names of the sources in priority order. A set is taken from the first
+	// source which has it. When there are none, all sources without a label are used, in
+	// order of name.
+	Sources []string
+	// MaxDepth is the number of levels of nested sets which are expanded. DefaultExpandDepth is
+	// used when it's 0.
+	MaxDepth int
+}
+
+// ExpandedSet is a set which was expanded, and the source it was taken from
+type ExpandedSet struct {
+	Name   string
+	Source string
+	// Depth is 0 for the set which was asked for
+	Depth int
+}
+
+// SetExpansion is an as-set resolved to AS numbers, or a route-set resolved to prefixes
+type SetExpansion struct {
+	Name       string
+	ObjectType string
+	Sources    []string
+	// ASNs are the AS numbers of an as-set, in numerical order
+	ASNs []string
+	// Prefixes are the prefixes of a route-set, with their range operators, in address order
+	Prefixes []string
+	Sets     []ExpandedSet
+	// Missing are the sets which are members, but are not in any source
+	Missing []string
+	// Cycles are the paths of sets which contain themselves, e.g. AS-A > AS-B > AS-A
+	Cycles []string
+	// DepthLimited are the sets which were not expanded, because they're nested too deeply
+	DepthLimited []string
+}
+
+// ExpandSet resolves an as-set to its AS numbers, or a route-set to its prefixes, recursively,
+// like IRRd's !i query. Members are taken from the members and mp-members attributes, and
+// from objects in the set's source whose member-of names the set, if they're maintained by one
+// of the set's mbrs-by-ref maintainers, or the set's mbrs-by-ref is ANY. A route-set member which is an AS
+// number or an as-set stands for the routes originated by those ASes, in any of the sources.
+// A range operator on a member set is applied to its prefixes as in RFC 2622 section 5.2: it's
+// intersected with the range a prefix already has, and the prefix is dropped if the ranges
+// don't overlap.
+func (p NRTMProcessor) ExpandSet(ctx context.Context, name string, opts ExpandOptions) (SetExpansion, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	objectType := setType(name)
+	expansion := SetExpansion{
+		Name:         name,
+		ObjectType:   objectType,
+		Sources:      []string{},
+		ASNs:         []string{},
+		Prefixes:     []string{},
+		Sets:         []ExpandedSet{},
+		Missing:      []string{},
+		Cycles:       []string{},
+		DepthLimited: []string{},
+	}
+	if len(objectType) == 0 {
+		return expansion, ErrInvalidSetName
+	}
+	sources, err := p.expandSources(opts.Sources)
+	if err != nil {
+		return expansion, err
+	}
+	for _, s := range sources {
+		expansion.Sources = append(expansion.Sources, s.Source)
+	}
+	maxDepth := opts.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultExpandDepth
+	}
+	ex := &expander{
+		ctx:      ctx,
+		repo:     p.repo,
+		sources:  sources,
+		maxDepth: maxDepth,
+		result:   &expansion,
+		found:    map[string]*rpsl.Rpsl{},
+		resolved: map[string]resolvedSet{},
+		setIndex: map[string]int{},
+		expanded: map[string]bool{},
+		limited:  []string{},
+		reported: map[string]bool{},
+	}
+	top := ex.resolve(objectType, name, 0, []string{})
+	if ex.stopOnErr != nil {
+		return expansion, ex.stopOnErr
+	}
+	if len(expansion.Sets) == 0 {
+		expansion.Missing = []string{}
+		return expansion, ErrSetNotFound
+	}
+	asns := top.asns
+	prefixes := map[string]bool{}
+	for p := range top.prefixes {
+		prefixes[p.name+p.op] = true
+	}
+	if objectType == "ROUTE-SET" {
+		asns = map[string]bool{}
+		ex.addOriginatedPrefixes(top.origins, prefixes)
+		if ex.stopOnErr != nil {
+			return expansion, ex.stopOnErr
+		}
+	}
+	for _, name := range ex.limited {
+		if !ex.expanded[name] {
+			expansion.DepthLimited = append(expansion.DepthLimited, name)
+		}
+	}
+	expansion.ASNs = sortedASNs(asns)
+	expansion.Prefixes = sortedPrefixes(prefixes)
+	return expansion, nil
+}
+
+// expandSources returns the sources named in priority order, or all sources without a label
+func (p NRTMProcessor) expandSources(names []string) ([]persist.NRTMSource, error) {
+	ds := NrtmDataService{Repository: p.repo}
+	sources := []persist.NRTMSource{}
+	if len(names) == 0 {
+		all, err := p.repo.ListSources()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range all {
+			if len(s.Label) == 0 {
+				sources = append(sources, s)
+			}
+		}
+		slices.SortFunc(sources, func(a, b persist.NRTMSource) int { return strings.Compare(a.Source, b.Source) })
+		return sources, nil
+	}
+	for _, name := range names {
+		source := ds.getSourceByNameAndLabel(strings.TrimSpace(name), "")
+		if source == nil {
+			return nil, ErrSourceNotFound
+		}
+		sources = append(sources, *source)
+	}
+	return sources, nil
+}
+
+// setType returns AS-SET or ROUTE-SET, from the last component of a hierarchical set name, or
+// an empty string if the name is not a set
+func setType(name string) string {
+	parts := strings.Split(name, ":")
+	last := strings.ToUpper(parts[len(parts)-1])
+	switch {
+	case strings.HasPrefix(last, "AS-"):
+		return "AS-SET"
+	case strings.HasPrefix(last, "RS-"):
+		return "ROUTE-SET"
+	}
+	return ""
+}
+
+type expander struct {
+	ctx      context.Context
+	repo     persist.Repository
+	sources  []persist.NRTMSource
+	maxDepth int
+	result   *SetExpansion
+	// found are the sets looked up so far, nil if they're not in any source
+	found map[string]*rpsl.Rpsl
+	// resolved are the members of sets which can be used again when the sets are nested in
+	// others
+	resolved map[string]resolvedSet
+	// setIndex is the index of each set in result.Sets
+	setIndex map[string]int
+	// expanded are the names of the sets whose members have been resolved
+	expanded map[string]bool
+	// limited are the sets which were too deep to expand, where they were reached
+	limited  []string
+	reported map[string]bool
+	// stopOnErr is the first repo error, after which nothing more is looked up
+	stopOnErr error
+}
+
+// rangedMember is a prefix, or an AS whose routes are members, with the range operator which
+// was given to it, if any
+type rangedMember struct {
+	name, op string
+}
+
+// setMembers are the members of a set and its nested sets. The range operators of member
+// sets are applied to their prefixes when they're merged into the set. The prefixes of member
+// ASes aren't known yet, so their range operators are kept in order, e.g. ^24-28^27-30.
+type setMembers struct {
+	asns     map[string]bool
+	prefixes map[rangedMember]bool
+	origins  map[rangedMember]bool
+	// limited is true if nested sets were not expanded, because they're too deep
+	limited bool
+	// cycleAt is the depth of the shallowest set which a cycle in the nested sets went back to
+	cycleAt int
+}
+
+func newSetMembers() *setMembers {
+	return &setMembers{
+		asns:     map[string]bool{},
+		prefixes: map[rangedMember]bool{},
+		origins:  map[rangedMember]bool{},
+		cycleAt:  math.MaxInt,
+	}
+}
+
+// merge adds the members of a nested set, applying rangeOp to its prefixes
+func (m *setMembers) merge(nested *setMembers, rangeOp string) {
+	for asn := range nested.asns {
+		m.asns[asn] = true
+	}
+	for member := range nested.prefixes {
+		if op, ok := applyRangeOps(netip.MustParsePrefix(member.name), member.op, rangeOp); ok {
+			m.prefixes[rangedMember{member.name, op}] = true
+		}
+	}
+	for member := range nested.origins {
+		m.origins[rangedMember{member.name, member.op + rangeOp}] = true
+	}
+	m.mergeLimits(nested)
+}
+
+func (m *setMembers) mergeLimits(nested *setMembers) {
+	m.limited = m.limited || nested.limited
+	m.cycleAt = min(m.cycleAt, nested.cycleAt)
+}
+
+// resolvedSet are the members of a set, resolved at a depth
+type resolvedSet struct {
+	members *setMembers
+	depth   int
+}
+
+// resolve returns the members of a set at the depth, which are empty if it's missing, part of
+// a cycle or too deep. path is the sets which it's nested in.
+//
+// Members are used again when the set is nested in another one, unless they were cut short:
+// by the depth limit, when the set is nested less deeply, or by a cycle which goes back to a
+// set above it.
+func (ex *expander) resolve(objectType, name string, depth int, path []string) *setMembers {
+	if ex.stopOnErr != nil {
+		return newSetMembers()
+	}
+	name = rpsl.NormalizePrimaryKey(objectType, name)
+	if i := slices.Index(path, name); i >= 0 {
+		ex.report(&ex.result.Cycles, strings.Join(slices.Concat(path, []string{name}), " > "))
+		m := newSetMembers()
+		m.cycleAt = i
+		return m
+	}
+	key := objectType + " " + name
+	if r, ok := ex.resolved[key]; ok && (!r.members.limited || depth >= r.depth) {
+		return r.members
+	}
+	if depth > ex.maxDepth {
+		if !slices.Contains(ex.limited, name) {
+			ex.limited = append(ex.limited, name)
+		}
+		m := newSetMembers()
+		m.limited = true
+		return m
+	}
+	obj, err := ex.find(objectType, name)
+	if err != nil {
+		ex.stopOnErr = err
+		return newSetMembers()
+	}
+	if obj == nil {
+		ex.report(&ex.result.Missing, name)
+		return newSetMembers()
+	}
+	if i, ok := ex.setIndex[name]; ok {
+		ex.result.Sets[i].Depth = min(ex.result.Sets[i].Depth, depth)
+	} else {
+		ex.setIndex[name] = len(ex.result.Sets)
+		ex.result.Sets = append(ex.result.Sets, ExpandedSet{Name: obj.PrimaryKey, Source: obj.Source, Depth: depth})
+	}
+	path = append(slices.Clone(path), name)
+	var m *setMembers
+	if objectType == "AS-SET" {
+		m = ex.asSetMembers(obj, depth, path)
+	} else {
+		m = ex.routeSetMembers(obj, depth, path)
+	}
+	ex.expanded[name] = true
+	if m.cycleAt >= depth {
+		ex.resolved[key] = resolvedSet{members: m, depth: depth}
+	}
+	return m
+}
+
+// find returns a set from the first source which has it, or nil
+func (ex *expander) find(objectType, name string) (*rpsl.Rpsl, error) {
+	key := rpsl.NormalizePrimaryKey(objectType, name)
+	if obj, ok := ex.found[objectType+" "+key]; ok {
+		return obj, nil
+	}
+	var found *rpsl.Rpsl
+	for _, source := range ex.sources {
+		obj, err := ex.repo.GetObject(source, objectType, key)
+		if err != nil {
+			return nil, err
+		}
+		if obj != nil {
+			parsed, _ := rpsl.ParseFromJSONString(obj.Payload)
+			parsed.Source = source.Source
+			parsed.PrimaryKey = obj.PrimaryKey
+			found = &parsed
+			break
+		}
+	}
+	ex.found[objectType+" "+key] = found
+	return found, nil
+}
+
+// report adds a finding to a list once
+func (ex *expander) report(list *[]string, finding string) {
+	if !ex.reported[finding] {
+		ex.reported[finding] = true
+		*list = append(*list, finding)
+	}
+}
+
+// asSetMembers returns the AS numbers in an as-set and its nested sets
+func (ex *expander) asSetMembers(set *rpsl.Rpsl, depth int, path []string) *setMembers {
+	m := newSetMembers()
+	for _, member := range listValues(set.Values("members")) {
+		switch {
+		case asNumberRegex.MatchString(member):
+			m.asns[strings.ToUpper(member)] = true
+		case setType(member) == "AS-SET":
+			m.merge(ex.resolve("AS-SET", member, depth+1, path), "")
+		}
+	}
+	ex.membersByRef(set, []string{"aut-num"}, func(obj rpsl.Rpsl) {
+		m.asns[obj.PrimaryKey] = true
+	})
+	return m
+}
+
+// routeSetMembers returns the prefixes in a route-set and its nested sets, and the ASes whose
+// routes are members
+func (ex *expander) routeSetMembers(set *rpsl.Rpsl, depth int, path []string) *setMembers {
+	m := newSetMembers()
+	members := append(set.Values("members"), set.Values("mp-members")...)
+	for _, member := range listValues(members) {
+		name, op := splitRangeOp(member)
+		if prefix, err := netip.ParsePrefix(name); err == nil {
+			m.prefixes[rangedMember{prefix.String(), op}] = true
+			continue
+		}
+		switch {
+		case asNumberRegex.MatchString(name):
+			m.origins[rangedMember{strings.ToUpper(name), op}] = true
+		case setType(name) == "AS-SET":
+			nested := ex.resolve("AS-SET", name, depth+1, path)
+			for asn := range nested.asns {
+				m.origins[rangedMember{asn, op}] = true
+			}
+			m.mergeLimits(nested)
+		case setType(name) == "ROUTE-SET":
+			m.merge(ex.resolve("ROUTE-SET", name, depth+1, path), op)
+		}
+	}
+	ex.membersByRef(set, []string{"route", "route6"}, func(obj rpsl.Rpsl) {
+		prefix := obj.Value("route")
+		if len(prefix) == 0 {
+			prefix = obj.Value("route6")
+		}
+		if p, err := netip.ParsePrefix(prefix); err == nil {
+			m.prefixes[rangedMember{p.String(), ""}] = true
+		}
+	})
+	return m
+}
+
+// addOriginatedPrefixes adds the prefixes of the routes originated by the member ASes of a
+// route-set, from every source, with the range operators given to the ASes
+func (ex *expander) addOriginatedPrefixes(origins map[rangedMember]bool, prefixes map[string]bool) {
+	if len(origins) == 0 || ex.stopOnErr != nil {
+		return
+	}
+	ops := map[string][]string{}
+	for origin := range origins {
+		ops[origin.name] = append(ops[origin.name], origin.op)
+	}
+	asns := make([]string, 0, len(ops))
+	for asn := range ops {
+		asns = append(asns, asn)
+	}
+	for _, source := range ex.sources {
+		err := ex.repo.RoutesByOrigin(ex.ctx, source, asns, func(obj rpsl.Rpsl) error {
+			route, err := rpsl.ParseFromJSONString(obj.Payload)
+			if err != nil {
+				return nil
+			}
+			prefix := route.Value("route")
+			if len(prefix) == 0 {
+				prefix = route.Value("route6")
+			}
+			p, err := netip.ParsePrefix(prefix)
+			if err != nil {
+				return nil
+			}
+			for _, chain := range ops[strings.ToUpper(route.Value("origin"))] {
+				if op, ok := applyRangeOps(p, splitRangeOps(chain)...); ok {
+					prefixes[p.String()+op] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			ex.stopOnErr = err
+			return
+		}
+	}
+}
+
+// membersByRef calls add with each object of the types which names the set in member-of, and
+// is maintained by one of the set's mbrs-by-ref maintainers. Objects are only looked up in the
+// set's own source.
+func (ex *expander) membersByRef(set *rpsl.Rpsl, objectTypes []string, add func(rpsl.Rpsl)) {
+	mbrsByRef := listValues(set.Values("mbrs-by-ref"))
+	if len(mbrsByRef) == 0 || ex.stopOnErr != nil {
+		return
+	}
+	i := slices.IndexFunc(ex.sources, func(s persist.NRTMSource) bool { return s.Source == set.Source })
+	if i < 0 {
+		return
+	}
+	anyMaintainer := slices.ContainsFunc(mbrsByRef, func(m string) bool { return strings.EqualFold(m, "ANY") })
+	err := ex.repo.ObjectsWithMemberOf(ex.ctx, ex.sources[i], objectTypes, set.PrimaryKey, func(obj rpsl.Rpsl) error {
+		member, err := rpsl.ParseFromJSONString(obj.Payload)
+		if err != nil {
+			return nil
+		}
+		isMember := slices.ContainsFunc(listValues(member.Values("member-of")), func(name string) bool {
+			return rpsl.NormalizePrimaryKey(set.ObjectType, name) == set.PrimaryKey
+		})
+		if !isMember {
+			return nil
+		}
+		maintained := anyMaintainer || slices.ContainsFunc(listValues(member.Values("mnt-by")), func(m string) bool {
+			return slices.ContainsFunc(mbrsByRef, func(ref string) bool { return strings.EqualFold(m, ref) })
+		})
+		if maintained {
+			add(member)
+		}
+		return nil
+	})
+	if err != nil {
+		ex.stopOnErr = err
+	}
+}
+
+// listValues splits attribute values which are lists separated by commas or white space
+func listValues(values []string) []string {
+	list := []string{}
+	for _, v := range values {
+		list = append(list, strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return list
+}
+
+// splitRangeOp separates a member from the range operator after it, e.g. RS-EXAMPLE^+
+func splitRangeOp(member string) (string, string) {
+	if loc := rangeOpRegex.FindStringIndex(member); loc != nil {
+		return member[:loc[0]], member[loc[0]:]
+	}
+	return member, ""
+}
+
+// splitRangeOps separates range operators which were applied in turn, e.g. ^24-28^27-30
+func splitRangeOps(chain string) []string {
+	ops := []string{}
+	for _, op := range strings.Split(chain, "^")[1:] {
+		ops = append(ops, "^"+op)
+	}
+	return ops
+}
+
+// applyRangeOps applies range operators to a prefix in turn, and returns the range operator
+// which stands for the result. The first operator gives the prefix its range, and each one
+// after it is intersected with it, e.g. 30.0.0.0/8^24-28 with ^27-30 is 30.0.0.0/8^27-28.
+// Returns false if the range is empty.
+func applyRangeOps(prefix netip.Prefix, ops ...string) (string, bool) {
+	bits, maxBits := prefix.Bits(), prefix.Addr().BitLen()
+	lo, hi := bits, bits
+	ranged := false
+	for _, op := range ops {
+		if len(op) == 0 {
+			continue
+		}
+		opLo, opHi, ok := rangeBounds(op, bits, maxBits)
+		if !ok {
+			return "", false
+		}
+		if ranged {
+			lo, hi = max(lo, opLo), min(hi, opHi)
+		} else {
+			lo, hi, ranged = opLo, opHi, true
+		}
+	}
+	if lo > hi || lo < bits || hi > maxBits {
+		return "", false
+	}
+	switch {
+	case lo == bits && hi == bits:
+		return "", true
+	case lo == bits && hi == maxBits:
+		return "^+", true
+	case lo == bits+1 && hi == maxBits:
+		return "^-", true
+	case lo == hi:
+		return fmt.Sprintf("^%d", lo), true
+	}
+	return fmt.Sprintf("^%d-%d", lo, hi), true
+}
+
+// rangeBounds returns the lengths of the prefixes which a range operator stands for, when
+// it's applied to a prefix of the length bits
+func rangeBounds(op string, bits, maxBits int) (int, int, bool) {
+	switch op {
+	case "^+":
+		return bits, maxBits, true
+	case "^-":
+		return bits + 1, maxBits, true
+	}
+	from, to, isRange := strings.Cut(op[1:], "-")
+	lo, err := strconv.Atoi(from)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return lo, lo, true
+	}
+	hi, err := strconv.Atoi(to)
+	if err != nil {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+func sortedASNs(asns map[string]bool) []string {
+	list := make([]string, 0, len(asns))
+	for asn := range asns {
+		list = append(list, asn)
+	}
+	slices.SortFunc(list, func(a, b string) int {
+		na, _ := strconv.ParseUint(a[2:], 10, 32)
+		nb, _ := strconv.ParseUint(b[2:], 10, 32)
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	return list
+}
+
+// sortedPrefixes orders IPv4 before IPv6, then by address and length
+func sortedPrefixes(prefixes map[string]bool) []string {
+	list := make([]string, 0, len(prefixes))
+	for p := range prefixes {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b string) int {
+		pa, _ := netip.ParsePrefix(strings.SplitN(a, "^", 2)[0])
+		pb, _ := netip.ParsePrefix(strings.SplitN(b, "^", 2)[0])
+		if c := pa.Addr().Compare(pb.Addr()); c != 0 {
+			return c
+		}
+		if pa.Bits() != pb.Bits() {
+			return pa.Bits() - pb.Bits()
+		}
+		return strings.Compare(a, b)
+	})
+	return list
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func expandProcessor(t *testing.T) NRTMProcessor {
+	repo := mockRepo{
+		sources: []persist.NRTMSource{
+			{ID: 1, Source: "TEST"},
+			{ID: 2, Source: "OTHER"},
+			{ID: 3, Source: "TEST", Label: "staged"},
+		},
+		objects: map[string][]string{
+			"TEST": {
+				"as-set: AS-TOP\nmembers: AS3, AS-NESTED, AS-MISSING\nmembers: AS1\nmbrs-by-ref: TEST-MNT\nsource: TEST",
+				"as-set: AS-NESTED\nmembers: AS2 AS-LOOP\nsource: TEST",
+				"as-set: AS-LOOP\nmembers: AS-NESTED, AS10\nsource: TEST",
+				"aut-num: AS64500\nmember-of: AS-TOP\nmnt-by: TEST-MNT\nsource: TEST",
+				"aut-num: AS64501\nmember-of: AS-TOP\nmnt-by: OTHER-MNT\nsource: TEST",
+				"aut-num: AS64502\nmember-of: AS-OTHER\nmnt-by: TEST-MNT\nsource: TEST",
+				"route-set: RS-TOP\nmembers: 192.0.2.0/24, RS-NESTED^+, AS-ORIGINS\nmp-members: 2001:db8::/32^48\nmbrs-by-ref: ANY\nsource: TEST",
+				"route-set: RS-NESTED\nmembers: 198.51.100.0/24, 203.0.113.0/24^26\nsource: TEST",
+				"as-set: AS-ORIGINS\nmembers: AS64510\nsource: TEST",
+				"route: 10.1.0.0/16\norigin: AS64510\nsource: TEST",
+				"route6: 2001:db8:1::/48\norigin: AS64510\nsource: TEST",
+				"route: 10.2.0.0/16\norigin: AS64511\nmember-of: RS-TOP\nmnt-by: ANYONE-MNT\nsource: TEST",
+				"route-set: RS-OPS\nmembers: AS-A^+, AS-B^24\nsource: TEST",
+				"as-set: AS-A\nmembers: AS-C\nsource: TEST",
+				"as-set: AS-B\nmembers: AS-C\nsource: TEST",
+				"as-set: AS-C\nmembers: AS64520\nsource: TEST",
+				"route: 10.20.0.0/16\norigin: AS64520\nsource: TEST",
+				"as-set: AS-DTOP\nmembers: AS-D1, AS-D3\nsource: TEST",
+				"as-set: AS-D1\nmembers: AS-D3\nsource: TEST",
+				"as-set: AS-D3\nmembers: AS-D4\nsource: TEST",
+				"as-set: AS-D4\nmembers: AS64530\nsource: TEST",
+				"route-set: RS-RFC\nmembers: RS-RFC-NESTED^27-30\nsource: TEST",
+				"route-set: RS-RFC-NESTED\nmembers: 5.0.0.0/8^+, 128.9.0.0/16^-, 30.0.0.0/8^24-28, 40.0.0.0/8^16, AS64540^24-28\nsource: TEST",
+				"route: 10.40.0.0/16\norigin: AS64540\nsource: TEST",
+			},
+			"OTHER": {
+				"as-set: AS-TOP\nmembers: AS99\nsource: OTHER",
+				"as-set: AS-MISSING\nmembers: AS4\nsource: OTHER",
+				"route: 10.3.0.0/16\norigin: AS64510\nsource: OTHER",
+				"aut-num: AS64503\nmember-of: AS-TOP\nmnt-by: TEST-MNT\nsource: OTHER",
+			},
+		},
+	}
+	return NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, fileMapClient{})
+}
+
+func TestExpandASSet(t *testing.T) {
+	p := expandProcessor(t)
+	ctx := context.Background()
+
+	exp, err := p.ExpandSet(ctx, "as-top", ExpandOptions{Sources: []string{"TEST", "OTHER"}})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	expected := []string{"AS1", "AS2", "AS3", "AS4", "AS10", "AS64500"}
+	if !slices.Equal(exp.ASNs, expected) {
+		t.Error("Expected", expected, "but was", exp.ASNs)
+	}
+	if len(exp.Cycles) != 1 || exp.Cycles[0] != "AS-TOP > AS-NESTED > AS-LOOP > AS-NESTED" {
+		t.Error("Expected a cycle", exp.Cycles)
+	}
+	if exp.Sets[0] != (ExpandedSet{Name: "AS-TOP", Source: "TEST", Depth: 0}) || len(exp.Sets) != 4 {
+		t.Error("Unexpected sets", exp.Sets)
+	}
+}
+
+func TestExpandSourcePriority(t *testing.T) {
+	p := expandProcessor(t)
+	ctx := context.Background()
+
+	exp, err := p.ExpandSet(ctx, "AS-TOP", ExpandOptions{})
+	if err != nil || !slices.Equal(exp.ASNs, []string{"AS99"}) || exp.Sets[0].Source != "OTHER" {
+		t.Error("Set should be taken from the first source", exp, err)
+	}
+	if !slices.Equal(exp.Sources, []string{"OTHER", "TEST"}) {
+		t.Error("Sources without a label should be used in order of name", exp.Sources)
+	}
+
+	exp, err = p.ExpandSet(ctx, "AS-TOP", ExpandOptions{Sources: []string{"TEST"}})
+	if err != nil || !slices.Equal(exp.Missing, []string{"AS-MISSING"}) || slices.Contains(exp.ASNs, "AS4") {
+		t.Error("Set in another source should be missing", exp, err)
+	}
+
+	if _, err = p.ExpandSet(ctx, "AS-TOP", ExpandOptions{Sources: []string{"NOPE"}}); err != ErrSourceNotFound {
+		t.Error("Expected ErrSourceNotFound", err)
+	}
+}
+
+func TestExpandDepthLimit(t *testing.T) {
+	p := expandProcessor(t)
+
+	exp, err := p.ExpandSet(context.Background(), "AS-TOP", ExpandOptions{Sources: []string{"TEST", "OTHER"}, MaxDepth: 1})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	if !slices.Equal(exp.DepthLimited, []string{"AS-LOOP"}) || slices.Contains(exp.ASNs, "AS10") {
+		t.Error("Sets below the depth limit should not be expanded", exp.DepthLimited, exp.ASNs)
+	}
+}
+
+func TestExpandDepthLimitReachedAgain(t *testing.T) {
+	p := expandProcessor(t)
+
+	// AS-D3 is first reached at the depth limit through AS-D1, then directly from AS-DTOP
+	exp, err := p.ExpandSet(context.Background(), "AS-DTOP", ExpandOptions{Sources: []string{"TEST"}, MaxDepth: 2})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	if !slices.Equal(exp.ASNs, []string{"AS64530"}) || len(exp.DepthLimited) != 0 {
+		t.Error("Set reached again at a shallower depth should be expanded", exp.ASNs, exp.DepthLimited)
+	}
+	if !slices.Contains(exp.Sets, ExpandedSet{Name: "AS-D3", Source: "TEST", Depth: 1}) {
+		t.Error("Set should have the shallowest depth it was reached at", exp.Sets)
+	}
+}
+
+func TestExpandNestedSetRangeOperators(t *testing.T) {
+	p := expandProcessor(t)
+
+	exp, err := p.ExpandSet(context.Background(), "RS-OPS", ExpandOptions{Sources: []string{"TEST"}})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	expected := []string{"10.20.0.0/16^+", "10.20.0.0/16^24"}
+	if !slices.Equal(exp.Prefixes, expected) {
+		t.Error("Expected", expected, "but was", exp.Prefixes)
+	}
+}
+
+func TestExpandComposesRangeOperators(t *testing.T) {
+	p := expandProcessor(t)
+
+	// RFC 2622 section 5.2: {5.0.0.0/8^+, 128.9.0.0/16^-, 30.0.0.0/8^24-28}^27-30
+	exp, err := p.ExpandSet(context.Background(), "RS-RFC", ExpandOptions{Sources: []string{"TEST"}})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	expected := []string{"5.0.0.0/8^27-30", "10.40.0.0/16^27-28", "30.0.0.0/8^27-28", "128.9.0.0/16^27-30"}
+	if !slices.Equal(exp.Prefixes, expected) {
+		t.Error("Expected", expected, "but was", exp.Prefixes)
+	}
+}
+
+func TestExpandRouteSet(t *testing.T) {
+	p := expandProcessor(t)
+
+	exp, err := p.ExpandSet(context.Background(), "RS-TOP", ExpandOptions{})
+	if err != nil {
+		t.Fatal("Cannot expand set", err)
+	}
+	expected := []string{
+		"10.1.0.0/16",
+		"10.2.0.0/16",
+		"10.3.0.0/16",
+		"192.0.2.0/24",
+		"198.51.100.0/24^+",
+		"203.0.113.0/24^26",
+		"2001:db8::/32^48",
+		"2001:db8:1::/48",
+	}
+	if !slices.Equal(exp.Prefixes, expected) {
+		t.Error("Expected", expected, "but was", exp.Prefixes)
+	}
+	if exp.ObjectType != "ROUTE-SET" || len(exp.ASNs) != 0 {
+		t.Error("Unexpected expansion", exp)
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	p := expandProcessor(t)
+	ctx := context.Background()
+
+	if _, err := p.ExpandSet(ctx, "AS64500", ExpandOptions{}); err != ErrInvalidSetName {
+		t.Error("Expected ErrInvalidSetName", err)
+	}
+	if _, err := p.ExpandSet(ctx, "AS-NOPE", ExpandOptions{}); err != ErrSetNotFound {
+		t.Error("Expected ErrSetNotFound", err)
+	}
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"slices"
@@ -22,6 +24,9 @@ import (
 // GZIPSnapshotExtension extension GZIP files
 var GZIPSnapshotExtension = ".gz"
 
+// partialFileExtension is added to the name of a file until it's downloaded and its hash matches
+const partialFileExtension = ".part"
+
 type fileManager struct {
 	client Client
 }
@@ -42,50 +47,75 @@ func (fm fileManager) ensureDirectoryExists(path string) error {
 const numVersionsPerDirectory = 10000
 
 // fetchFileAndCheckHash returns an open file pointer to the file in fileRef.URL
-func (fm fileManager) fetchFileAndCheckHash(unfURL string, fileRef persist.FileRefJSON, basePath string) (*os.File, error) {
-	fURL := fullURL(unfURL, fileRef.URL)
+func (fm fileManager) fetchFileAndCheckHash(ctx context.Context, unfURL string, fileRef persist.FileRefJSON, basePath string) (*os.File, error) {
+	fURL, err := fullURL(unfURL, fileRef.URL)
+	if err != nil {
+		logger.Error("URL in fileRef is not allowed", "unfURL", unfURL, "fileRef.URL", fileRef.URL, "error", err)
+		return nil, err
+	}
 	if !validateURLString(fURL) {
 		logger.Error("URL in fileRef cannot be parsed", "unfURL", unfURL, "fileRef.URL", fileRef.URL)
 		return nil, errors.New("invalid URL in reference")
 	}
-	vdir := (fileRef.Version / numVersionsPerDirectory) * numVersionsPerDirectory
-	subdir := filepath.Join(basePath, fmt.Sprintf("%d", vdir))
-	_, err := os.Stat(subdir)
+	path := localPathForRef(basePath, fURL, fileRef)
+	subdir := filepath.Dir(path)
+	ctx = withFileRoot(ctx, unfURL)
+	_, err = os.Stat(subdir)
 	if os.IsNotExist(err) {
-		err = os.Mkdir(subdir, 0775)
+		// MkdirAll, because another download may create it at the same time
+		err = os.MkdirAll(subdir, 0775)
 		if err != nil {
 			logger.Error("Failed to create subdirectory", "subdir", subdir, "error", err)
 			return nil, err
 		}
 	}
-	path := filepath.Join(subdir, filepath.Base(fURL))
-	var file *os.File
-	if file, err = os.Open(path); err != nil {
-		UserLogger.Debug("Downloading file", "url", fURL, "path", path)
-		if _, err = fm.writeResourceToPath(fURL, path); err != nil {
-			logger.Error("Failed to write file", "url", fURL, "path", path)
+	if file, err := os.Open(path); err == nil {
+		UserLogger.Debug("Using existing file", "url", fURL, "path", path)
+		sum, err := calcHash256(file)
+		if err != nil {
+			file.Close()
 			return nil, err
 		}
-		if file, err = os.Open(path); err != nil {
-			logger.Error("Failed to open file", "url", fURL, "path", path)
-			return nil, err
+		if sum == fileRef.Hash {
+			UserLogger.Debug("File hash is ok", "file", file.Name())
+			return file, nil
 		}
-	} else {
-		UserLogger.Debug("Using existing file", "url", fURL, "path", path)
+		file.Close()
+		return nil, fm.rejectBadHash(ctx, fURL, path, fileRef.Hash, sum)
 	}
-	sum, err := calcHash256(file)
+	UserLogger.Debug("Downloading file", "url", fURL, "path", path)
+	partPath := path + partialFileExtension
+	sum, err := fm.writeResourceToPath(ctx, fURL, partPath)
 	if err != nil {
+		logger.Error("Failed to write file", "url", fURL, "path", partPath, "error", err)
 		return nil, err
 	}
 	if sum != fileRef.Hash {
-		if err = os.Rename(file.Name(), file.Name()+"-BADHASH"); err != nil {
-			return nil, err
-		}
-		UserLogger.Error("Hash does not match the downloaded file", "file", file.Name(), "hash", fileRef.Hash, "calculated", sum)
-		return nil, ErrHashMismatch
+		return nil, fm.rejectBadHash(ctx, fURL, partPath, fileRef.Hash, sum)
+	}
+	if err = os.Rename(partPath, path); err != nil {
+		return nil, err
+	}
+	UserLogger.Debug("File hash is ok", "file", path)
+	return os.Open(path)
+}
+
+// rejectBadHash moves a file which doesn't match its hash out of the way, so it's downloaded
+// again next time
+func (fm fileManager) rejectBadHash(ctx context.Context, fURL, path, hash, sum string) error {
+	badPath := strings.TrimSuffix(path, partialFileExtension) + "-BADHASH"
+	if err := os.Rename(path, badPath); err != nil {
+		return err
 	}
-	UserLogger.Debug("File hash is ok", "file", file.Name())
-	return file, nil
+	UserLogger.Error("Hash does not match the downloaded file", "file", badPath, "hash", hash, "calculated", sum)
+	reportProgress(ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressFailed, Total: -1, URL: fURL, Error: ErrHashMismatch.Error()})
+	return ErrHashMismatch
+}
+
+// localPathForRef is where the file at fURL is stored
+func localPathForRef(basePath string, fURL string, fileRef persist.FileRefJSON) string {
+	vdir := (fileRef.Version / numVersionsPerDirectory) * numVersionsPerDirectory
+	return filepath.Join(basePath, fmt.Sprintf("%d", vdir), filepath.Base(fURL))
 }
 
 func (fm fileManager) readJSONSeqRecords(
@@ -116,56 +146,120 @@ func (fm fileManager) readJSONSeqRecords(
 	return err
 }
 
-func (fm fileManager) writeResourceToPath(url string, fileName string) (*os.File, error) {
-	if f, err := os.Open(fileName); err == nil {
-		return f, err
+// writeResourceToPath downloads url to partPath and returns the SHA-256 of the whole file. If
+// partPath already has part of the file, and the client supports it, the download continues
+// from the end of it. The file is hashed as it's written. If the download fails, partPath is
+// left so the next attempt can resume it.
+func (fm fileManager) writeResourceToPath(ctx context.Context, url string, partPath string) (string, error) {
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Error("Failed to open file on disk", "error", err)
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	offset, err := io.CopyBuffer(hasher, file, make([]byte, fileWriteBufferLength))
+	if err != nil {
+		return "", err
 	}
 	var reader io.Reader
-	var err error
-	if reader, err = fm.client.getResponseBody(url); err != nil {
+	start := int64(0)
+	if rc, ok := fm.client.(rangeClient); ok && offset > 0 {
+		UserLogger.Info("Resuming download", "url", url, "offset", offset)
+		reader, start, err = rc.getResponseBodyFrom(ctx, url, offset)
+	} else {
+		reader, err = fm.client.getResponseBody(ctx, url)
+	}
+	if err != nil {
 		logger.Error("Failed to fetch file", "url", url, "error", err)
-		return nil, err
+		reportProgress(ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressFailed, Total: -1, URL: url, Error: err.Error()})
+		return "", err
+	}
+	if rc, ok := reader.(io.Closer); ok {
+		defer rc.Close()
+	}
+	if start != offset {
+		// Server sent the whole file
+		if err = file.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		hasher.Reset()
+		start = 0
+	}
+	pr := newProgressReader(ctx, reader, url, start)
+	_, err = io.CopyBuffer(io.MultiWriter(file, hasher), pr, make([]byte, fileWriteBufferLength))
+	pr.finish(err)
+	if err != nil {
+		logger.Error("Download stopped before the end of the file", "url", url, "path", partPath, "error", err)
+		return "", err
 	}
-	return readerToFile(reader, fileName)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func (fm fileManager) downloadNotificationFile(url string) (persist.NotificationJSON, error) {
-	var notification persist.NotificationJSON
-	var err error
-	if notification, err = fm.client.getUpdateNotification(url); err != nil {
+// downloadNotificationFile fetches, verifies and validates the notification file. Unsigned files
+// are rejected if the trust policy requires a signature. Returns the key which verified the
+// signature, or an empty string.
+func (fm fileManager) downloadNotificationFile(ctx context.Context, url string, trust notificationTrust) (persist.NotificationJSON, string, error) {
+	notification, verifiedBy, err := fm.client.getUpdateNotification(ctx, url, trust.findKeys)
+	if err != nil {
 		logger.Error("getUpdateNotification returned an error", "error", err)
-		return notification, err
+		return notification, "", err
+	}
+	if len(verifiedBy) == 0 {
+		if trust.requireSignature {
+			UserLogger.Error("Notification file is not signed with a trusted key", "url", url)
+			return notification, "", ErrNotificationUnsigned
+		}
+		UserLogger.Warn("Notification signature was not verified, no trusted key for source", "url", url, "source", notification.Source)
 	}
-	return notification, validateNotificationFile(notification)
+	return notification, verifiedBy, validateNotificationFile(notification)
 }
 
+// validateNotificationFile returns the first violation in the fields of a notification file
 func validateNotificationFile(file persist.NotificationJSON) error {
-	if file.NrtmVersion != 4 {
-		return newNRTMServiceError("notificationFile nrtm version is not 4: '%v'", file.NrtmVersion)
+	if errs := notificationFileErrors(file); len(errs) > 0 {
+		return errs[0]
 	}
-	t, err := time.Parse(time.RFC3339, file.Timestamp)
-	if err != nil {
-		return newNRTMServiceError("notificationFile timestamp is not valid: '%v'", file.Timestamp)
+	return nil
+}
+
+// notificationFileErrors returns every violation in the fields of a notification file
+func notificationFileErrors(file persist.NotificationJSON) []error {
+	errs := []error{}
+	if file.NrtmVersion != 4 {
+		errs = append(errs, newNRTMServiceError("notificationFile nrtm version is not 4: '%v'", file.NrtmVersion))
 	}
-	if t.AddDate(0, 0, 1).Before(util.AppClock.Now()) {
+	if t, err := time.Parse(time.RFC3339, file.Timestamp); err != nil {
+		errs = append(errs, newNRTMServiceError("notificationFile timestamp is not valid: '%v'", file.Timestamp))
+	} else if t.AddDate(0, 0, 1).Before(util.AppClock.Now()) {
 		UserLogger.Warn("Notification timestamp is older than 24hr", "timestamp", file.Timestamp)
 	}
 	if len(file.SessionID) < 36 {
-		return newNRTMServiceError("notificationFile session ID is not valid: '%v'", file.SessionID)
+		errs = append(errs, newNRTMServiceError("notificationFile session ID is not valid: '%v'", file.SessionID))
 	}
 	if len(file.Source) < 1 {
 		// TODO: check RFC for valid names
-		return newNRTMServiceError("notificationFile source name is not valid: '%v'", file.Source)
+		errs = append(errs, newNRTMServiceError("notificationFile source name is not valid: '%v'", file.Source))
 	}
 	if file.Version < 1 {
-		return newNRTMServiceError("notificationFile version must be positive: '%v'", file.NrtmVersion)
+		errs = append(errs, newNRTMServiceError("notificationFile version must be positive: '%v'", file.Version))
 	}
-	if validateURLString(file.SnapshotRef.URL) {
-		return newNRTMServiceError("notificationFile snapshot url is not valid: '%v'", file.SnapshotRef.URL)
+	if !validateURLReference(file.SnapshotRef.URL) {
+		errs = append(errs, newNRTMServiceError("notificationFile snapshot url is not valid: '%v'", file.SnapshotRef.URL))
 	}
+	return append(errs, deltaRefErrors(file)...)
+}
+
+// deltaRefErrors checks that the deltas in a notification file are a sequence which ends at
+// the notification version
+func deltaRefErrors(file persist.NotificationJSON) []error {
 	if len(file.DeltaRefs) == 0 {
-		return ErrNRTM4NoDeltasInNotification
+		return []error{ErrNRTM4NoDeltasInNotification}
 	}
+	errs := []error{}
 	versions := make([]int64, len(file.DeltaRefs))
 	for i, dr := range file.DeltaRefs {
 		versions[i] = dr.Version
@@ -173,55 +267,20 @@ func validateNotificationFile(file persist.NotificationJSON) error {
 	versionSet := util.NewSet(versions...)
 	if len(versionSet) != len(versions) {
 		logger.Error("Duplicate delta version found in notification file", "source", file.Source)
-		return ErrNRTM4DuplicateDeltaVersion
+		errs = append(errs, ErrNRTM4DuplicateDeltaVersion)
 	}
 	slices.Sort(versions)
+	versions = slices.Compact(versions)
 	lo := versions[0]
 	hi := versions[len(versions)-1]
 	if hi != file.Version {
-		return ErrNRTM4NotificationVersionDoesNotMatchDelta
+		errs = append(errs, ErrNRTM4NotificationVersionDoesNotMatchDelta)
 	}
 	if lo+int64(len(versions)-1) != hi {
 		logger.Error("Delta version is missing from the notification file", "source", file.Source)
-		return ErrNRTM4NotificationDeltaSequenceBroken
-	}
-	return nil
-}
-
-func readerToFile(reader io.Reader, fileName string) (*os.File, error) {
-	var outFile *os.File
-	var err error
-	if outFile, err = os.Create(fileName); err != nil {
-		logger.Error("Failed to open file on disk", "error", err)
-		return nil, err
-	}
-	defer func() {
-		if err := outFile.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	if err = transferReaderToFile(reader, outFile); err != nil {
-		logger.Error("writing file:", "error", err)
-		return nil, err
+		errs = append(errs, ErrNRTM4NotificationDeltaSequenceBroken)
 	}
-	return outFile, err
-}
-
-func transferReaderToFile(from io.Reader, to *os.File) error {
-	buf := make([]byte, fileWriteBufferLength)
-	for {
-		n, err := from.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			break
-		}
-		if _, err := to.Write(buf[:n]); err != nil {
-			return err
-		}
-	}
-	return nil
+	return errs
 }
 
 func calcHash256(file *os.File) (string, error) {
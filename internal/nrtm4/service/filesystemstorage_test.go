@@ -1,10 +1,19 @@
 package service
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/testresources"
@@ -12,7 +21,7 @@ import (
 
 func TestSuccess(t *testing.T) {
 	fm := fileManager{NewTestClient(t, baseURL, "version2to6", "unf_2-4.json")}
-	_, err := fm.downloadNotificationFile("")
+	_, _, err := fm.downloadNotificationFile(context.Background(), "", notificationTrust{})
 	if err != nil {
 		t.Error("should not be any errors but found:", err)
 	} else {
@@ -85,15 +94,20 @@ func TestWriteFileToPath(t *testing.T) {
 	snapshotPath := "snapshot.2.TEST.jsonseq.gz"
 
 	// When...
-	file, err := fm.writeResourceToPath(baseURL+snapshotPath, filepath.Join(tmpdir, snapshotPath))
-	if file == nil || err != nil {
+	expected := filepath.Join(tmpdir, snapshotPath)
+	sum, err := fm.writeResourceToPath(context.Background(), baseURL+snapshotPath, expected)
+	if err != nil {
 		t.Fatal("File was not written:", err)
 	}
 
 	// Then...
-	expected := filepath.Join(tmpdir, snapshotPath)
-	if file.Name() != expected {
-		t.Error("File name failed. Expected", expected, "but was", file.Name())
+	file, err := os.Open(expected)
+	if err != nil {
+		t.Fatal("File was not written to", expected, err)
+	}
+	defer file.Close()
+	if written, _ := calcHash256(file); written != sum {
+		t.Error("Hash of written file should be", sum, "but was", written)
 	}
 
 }
@@ -121,7 +135,7 @@ func TestFetchFileAndCheckHash(t *testing.T) {
 		fm := fileManager{
 			client: client,
 		}
-		_, err := fm.fetchFileAndCheckHash(unfURL, ref, dir)
+		_, err := fm.fetchFileAndCheckHash(context.Background(), unfURL, ref, dir)
 		if err != ErrHashMismatch {
 			t.Fatal("Expected ErrHashMismatch but was:", err)
 		}
@@ -131,7 +145,7 @@ func TestFetchFileAndCheckHash(t *testing.T) {
 			client: client,
 		}
 		ref.Hash = "4d14d44910c1abae9b55b6cc0f722369834b3c1942f3ee4bc0e051b1de10794d"
-		f, err := fm.fetchFileAndCheckHash(unfURL, ref, dir)
+		f, err := fm.fetchFileAndCheckHash(context.Background(), unfURL, ref, dir)
 		if err != nil {
 			t.Fatal("Unexpected error:", err)
 		}
@@ -146,3 +160,141 @@ func TestFetchFileAndCheckHash(t *testing.T) {
 	}
 
 }
+
+func TestFetchFileResumesPartialDownload(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 1000)
+	sum := sha256.Sum256([]byte(content))
+	ranges := []string{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "snapshot.jsonseq", time.Time{}, strings.NewReader(content))
+	}))
+	defer svr.Close()
+	dir := t.TempDir()
+	ref := persist.FileRefJSON{URL: "snapshot.jsonseq", Hash: hex.EncodeToString(sum[:]), Version: 3}
+	path := localPathForRef(dir, svr.URL+"/snapshot.jsonseq", ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+partialFileExtension, []byte(content[:5000]), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := fileManager{client: NewHTTPClient(testHTTPClientConfig(), nil)}
+	f, err := fm.fetchFileAndCheckHash(context.Background(), svr.URL+"/notification.json", ref, dir)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer f.Close()
+
+	if len(ranges) != 1 || ranges[0] != "bytes=5000-" {
+		t.Error("Expected a range request from byte 5000, but was", ranges)
+	}
+	if bytes, _ := os.ReadFile(f.Name()); string(bytes) != content {
+		t.Error("Resumed file does not match the content")
+	}
+	if _, err := os.Stat(path + partialFileExtension); !os.IsNotExist(err) {
+		t.Error("Partial file should be renamed", err)
+	}
+}
+
+func TestFetchFileRestartsWhenRangeIsIgnored(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 100)
+	sum := sha256.Sum256([]byte(content))
+	client := stubDeltaClient{responseBody: content}
+	dir := t.TempDir()
+	unfURL := "https://wherever.eu/unf.json"
+	ref := persist.FileRefJSON{URL: "snapshot.jsonseq", Hash: hex.EncodeToString(sum[:]), Version: 3}
+	path := localPathForRef(dir, "https://wherever.eu/snapshot.jsonseq", ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// stubDeltaClient doesn't do ranges, so the part is replaced
+	if err := os.WriteFile(path+partialFileExtension, []byte("something else"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := fileManager{client: client}
+	f, err := fm.fetchFileAndCheckHash(context.Background(), unfURL, ref, dir)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer f.Close()
+	if bytes, _ := os.ReadFile(f.Name()); string(bytes) != content {
+		t.Error("File does not match the content")
+	}
+}
+
+func TestFetchFileKeepsPartWhenDownloadFails(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10000")
+		fmt.Fprint(w, strings.Repeat("x", 4000))
+		// Connection closes before the whole body is sent
+	}))
+	defer svr.Close()
+	dir := t.TempDir()
+	ref := persist.FileRefJSON{URL: "snapshot.jsonseq", Hash: "123456", Version: 3}
+	path := localPathForRef(dir, svr.URL+"/snapshot.jsonseq", ref)
+
+	fm := fileManager{client: NewHTTPClient(testHTTPClientConfig(), nil)}
+	if _, err := fm.fetchFileAndCheckHash(context.Background(), svr.URL+"/notification.json", ref, dir); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	info, err := os.Stat(path + partialFileExtension)
+	if err != nil {
+		t.Fatal("Partial file should be kept", err)
+	}
+	if info.Size() != 4000 {
+		t.Error("Expected 4000 bytes in the partial file, but was", info.Size())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Incomplete file should not be renamed", err)
+	}
+}
+
+func TestFetchFileFromLocalMirror(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 100)
+	sum := sha256.Sum256([]byte(content))
+	mirror := t.TempDir()
+	if err := os.WriteFile(filepath.Join(mirror, "nrtm-snapshot.3.RIPE.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unfURL := "file://" + filepath.ToSlash(filepath.Join(mirror, notificationFileName))
+	// References in a mirrored notification file still point to the server
+	ref := persist.FileRefJSON{URL: "https://nrtm.example.eu/RIPE/nrtm-snapshot.3.RIPE.json", Hash: hex.EncodeToString(sum[:]), Version: 3}
+	dir := t.TempDir()
+
+	fm := fileManager{client: NewHTTPClient(testHTTPClientConfig(), nil)}
+	f, err := fm.fetchFileAndCheckHash(context.Background(), unfURL, ref, dir)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer f.Close()
+
+	if bytes, _ := os.ReadFile(f.Name()); string(bytes) != content {
+		t.Error("Copied file does not match the content")
+	}
+}
+
+func TestFetchFileRefFromRemoteNotification(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("secret"))
+	ref := persist.FileRefJSON{URL: "file://" + filepath.ToSlash(secret), Hash: hex.EncodeToString(sum[:]), Version: 3}
+
+	fm := fileManager{client: NewHTTPClient(testHTTPClientConfig(), nil)}
+	if _, err := fm.fetchFileAndCheckHash(context.Background(), "https://nrtm.example.eu/RIPE/notification.json", ref, t.TempDir()); err != ErrFileRefNotAllowed {
+		t.Error("Expected ErrFileRefNotAllowed", err)
+	}
+	// The file transport doesn't read files without a local notification file's directory
+	if _, err := fm.client.getResponseBody(context.Background(), ref.URL); !errors.Is(err, ErrFileRefNotAllowed) {
+		t.Error("Expected ErrFileRefNotAllowed from the transport", err)
+	}
+	ctx := withFileRoot(context.Background(), "file://"+filepath.ToSlash(filepath.Join(t.TempDir(), notificationFileName)))
+	if _, err := fm.client.getResponseBody(ctx, ref.URL); !errors.Is(err, ErrFileRefNotAllowed) {
+		t.Error("Expected ErrFileRefNotAllowed for a file outside the directory", err)
+	}
+}
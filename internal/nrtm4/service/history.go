@@ -0,0 +1,42 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// ObjectHistory is every revision of an object in a source, oldest first
+type ObjectHistory struct {
+	Source     string
+	Label      string
+	ObjectType string
+	PrimaryKey string
+	// Revisions is empty if the object has never been in the source
+	Revisions []persist.ObjectRevision
+}
+
+// GetObjectHistory returns every revision of an object, including deletions. The object type
+// is not case sensitive, and the primary key is normalized in the same way as object keys.
+func (p NRTMProcessor) GetObjectHistory(sourceName, label, objectType, primaryKey string) (ObjectHistory, error) {
+	history := ObjectHistory{
+		Source:     sourceName,
+		Label:      label,
+		ObjectType: strings.ToUpper(strings.TrimSpace(objectType)),
+		PrimaryKey: rpsl.NormalizePrimaryKey(objectType, primaryKey),
+		Revisions:  []persist.ObjectRevision{},
+	}
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return history, ErrSourceNotFound
+	}
+	history.Source = source.Source
+	revisions, err := p.repo.ObjectHistory(*source, history.ObjectType, history.PrimaryKey)
+	if err != nil {
+		return history, err
+	}
+	history.Revisions = revisions
+	return history, nil
+}
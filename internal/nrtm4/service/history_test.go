@@ -0,0 +1,39 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func TestGetObjectHistory(t *testing.T) {
+	repo := mockRepo{
+		sources: []persist.NRTMSource{verifyTestSource()},
+		revisions: map[string][]persist.ObjectRevision{
+			"MNTNER TEST-MNT": {
+				{Version: 3, RPSL: "mntner: TEST-MNT\nsource: TEST"},
+				{Version: 4, Deleted: true},
+			},
+		},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, fileMapClient{})
+
+	history, err := p.GetObjectHistory("test", "", "mntner", " test-mnt ")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if history.Source != "TEST" || history.ObjectType != "MNTNER" || history.PrimaryKey != "TEST-MNT" {
+		t.Error("Object should be identified by its normalized type and key", history)
+	}
+	if len(history.Revisions) != 2 || !history.Revisions[1].Deleted {
+		t.Error("History should end with the deletion", history.Revisions)
+	}
+
+	history, err = p.GetObjectHistory("TEST", "", "person", "NOPE-TEST")
+	if err != nil || len(history.Revisions) != 0 {
+		t.Error("Unknown object should have no revisions", history, err)
+	}
+	if _, err = p.GetObjectHistory("NOPE", "", "mntner", "TEST-MNT"); err != ErrSourceNotFound {
+		t.Error("Expected ErrSourceNotFound", err)
+	}
+}
@@ -1,33 +1,24 @@
 package service
 
 import (
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 )
 
-var publicKeyMap = map[string]string{}
-
-func init() {
-	publicKeyMap["ripe.net"] = `-----BEGIN PUBLIC KEY-----
-MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEOkzpjobirEcqoR6zLXnPkm4cCTEY
-Xi2rLlCSXc5EZ3L3PycAdDmWQtGHD8GF++RqWgrdKv+9l+InalmiCGkpRQ==
------END PUBLIC KEY-----`
-
-	publicKeyMap["s42.re"] = `-----BEGIN PUBLIC KEY-----
-MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEsYTv7kPkzBlpm6TfdqiSQqQ7Qajv
-gh4HeTD4QUtluJwaHzW7Gaq03KUqj581nN5YTLxehAf8JkyoIrXxNkaS5Q==
------END PUBLIC KEY-----`
-}
+// ErrReadTimeout the server stopped sending data for longer than the read timeout
+var ErrReadTimeout = errors.New("timed out reading response from server")
 
 // HTTPResponseError is used to model an error response from a http client
 type HTTPResponseError struct {
@@ -42,86 +33,370 @@ func (cerr HTTPResponseError) Error() string {
 
 // Client fetches things from the NRTM server, or anywhwere, actually
 type Client interface {
-	getUpdateNotification(string) (persist.NotificationJSON, error)
-	getResponseBody(string) (io.Reader, error)
+	getUpdateNotification(context.Context, string, keyFinder) (persist.NotificationJSON, string, error)
+	getResponseBody(context.Context, string) (io.Reader, error)
+	getContentLength(context.Context, string) (int64, error)
+}
+
+// Doer sends an HTTP request. *http.Client implements it, and tests can stub it.
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// HTTPClientConfig settings for HTTPClient
+type HTTPClientConfig struct {
+	// ConnectTimeout limits the time to connect to the server, including the TLS handshake
+	ConnectTimeout time.Duration
+	// ReadTimeout limits the time waiting for response headers, and between reads of the body
+	ReadTimeout time.Duration
+	// MaxRetries is how many times a request is retried after a network error or a 5xx response
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry. It doubles for each retry after that.
+	RetryBackoff time.Duration
+	// MaxBackoff is the longest wait between retries
+	MaxBackoff time.Duration
+	UserAgent  string
+}
+
+// DefaultHTTPClientConfig returns the settings used by the command line client and nrtm4serve
+func DefaultHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		ConnectTimeout: 10 * time.Second,
+		ReadTimeout:    60 * time.Second,
+		MaxRetries:     4,
+		RetryBackoff:   time.Second,
+		MaxBackoff:     30 * time.Second,
+		UserAgent:      "nrtm4tools (+https://github.com/petchells/nrtm4tools)",
+	}
 }
 
 // HTTPClient implementation of Client
-type HTTPClient struct{}
+//
+// Notification files are fetched with If-None-Match and If-Modified-Since when the server sent
+// an ETag or Last-Modified header, so polling an unchanged notification file doesn't download it
+// again. The zero value uses DefaultHTTPClientConfig and doesn't send conditional requests.
+type HTTPClient struct {
+	config        HTTPClientConfig
+	doer          Doer
+	notifications *notificationCache
+}
 
-func (cl HTTPClient) getUpdateNotification(urlStr string) (persist.NotificationJSON, error) {
-	nURL, err := url.Parse(urlStr)
-	if err != nil {
-		logger.Warn("Failed to parse URL", "urlStr", urlStr)
-	}
-	havePublicKey := false
-	keyTxt := ""
-	for domain, pk := range publicKeyMap {
-		if strings.HasSuffix(nURL.Host, domain) {
-			havePublicKey = true
-			keyTxt = pk
-			break
-		}
+// NewHTTPClient creates an HTTPClient. If doer is nil, an http.Client with the timeouts in
+// config is used.
+func NewHTTPClient(config HTTPClientConfig, doer Doer) HTTPClient {
+	if doer == nil {
+		doer = newTimeoutHTTPClient(config)
+	}
+	return HTTPClient{config: config, doer: doer, notifications: newNotificationCache()}
+}
+
+var defaultHTTPClient = sync.OnceValue(func() HTTPClient {
+	return NewHTTPClient(DefaultHTTPClientConfig(), nil)
+})
+
+func newTimeoutHTTPClient(config HTTPClientConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = config.ConnectTimeout
+	transport.ResponseHeaderTimeout = config.ReadTimeout
+	// file:// URLs are served from the local filesystem, with support for Range and conditional
+	// requests, but only from the directory given to withFileRoot
+	transport.RegisterProtocol("file", fileTransport{})
+	return &http.Client{Transport: transport}
+}
+
+type fileRootKey struct{}
+
+// withFileRoot allows file:// requests made with ctx to read files in the directory of a local
+// notification file. Requests for files made without it, or for a remote notification file, fail.
+func withFileRoot(ctx context.Context, notificationURL string) context.Context {
+	u, err := url.Parse(notificationURL)
+	if err != nil || u.Scheme != "file" {
+		return ctx
+	}
+	return context.WithValue(ctx, fileRootKey{}, path.Dir(path.Clean(u.Path)))
+}
+
+// fileTransport serves file:// requests from the directory in the request's context
+type fileTransport struct{}
+
+func (fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	root, ok := req.Context().Value(fileRootKey{}).(string)
+	name := path.Clean(req.URL.Path)
+	if !ok || !inDir(root, name) {
+		return nil, ErrFileRefNotAllowed
 	}
+	scoped := req.Clone(req.Context())
+	scoped.URL.Path = strings.TrimPrefix(name, strings.TrimSuffix(root, "/"))
+	return http.NewFileTransport(http.Dir(root)).RoundTrip(scoped)
+}
+
+// settings returns the client's config and doer, or the defaults for a zero value HTTPClient
+func (cl HTTPClient) settings() (HTTPClientConfig, Doer) {
+	if cl.doer == nil {
+		def := defaultHTTPClient()
+		return def.config, def.doer
+	}
+	return cl.config, cl.doer
+}
+
+// getUpdateNotification downloads the notification file and checks its signature with the keys
+// from findKeys. Returns the key which verified the signature, or an empty string.
+func (cl HTTPClient) getUpdateNotification(ctx context.Context, urlStr string, findKeys keyFinder) (persist.NotificationJSON, string, error) {
 	var unf persist.NotificationJSON
-	body, err := cl.getResponseBody(urlStr)
-	if err != nil || body == nil {
-		logger.Warn("Failed to read response", "urlStr", urlStr, "error", err)
-		return unf, err
+	ctx = withFileRoot(ctx, urlStr)
+	header := http.Header{}
+	cached, haveCached := cl.notifications.get(urlStr)
+	if haveCached {
+		if len(cached.etag) > 0 {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if len(cached.lastModified) > 0 {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
 	}
-	bytes, err := io.ReadAll(body)
+	resp, err := cl.do(ctx, http.MethodGet, urlStr, header)
 	if err != nil {
-		logger.Warn("Failed to read body", "urlStr", urlStr, "body", body, "error", err)
-		return unf, err
-	}
-	var pub any
-	if havePublicKey {
-		block, _ := pem.Decode([]byte(keyTxt))
-		if block == nil || block.Type != "PUBLIC KEY" {
-			logger.Warn("Failed to decode PEM block containing public key", "urlStr", urlStr, "body", body, "error", err)
-			return unf, errors.New("failed to decode PEM block containing public key")
-		}
-		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		logger.Warn("Failed to read response", "urlStr", urlStr, "error", err)
+		return unf, "", err
+	}
+	defer resp.Body.Close()
+	var token string
+	switch {
+	case resp.StatusCode == http.StatusNotModified && haveCached:
+		logger.Debug("Notification file not modified", "urlStr", urlStr)
+		token = cached.token
+	case resp.StatusCode == http.StatusOK:
+		bytes, err := io.ReadAll(resp.Body)
 		if err != nil {
-			logger.Warn("Failed to parse public key", "urlStr", urlStr, "pub", pub, "error", err)
-			return unf, err
+			logger.Warn("Failed to read body", "urlStr", urlStr, "error", err)
+			return unf, "", err
 		}
+		token = string(bytes)
+		cl.notifications.put(urlStr, cachedNotification{
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			token:        token,
+		})
+	default:
+		logger.Warn("HTTPClient getUpdateNotification received bad response", "status", resp.StatusCode, "message", resp.Status)
+		return unf, "", clientErrFromResponse(resp, urlStr)
 	}
-	tokenString := string(bytes)
-	claims := jwt.MapClaims{}
-	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
-		return pub, nil
-	})
+	return parseNotificationToken(token, findKeys)
+}
+
+// getResponseBody returns the body of a GET request. The caller should close it if it's an
+// io.Closer.
+func (cl HTTPClient) getResponseBody(ctx context.Context, url string) (io.Reader, error) {
+	resp, err := cl.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		_, isValidationError := err.(*jwt.ValidationError)
-		if havePublicKey || !isValidationError {
-			logger.Warn("Failed to parse with claims", "urlStr", urlStr, "error", err)
-			return unf, err
-		}
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return responseBody{ReadCloser: resp.Body, length: resp.ContentLength}, nil
 	}
-	// do something with decoded claims
-	cljson, err := json.Marshal(claims)
+	resp.Body.Close()
+	logger.Warn("HTTPClient getResponseBody received bad response", "status", resp.StatusCode, "message", resp.Status)
+	return nil, clientErrFromResponse(resp, url)
+}
+
+// rangeClient is a Client which can download the end of a file
+type rangeClient interface {
+	// getResponseBodyFrom returns the body starting at offset, and the offset where the body
+	// starts. That's 0 if the server sent the whole file.
+	getResponseBodyFrom(context.Context, string, int64) (io.Reader, int64, error)
+}
+
+// getResponseBodyFrom implements rangeClient with a Range request
+func (cl HTTPClient) getResponseBodyFrom(ctx context.Context, url string, offset int64) (io.Reader, int64, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := cl.do(ctx, http.MethodGet, url, header)
 	if err != nil {
-		logger.Warn("Failed to marshal claims", "urlStr", urlStr, "error", err)
-		return unf, err
+		return nil, 0, err
 	}
-	notification := new(persist.NotificationJSON)
-	err = json.Unmarshal(cljson, notification)
-	return *notification, err
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			logger.Warn("Server sent the wrong range", "url", url, "offset", offset, "Content-Range", resp.Header.Get("Content-Range"))
+			return nil, 0, clientErrFromResponse(resp, url)
+		}
+		return responseBody{ReadCloser: resp.Body, length: resp.ContentLength}, offset, nil
+	case http.StatusOK:
+		return responseBody{ReadCloser: resp.Body, length: resp.ContentLength}, 0, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The part already downloaded is the whole file
+		resp.Body.Close()
+		return responseBody{ReadCloser: io.NopCloser(strings.NewReader("")), length: 0}, offset, nil
+	}
+	resp.Body.Close()
+	logger.Warn("HTTPClient getResponseBodyFrom received bad response", "status", resp.StatusCode, "message", resp.Status)
+	return nil, 0, clientErrFromResponse(resp, url)
 }
 
-func (cl HTTPClient) getResponseBody(url string) (io.Reader, error) {
-	resp, err := http.Get(url)
+// getContentLength returns the size of the resource at url, or -1 if the server doesn't say
+func (cl HTTPClient) getContentLength(ctx context.Context, url string) (int64, error) {
+	resp, err := cl.do(ctx, http.MethodHead, url, nil)
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
-		return resp.Body, err
+		return resp.ContentLength, nil
 	}
-	logger.Warn("HTTPClient getResponseBody received bad response", "status", resp.StatusCode, "message", resp.Status)
-	return nil, clientErrFromResponse(resp)
+	logger.Warn("HTTPClient getContentLength received bad response", "status", resp.StatusCode, "message", resp.Status)
+	return -1, clientErrFromResponse(resp, url)
+}
+
+// do sends a request, retrying with exponential backoff after network errors and 5xx responses.
+// Any other response is returned, and its body must be closed. Reading the body fails with
+// ErrReadTimeout if the server stops sending data for longer than the read timeout.
+func (cl HTTPClient) do(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	config, doer := cl.settings()
+	backoff := config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := context.WithCancel(ctx)
+		req, err := http.NewRequestWithContext(reqCtx, method, url, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if len(config.UserAgent) > 0 {
+			req.Header.Set("User-Agent", config.UserAgent)
+		}
+		resp, err := doer.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			resp.Body = newTimeoutBody(resp.Body, config.ReadTimeout, cancel)
+			return resp, nil
+		}
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = clientErrFromResponse(resp, url)
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= config.MaxRetries {
+			return nil, err
+		}
+		UserLogger.Warn("Request failed, retrying", "url", url, "attempt", attempt+1, "wait", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, config.MaxBackoff)
+	}
+}
+
+// timeoutBody cancels the request when no data is read for longer than timeout
+type timeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut *atomic.Bool
+}
+
+func newTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) io.ReadCloser {
+	if timeout <= 0 {
+		return cancelOnClose{ReadCloser: body, cancel: cancel}
+	}
+	tb := timeoutBody{ReadCloser: body, timeout: timeout, cancel: cancel, timedOut: new(atomic.Bool)}
+	tb.timer = time.AfterFunc(timeout, func() {
+		tb.timedOut.Store(true)
+		cancel()
+	})
+	return tb
+}
+
+func (tb timeoutBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err != nil && tb.timedOut.Load() {
+		return n, ErrReadTimeout
+	}
+	tb.timer.Reset(tb.timeout)
+	return n, err
+}
+
+func (tb timeoutBody) Close() error {
+	tb.timer.Stop()
+	err := tb.ReadCloser.Close()
+	tb.cancel()
+	return err
+}
+
+// cancelOnClose releases the request's context when the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cc cancelOnClose) Close() error {
+	err := cc.ReadCloser.Close()
+	cc.cancel()
+	return err
+}
+
+// cachedNotification is the last notification file downloaded from a URL, with the validators
+// the server sent for it
+type cachedNotification struct {
+	etag         string
+	lastModified string
+	token        string
+}
+
+// notificationCache keeps the last notification file for each URL, for conditional requests
+type notificationCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedNotification
+}
+
+func newNotificationCache() *notificationCache {
+	return &notificationCache{entries: make(map[string]cachedNotification)}
+}
+
+func (nc *notificationCache) get(url string) (cachedNotification, bool) {
+	if nc == nil {
+		return cachedNotification{}, false
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	cn, ok := nc.entries[url]
+	return cn, ok
+}
+
+// put stores a notification file if the server sent a validator for it
+func (nc *notificationCache) put(url string, cn cachedNotification) {
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if len(cn.etag) == 0 && len(cn.lastModified) == 0 {
+		delete(nc.entries, url)
+		return
+	}
+	nc.entries[url] = cn
+}
+
+// responseBody is a response body which knows how long it is
+type responseBody struct {
+	io.ReadCloser
+	length int64
+}
+
+// ContentLength is the length the server sent, or -1 if it's unknown
+func (rb responseBody) ContentLength() int64 {
+	return rb.length
 }
 
-func clientErrFromResponse(resp *http.Response) HTTPResponseError {
-	return HTTPResponseError{Status: resp.StatusCode, Message: resp.Status, URL: resp.Request.URL.String()}
+func clientErrFromResponse(resp *http.Response, url string) HTTPResponseError {
+	return HTTPResponseError{Status: resp.StatusCode, Message: resp.Status, URL: url}
 }
@@ -1,12 +1,16 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/testresources"
 )
@@ -30,7 +34,7 @@ func TestGetNotification(t *testing.T) {
 
 	c := HTTPClient{}
 
-	res, err := c.getUpdateNotification(svr.URL)
+	res, _, err := c.getUpdateNotification(context.Background(), svr.URL, nil)
 	if err != nil {
 		t.Errorf("expected err to be nil got %v", err)
 	}
@@ -42,6 +46,27 @@ func TestGetNotification(t *testing.T) {
 	}
 }
 
+func TestGetNotificationFromFileURL(t *testing.T) {
+	unf, err := filepath.Abs(filepath.Join("..", "testresources", "update-notification-file.jose"))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	c := NewHTTPClient(DefaultHTTPClientConfig(), nil)
+
+	res, verifiedBy, err := c.getUpdateNotification(context.Background(), "file://"+filepath.ToSlash(unf), func(string) []string {
+		return []string{publicKeyMap["ripe.net"]}
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(verifiedBy) == 0 {
+		t.Error("Notification should be verified")
+	}
+	if res.Version != 399659 {
+		t.Errorf("expected version to be %v got %v", 399659, res.Version)
+	}
+}
+
 func TestGetResponseBody(t *testing.T) {
 	expected := "dummy data"
 	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -50,7 +75,7 @@ func TestGetResponseBody(t *testing.T) {
 	defer svr.Close()
 
 	c := HTTPClient{}
-	res, err := c.getResponseBody(svr.URL)
+	res, err := c.getResponseBody(context.Background(), svr.URL)
 
 	if err != nil {
 		t.Errorf("expected err to be nil got %v", err)
@@ -72,7 +97,7 @@ func TestGetResponseBodyError(t *testing.T) {
 	defer svr.Close()
 
 	c := HTTPClient{}
-	_, err := c.getResponseBody(svr.URL)
+	_, err := c.getResponseBody(context.Background(), svr.URL)
 
 	rerr, ok := err.(HTTPResponseError)
 	if !ok {
@@ -82,3 +107,154 @@ func TestGetResponseBodyError(t *testing.T) {
 		t.Fatal("Expected status to be", http.StatusForbidden, "but was", rerr.Status)
 	}
 }
+
+func testHTTPClientConfig() HTTPClientConfig {
+	config := DefaultHTTPClientConfig()
+	config.RetryBackoff = time.Millisecond
+	config.MaxBackoff = time.Millisecond
+	config.ReadTimeout = time.Second
+	config.UserAgent = "nrtm4tools-test"
+	return config
+}
+
+func TestGetResponseBodyRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("User-Agent") != "nrtm4tools-test" {
+			t.Error("Unexpected User-Agent", r.Header.Get("User-Agent"))
+		}
+		fmt.Fprint(w, "dummy data")
+	}))
+	defer svr.Close()
+
+	c := NewHTTPClient(testHTTPClientConfig(), nil)
+	res, err := c.getResponseBody(context.Background(), svr.URL)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer res.(io.Closer).Close()
+	if calls.Load() != 3 {
+		t.Error("Expected 3 requests but was", calls.Load())
+	}
+	if body, _ := io.ReadAll(res); string(body) != "dummy data" {
+		t.Error("Unexpected body", string(body))
+	}
+}
+
+func TestGetResponseBodyGivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer svr.Close()
+
+	config := testHTTPClientConfig()
+	config.MaxRetries = 2
+	c := NewHTTPClient(config, nil)
+	_, err := c.getResponseBody(context.Background(), svr.URL)
+
+	if rerr, ok := err.(HTTPResponseError); !ok || rerr.Status != http.StatusBadGateway {
+		t.Error("Expected bad gateway error but was", err)
+	}
+	if calls.Load() != 3 {
+		t.Error("Expected 3 requests but was", calls.Load())
+	}
+}
+
+func TestGetResponseBodyDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer svr.Close()
+
+	c := NewHTTPClient(testHTTPClientConfig(), nil)
+	if _, err := c.getResponseBody(context.Background(), svr.URL); err == nil {
+		t.Error("Expected an error")
+	}
+	if calls.Load() != 1 {
+		t.Error("Expected 1 request but was", calls.Load())
+	}
+}
+
+func TestGetResponseBodyReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer svr.Close()
+	defer close(release)
+
+	config := testHTTPClientConfig()
+	config.ReadTimeout = 50 * time.Millisecond
+	c := NewHTTPClient(config, nil)
+	res, err := c.getResponseBody(context.Background(), svr.URL)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer res.(io.Closer).Close()
+
+	if _, err = io.ReadAll(res); err != ErrReadTimeout {
+		t.Error("Expected ErrReadTimeout but was", err)
+	}
+}
+
+// stubDoer answers every request with a response from respond
+type stubDoer struct {
+	requests []*http.Request
+	respond  func(*http.Request) *http.Response
+}
+
+func (d *stubDoer) Do(req *http.Request) (*http.Response, error) {
+	d.requests = append(d.requests, req)
+	return d.respond(req), nil
+}
+
+func TestGetUpdateNotificationConditionalRequest(t *testing.T) {
+	token := readNotificationToken(t)
+	doer := &stubDoer{respond: func(req *http.Request) *http.Response {
+		if req.Header.Get("If-None-Match") == `"v399659"` {
+			return &http.Response{StatusCode: http.StatusNotModified, Status: "304 Not Modified", Body: io.NopCloser(strings.NewReader(""))}
+		}
+		header := http.Header{}
+		header.Set("ETag", `"v399659"`)
+		header.Set("Last-Modified", "Mon, 06 Jan 2025 12:00:00 GMT")
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: io.NopCloser(strings.NewReader(token))}
+	}}
+	c := NewHTTPClient(testHTTPClientConfig(), doer)
+	url := "https://nrtm.example.com/update-notification-file.jose"
+
+	first, _, err := c.getUpdateNotification(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	second, _, err := c.getUpdateNotification(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if len(doer.requests) != 2 {
+		t.Fatal("Expected 2 requests but was", len(doer.requests))
+	}
+	if doer.requests[0].Header.Get("If-None-Match") != "" {
+		t.Error("First request should not be conditional")
+	}
+	if doer.requests[1].Header.Get("If-Modified-Since") != "Mon, 06 Jan 2025 12:00:00 GMT" {
+		t.Error("Second request should send If-Modified-Since")
+	}
+	if second.Version != first.Version || second.Version != 399659 {
+		t.Error("Not modified notification should be the cached one, but was version", second.Version)
+	}
+}
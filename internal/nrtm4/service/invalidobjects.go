@@ -0,0 +1,82 @@
+package service
+
+import (
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// InvalidObjectReport lists the objects of a source which didn't match their class templates
+// when they were last loaded
+type InvalidObjectReport struct {
+	Source     string
+	Label      string
+	Validation string
+	// Rejected is the number of objects which were not saved
+	Rejected int
+	Objects  []persist.InvalidObject
+}
+
+// checkObject validates an object for a source's validation mode. It returns the record of an
+// invalid object, or nil if the object is valid or the source doesn't validate objects, and
+// whether the object should be saved. An object which couldn't be parsed is invalid.
+func checkObject(mode persist.ValidationMode, obj rpsl.Rpsl, parseErr error, version int64) (*persist.InvalidObject, bool) {
+	if mode == persist.ValidationNone {
+		return nil, true
+	}
+	findings := rpsl.Validate(obj)
+	if parseErr != nil {
+		findings = append([]rpsl.Finding{{Message: parseErr.Error()}}, findings...)
+	}
+	if len(findings) == 0 {
+		return nil, true
+	}
+	rejected := mode == persist.ValidationStrict
+	return &persist.InvalidObject{
+		ObjectType: obj.ObjectType,
+		PrimaryKey: obj.PrimaryKey,
+		Version:    uint32(version),
+		Rejected:   rejected,
+		Findings:   findings,
+		RPSL:       obj.Payload,
+	}, !rejected
+}
+
+// SetValidationMode sets how objects are checked against their class templates when snapshots
+// and deltas are loaded into a source. It applies to files loaded after it's set.
+func (p NRTMProcessor) SetValidationMode(sourceName, label string, mode persist.ValidationMode) (*persist.NRTMSource, error) {
+	ds := NrtmDataService{Repository: p.repo}
+	src := ds.getSourceByNameAndLabel(sourceName, label)
+	if src == nil {
+		return nil, ErrSourceNotFound
+	}
+	src.Properties.Validation = mode
+	UserLogger.Info("Set validation mode", "sourceName", sourceName, "label", label, "mode", mode.String())
+	return ds.saveSource(*src)
+}
+
+// InvalidObjects returns the report of a source's invalid objects
+func (p NRTMProcessor) InvalidObjects(sourceName, label string) (InvalidObjectReport, error) {
+	report := InvalidObjectReport{
+		Source:  sourceName,
+		Label:   label,
+		Objects: []persist.InvalidObject{},
+	}
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return report, ErrSourceNotFound
+	}
+	report.Source = source.Source
+	report.Validation = source.Properties.Validation.String()
+	objects, err := p.repo.ListInvalidObjects(*source)
+	if err != nil {
+		return report, err
+	}
+	for _, obj := range objects {
+		if obj.Rejected {
+			report.Rejected++
+		}
+	}
+	report.Objects = objects
+	return report, nil
+}
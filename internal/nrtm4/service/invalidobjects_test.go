@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+const (
+	validAsSet   = "as-set: AS-TEST\nmembers: AS64500\nadmin-c: TEST-NIC\ntech-c: TEST-NIC\nmnt-by: TEST-MNT\nsource: TEST"
+	invalidAsSet = "as-set: AS-BROKEN\nmembers: not a member\nsource: TEST"
+)
+
+func applyTestDelta(t *testing.T, mode persist.ValidationMode, objects ...string) *recordingDeltaTx {
+	source := verifyTestSource()
+	source.Properties.Validation = mode
+	ref := persist.FileRefJSON{Version: 6}
+	dtx := &recordingDeltaTx{}
+	fn := applyDeltaFunc(dtx, source, ref)
+	header, _ := json.Marshal(persist.DeltaFileJSON{NrtmFileJSON: persist.NrtmFileJSON{
+		NrtmVersion: 4, Type: "delta", Source: source.Source, SessionID: source.SessionID, Version: 6,
+	}})
+	if err := fn(header, nil); err != nil {
+		t.Fatal("Header was rejected", err)
+	}
+	for _, obj := range objects {
+		record, _ := json.Marshal(persist.DeltaJSON{Action: persist.DeltaAddModifyAction, Object: &obj})
+		if err := fn(record, nil); err != nil {
+			t.Fatal("Delta was not applied", err)
+		}
+	}
+	return dtx
+}
+
+func TestDeltaValidationModes(t *testing.T) {
+	dtx := applyTestDelta(t, persist.ValidationNone, validAsSet, invalidAsSet)
+	if dtx.changes != 2 || len(dtx.invalid) != 0 {
+		t.Error("Objects should not be validated", dtx.changes, dtx.invalid)
+	}
+
+	dtx = applyTestDelta(t, persist.ValidationLenient, validAsSet, invalidAsSet)
+	if dtx.changes != 2 || len(dtx.invalid) != 1 {
+		t.Fatal("Lenient mode should save both objects and record one", dtx.changes, dtx.invalid)
+	}
+	invalid := dtx.invalid[0]
+	if invalid.Rejected || invalid.PrimaryKey != "AS-BROKEN" || invalid.Version != 6 || len(invalid.Findings) == 0 {
+		t.Error("Unexpected invalid object", invalid)
+	}
+
+	dtx = applyTestDelta(t, persist.ValidationStrict, validAsSet, invalidAsSet)
+	if dtx.changes != 1 || len(dtx.invalid) != 1 || !dtx.invalid[0].Rejected {
+		t.Error("Strict mode should reject the invalid object", dtx.changes, dtx.invalid)
+	}
+}
+
+func TestSnapshotValidationStrict(t *testing.T) {
+	repo := &checkpointRepo{}
+	source := persist.NRTMSource{
+		ID:         1,
+		Source:     "RIPE",
+		SessionID:  "17db6715-18ae-410f-973e-47981b52f023",
+		Properties: persist.SourceProperties{Validation: persist.ValidationStrict},
+	}
+
+	readSnapshotSample(t, repo, source, persist.SnapshotCheckpoint{})
+
+	if repo.objects != 9 || len(repo.invalid) != 0 {
+		t.Error("All sample objects should be valid", repo.objects, repo.invalid)
+	}
+}
+
+func TestInvalidObjectReport(t *testing.T) {
+	source := verifyTestSource()
+	source.Properties.Validation = persist.ValidationStrict
+	repo := mockRepo{
+		sources: []persist.NRTMSource{source},
+		invalid: []persist.InvalidObject{
+			{ObjectType: "AS-SET", PrimaryKey: "AS-BROKEN", Rejected: true},
+			{ObjectType: "AUT-NUM", PrimaryKey: "AS64500"},
+		},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, fileMapClient{})
+
+	report, err := p.InvalidObjects("TEST", "")
+	if err != nil || len(report.Objects) != 2 || report.Rejected != 1 || report.Validation != "strict" {
+		t.Error("Unexpected report", report, err)
+	}
+	if _, err = p.InvalidObjects("NOPE", ""); err != ErrSourceNotFound {
+		t.Error("Expected ErrSourceNotFound", err)
+	}
+}
+
+func TestParseValidationMode(t *testing.T) {
+	for name, expected := range map[string]persist.ValidationMode{
+		"none":    persist.ValidationNone,
+		"Lenient": persist.ValidationLenient,
+		"STRICT":  persist.ValidationStrict,
+	} {
+		if mode, err := persist.ParseValidationMode(name); err != nil || mode != expected {
+			t.Error("Unexpected mode", name, mode, err)
+		}
+	}
+	if _, err := persist.ParseValidationMode("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -40,3 +40,20 @@ func (e ErrNRTMServiceError) Error() string {
 func newNRTMServiceError(msg string, args ...any) ErrNRTMServiceError {
 	return ErrNRTMServiceError{fmt.Sprintf(msg, args...)}
 }
+
+// ErrDeltaHashChanged is when the server publishes a delta version with a different url or
+// hash to the one it published before
+type ErrDeltaHashChanged struct {
+	Version      int64
+	URL          string
+	Hash         string
+	PreviousURL  string
+	PreviousHash string
+}
+
+func (e ErrDeltaHashChanged) Error() string {
+	return fmt.Sprintf(
+		"delta version %d was previously published with url '%v' hash '%v' but is now url '%v' hash '%v'",
+		e.Version, e.PreviousURL, e.PreviousHash, e.URL, e.Hash,
+	)
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+// UpdatePlan reports what Connect or Update would do, without changing the repository
+type UpdatePlan struct {
+	Source           string
+	Label            string
+	SessionID        string
+	FromVersion      uint32
+	ToVersion        int64
+	SessionRestarted bool
+	SnapshotRequired bool
+	TooFarBehind     bool
+	Snapshot         *PlannedDownload
+	Deltas           []PlannedDownload
+	DownloadBytes    int64
+}
+
+// PlannedDownload is a file which would be fetched from the server
+type PlannedDownload struct {
+	Version int64
+	URL     string
+	// Bytes is the size reported by the server, or -1 if it's not known
+	Bytes int64
+	// Cached is true if the file has already been downloaded
+	Cached bool
+}
+
+// PlanConnect downloads the notification file and reports what Connect would do
+func (p NRTMProcessor) PlanConnect(ctx context.Context, notificationURL string, label string) (UpdatePlan, error) {
+	unfURL := notificationURLFromPath(strings.TrimSpace(notificationURL))
+	if !validateURLString(unfURL) {
+		return UpdatePlan{}, ErrBadNotificationURL
+	}
+	label = strings.TrimSpace(label)
+	if !validateLabel(label) {
+		return UpdatePlan{}, ErrInvalidLabel
+	}
+	ds := NrtmDataService{Repository: p.repo}
+	if ds.getSourceByURLAndLabel(unfURL, label) != nil {
+		return UpdatePlan{}, ErrSourceAlreadyExists
+	}
+	trust, err := p.trustFor(unfURL, persist.SourceProperties{})
+	if err != nil {
+		return UpdatePlan{}, err
+	}
+	fm := fileManager{p.client}
+	notification, _, err := fm.downloadNotificationFile(ctx, unfURL, trust)
+	if err != nil {
+		return UpdatePlan{}, err
+	}
+	source := persist.NewNRTMSource(notification, label, unfURL)
+	return p.planFromSnapshot(ctx, source, notification), nil
+}
+
+// PlanUpdate downloads the notification file and reports what Update would do
+func (p NRTMProcessor) PlanUpdate(ctx context.Context, sourceName, label string) (UpdatePlan, error) {
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return UpdatePlan{}, ErrSourceNotFound
+	}
+	trust, err := p.trustFor(source.NotificationURL, source.Properties)
+	if err != nil {
+		return UpdatePlan{}, err
+	}
+	fm := fileManager{p.client}
+	notification, _, err := fm.downloadNotificationFile(ctx, source.NotificationURL, trust)
+	if err != nil {
+		return UpdatePlan{}, err
+	}
+	if notification.SessionID != source.SessionID {
+		restarted := persist.NewNRTMSource(notification, source.Label, source.NotificationURL)
+		plan := p.planFromSnapshot(ctx, restarted, notification)
+		plan.FromVersion = source.Version
+		plan.SessionRestarted = true
+		return plan, nil
+	}
+	if notification.Version < int64(source.Version) {
+		return UpdatePlan{}, ErrNRTM4NotificationOutOfDate
+	}
+	if err = checkDeltaRefs(ds, *source, notification); err != nil {
+		return UpdatePlan{}, err
+	}
+	plan := UpdatePlan{
+		Source:      source.Source,
+		Label:       source.Label,
+		SessionID:   source.SessionID,
+		FromVersion: source.Version,
+		ToVersion:   notification.Version,
+	}
+	deltaRefs, err := findUpdates(notification, *source)
+	if err == ErrNextConsecutiveDeltaUnavaliable {
+		plan.TooFarBehind = true
+		plan.SnapshotRequired = true
+		plan.Snapshot = p.planDownload(ctx, *source, notification.SnapshotRef)
+		plan.DownloadBytes = addBytes(plan.DownloadBytes, *plan.Snapshot)
+		return plan, nil
+	} else if err != nil {
+		return UpdatePlan{}, err
+	}
+	p.planDeltas(ctx, &plan, *source, deltaRefs)
+	return plan, nil
+}
+
+func (p NRTMProcessor) planFromSnapshot(ctx context.Context, source persist.NRTMSource, notification persist.NotificationJSON) UpdatePlan {
+	plan := UpdatePlan{
+		Source:           source.Source,
+		Label:            source.Label,
+		SessionID:        source.SessionID,
+		ToVersion:        notification.Version,
+		SnapshotRequired: true,
+	}
+	plan.Snapshot = p.planDownload(ctx, source, notification.SnapshotRef)
+	plan.DownloadBytes = addBytes(plan.DownloadBytes, *plan.Snapshot)
+	deltaRefs, err := findUpdates(notification, source)
+	if err == ErrNextConsecutiveDeltaUnavaliable {
+		// The server's snapshot is older than its oldest delta
+		plan.TooFarBehind = true
+		return plan
+	}
+	p.planDeltas(ctx, &plan, source, deltaRefs)
+	return plan
+}
+
+func (p NRTMProcessor) planDeltas(ctx context.Context, plan *UpdatePlan, source persist.NRTMSource, deltaRefs []persist.FileRefJSON) {
+	plan.Deltas = make([]PlannedDownload, 0, len(deltaRefs))
+	for _, ref := range deltaRefs {
+		dl := p.planDownload(ctx, source, ref)
+		plan.Deltas = append(plan.Deltas, *dl)
+		plan.DownloadBytes = addBytes(plan.DownloadBytes, *dl)
+	}
+}
+
+func (p NRTMProcessor) planDownload(ctx context.Context, source persist.NRTMSource, ref persist.FileRefJSON) *PlannedDownload {
+	fURL, err := fullURL(source.NotificationURL, ref.URL)
+	if err != nil {
+		logger.Warn("URL in fileRef is not allowed", "url", ref.URL, "error", err)
+		return &PlannedDownload{Version: ref.Version, URL: ref.URL, Bytes: -1}
+	}
+	dl := PlannedDownload{Version: ref.Version, URL: fURL, Bytes: -1}
+	dirname := filepath.Join(p.config.NRTMFilePath, source.Source, source.SessionID)
+	if info, err := os.Stat(localPathForRef(dirname, fURL, ref)); err == nil {
+		dl.Cached = true
+		dl.Bytes = info.Size()
+		return &dl
+	}
+	size, err := p.client.getContentLength(withFileRoot(ctx, source.NotificationURL), fURL)
+	if err != nil {
+		logger.Warn("Cannot determine size of file", "url", fURL, "error", err)
+		return &dl
+	}
+	dl.Bytes = size
+	return &dl
+}
+
+func addBytes(total int64, dl PlannedDownload) int64 {
+	if dl.Cached || dl.Bytes < 0 {
+		return total
+	}
+	return total + dl.Bytes
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func TestPlanConnect(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nrtmtest*")
+	if err != nil {
+		t.Fatal("Could not create temp test directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	conf := AppConfig{
+		NRTMFilePath: tmpDir,
+	}
+	stubClient := NewTestClient(t, baseURL, "version2to6", "unf_2-4.json")
+	processor := NewNRTMProcessor(conf, mockRepo{}, stubClient)
+
+	plan, err := processor.PlanConnect(context.Background(), baseURL+stubNotificationURL, "")
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !plan.SnapshotRequired || plan.Snapshot == nil {
+		t.Fatal("Snapshot should be required")
+	}
+	if plan.Snapshot.Version != 2 {
+		t.Error("Expected snapshot version 2 but was", plan.Snapshot.Version)
+	}
+	if len(plan.Deltas) != 2 || plan.Deltas[0].Version != 3 || plan.Deltas[1].Version != 4 {
+		t.Fatal("Expected deltas 3 and 4 but got", plan.Deltas)
+	}
+	if plan.TooFarBehind {
+		t.Error("Should not be too far behind")
+	}
+	expected := plan.Snapshot.Bytes + plan.Deltas[0].Bytes + plan.Deltas[1].Bytes
+	if plan.DownloadBytes <= 0 || plan.DownloadBytes != expected {
+		t.Error("Expected DownloadBytes to be", expected, "but was", plan.DownloadBytes)
+	}
+}
+
+func TestPlanUpdate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "nrtmtest*")
+	if err != nil {
+		t.Fatal("Could not create temp test directory")
+	}
+	defer os.RemoveAll(tmpDir)
+	conf := AppConfig{
+		NRTMFilePath: tmpDir,
+	}
+	source := persist.NRTMSource{
+		ID:              1001,
+		Source:          "TEST",
+		SessionID:       "17db6715-18ae-410f-973e-47981b52f023",
+		NotificationURL: baseURL + stubNotificationURL,
+	}
+	stubClient := NewTestClient(t, baseURL, "version2to6", "unf_2-6.json")
+	{
+		source.Version = 4
+		processor := NewNRTMProcessor(conf, mockRepo{sources: []persist.NRTMSource{source}}, stubClient)
+
+		plan, err := processor.PlanUpdate(context.Background(), "TEST", "")
+
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if plan.SnapshotRequired || plan.TooFarBehind {
+			t.Error("Snapshot should not be required")
+		}
+		if len(plan.Deltas) != 2 || plan.Deltas[0].Version != 5 || plan.Deltas[1].Version != 6 {
+			t.Error("Expected deltas 5 and 6 but got", plan.Deltas)
+		}
+	}
+	{
+		source.Version = 1
+		processor := NewNRTMProcessor(conf, mockRepo{sources: []persist.NRTMSource{source}}, stubClient)
+
+		plan, err := processor.PlanUpdate(context.Background(), "TEST", "")
+
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if !plan.TooFarBehind || !plan.SnapshotRequired {
+			t.Error("Repo should be too far behind to update")
+		}
+		if len(plan.Deltas) != 0 {
+			t.Error("Expected no deltas but got", plan.Deltas)
+		}
+	}
+	{
+		processor := NewNRTMProcessor(conf, mockRepo{}, stubClient)
+
+		if _, err := processor.PlanUpdate(context.Background(), "TEST", ""); err != ErrSourceNotFound {
+			t.Error("Expected ErrSourceNotFound but was", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+// errStateLimitReached stops reading objects when a SourceState is full
+var errStateLimitReached = errors.New("source state limit reached")
+
+// SourceState is the set of objects in a source at a version
+type SourceState struct {
+	Source  string
+	Label   string
+	Version uint32
+	Objects []rpsl.Rpsl
+	// Truncated is true when the source had more objects than were asked for
+	Truncated bool
+}
+
+// ParseTimestamp parses an RFC 3339 time, or a date which is taken as midnight UTC
+func ParseTimestamp(str string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, str); err == nil {
+		return t, nil
+	}
+	return time.Time{}, ErrInvalidTimestamp
+}
+
+// ObjectsAt calls fn with each object of a source as it was at a version, ordered by type and
+// primary key. If version is 0 and at is not zero, the version is the latest one published at or
+// before that time. If both are zero it's the current version. Only objects of the given types
+// are included, unless there are none. Returns the version used.
+func (p NRTMProcessor) ObjectsAt(
+	ctx context.Context,
+	sourceName, label string,
+	version uint32,
+	at time.Time,
+	objectTypes []string,
+	fn func(rpsl.Rpsl) error,
+) (uint32, error) {
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return 0, ErrSourceNotFound
+	}
+	if isSnapshotUnfinished(source.Status) {
+		return 0, ErrVersionNotHeld
+	}
+	var err error
+	switch {
+	case version > 0:
+	case !at.IsZero():
+		if version, err = p.repo.VersionAtTime(*source, at); err == persist.ErrVersionNotAvailable {
+			return 0, ErrVersionNotHeld
+		} else if err != nil {
+			return 0, err
+		}
+	default:
+		version = source.Version
+	}
+	err = p.repo.ObjectsAtVersion(ctx, *source, version, objectTypes, fn)
+	if err == persist.ErrVersionNotAvailable {
+		return version, ErrVersionNotHeld
+	}
+	return version, err
+}
+
+// SourceStateAt returns up to limit objects of a source at a version or time, in the same way as
+// ObjectsAt. A limit of 0 or less returns all objects.
+func (p NRTMProcessor) SourceStateAt(
+	ctx context.Context,
+	sourceName, label string,
+	version uint32,
+	at time.Time,
+	objectTypes []string,
+	limit int,
+) (SourceState, error) {
+	state := SourceState{Source: sourceName, Label: label, Objects: []rpsl.Rpsl{}}
+	var err error
+	state.Version, err = p.ObjectsAt(ctx, sourceName, label, version, at, objectTypes, func(obj rpsl.Rpsl) error {
+		if limit > 0 && len(state.Objects) == limit {
+			state.Truncated = true
+			return errStateLimitReached
+		}
+		state.Objects = append(state.Objects, obj)
+		return nil
+	})
+	if err == errStateLimitReached {
+		err = nil
+	}
+	return state, err
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+)
+
+func pointInTimeProcessor(t *testing.T) NRTMProcessor {
+	repo := mockRepo{
+		sources: []persist.NRTMSource{verifyTestSource()},
+		versions: map[uint32][]string{
+			4: {"mntner: TEST-MNT\nsource: TEST"},
+			5: {"mntner: TEST-MNT\nsource: TEST", "as-set: AS-TEST\nsource: TEST"},
+		},
+		published: map[uint32]time.Time{
+			4: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC),
+			5: time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	return NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, fileMapClient{})
+}
+
+func TestObjectsAtVersionOrTime(t *testing.T) {
+	p := pointInTimeProcessor(t)
+	ctx := context.Background()
+
+	count := 0
+	version, err := p.ObjectsAt(ctx, "TEST", "", 0, time.Time{}, nil, func(rpsl.Rpsl) error {
+		count++
+		return nil
+	})
+	if err != nil || version != 5 || count != 2 {
+		t.Error("Current version should be used when no version or time is given", version, count, err)
+	}
+
+	state, err := p.SourceStateAt(ctx, "TEST", "", 0, time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC), nil, 0)
+	if err != nil || state.Version != 4 || len(state.Objects) != 1 || state.Truncated {
+		t.Error("Version published before the time should be used", state, err)
+	}
+
+	state, err = p.SourceStateAt(ctx, "TEST", "", 5, time.Time{}, nil, 1)
+	if err != nil || len(state.Objects) != 1 || !state.Truncated {
+		t.Error("State should be truncated at the limit", state, err)
+	}
+}
+
+func TestObjectsAtVersionNotHeld(t *testing.T) {
+	p := pointInTimeProcessor(t)
+	ctx := context.Background()
+
+	if _, err := p.SourceStateAt(ctx, "TEST", "", 3, time.Time{}, nil, 0); err != ErrVersionNotHeld {
+		t.Error("Expected ErrVersionNotHeld for a version without history", err)
+	}
+	if _, err := p.SourceStateAt(ctx, "TEST", "", 0, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), nil, 0); err != ErrVersionNotHeld {
+		t.Error("Expected ErrVersionNotHeld for a time before the first notification", err)
+	}
+	if _, err := p.SourceStateAt(ctx, "NOPE", "", 0, time.Time{}, nil, 0); err != ErrSourceNotFound {
+		t.Error("Expected ErrSourceNotFound", err)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for str, expected := range map[string]time.Time{
+		"2024-01-02":                time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		"2024-01-02T15:04:05Z":      time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		"2024-01-02T15:04:05+01:00": time.Date(2024, 1, 2, 14, 4, 5, 0, time.UTC),
+	} {
+		ts, err := ParseTimestamp(str)
+		if err != nil || !ts.Equal(expected) {
+			t.Error("Timestamp was not parsed", str, ts, err)
+		}
+	}
+	if _, err := ParseTimestamp("last tuesday"); err != ErrInvalidTimestamp {
+		t.Error("Expected ErrInvalidTimestamp", err)
+	}
+}
@@ -1,10 +1,13 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"io"
+	"math"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -25,6 +28,9 @@ type AppConfig struct {
 	BoltDatabasePath string
 	WebSocketURL     string
 	RPCEndpoint      string
+	// DeltaDownloadWorkers is the number of delta files downloaded ahead of the one being
+	// applied. Defaults to 4.
+	DeltaDownloadWorkers int
 }
 
 // NewNRTMProcessor injects repo and client into service and return a new instance
@@ -57,7 +63,7 @@ func (p NRTMProcessor) StartAutoUpdater() {
 			logger.Error("ListSources failed", "error", err)
 		}
 		for _, s := range srcs {
-			if s.Status != "ok" {
+			if s.Status != "ok" || isStagingLabel(s.Label) {
 				continue
 			}
 			a := GetAutoUpdaterInstance(p, s.ID)
@@ -73,9 +79,9 @@ func (p NRTMProcessor) StartAutoUpdater() {
 }
 
 // Connect stores details about a connection
-func (p NRTMProcessor) Connect(notificationURL string, label string) error {
+func (p NRTMProcessor) Connect(ctx context.Context, notificationURL string, label string) error {
 	UserLogger.Info("Connect to source", "url", notificationURL, "label", label)
-	unfURL := strings.TrimSpace(notificationURL)
+	unfURL := notificationURLFromPath(strings.TrimSpace(notificationURL))
 	if !validateURLString(unfURL) {
 		return ErrBadNotificationURL
 	}
@@ -87,11 +93,11 @@ func (p NRTMProcessor) Connect(notificationURL string, label string) error {
 	if ds.getSourceByURLAndLabel(unfURL, label) != nil {
 		return ErrSourceAlreadyExists
 	}
-	fm := fileManager{p.client}
-	notification, err := fm.downloadNotificationFile(unfURL)
+	notification, err := p.fetchNotification(ctx, unfURL, persist.SourceProperties{})
 	if err != nil {
 		return err
 	}
+	fm := fileManager{p.client}
 	err = fm.ensureDirectoryExists(p.config.NRTMFilePath)
 	if err != nil {
 		return err
@@ -103,16 +109,70 @@ func (p NRTMProcessor) Connect(notificationURL string, label string) error {
 		return err
 	}
 	UserLogger.Info("Saved source", "source", notification.Source, "version", notification.Version, "label", label)
+	return p.loadSnapshotAndSyncDeltas(ctx, source, notification, notification, persist.SnapshotCheckpoint{})
+}
+
+// ResumeConnect continues a Connect which did not finish loading the snapshot, starting
+// after the last batch of objects that was committed
+func (p NRTMProcessor) ResumeConnect(ctx context.Context, notificationURL string, label string) error {
+	UserLogger.Info("Resume connection to source", "url", notificationURL, "label", label)
+	unfURL := notificationURLFromPath(strings.TrimSpace(notificationURL))
+	label = strings.TrimSpace(label)
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByURLAndLabel(unfURL, label)
+	if source == nil {
+		return ErrSourceNotFound
+	}
+	if !isSnapshotUnfinished(source.Status) {
+		UserLogger.Warn("Source does not have an unfinished snapshot", "status", source.Status)
+		return ErrNoSnapshotToResume
+	}
+	snapshotNotification, err := findSnapshotNotification(ds, *source)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := p.repo.GetSnapshotCheckpoint(*source)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		checkpoint = &persist.SnapshotCheckpoint{}
+	}
+	notification, err := p.fetchNotification(ctx, unfURL, source.Properties)
+	if err != nil {
+		return err
+	}
+	if notification.SessionID != source.SessionID {
+		source.Status = "session.restarted"
+		ds.saveSource(*source)
+		return ErrSessionRestarted
+	}
+	return p.loadSnapshotAndSyncDeltas(ctx, *source, snapshotNotification, notification, *checkpoint)
+}
+
+// loadSnapshotAndSyncDeltas inserts the snapshot listed in snapshotNotification, starting from
+// checkpoint, then applies the deltas in notification
+func (p NRTMProcessor) loadSnapshotAndSyncDeltas(
+	ctx context.Context,
+	source persist.NRTMSource,
+	snapshotNotification persist.NotificationJSON,
+	notification persist.NotificationJSON,
+	checkpoint persist.SnapshotCheckpoint,
+) error {
+	ctx = withProgressSource(ctx, source)
+	ds := NrtmDataService{Repository: p.repo}
+	fm := fileManager{p.client}
 	dirname := filepath.Join(p.config.NRTMFilePath, source.Source, source.SessionID)
-	_, err = os.Stat(dirname)
+	_, err := os.Stat(dirname)
 	if os.IsNotExist(err) {
 		if err = os.MkdirAll(dirname, 0755); err != nil {
 			return err
 		}
 	}
 	// Download snapshot
-	UserLogger.Info("Fetching snapshot file", "url", notification.SnapshotRef.URL)
-	snapshotFile, err := fm.fetchFileAndCheckHash(unfURL, notification.SnapshotRef, dirname)
+	snapshotRef := snapshotNotification.SnapshotRef
+	UserLogger.Info("Fetching snapshot file", "url", snapshotRef.URL)
+	snapshotFile, err := fm.fetchFileAndCheckHash(ctx, source.NotificationURL, snapshotRef, dirname)
 	if err != nil {
 		source.Status = "snapshot.file.failed: " + err.Error()
 		ds.saveSource(source)
@@ -120,31 +180,58 @@ func (p NRTMProcessor) Connect(notificationURL string, label string) error {
 	}
 	defer snapshotFile.Close()
 
-	UserLogger.Info("Inserting snapshot objects", "source", notification.Source)
-	if err := fm.readJSONSeqRecords(snapshotFile, snapshotObjectInsertFunc(p.repo, source, notification)); err != io.EOF {
-		UserLogger.Error("Invalid snapshot. Remove Source and restart sync", "error", err)
+	UserLogger.Info("Inserting snapshot objects", "source", source.Source)
+	if err := fm.readJSONSeqRecords(snapshotFile, snapshotObjectInsertFunc(ctx, p.repo, source, snapshotNotification, checkpoint)); err != io.EOF {
+		UserLogger.Error("Snapshot was not loaded. Use connect -resume to continue", "error", err)
+		reportFailure(ctx, PhaseSnapshot, err)
 		source.Status = "snapshot.insert.failed: " + err.Error()
 		ds.saveSource(source)
 		return err
 	}
+	source.Version = uint32(snapshotRef.Version)
 	source.Status = "updating"
 	ds.saveSource(source)
 
 	UserLogger.Info("Synchronizing deltas", "total refs", len(notification.DeltaRefs))
-	source, err = syncDeltas(p, notification, source)
+	source, err = syncDeltas(ctx, p, notification, source)
 	if err != nil {
 		UserLogger.Error("Failed to sync deltas", "source", source.Source, "version", source.Version, "error", err)
+		reportFailure(ctx, PhaseDeltas, err)
 		source.Status = "delta.failed: " + err.Error()
 		ds.saveSource(source)
 		return err
 	}
 	source.Status = "ok"
-	_, err = ds.saveSource(source)
+	saved, err := ds.saveSource(source)
+	if err == nil {
+		p.collectSourceGarbage(*saved)
+	}
 	return err
 }
 
+// isSnapshotUnfinished is true when a source has been created but its snapshot hasn't been loaded
+func isSnapshotUnfinished(status string) bool {
+	return status == "new" ||
+		strings.HasPrefix(status, "snapshot.file.failed") ||
+		strings.HasPrefix(status, "snapshot.insert.failed")
+}
+
+// findSnapshotNotification finds the notification that was used to start loading the snapshot
+func findSnapshotNotification(ds NrtmDataService, source persist.NRTMSource) (persist.NotificationJSON, error) {
+	notifications, err := ds.getNotifications(source, source.Version, math.MaxUint32)
+	if err != nil {
+		return persist.NotificationJSON{}, err
+	}
+	for _, n := range notifications {
+		if n.Payload.SnapshotRef.Version == int64(source.Version) {
+			return n.Payload, nil
+		}
+	}
+	return persist.NotificationJSON{}, ErrNoSnapshotToResume
+}
+
 // Update brings the local mirror up to date
-func (p NRTMProcessor) Update(sourceName, label string) (*persist.NRTMSource, error) {
+func (p NRTMProcessor) Update(ctx context.Context, sourceName, label string) (*persist.NRTMSource, error) {
 	UserLogger.Warn("Update", "sourceName", sourceName, "label", label)
 	ds := NrtmDataService{Repository: p.repo}
 	source := ds.getSourceByNameAndLabel(sourceName, label)
@@ -152,8 +239,15 @@ func (p NRTMProcessor) Update(sourceName, label string) (*persist.NRTMSource, er
 		logger.Warn("No source with given name and label", "sourceName", sourceName, "label", label)
 		return nil, ErrSourceNotFound
 	}
-	fm := fileManager{p.client}
-	notification, err := fm.downloadNotificationFile(source.NotificationURL)
+	if isSnapshotUnfinished(source.Status) {
+		UserLogger.Info("Snapshot was not loaded, resuming from the last checkpoint", "sourceName", sourceName, "label", label)
+		if err := p.ResumeConnect(ctx, source.NotificationURL, source.Label); err != nil {
+			return nil, err
+		}
+		return ds.getSourceByNameAndLabel(sourceName, label), nil
+	}
+	ctx = withProgressSource(ctx, *source)
+	notification, err := p.fetchNotification(ctx, source.NotificationURL, source.Properties)
 	if err != nil {
 		UserLogger.Warn("Notification file was not downloaded", "error", err)
 		return nil, err
@@ -168,6 +262,12 @@ func (p NRTMProcessor) Update(sourceName, label string) (*persist.NRTMSource, er
 		UserLogger.Warn("Notification file is out of date")
 		return nil, ErrNRTM4NotificationOutOfDate
 	}
+	if err = checkDeltaRefs(ds, *source, notification); err != nil {
+		source.Status = "delta.hash.changed: " + err.Error()
+		UserLogger.Error("Server changed a delta file which it published before", "sourceName", sourceName, "label", label, "error", err)
+		ds.saveSource(*source)
+		return nil, err
+	}
 	// Save notification even though the version might be the same, because
 	// the snapshot version might be different.
 	saved, err := ds.saveSourceWithNotification(*source, notification)
@@ -183,13 +283,77 @@ func (p NRTMProcessor) Update(sourceName, label string) (*persist.NRTMSource, er
 	saved.Status = "updating"
 	ds.saveSource(saved)
 	var updated persist.NRTMSource
-	if updated, err = syncDeltas(p, notification, saved); err != nil {
+	if updated, err = syncDeltas(ctx, p, notification, saved); err != nil {
+		reportFailure(ctx, PhaseDeltas, err)
 		updated.Status = "delta.failed: " + err.Error()
 		ds.saveSource(updated)
 		return nil, err
 	}
 	updated.Status = "ok"
-	return ds.saveSource(updated)
+	result, err := ds.saveSource(updated)
+	if err == nil {
+		p.collectSourceGarbage(*result)
+	}
+	return result, err
+}
+
+// ResyncStaged loads the latest snapshot under a staging label, then swaps it with the source
+// when it's up to date. The source can be queried until the swap, which is atomic. The old
+// source is removed afterwards.
+func (p NRTMProcessor) ResyncStaged(ctx context.Context, sourceName, label string) (*persist.NRTMSource, error) {
+	UserLogger.Info("Resync source using a staging label", "sourceName", sourceName, "label", label)
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return nil, ErrSourceNotFound
+	}
+	stgLabel := stagingLabel(source.Label)
+	staged := ds.getSourceByURLAndLabel(source.NotificationURL, stgLabel)
+	var err error
+	if staged != nil && isSnapshotUnfinished(staged.Status) {
+		err = p.ResumeConnect(ctx, source.NotificationURL, stgLabel)
+	} else {
+		if staged != nil {
+			// Left over from a resync that failed after loading the snapshot
+			if err = ds.deleteSource(ctx, *staged); err != nil {
+				return nil, err
+			}
+		}
+		err = p.Connect(ctx, source.NotificationURL, stgLabel)
+	}
+	if err != nil {
+		UserLogger.Error("Failed to load staged source. The source was not changed", "sourceName", sourceName, "label", label, "error", err)
+		return nil, err
+	}
+	staged = ds.getSourceByURLAndLabel(source.NotificationURL, stgLabel)
+	if staged == nil {
+		return nil, ErrSourceNotFound
+	}
+	promoted, err := p.repo.ReplaceSource(*source, *staged)
+	if err != nil {
+		return nil, err
+	}
+	UserLogger.Info("Staged source replaced the old one", "sourceName", sourceName, "label", label, "version", promoted.Version)
+	retired := ds.getSourceByURLAndLabel(source.NotificationURL, stgLabel)
+	if retired != nil {
+		if err = ds.deleteSource(ctx, *retired); err != nil {
+			UserLogger.Warn("Failed to remove the old source", "label", stgLabel, "error", err)
+		}
+	}
+	return &promoted, nil
+}
+
+// stagingLabelSuffix is added to a source's label while it's resynced
+const stagingLabelSuffix = ":STAGING:"
+
+func stagingLabel(label string) string {
+	return strings.TrimSpace(label + " " + stagingLabelSuffix)
+}
+
+// isStagingLabel is true for the label of a source which is being resynced, or was replaced by
+// one. Staged sources are not updated, because they're swapped or removed when the resync ends.
+func isStagingLabel(label string) bool {
+	return strings.HasSuffix(label, stagingLabelSuffix)
 }
 
 // ListSources gets details, including notifications, of all sources
@@ -224,6 +388,11 @@ func (p NRTMProcessor) SaveProperties(source, label string, props persist.Source
 	}
 	src.Properties.AutoUpdateInterval = props.AutoUpdateInterval
 	src.Properties.UpdateMode = props.UpdateMode
+	src.Properties.RequireSignature = props.RequireSignature
+	if props.Retention.KeepDeltas < 0 || props.Retention.MaxAgeDays < 0 {
+		return nil, ErrInvalidRetentionPolicy
+	}
+	src.Properties.Retention = props.Retention
 	return ds.saveSource(*src)
 }
 
@@ -247,32 +416,133 @@ func (p NRTMProcessor) ReplaceLabel(src, fromLabel, toLabel string) (*persist.NR
 }
 
 // RemoveSource removes a source from the repo
-func (p NRTMProcessor) RemoveSource(src, label string) error {
+func (p NRTMProcessor) RemoveSource(ctx context.Context, src, label string) error {
 	UserLogger.Info("Remove source", "sourceName", src, "label", label)
 	ds := NrtmDataService{Repository: p.repo}
 	target := ds.getSourceByNameAndLabel(src, label)
 	if target == nil {
 		return ErrSourceNotFound
 	}
-	return ds.deleteSource(*target)
+	return ds.deleteSource(ctx, *target)
 }
 
-func fullURL(base, relpath string) string {
+// checkDeltaRefs compares the delta refs in the notification with those in stored notifications
+// which could have listed the same delta versions
+func checkDeltaRefs(ds NrtmDataService, source persist.NRTMSource, notification persist.NotificationJSON) error {
+	if len(notification.DeltaRefs) == 0 {
+		return nil
+	}
+	from := notification.DeltaRefs[0].Version
+	for _, ref := range notification.DeltaRefs {
+		from = min(from, ref.Version)
+	}
+	previous, err := ds.getNotifications(source, uint32(from), uint32(notification.Version))
+	if err != nil {
+		return err
+	}
+	return verifyDeltaRefsUnchanged(notification, previous)
+}
+
+// fullURL resolves a file reference from a notification file. Absolute http(s) references from a
+// local copy of a server's files are resolved against the local directory, because the files
+// are copied with the notification file. File references are only allowed in a local
+// notification file, and must be in its directory.
+func fullURL(base, relpath string) (string, error) {
+	isFile := strings.HasPrefix(base, "file:")
+	if ref, err := url.Parse(relpath); err == nil && ref.IsAbs() {
+		if ref.Scheme == "file" {
+			if !isFile {
+				return "", ErrFileRefNotAllowed
+			}
+			return fileRefInDir(base, relpath)
+		}
+		if !isFile {
+			return relpath, nil
+		}
+		relpath = path.Base(ref.Path)
+	}
 	idx := strings.LastIndex(base, "/")
 	if idx < 0 {
 		logger.Error("fullURL called with a path that does not contain '/'", "base", base)
-		return ""
+		return "", ErrBadNotificationURL
 	}
 	sepIdx := 0
 	if strings.HasPrefix(relpath, "/") {
 		sepIdx = 1
 	}
-	return base[:idx+1] + relpath[sepIdx:]
+	fURL := base[:idx+1] + relpath[sepIdx:]
+	if isFile {
+		return fileRefInDir(base, fURL)
+	}
+	return fURL, nil
+}
+
+// fileRefInDir returns the file URL fURL, cleaned, if it's in the directory of the local
+// notification file at base
+func fileRefInDir(base, fURL string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", ErrBadNotificationURL
+	}
+	ref, err := url.Parse(fURL)
+	if err != nil {
+		return "", ErrFileRefNotAllowed
+	}
+	ref.Path = path.Clean(ref.Path)
+	if !inDir(path.Dir(baseURL.Path), ref.Path) {
+		return "", ErrFileRefNotAllowed
+	}
+	return ref.String(), nil
+}
+
+// inDir is true if the cleaned slash separated path p is below dir
+func inDir(dir, p string) bool {
+	return strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
 }
 
 func validateURLString(str string) bool {
 	url, err := url.Parse(str)
-	return err == nil && (url.Scheme == "http" || url.Scheme == "https")
+	return err == nil && (url.Scheme == "http" || url.Scheme == "https" || url.Scheme == "file" && len(url.Path) > 1)
+}
+
+// validateURLReference returns true if str is a URL which validateURLString accepts, or a
+// relative reference to a file, which is resolved against the notification URL
+func validateURLReference(str string) bool {
+	u, err := url.Parse(str)
+	if err != nil || len(str) == 0 {
+		return false
+	}
+	if u.IsAbs() {
+		return validateURLString(str)
+	}
+	return len(u.Path) > 0
+}
+
+// notificationFileName is the name of the notification file in an NRTMv4 directory
+const notificationFileName = "update-notification-file.jose"
+
+// notificationURLFromPath returns a file URL for a local path, so a source can be connected from
+// a directory or file on disk. A directory is expected to contain update-notification-file.jose.
+// Other URLs, and paths that don't exist, are returned unchanged.
+func notificationURLFromPath(str string) string {
+	filePath := str
+	if u, err := url.Parse(str); err == nil && u.Scheme == "file" {
+		filePath = u.Path
+	} else if err == nil && len(u.Scheme) > 0 {
+		return str
+	}
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return str
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return str
+	}
+	if info.IsDir() {
+		abs = filepath.Join(abs, notificationFileName)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
 }
 
 func validateLabel(label string) bool {
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
@@ -34,6 +35,12 @@ func TestConnectWithPgRepo(t *testing.T) {
 		invoke := processInvoker{t: t, p: processor}
 		invoke.testConnect(srcname, label)
 	}
+	{
+		stubClient := NewTestClient(t, baseURL, "version2to6", "unf_2-6_hashchanged.json")
+		processor := NewNRTMProcessor(conf, pgTestRepo, stubClient)
+		invoke := processInvoker{t: t, p: processor}
+		invoke.testUpdateHashChanged(srcname, label)
+	}
 	{
 		stubClient := NewTestClient(t, baseURL, "version2to6", "unf_2-6.json")
 		processor := NewNRTMProcessor(conf, pgTestRepo, stubClient)
@@ -64,7 +71,7 @@ type processInvoker struct {
 func (pi processInvoker) testConnect(srcname, label string) {
 	t := pi.t
 	var err error
-	if err = pi.p.Connect(baseURL+stubNotificationURL, label); err != nil {
+	if err = pi.p.Connect(context.Background(), baseURL+stubNotificationURL, label); err != nil {
 		t.Fatal("Failed to Connect", err)
 	}
 
@@ -93,7 +100,7 @@ func (pi processInvoker) testConnect(srcname, label string) {
 
 func (pi processInvoker) testUpdate(srcname, label string) {
 	t := pi.t
-	_, err := pi.p.Update(strings.ToLower(srcname), label)
+	_, err := pi.p.Update(context.Background(), strings.ToLower(srcname), label)
 	if err != nil {
 		t.Error("Error update returned an error", err)
 	}
@@ -111,6 +118,26 @@ func (pi processInvoker) testUpdate(srcname, label string) {
 	}
 }
 
+func (pi processInvoker) testUpdateHashChanged(srcname, label string) {
+	t := pi.t
+	_, err := pi.p.Update(context.Background(), srcname, label)
+	if _, ok := err.(ErrDeltaHashChanged); !ok {
+		t.Fatalf("Expected %T but was %T %v", ErrDeltaHashChanged{}, err, err)
+	}
+
+	sources, err := pi.p.ListSources()
+	if err != nil {
+		t.Error("Error list sources returned an error", err)
+	}
+	src := findSource(sources, srcname, label)
+	if src.Version != 4 {
+		t.Error("Version should still be 4")
+	}
+	if !strings.HasPrefix(src.Status, "delta.hash.changed") {
+		t.Error("Status should record the changed hash but was", src.Status)
+	}
+}
+
 func (pi processInvoker) testRename(srcname, label, to string) {
 	t := pi.t
 	_, err := pi.p.ReplaceLabel(srcname, label, to)
@@ -130,7 +157,7 @@ func (pi processInvoker) testRename(srcname, label, to string) {
 
 func (pi processInvoker) testRemove(srcname, label string) {
 	t := pi.t
-	err := pi.p.RemoveSource(srcname, label)
+	err := pi.p.RemoveSource(context.Background(), srcname, label)
 	if err != nil {
 		t.Error("Error RemoveSource returned an error", err)
 	}
@@ -176,14 +203,14 @@ func (c TestClient) NotificationFileName(fname string) {
 	c.conf.notifile = fname
 }
 
-func (c TestClient) getUpdateNotification(_ string) (persist.NotificationJSON, error) {
+func (c TestClient) getUpdateNotification(_ context.Context, _ string, _ keyFinder) (persist.NotificationJSON, string, error) {
 	var notifile persist.NotificationJSON
 	fname := filepath.Join(c.conf.testDataDir, c.conf.notifile)
 	testresources.ReadTestJSONToPtr(c.t, fname, &notifile)
-	return notifile, nil
+	return notifile, "", nil
 }
 
-func (c TestClient) getResponseBody(requrl string) (io.Reader, error) {
+func (c TestClient) getResponseBody(_ context.Context, requrl string) (io.Reader, error) {
 	if !strings.HasPrefix(requrl, c.conf.baseURL) {
 		c.t.Fatal("Request for unrecognizer URL", requrl)
 	}
@@ -191,3 +218,17 @@ func (c TestClient) getResponseBody(requrl string) (io.Reader, error) {
 	fpath := filepath.Join(c.conf.testDataDir, fname)
 	return testresources.OpenFile(c.t, fpath), nil
 }
+
+func (c TestClient) getContentLength(ctx context.Context, requrl string) (int64, error) {
+	f, err := c.getResponseBody(ctx, requrl)
+	if err != nil {
+		return -1, err
+	}
+	file := f.(*os.File)
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return -1, err
+	}
+	return info.Size(), nil
+}
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"context"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -117,6 +119,22 @@ func TestValidateNotificationErrors(t *testing.T) {
 			t.Errorf("Expected error %v but was %v", expect, err)
 		}
 	}
+	for url, valid := range map[string]bool{
+		"nrtm-snapshot.4.RIPE.json.gz":                      true,
+		"https://nrtm.example.eu/nrtm-snapshot.4.RIPE.json": true,
+		"ftp://nrtm.example.eu/nrtm-snapshot.4.RIPE.json":   false,
+		"": false,
+	} {
+		testresources.ReadTestJSONToPtr(t, "ripe-notification-file.json", &notification)
+		notification.SnapshotRef.URL = url
+
+		err := validateNotificationFile(notification)
+		if valid && err != nil {
+			t.Errorf("Snapshot url %q should be valid, but was %v", url, err)
+		} else if !valid && err == nil {
+			t.Errorf("Snapshot url %q should not be valid", url)
+		}
+	}
 }
 
 func TestFullURLFunction(t *testing.T) {
@@ -125,7 +143,7 @@ func TestFullURLFunction(t *testing.T) {
 		rel := "source/r2d1-65535.EXAMPLE.json"
 		expected := "https://nrtm.example.eu/path/to/nrtm4/source/r2d1-65535.EXAMPLE.json"
 
-		result := fullURL(base, rel)
+		result, _ := fullURL(base, rel)
 
 		if result != expected {
 			t.Error("fullURL returned wrong url expected:", expected, "but was:", result)
@@ -135,7 +153,7 @@ func TestFullURLFunction(t *testing.T) {
 		rel := "/source/r2d1-65535.EXAMPLE.json"
 		expected := "https://nrtm.example.eu/path/to/nrtm4/source/r2d1-65535.EXAMPLE.json"
 
-		result := fullURL(base, rel)
+		result, _ := fullURL(base, rel)
 
 		if result != expected {
 			t.Error("fullURL returned wrong url expected:", expected, "but was:", result)
@@ -146,12 +164,77 @@ func TestFullURLFunction(t *testing.T) {
 		rel := "/source/r2d1-65535.EXAMPLE.json"
 		expected := ""
 
-		result := fullURL(base, rel)
+		result, _ := fullURL(base, rel)
+
+		if result != expected {
+			t.Error("fullURL returned wrong url expected:", expected, "but was:", result)
+		}
+	}
+	{
+		base = "file:///var/nrtm4/RIPE/update-notification-file.jose"
+		rel := "https://nrtm.example.eu/path/to/nrtm4/RIPE/nrtm-delta.1.RIPE.json"
+		expected := "file:///var/nrtm4/RIPE/nrtm-delta.1.RIPE.json"
+
+		result, _ := fullURL(base, rel)
 
 		if result != expected {
 			t.Error("fullURL returned wrong url expected:", expected, "but was:", result)
 		}
 	}
+	{
+		base = "https://nrtm.example.eu/path/to/nrtm4/notification-file.json"
+		rel := "https://cdn.example.eu/nrtm4/nrtm-delta.1.RIPE.json"
+
+		result, _ := fullURL(base, rel)
+
+		if result != rel {
+			t.Error("fullURL returned wrong url expected:", rel, "but was:", result)
+		}
+	}
+}
+
+func TestFullURLRejectsFileRefs(t *testing.T) {
+	for _, tc := range []struct {
+		base, rel string
+	}{
+		{"https://nrtm.example.eu/nrtm4/notification-file.json", "file:///etc/shadow"},
+		{"http://nrtm.example.eu/nrtm4/notification-file.json", "file:///var/nrtm4/RIPE/nrtm-delta.1.RIPE.json"},
+		{"file:///var/nrtm4/RIPE/update-notification-file.jose", "file:///etc/shadow"},
+		{"file:///var/nrtm4/RIPE/update-notification-file.jose", "../../../etc/shadow"},
+		{"file:///var/nrtm4/RIPE/update-notification-file.jose", "file:///var/nrtm4/RIPE/../OTHER/nrtm-delta.1.OTHER.json"},
+	} {
+		if result, err := fullURL(tc.base, tc.rel); err != ErrFileRefNotAllowed {
+			t.Error("Expected ErrFileRefNotAllowed for", tc.rel, "from", tc.base, "but was", result, err)
+		}
+	}
+	result, err := fullURL("file:///var/nrtm4/RIPE/update-notification-file.jose", "file:///var/nrtm4/RIPE/deltas/nrtm-delta.1.RIPE.json")
+	if err != nil || result != "file:///var/nrtm4/RIPE/deltas/nrtm-delta.1.RIPE.json" {
+		t.Error("File reference in the notification's directory should be allowed", result, err)
+	}
+}
+
+func TestNotificationURLFromPath(t *testing.T) {
+	dir := t.TempDir()
+	unf := filepath.Join(dir, notificationFileName)
+	if err := os.WriteFile(unf, []byte("{}"), 0644); err != nil {
+		t.Fatal("Could not write notification file", err)
+	}
+	expected := "file://" + filepath.ToSlash(unf)
+	tests := []struct {
+		str      string
+		expected string
+	}{
+		{dir, expected},
+		{unf, expected},
+		{"file://" + filepath.ToSlash(dir), expected},
+		{"https://nrtm.example.eu/notification.json", "https://nrtm.example.eu/notification.json"},
+		{filepath.Join(dir, "missing"), filepath.Join(dir, "missing")},
+	}
+	for _, tt := range tests {
+		if got := notificationURLFromPath(tt.str); got != tt.expected {
+			t.Error("Expected", tt.expected, "for", tt.str, "but was", got)
+		}
+	}
 }
 
 func TestValidateURLString(t *testing.T) {
@@ -163,6 +246,8 @@ func TestValidateURLString(t *testing.T) {
 		{"https://nrtm4.example.com/nrtm4/notification.json", true},
 		{"https:///nrtm4.example.com/nrtm4/notification.json", true},
 		{"ftp://nrtm4.example.com/nrtm4/notification.json", false},
+		{"file:///var/nrtm4/RIPE/update-notification-file.jose", true},
+		{"file:///", false},
 		{"RIPE/nrtm-snapshot.374234.RIPE.db44e038-1f07-4d54-a307-1b32339f141a.7755dc0a05b5024dd092a7a68d1b7b0.json.gz", false},
 	}
 	for _, turl := range testURLs {
@@ -190,19 +275,19 @@ func TestConnectErrors(t *testing.T) {
 	// Run test
 	label := "what a load of testing"
 	{
-		if err = processor.Connect("not a url", label); err != ErrBadNotificationURL {
+		if err = processor.Connect(context.Background(), "not a url", label); err != ErrBadNotificationURL {
 			t.Error("Bad URL should fail", err)
 		}
 	}
 	{
-		if err = processor.Connect(baseURL+stubNotificationURL, "-=-"); err != ErrInvalidLabel {
+		if err = processor.Connect(context.Background(), baseURL+stubNotificationURL, "-=-"); err != ErrInvalidLabel {
 			t.Error("Bad label should fail", err)
 		}
 	}
 	{
 		str := "1234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789012345678901234567890"
 		str += str
-		if err = processor.Connect(baseURL+stubNotificationURL, str); err != ErrInvalidLabel {
+		if err = processor.Connect(context.Background(), baseURL+stubNotificationURL, str); err != ErrInvalidLabel {
 			t.Error("Bad label should fail", err)
 		}
 	}
@@ -216,7 +301,7 @@ func TestConnectErrors(t *testing.T) {
 		}
 		pgTestRepo.sources = sources
 		processor.repo = pgTestRepo
-		if err = processor.Connect(baseURL+stubNotificationURL, label); err != ErrSourceAlreadyExists {
+		if err = processor.Connect(context.Background(), baseURL+stubNotificationURL, label); err != ErrSourceAlreadyExists {
 			t.Error("Source already exist, should be rejected", err)
 		}
 	}
@@ -238,3 +323,18 @@ func stubsource() persist.NRTMSource {
 	}
 	return src
 }
+
+func TestStagingLabelIsValid(t *testing.T) {
+	for _, lbl := range []string{"", "label", "2024-01-01"} {
+		stg := stagingLabel(lbl)
+		if !validateLabel(stg) {
+			t.Error("Staging label should be valid", stg)
+		}
+		if stg == lbl {
+			t.Error("Staging label should differ from label", lbl)
+		}
+		if !isStagingLabel(stg) || isStagingLabel(lbl) {
+			t.Error("Only the staging label should be recognised", stg)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/jsonseq"
@@ -13,37 +16,175 @@ import (
 	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
 )
 
-func syncDeltas(p NRTMProcessor, notification persist.NotificationJSON, source persist.NRTMSource) (persist.NRTMSource, error) {
+func syncDeltas(ctx context.Context, p NRTMProcessor, notification persist.NotificationJSON, source persist.NRTMSource) (persist.NRTMSource, error) {
 	dlDir := filepath.Join(p.config.NRTMFilePath, source.Source, source.SessionID)
 	deltaRefs, err := findUpdates(notification, source)
 	if err != nil {
 		return source, err
 	}
 	fm := fileManager{p.client}
-	ds := NrtmDataService{Repository: p.repo}
-	for _, deltaRef := range deltaRefs {
-		UserLogger.Info("Fetching delta", "version", deltaRef.Version, "relurl", deltaRef.URL)
-		file, err := fm.fetchFileAndCheckHash(source.NotificationURL, deltaRef, dlDir)
-		if err != nil {
-			UserLogger.Error("Error fetching delta", "source", source.Source, "delta", deltaRef.Version, "relurl", deltaRef.URL, "error", err)
+	total := int64(len(deltaRefs))
+	reportProgress(ctx, ProgressEvent{Phase: PhaseDeltas, Kind: ProgressStarted, Total: total})
+	prefetch := prefetchDeltas(ctx, fm, source.NotificationURL, deltaRefs, dlDir, p.config.DeltaDownloadWorkers)
+	defer prefetch.stop()
+	for i, deltaRef := range deltaRefs {
+		if err := ctx.Err(); err != nil {
+			UserLogger.Warn("Delta sync was cancelled", "source", source.Source, "version", source.Version)
 			return source, err
 		}
-		defer file.Close()
-		if err := fm.readJSONSeqRecords(file, applyDeltaFunc(p.repo, source, deltaRef)); err != io.EOF {
-			UserLogger.Error("Failed to apply delta", "source", source.Source, "delta", deltaRef.Version, "relurl", deltaRef.URL)
+		file, err := prefetch.next(ctx, i)
+		if err != nil {
+			UserLogger.Error("Error fetching delta", "source", source.Source, "delta", deltaRef.Version, "relurl", deltaRef.URL, "error", err)
 			return source, err
 		}
-		source.Version = uint32(deltaRef.Version)
-		src, err := ds.saveSource(source)
+		source, err = applyDeltaFile(ctx, p.repo, fm, file, source, deltaRef)
+		file.Close()
 		if err != nil {
 			return source, err
 		}
-		source = *src
+		reportProgress(ctx, ProgressEvent{Phase: PhaseDeltas, Kind: ProgressUpdated, Current: int64(i + 1), Total: total, Version: deltaRef.Version})
 	}
+	reportProgress(ctx, ProgressEvent{Phase: PhaseDeltas, Kind: ProgressFinished, Current: total, Total: total, Version: int64(source.Version)})
 	UserLogger.Info("Delta sync complete", "number of deltas files applied", len(deltaRefs))
 	return source, nil
 }
 
+// defaultDeltaDownloadWorkers is the number of delta files downloaded at the same time when
+// AppConfig.DeltaDownloadWorkers isn't set
+const defaultDeltaDownloadWorkers = 4
+
+type fetchedDelta struct {
+	file *os.File
+	err  error
+}
+
+// deltaPrefetcher downloads and verifies delta files ahead of the one being applied. Files are
+// handed out in the order of the refs, however they finish downloading.
+type deltaPrefetcher struct {
+	results []chan fetchedDelta
+	// window limits how many files are fetched but not yet applied
+	window chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	// failed is the first fetch error, which cancelled the other fetches
+	failed error
+}
+
+// prefetchDeltas starts a pool of workers which fetch the files in refs. stop must be called
+// when the files are no longer needed.
+func prefetchDeltas(ctx context.Context, fm fileManager, unfURL string, refs []persist.FileRefJSON, dir string, workers int) *deltaPrefetcher {
+	if workers < 1 {
+		workers = defaultDeltaDownloadWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	pf := &deltaPrefetcher{
+		results: make([]chan fetchedDelta, len(refs)),
+		window:  make(chan struct{}, 2*workers),
+		cancel:  cancel,
+	}
+	for i := range pf.results {
+		pf.results[i] = make(chan fetchedDelta, 1)
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range refs {
+			select {
+			case pf.window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for range min(workers, len(refs)) {
+		pf.wg.Add(1)
+		go func() {
+			defer pf.wg.Done()
+			for i := range jobs {
+				file, err := fm.fetchFileAndCheckHash(ctx, unfURL, refs[i], dir)
+				if err != nil {
+					// Files after this one can't be applied without it
+					pf.fail(err)
+				}
+				pf.results[i] <- fetchedDelta{file, err}
+			}
+		}()
+	}
+	return pf
+}
+
+// fail records the first fetch error and cancels the other fetches
+func (pf *deltaPrefetcher) fail(err error) {
+	pf.mu.Lock()
+	if pf.failed == nil {
+		pf.failed = err
+	}
+	pf.mu.Unlock()
+	pf.cancel()
+}
+
+// next waits for the file of the i'th ref. Files must be taken in order. When the fetch failed
+// because another one failed first, the first error is returned.
+func (pf *deltaPrefetcher) next(ctx context.Context, i int) (*os.File, error) {
+	select {
+	case fetched := <-pf.results[i]:
+		<-pf.window
+		if fetched.err != nil {
+			pf.mu.Lock()
+			defer pf.mu.Unlock()
+			return nil, pf.failed
+		}
+		return fetched.file, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop cancels outstanding downloads, waits for the workers, and closes files which were
+// fetched but not taken
+func (pf *deltaPrefetcher) stop() {
+	pf.cancel()
+	pf.wg.Wait()
+	for _, results := range pf.results {
+		select {
+		case fetched := <-results:
+			if fetched.file != nil {
+				fetched.file.Close()
+			}
+		default:
+		}
+	}
+}
+
+// applyDeltaFile applies all changes in the file and bumps the source version in one
+// transaction. The source is returned unchanged if there's an error.
+func applyDeltaFile(ctx context.Context, repo persist.Repository, fm fileManager, file *os.File, source persist.NRTMSource, deltaRef persist.FileRefJSON) (persist.NRTMSource, error) {
+	dtx, err := repo.BeginDelta(ctx, source)
+	if err != nil {
+		return source, err
+	}
+	if err := fm.readJSONSeqRecords(file, applyDeltaFunc(dtx, source, deltaRef)); err != io.EOF {
+		UserLogger.Error("Failed to apply delta", "source", source.Source, "delta", deltaRef.Version, "relurl", deltaRef.URL)
+		if rerr := dtx.Rollback(); rerr != nil {
+			logger.Error("Failed to roll back delta", "source", source.Source, "delta", deltaRef.Version, "error", rerr)
+		}
+		return source, err
+	}
+	next := source
+	next.Version = uint32(deltaRef.Version)
+	saved, err := dtx.Commit(next)
+	if err != nil {
+		return source, err
+	}
+	return saved, nil
+}
+
 func findUpdates(notification persist.NotificationJSON, source persist.NRTMSource) ([]persist.FileRefJSON, error) {
 
 	deltaRefs := []persist.FileRefJSON{}
@@ -64,7 +205,39 @@ func findUpdates(notification persist.NotificationJSON, source persist.NRTMSourc
 	return deltaRefs, nil
 }
 
-func applyDeltaFunc(repo persist.Repository, source persist.NRTMSource, deltaRef persist.FileRefJSON) jsonseq.RecordReaderFunc {
+// verifyDeltaRefsUnchanged checks that every delta listed in the notification has the same
+// url and hash as it had in previously seen notifications for the same session. See §4.3
+func verifyDeltaRefsUnchanged(notification persist.NotificationJSON, previous []persist.Notification) error {
+	seen := make(map[int64]persist.FileRefJSON)
+	for _, n := range previous {
+		if n.Payload.SessionID != notification.SessionID {
+			continue
+		}
+		for _, ref := range n.Payload.DeltaRefs {
+			if _, ok := seen[ref.Version]; !ok {
+				seen[ref.Version] = ref
+			}
+		}
+	}
+	for _, ref := range notification.DeltaRefs {
+		prev, ok := seen[ref.Version]
+		if !ok {
+			continue
+		}
+		if prev.URL != ref.URL || prev.Hash != ref.Hash {
+			return ErrDeltaHashChanged{
+				Version:      ref.Version,
+				URL:          ref.URL,
+				Hash:         ref.Hash,
+				PreviousURL:  prev.URL,
+				PreviousHash: prev.Hash,
+			}
+		}
+	}
+	return nil
+}
+
+func applyDeltaFunc(dtx persist.DeltaTransaction, source persist.NRTMSource, deltaRef persist.FileRefJSON) jsonseq.RecordReaderFunc {
 	var header *persist.DeltaFileJSON
 	return func(bytes []byte, err error) error {
 		if err != nil && err != io.EOF { // eof also gives us a record
@@ -92,13 +265,22 @@ func applyDeltaFunc(repo persist.Repository, source persist.NRTMSource, deltaRef
 				UserLogger.Error("Cannot parse RPSL for AddModify action", "object", *delta.Object, "error", err)
 				return err
 			}
-			err = repo.AddModifyObject(source, rpsl, header.NrtmFileJSON)
-			if err != nil {
-				UserLogger.Error("Delta AddModifyObject failed", "rpsl", rpsl, "relurl", deltaRef.URL, "error", err)
-				return err
+			invalid, save := checkObject(source.Properties.Validation, rpsl, nil, header.Version)
+			if save {
+				err = dtx.AddModifyObject(rpsl, header.NrtmFileJSON)
+				if err != nil {
+					UserLogger.Error("Delta AddModifyObject failed", "rpsl", rpsl, "relurl", deltaRef.URL, "error", err)
+					return err
+				}
+			} else {
+				// The revision before a rejected object stays in the repo
+				UserLogger.Warn("Invalid object rejected", "type", rpsl.ObjectType, "primaryKey", rpsl.PrimaryKey, "relurl", deltaRef.URL)
+			}
+			if invalid != nil {
+				return dtx.SaveInvalidObject(*invalid)
 			}
 		case delta.Action == persist.DeltaDeleteAction:
-			err = repo.DeleteObject(source, *delta.ObjectClass, *delta.PrimaryKey, header.NrtmFileJSON)
+			err = dtx.DeleteObject(*delta.ObjectClass, *delta.PrimaryKey, header.NrtmFileJSON)
 			if err != nil {
 				if err == pgx.ErrNoRows {
 					const txt = "Delta delete_object failed because object is not in the repository"
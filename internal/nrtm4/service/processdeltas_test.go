@@ -1,13 +1,22 @@
 package service
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/testresources"
 )
 
@@ -67,30 +76,368 @@ func TestApplyDeltas(t *testing.T) {
 	srcs, _ := repo.ListSources()
 	for _, src := range srcs {
 		if src.Source == source.Source && src.Label == source.Label {
-			repo.RemoveSource(src)
+			repo.RemoveSource(context.Background(), src)
 		}
 	}
 	if source, err = repo.SaveSource(source, &notification); err != nil {
 		t.Fatal("Failed to save source")
 	}
 
-	_, err = syncDeltas(p, notification, source)
+	_, err = syncDeltas(context.Background(), p, notification, source)
 
 	if err != nil {
 		t.Error("Failed to apply deltas", err)
 	}
 }
 
+func TestVerifyDeltaRefsUnchanged(t *testing.T) {
+	sessionID := "db44e038-1f07-4d54-a307-1b32339f141a"
+	notification := func(sessionID string, refs ...persist.FileRefJSON) persist.NotificationJSON {
+		return persist.NotificationJSON{
+			NrtmFileJSON: persist.NrtmFileJSON{SessionID: sessionID},
+			DeltaRefs:    refs,
+		}
+	}
+	ref3 := persist.FileRefJSON{Version: 3, URL: "n3.json", Hash: "abc3"}
+	ref4 := persist.FileRefJSON{Version: 4, URL: "n4.json", Hash: "abc4"}
+	ref5 := persist.FileRefJSON{Version: 5, URL: "n5.json", Hash: "abc5"}
+	previous := []persist.Notification{
+		{Version: 4, Payload: notification(sessionID, ref3, ref4)},
+	}
+	{
+		err := verifyDeltaRefsUnchanged(notification(sessionID, ref3, ref4, ref5), previous)
+		if err != nil {
+			t.Error("Unexpected error", err)
+		}
+	}
+	{
+		changed := ref4
+		changed.Hash = "def4"
+		err := verifyDeltaRefsUnchanged(notification(sessionID, ref3, changed, ref5), previous)
+		hashErr, ok := err.(ErrDeltaHashChanged)
+		if !ok {
+			t.Fatalf("Expected %T but was %T", ErrDeltaHashChanged{}, err)
+		}
+		if hashErr.Version != 4 || hashErr.PreviousHash != "abc4" || hashErr.Hash != "def4" {
+			t.Error("Error has unexpected values", hashErr)
+		}
+	}
+	{
+		changed := ref3
+		changed.URL = "n3-again.json"
+		err := verifyDeltaRefsUnchanged(notification(sessionID, changed, ref4, ref5), previous)
+		if _, ok := err.(ErrDeltaHashChanged); !ok {
+			t.Errorf("Expected %T but was %T", ErrDeltaHashChanged{}, err)
+		}
+	}
+	{
+		changed := ref4
+		changed.Hash = "def4"
+		err := verifyDeltaRefsUnchanged(notification("another-session", ref3, changed, ref5), previous)
+		if err != nil {
+			t.Error("Notifications from another session should be ignored", err)
+		}
+	}
+}
+
+func TestApplyDeltaFileIsAtomic(t *testing.T) {
+	sessionID := "17db6715-18ae-410f-973e-47981b52f023"
+	header := `{"nrtm_version":4,"type":"delta","source":"TEST","session_id":"` + sessionID + `","version":5}`
+	addModify := `{"action":"add_modify","object":"mntner: TEST-MNT\nsource: TEST"}`
+	source := persist.NRTMSource{
+		ID:        1001,
+		Source:    "TEST",
+		SessionID: sessionID,
+		Version:   4,
+	}
+	ref := persist.FileRefJSON{Version: 5, URL: "delta.005.TEST.jsonseq"}
+	tmpDir, err := os.MkdirTemp("", "nrtm4*")
+	if err != nil {
+		t.Fatal("Could not create temp dir")
+	}
+	defer os.RemoveAll(tmpDir)
+	writeDelta := func(records ...string) *os.File {
+		path := filepath.Join(tmpDir, "delta.jsonseq")
+		content := "\x1e" + strings.Join(records, "\n\x1e") + "\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal("Could not write delta file", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal("Could not open delta file", err)
+		}
+		return f
+	}
+	{
+		dtx := &recordingDeltaTx{}
+		repo := deltaTxRepo{dtx: dtx}
+		file := writeDelta(header, addModify, `{"action":"destroy"}`, addModify)
+		defer file.Close()
+
+		result, err := applyDeltaFile(context.Background(), repo, fileManager{}, file, source, ref)
+
+		if err == nil {
+			t.Fatal("Expected an error")
+		}
+		if dtx.committed || !dtx.rolledBack {
+			t.Error("Delta should have been rolled back")
+		}
+		if result.Version != 4 {
+			t.Error("Source version should not change, but was", result.Version)
+		}
+	}
+	{
+		dtx := &recordingDeltaTx{}
+		repo := deltaTxRepo{dtx: dtx}
+		file := writeDelta(header, addModify, addModify)
+		defer file.Close()
+
+		result, err := applyDeltaFile(context.Background(), repo, fileManager{}, file, source, ref)
+
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if !dtx.committed || dtx.rolledBack {
+			t.Error("Delta should have been committed")
+		}
+		if dtx.changes != 2 {
+			t.Error("Expected 2 changes but was", dtx.changes)
+		}
+		if result.Version != 5 {
+			t.Error("Source version should be 5, but was", result.Version)
+		}
+	}
+}
+
+func TestSyncDeltasStopsWhenCancelled(t *testing.T) {
+	dtx := &recordingDeltaTx{}
+	p := NRTMProcessor{
+		config: AppConfig{NRTMFilePath: t.TempDir()},
+		repo:   deltaTxRepo{dtx: dtx},
+		client: stubDeltaClient{},
+	}
+	source := persist.NRTMSource{Source: "TEST", SessionID: "sess", Version: 4, NotificationURL: baseURL + stubNotificationURL}
+	notification := persist.NotificationJSON{
+		DeltaRefs: []persist.FileRefJSON{{Version: 5, URL: "nrtm-delta.5.json"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := syncDeltas(ctx, p, notification, source)
+
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled but was", err)
+	}
+	if result.Version != 4 {
+		t.Error("Source version should not change, but was", result.Version)
+	}
+	if dtx.committed {
+		t.Error("No delta should be applied")
+	}
+}
+
+// deltaServer serves delta files for versions 5 to 5+n-1 after calling handle, which can
+// delay or fail the request
+func deltaServer(t *testing.T, n int, handle func(version int64, w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, []persist.FileRefJSON) {
+	sessionID := "17db6715-18ae-410f-973e-47981b52f023"
+	contents := map[string]string{}
+	refs := []persist.FileRefJSON{}
+	for v := int64(5); v < int64(5+n); v++ {
+		header := fmt.Sprintf(`{"nrtm_version":4,"type":"delta","source":"TEST","session_id":"%v","version":%d}`, sessionID, v)
+		content := "\x1e" + header + "\n\x1e" + `{"action":"add_modify","object":"mntner: TEST-MNT\nsource: TEST"}` + "\n"
+		name := fmt.Sprintf("nrtm-delta.%d.TEST.json", v)
+		contents["/"+name] = content
+		sum := sha256.Sum256([]byte(content))
+		refs = append(refs, persist.FileRefJSON{Version: v, URL: name, Hash: hex.EncodeToString(sum[:])})
+	}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var version int64
+		fmt.Sscanf(r.URL.Path, "/nrtm-delta.%d.TEST.json", &version)
+		if handle(version, w, r) {
+			fmt.Fprint(w, contents[r.URL.Path])
+		}
+	}))
+	t.Cleanup(svr.Close)
+	return svr, refs
+}
+
+func TestSyncDeltasPrefetchesInParallelAndAppliesInOrder(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	svr, refs := deltaServer(t, 8, func(version int64, w http.ResponseWriter, r *http.Request) bool {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// Earlier deltas take longer, so later ones finish first
+		time.Sleep(time.Duration(13-version) * 5 * time.Millisecond)
+		return true
+	})
+	dtx := &recordingDeltaTx{}
+	p := NRTMProcessor{
+		config: AppConfig{NRTMFilePath: t.TempDir(), DeltaDownloadWorkers: 3},
+		repo:   deltaTxRepo{dtx: dtx},
+		client: NewHTTPClient(testHTTPClientConfig(), nil),
+	}
+	source := persist.NRTMSource{Source: "TEST", SessionID: "17db6715-18ae-410f-973e-47981b52f023", Version: 4, NotificationURL: svr.URL + "/update-notification-file.jose"}
+	notification := persist.NotificationJSON{DeltaRefs: refs}
+
+	result, err := syncDeltas(context.Background(), p, notification, source)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if result.Version != 12 {
+		t.Error("Expected version 12 but was", result.Version)
+	}
+	expected := []uint32{5, 6, 7, 8, 9, 10, 11, 12}
+	if fmt.Sprint(dtx.versions) != fmt.Sprint(expected) {
+		t.Error("Deltas should be applied in order, but were", dtx.versions)
+	}
+	if m := maxInFlight.Load(); m < 2 || m > 3 {
+		t.Error("Expected 2 or 3 parallel downloads but was", m)
+	}
+}
+
+func TestSyncDeltasCancelsFetchesOnError(t *testing.T) {
+	cancelled := make(chan int64, 8)
+	svr, refs := deltaServer(t, 4, func(version int64, w http.ResponseWriter, r *http.Request) bool {
+		switch version {
+		case 5:
+			return true
+		case 6:
+			time.Sleep(20 * time.Millisecond)
+			http.Error(w, "gone", http.StatusNotFound)
+			return false
+		}
+		<-r.Context().Done()
+		cancelled <- version
+		return false
+	})
+	dtx := &recordingDeltaTx{}
+	p := NRTMProcessor{
+		config: AppConfig{NRTMFilePath: t.TempDir(), DeltaDownloadWorkers: 4},
+		repo:   deltaTxRepo{dtx: dtx},
+		client: NewHTTPClient(testHTTPClientConfig(), nil),
+	}
+	source := persist.NRTMSource{Source: "TEST", SessionID: "17db6715-18ae-410f-973e-47981b52f023", Version: 4, NotificationURL: svr.URL + "/update-notification-file.jose"}
+	notification := persist.NotificationJSON{DeltaRefs: refs}
+
+	result, err := syncDeltas(context.Background(), p, notification, source)
+
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if result.Version != 5 {
+		t.Error("Expected version 5 but was", result.Version)
+	}
+	for range 2 {
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Outstanding downloads should be cancelled")
+		}
+	}
+}
+
+func TestPrefetchDeltasCancelsLaterFetchesOnError(t *testing.T) {
+	cancelled := make(chan int64, 8)
+	svr, refs := deltaServer(t, 4, func(version int64, w http.ResponseWriter, r *http.Request) bool {
+		if version == 5 {
+			time.Sleep(20 * time.Millisecond)
+			http.Error(w, "gone", http.StatusNotFound)
+			return false
+		}
+		<-r.Context().Done()
+		select {
+		case cancelled <- version:
+		default:
+		}
+		return false
+	})
+	config := testHTTPClientConfig()
+	config.ReadTimeout = time.Minute
+	fm := fileManager{NewHTTPClient(config, nil)}
+	pf := prefetchDeltas(context.Background(), fm, svr.URL+"/update-notification-file.jose", refs, t.TempDir(), 3)
+	defer pf.stop()
+
+	// Nothing is taken from the prefetcher and requests don't time out, so only the failed
+	// fetch can cancel the others
+	for range 2 {
+		select {
+		case <-cancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Later fetches should be cancelled when a fetch fails")
+		}
+	}
+	if _, err := pf.next(context.Background(), 0); err == nil {
+		t.Error("The failed fetch should return its error")
+	}
+	if _, err := pf.next(context.Background(), 1); err == nil || err == context.Canceled {
+		t.Error("A cancelled fetch should return the error which cancelled it, but was", err)
+	}
+}
+
+type deltaTxRepo struct {
+	persist.Repository
+	dtx *recordingDeltaTx
+}
+
+func (r deltaTxRepo) BeginDelta(context.Context, persist.NRTMSource) (persist.DeltaTransaction, error) {
+	return r.dtx, nil
+}
+
+type recordingDeltaTx struct {
+	changes    int
+	committed  bool
+	rolledBack bool
+	versions   []uint32
+	invalid    []persist.InvalidObject
+}
+
+func (dtx *recordingDeltaTx) AddModifyObject(rpsl.Rpsl, persist.NrtmFileJSON) error {
+	dtx.changes++
+	return nil
+}
+
+func (dtx *recordingDeltaTx) DeleteObject(string, string, persist.NrtmFileJSON) error {
+	dtx.changes++
+	return nil
+}
+
+func (dtx *recordingDeltaTx) SaveInvalidObject(obj persist.InvalidObject) error {
+	dtx.invalid = append(dtx.invalid, obj)
+	return nil
+}
+
+func (dtx *recordingDeltaTx) Commit(source persist.NRTMSource) (persist.NRTMSource, error) {
+	dtx.committed = true
+	dtx.versions = append(dtx.versions, source.Version)
+	return source, nil
+}
+
+func (dtx *recordingDeltaTx) Rollback() error {
+	dtx.rolledBack = true
+	return nil
+}
+
 type stubDeltaClient struct {
 	notification persist.NotificationJSON
 	responseBody string
 }
 
-func (c stubDeltaClient) getUpdateNotification(string) (persist.NotificationJSON, error) {
-	return c.notification, nil
+func (c stubDeltaClient) getUpdateNotification(context.Context, string, keyFinder) (persist.NotificationJSON, string, error) {
+	return c.notification, "", nil
 }
 
-func (c stubDeltaClient) getResponseBody(string) (io.Reader, error) {
+func (c stubDeltaClient) getResponseBody(context.Context, string) (io.Reader, error) {
 	rdr := strings.NewReader(c.responseBody)
 	return rdr, nil
 }
+
+func (c stubDeltaClient) getContentLength(context.Context, string) (int64, error) {
+	return int64(len(c.responseBody)), nil
+}
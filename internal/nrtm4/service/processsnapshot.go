@@ -1,16 +1,15 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/jsonseq"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
-	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
 )
 
 type rpslObjectParser struct{}
@@ -40,17 +39,24 @@ func (pool *rpslParserPool) Close() {
 	close(pool.Parsers)
 }
 
-func (p *rpslObjectParser) bytesToRPSL(bytes []byte) *rpsl.Rpsl {
+// bytesToRPSL returns nil if the record can't be unmarshalled. An object which can't be parsed
+// is returned with the parse error.
+func (p *rpslObjectParser) bytesToRPSL(bytes []byte) (*rpsl.Rpsl, error) {
 	so := new(persist.SnapshotObjectJSON)
 	if err := json.Unmarshal(bytes, so); err != nil {
 		logger.Warn("Failed to unmarshal RPSL string from", "so.Object", so.Object, "error", err)
-		return nil
+		return nil, err
 	}
 	rpsl, err := rpsl.ParseFromJSONString(so.Object)
 	if err != nil {
 		logger.Warn("Failed to parse rpsl.Rpsl from", "so.Object", so.Object, "error", err)
 	}
-	return &rpsl
+	return &rpsl, err
+}
+
+type parsedObject struct {
+	rpsl *rpsl.Rpsl
+	err  error
 }
 
 // CounterMsg is a message that can be sent to a counter
@@ -67,17 +73,28 @@ const (
 	REPORT
 )
 
-func snapshotObjectInsertFunc(repo persist.Repository, source persist.NRTMSource, notification persist.NotificationJSON) jsonseq.RecordReaderFunc {
+// snapshotObjectInsertFunc saves snapshot objects in batches, in the order they appear in the
+// file. Each batch is saved with a checkpoint so that an interrupted load can be resumed. Records
+// which were committed before the checkpoint are skipped.
+func snapshotObjectInsertFunc(
+	ctx context.Context,
+	repo persist.Repository,
+	source persist.NRTMSource,
+	notification persist.NotificationJSON,
+	checkpoint persist.SnapshotCheckpoint,
+) jsonseq.RecordReaderFunc {
 
 	var snapshotHeader *persist.SnapshotFileJSON
-	var wgParsers sync.WaitGroup
 	var wgCounter sync.WaitGroup
+	var stopOnce sync.Once
 
-	objectList := util.NewLockingList[rpsl.Rpsl](rpslInsertBatchSize * 2)
+	batch := make([][]byte, 0, rpslInsertBatchSize)
 	counterMsgChan := make(chan CounterMsg, 1000)
 	successCount := 0
 	failureCount := 0
 	expectHeader := true
+	recordOffset := int64(0)
+	objectCount := checkpoint.ObjectCount
 
 	ticker := time.NewTicker(1 * time.Minute)
 	wgCounter.Add(1)
@@ -102,74 +119,130 @@ func snapshotObjectInsertFunc(repo persist.Repository, source persist.NRTMSource
 			}
 		}
 	}()
+	stopCounter := func() {
+		stopOnce.Do(func() {
+			counterMsgChan <- STOP
+			wgCounter.Wait()
+		})
+	}
 
 	parserPool := newParserPool(4)
-	incrementCounters := func(res *rpsl.Rpsl) {
-		if obj := res; obj != nil {
-			objectList.Add(*obj)
-			counterMsgChan <- SUCCESS
-		} else {
-			counterMsgChan <- FAILURE
+	saveBatch := func() error {
+		results := make([]parsedObject, len(batch))
+		var wgParsers sync.WaitGroup
+		for i, bytes := range batch {
+			parser := parserPool.Acquire()
+			wgParsers.Add(1)
+			go func() {
+				defer wgParsers.Done()
+				defer parserPool.Release(parser)
+				obj, err := parser.bytesToRPSL(bytes)
+				results[i] = parsedObject{obj, err}
+			}()
 		}
-		rpslObjects := objectList.GetBatch(rpslInsertBatchSize)
-		if len(rpslObjects) > 0 {
-			err := repo.SaveSnapshotObjects(source, rpslObjects, snapshotHeader.NrtmFileJSON)
-			if err != nil {
-				log.Fatalln("Error saving snapshot object", err)
+		wgParsers.Wait()
+		rpslObjects := make([]rpsl.Rpsl, 0, len(results))
+		invalidObjects := []persist.InvalidObject{}
+		for _, res := range results {
+			if res.rpsl == nil {
+				counterMsgChan <- FAILURE
+				continue
+			}
+			invalid, save := checkObject(source.Properties.Validation, *res.rpsl, res.err, snapshotHeader.Version)
+			if invalid != nil {
+				invalidObjects = append(invalidObjects, *invalid)
 			}
+			if save {
+				rpslObjects = append(rpslObjects, *res.rpsl)
+				counterMsgChan <- SUCCESS
+			} else {
+				counterMsgChan <- FAILURE
+			}
+		}
+		cp := persist.SnapshotCheckpoint{
+			SourceID:     source.ID,
+			Version:      uint32(snapshotHeader.Version),
+			RecordOffset: recordOffset,
+			ObjectCount:  objectCount + int64(len(rpslObjects)),
+		}
+		if err := repo.SaveSnapshotObjects(ctx, source, rpslObjects, invalidObjects, snapshotHeader.NrtmFileJSON, cp); err != nil {
+			logger.Error("Error saving snapshot objects", "recordOffset", recordOffset, "error", err)
+			return err
+		}
+		objectCount = cp.ObjectCount
+		batch = batch[:0]
+		reportProgress(ctx, ProgressEvent{Phase: PhaseSnapshot, Kind: ProgressUpdated, Current: objectCount, Total: -1, Version: snapshotHeader.Version})
+		return nil
+	}
+	finish := func() error {
+		if err := saveBatch(); err != nil {
+			stopCounter()
+			return err
+		}
+		stopCounter()
+		logger.Info("Closed snapshot file", "numFailures", failureCount, "numSuccess", successCount, "numObjects", objectCount)
+		source.Version = uint32(snapshotHeader.Version)
+		if _, err := repo.SaveSource(source, &notification); err != nil {
+			return err
 		}
+		if err := repo.RemoveSnapshotCheckpoint(source); err != nil {
+			return err
+		}
+		reportProgress(ctx, ProgressEvent{Phase: PhaseSnapshot, Kind: ProgressFinished, Current: objectCount, Total: objectCount, Version: snapshotHeader.Version})
+		return nil
 	}
 
 	return func(bytes []byte, err error) error {
-		if err == io.EOF {
-			// Expected error reading to end of snapshot objects
-			parser := parserPool.Acquire()
-			incrementCounters(parser.bytesToRPSL(bytes))
-			parserPool.Release(parser)
-			wgParsers.Wait()
-			parserPool.Close()
-			counterMsgChan <- STOP
-			close(counterMsgChan)
-			wgCounter.Wait()
-			logger.Info("Closed snapshot file", "numFailures", failureCount, "numSuccess", successCount)
-			rpslObjects := objectList.GetAll()
-			err = repo.SaveSnapshotObjects(source, rpslObjects, snapshotHeader.NrtmFileJSON)
-			if err != nil {
-				return err
-			}
-			source.Version = uint32(snapshotHeader.Version)
-			_, err = repo.SaveSource(source, &notification)
-			return err
-		} else if err != nil {
+		if err != nil && err != io.EOF {
 			logger.Warn("Error reading jsonseq records.", "error", err)
+			stopCounter()
 			return err
-		} else if expectHeader {
+		}
+		if expectHeader {
 			// First record is the Snapshot header
 			expectHeader = false
 			sf := new(persist.SnapshotFileJSON)
-			if err = json.Unmarshal(bytes, sf); err != nil {
-				counterMsgChan <- FAILURE
-				counterMsgChan <- STOP
-				close(counterMsgChan)
-				logger.Warn("Error unmarshalling JSON. Expected SnapshotFile header", "error", err)
-				return err
+			if jerr := json.Unmarshal(bytes, sf); jerr != nil {
+				stopCounter()
+				logger.Warn("Error unmarshalling JSON. Expected SnapshotFile header", "error", jerr)
+				return jerr
 			}
 			if sf.Version != notification.SnapshotRef.Version {
+				stopCounter()
+				return ErrNRTM4FileVersionMismatch
+			}
+			if checkpoint.Version != 0 && int64(checkpoint.Version) != sf.Version {
+				stopCounter()
+				logger.Warn("Checkpoint is for a different snapshot version", "checkpoint", checkpoint.Version, "snapshot", sf.Version)
 				return ErrNRTM4FileVersionMismatch
 			}
+			if checkpoint.RecordOffset > 0 {
+				UserLogger.Info("Resuming snapshot", "skipping records", checkpoint.RecordOffset, "objects", checkpoint.ObjectCount)
+			}
 			snapshotHeader = sf
-			counterMsgChan <- SUCCESS
-			return nil
-		} else {
-			// Subsequent records are objects
-			parser := parserPool.Acquire()
-			wgParsers.Add(1)
-			go func() {
-				defer wgParsers.Done()
-				defer parserPool.Release(parser)
-				incrementCounters(parser.bytesToRPSL(bytes))
-			}()
+			reportProgress(ctx, ProgressEvent{Phase: PhaseSnapshot, Kind: ProgressStarted, Current: objectCount, Total: -1, Version: sf.Version})
+			if err == io.EOF {
+				return finish()
+			}
 			return nil
 		}
+		// Subsequent records are objects
+		if len(bytes) > 0 {
+			recordOffset++
+			if recordOffset > checkpoint.RecordOffset {
+				batch = append(batch, bytes)
+			}
+		}
+		if err == io.EOF {
+			// Expected error reading to end of snapshot objects
+			return finish()
+		}
+		if len(batch) >= rpslInsertBatchSize {
+			if serr := saveBatch(); serr != nil {
+				stopCounter()
+				return serr
+			}
+		}
+		return nil
 	}
 }
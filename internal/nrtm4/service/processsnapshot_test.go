@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/testresources"
+)
+
+func TestSnapshotInsertSavesCheckpoint(t *testing.T) {
+	repo := &checkpointRepo{}
+	source := persist.NRTMSource{ID: 1, Source: "RIPE", SessionID: "17db6715-18ae-410f-973e-47981b52f023"}
+
+	err := readSnapshotSample(t, repo, source, persist.SnapshotCheckpoint{})
+
+	if err != io.EOF {
+		t.Fatal("Expected EOF but was", err)
+	}
+	if repo.objects != 9 {
+		t.Error("Expected 9 objects to be saved, but was", repo.objects)
+	}
+	if repo.lastCheckpoint.RecordOffset != 9 || repo.lastCheckpoint.ObjectCount != 9 {
+		t.Error("Unexpected checkpoint", repo.lastCheckpoint)
+	}
+	if repo.lastCheckpoint.Version != 2 {
+		t.Error("Checkpoint should have snapshot version 2, but was", repo.lastCheckpoint.Version)
+	}
+	if !repo.checkpointRemoved {
+		t.Error("Checkpoint should be removed when the snapshot is loaded")
+	}
+	if repo.savedSource.Version != 2 {
+		t.Error("Source version should be 2, but was", repo.savedSource.Version)
+	}
+}
+
+func TestSnapshotInsertResumesFromCheckpoint(t *testing.T) {
+	repo := &checkpointRepo{}
+	source := persist.NRTMSource{ID: 1, Source: "RIPE", SessionID: "17db6715-18ae-410f-973e-47981b52f023"}
+	checkpoint := persist.SnapshotCheckpoint{SourceID: 1, Version: 2, RecordOffset: 5, ObjectCount: 5}
+
+	err := readSnapshotSample(t, repo, source, checkpoint)
+
+	if err != io.EOF {
+		t.Fatal("Expected EOF but was", err)
+	}
+	if repo.objects != 4 {
+		t.Error("Expected 4 objects to be saved, but was", repo.objects)
+	}
+	if repo.lastCheckpoint.RecordOffset != 9 || repo.lastCheckpoint.ObjectCount != 9 {
+		t.Error("Unexpected checkpoint", repo.lastCheckpoint)
+	}
+}
+
+func TestSnapshotInsertRejectsCheckpointForOtherVersion(t *testing.T) {
+	repo := &checkpointRepo{}
+	source := persist.NRTMSource{ID: 1, Source: "RIPE", SessionID: "17db6715-18ae-410f-973e-47981b52f023"}
+	checkpoint := persist.SnapshotCheckpoint{SourceID: 1, Version: 1, RecordOffset: 5, ObjectCount: 5}
+
+	err := readSnapshotSample(t, repo, source, checkpoint)
+
+	if err != ErrNRTM4FileVersionMismatch {
+		t.Error("Expected version mismatch but was", err)
+	}
+	if repo.objects != 0 {
+		t.Error("No objects should be saved, but was", repo.objects)
+	}
+}
+
+func readSnapshotSample(t *testing.T, repo persist.Repository, source persist.NRTMSource, checkpoint persist.SnapshotCheckpoint) error {
+	snapshotFile := testresources.OpenFile(t, "snapshot-sample.jsonseq")
+	defer snapshotFile.Close()
+	notification := persist.NotificationJSON{
+		NrtmFileJSON: persist.NrtmFileJSON{Source: "RIPE", SessionID: source.SessionID, Version: 2},
+		SnapshotRef:  persist.FileRefJSON{Version: 2},
+	}
+	fm := fileManager{}
+	return fm.readJSONSeqRecords(snapshotFile, snapshotObjectInsertFunc(context.Background(), repo, source, notification, checkpoint))
+}
+
+type checkpointRepo struct {
+	persist.Repository
+	objects           int
+	invalid           []persist.InvalidObject
+	lastCheckpoint    persist.SnapshotCheckpoint
+	checkpointRemoved bool
+	savedSource       persist.NRTMSource
+}
+
+func (r *checkpointRepo) SaveSnapshotObjects(ctx context.Context, source persist.NRTMSource, objects []rpsl.Rpsl, invalid []persist.InvalidObject, file persist.NrtmFileJSON, checkpoint persist.SnapshotCheckpoint) error {
+	r.objects += len(objects)
+	r.invalid = append(r.invalid, invalid...)
+	r.lastCheckpoint = checkpoint
+	return nil
+}
+
+func (r *checkpointRepo) SaveSource(source persist.NRTMSource, notification *persist.NotificationJSON) (persist.NRTMSource, error) {
+	r.savedSource = source
+	return source, nil
+}
+
+func (r *checkpointRepo) RemoveSnapshotCheckpoint(source persist.NRTMSource) error {
+	r.checkpointRemoved = true
+	return nil
+}
+
+func TestSnapshotInsertReportsProgress(t *testing.T) {
+	events := []ProgressEvent{}
+	defer func(h func(ProgressEvent)) { ProgressHandler = h }(ProgressHandler)
+	ProgressHandler = func(ev ProgressEvent) {
+		events = append(events, ev)
+	}
+	repo := &checkpointRepo{}
+	source := persist.NRTMSource{ID: 1, Source: "RIPE", SessionID: "17db6715-18ae-410f-973e-47981b52f023"}
+
+	if err := readSnapshotSample(t, repo, source, persist.SnapshotCheckpoint{}); err != io.EOF {
+		t.Fatal("Expected EOF but was", err)
+	}
+
+	if len(events) < 2 {
+		t.Fatal("Expected at least 2 events but was", len(events))
+	}
+	first, last := events[0], events[len(events)-1]
+	if first.Phase != PhaseSnapshot || first.Kind != ProgressStarted {
+		t.Error("First event should be snapshot started", first)
+	}
+	if last.Kind != ProgressFinished || last.Current != 9 || last.Version != 2 {
+		t.Error("Last event should be snapshot finished with 9 objects", last)
+	}
+}
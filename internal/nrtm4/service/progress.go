@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// ProgressPhase is a stage of Connect or Update
+type ProgressPhase string
+
+const (
+	// PhaseDownload a snapshot or delta file is downloaded
+	PhaseDownload ProgressPhase = "download"
+	// PhaseSnapshot snapshot objects are inserted into the repo
+	PhaseSnapshot ProgressPhase = "snapshot"
+	// PhaseDeltas delta files are applied to the repo
+	PhaseDeltas ProgressPhase = "deltas"
+)
+
+// ProgressKind says what happened in a phase
+type ProgressKind string
+
+const (
+	// ProgressStarted the phase started
+	ProgressStarted ProgressKind = "started"
+	// ProgressUpdated Current has increased
+	ProgressUpdated ProgressKind = "progress"
+	// ProgressFinished the phase finished without error
+	ProgressFinished ProgressKind = "finished"
+	// ProgressFailed the phase stopped with an error
+	ProgressFailed ProgressKind = "error"
+)
+
+// ProgressEvent reports progress of a long-running operation.
+//
+// Current and Total are bytes for PhaseDownload, objects for PhaseSnapshot and delta files for
+// PhaseDeltas. Total is -1 when it isn't known.
+type ProgressEvent struct {
+	Source  string
+	Label   string
+	Phase   ProgressPhase
+	Kind    ProgressKind
+	Current int64
+	Total   int64
+	Version int64  `json:",omitempty"`
+	URL     string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	Time    time.Time
+}
+
+// ProgressHandler receives progress events. Does nothing by default. Can be overridden.
+var ProgressHandler = func(ProgressEvent) {}
+
+// progressInterval is the minimum time between ProgressUpdated events for a download
+const progressInterval = 250 * time.Millisecond
+
+type progressSourceKey struct{}
+
+// withProgressSource returns a context which adds the source's name and label to progress events
+func withProgressSource(ctx context.Context, source persist.NRTMSource) context.Context {
+	return context.WithValue(ctx, progressSourceKey{}, source)
+}
+
+func reportProgress(ctx context.Context, ev ProgressEvent) {
+	if source, ok := ctx.Value(progressSourceKey{}).(persist.NRTMSource); ok {
+		ev.Source = source.Source
+		ev.Label = source.Label
+	}
+	ev.Time = util.AppClock.Now()
+	ProgressHandler(ev)
+}
+
+func reportFailure(ctx context.Context, phase ProgressPhase, err error) {
+	reportProgress(ctx, ProgressEvent{Phase: phase, Kind: ProgressFailed, Total: -1, Error: err.Error()})
+}
+
+// progressReader reports bytes read from a download
+type progressReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	url      string
+	total    int64
+	current  int64
+	reported time.Time
+}
+
+// newProgressReader reports progress of reading from reader. offset is the number of bytes
+// which were downloaded before, when a download is resumed.
+func newProgressReader(ctx context.Context, reader io.Reader, url string, offset int64) *progressReader {
+	total := int64(-1)
+	if cl, ok := reader.(interface{ ContentLength() int64 }); ok && cl.ContentLength() >= 0 {
+		total = offset + cl.ContentLength()
+	}
+	pr := &progressReader{ctx: ctx, reader: reader, url: url, total: total, current: offset, reported: time.Now()}
+	reportProgress(ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressStarted, Current: offset, Total: total, URL: url})
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	pr.current += int64(n)
+	if time.Since(pr.reported) >= progressInterval {
+		pr.reported = time.Now()
+		reportProgress(pr.ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressUpdated, Current: pr.current, Total: pr.total, URL: pr.url})
+	}
+	return n, err
+}
+
+func (pr *progressReader) finish(err error) {
+	if err != nil {
+		reportProgress(pr.ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressFailed, Current: pr.current, Total: pr.total, URL: pr.url, Error: err.Error()})
+		return
+	}
+	reportProgress(pr.ctx, ProgressEvent{Phase: PhaseDownload, Kind: ProgressFinished, Current: pr.current, Total: pr.total, URL: pr.url})
+}
@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// GarbageReport lists what was removed from NRTM4_FILE_PATH
+type GarbageReport struct {
+	// Removed are the files and session directories which were removed
+	Removed []string
+	// BytesFreed is the total size of the removed files
+	BytesFreed int64
+	// DryRun is true when nothing was removed
+	DryRun bool
+	// Orphans are session directories of removed sources which were kept because their removal
+	// was not requested
+	Orphans []string
+}
+
+var (
+	sessionDirRegex = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+	sourceDirRegex  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+)
+
+func (r *GarbageReport) add(path string, size int64) {
+	r.Removed = append(r.Removed, path)
+	r.BytesFreed += size
+}
+
+// SetRetentionPolicy sets which downloaded files are kept for a source
+func (p NRTMProcessor) SetRetentionPolicy(sourceName, label string, policy persist.RetentionPolicy) (*persist.NRTMSource, error) {
+	if policy.KeepDeltas < 0 || policy.MaxAgeDays < 0 {
+		return nil, ErrInvalidRetentionPolicy
+	}
+	ds := NrtmDataService{Repository: p.repo}
+	src := ds.getSourceByNameAndLabel(sourceName, label)
+	if src == nil {
+		return nil, ErrSourceNotFound
+	}
+	src.Properties.Retention = policy
+	UserLogger.Info("Set retention policy", "sourceName", sourceName, "label", label, "policy", policy)
+	return ds.saveSource(*src)
+}
+
+// CollectGarbage removes files which are outside the retention policy of their sources. The
+// session directories of sources which are no longer in the repo are only removed when
+// removeOrphans is true, otherwise they are listed in the report.
+func (p NRTMProcessor) CollectGarbage(ctx context.Context, dryRun, removeOrphans bool) (GarbageReport, error) {
+	report := GarbageReport{DryRun: dryRun}
+	sources, err := p.repo.ListSources()
+	if err != nil {
+		return report, err
+	}
+	sessions := map[string][]persist.NRTMSource{}
+	for _, src := range sources {
+		dir := p.sessionDirectory(src)
+		sessions[dir] = append(sessions[dir], src)
+	}
+	if err = p.removeOrphanedSessions(sessions, removeOrphans, &report); err != nil {
+		return report, err
+	}
+	for dir, srcs := range sessions {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		if err = p.applyRetention(dir, srcs, &report); err != nil {
+			return report, err
+		}
+	}
+	UserLogger.Info("Garbage collection finished", "removed", len(report.Removed), "bytesFreed", report.BytesFreed, "dryRun", dryRun)
+	return report, nil
+}
+
+// collectSourceGarbage applies the retention policy to the session directory of a source after
+// it was updated
+func (p NRTMProcessor) collectSourceGarbage(source persist.NRTMSource) {
+	if source.Properties.Retention.IsZero() {
+		return
+	}
+	sources, err := p.repo.ListSources()
+	if err != nil {
+		logger.Warn("Cannot list sources for garbage collection", "error", err)
+		return
+	}
+	dir := p.sessionDirectory(source)
+	sharing := []persist.NRTMSource{}
+	for _, src := range sources {
+		if p.sessionDirectory(src) == dir {
+			sharing = append(sharing, src)
+		}
+	}
+	report := GarbageReport{}
+	if err = p.applyRetention(dir, sharing, &report); err != nil {
+		logger.Warn("Garbage collection failed", "source", source.Source, "error", err)
+		return
+	}
+	if len(report.Removed) > 0 {
+		UserLogger.Info("Removed old files", "source", source.Source, "removed", len(report.Removed), "bytesFreed", report.BytesFreed)
+	}
+}
+
+func (p NRTMProcessor) sessionDirectory(source persist.NRTMSource) string {
+	return filepath.Join(p.config.NRTMFilePath, source.Source, source.SessionID)
+}
+
+// removeOrphanedSessions removes <source>/<session> directories which don't belong to any source
+// in the repo, and source directories which are left empty. Only directories named like a source
+// and a session ID are touched, anything else under NRTM4_FILE_PATH is left alone.
+func (p NRTMProcessor) removeOrphanedSessions(sessions map[string][]persist.NRTMSource, remove bool, report *GarbageReport) error {
+	sourceDirs, err := os.ReadDir(p.config.NRTMFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, sourceDir := range sourceDirs {
+		if !sourceDir.IsDir() || !sourceDirRegex.MatchString(sourceDir.Name()) {
+			continue
+		}
+		sourcePath := filepath.Join(p.config.NRTMFilePath, sourceDir.Name())
+		sessionDirs, err := os.ReadDir(sourcePath)
+		if err != nil {
+			return err
+		}
+		remaining := len(sessionDirs)
+		for _, sessionDir := range sessionDirs {
+			sessionPath := filepath.Join(sourcePath, sessionDir.Name())
+			if !sessionDir.IsDir() || !sessionDirRegex.MatchString(sessionDir.Name()) || len(sessions[sessionPath]) > 0 {
+				continue
+			}
+			if !remove {
+				report.Orphans = append(report.Orphans, sessionPath)
+				continue
+			}
+			size, err := directorySize(sessionPath)
+			if err != nil {
+				return err
+			}
+			if !report.DryRun {
+				if err = os.RemoveAll(sessionPath); err != nil {
+					return err
+				}
+			}
+			logger.Info("Removed session directory of a removed source", "path", sessionPath)
+			report.add(sessionPath, size)
+			remaining--
+		}
+		if remaining == 0 && !report.DryRun {
+			if err = os.Remove(sourcePath); err != nil {
+				logger.Warn("Cannot remove empty source directory", "path", sourcePath, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+func directorySize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+type storedFileKind int
+
+const (
+	storedDelta storedFileKind = iota
+	storedSnapshot
+	// storedOther are partial downloads and files which failed the hash check
+	storedOther
+)
+
+type storedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	kind    storedFileKind
+	// version is -1 when the file isn't listed in the latest notification
+	version int64
+}
+
+// applyRetention removes files from a session directory which none of the sources sharing it
+// want to keep. The directory is skipped while a source is being loaded or updated.
+func (p NRTMProcessor) applyRetention(dir string, sources []persist.NRTMSource, report *GarbageReport) error {
+	ds := NrtmDataService{Repository: p.repo}
+	var remove map[string]storedFile
+	for _, src := range sources {
+		if src.Status == "updating" || isSnapshotUnfinished(src.Status) {
+			logger.Debug("Skipping garbage collection while source is busy", "source", src.Source, "label", src.Label, "status", src.Status)
+			return nil
+		}
+		if src.Properties.Retention.IsZero() {
+			return nil
+		}
+		notifications, err := ds.getNotifications(src, src.Version, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		files, err := storedFiles(dir, src.NotificationURL, latestNotification(notifications))
+		if err != nil {
+			return err
+		}
+		expired := expiredFiles(files, src.Properties.Retention, util.AppClock.Now())
+		if remove == nil {
+			remove = expired
+			continue
+		}
+		// A file is kept if any source wants it
+		for path := range remove {
+			if _, ok := expired[path]; !ok {
+				delete(remove, path)
+			}
+		}
+	}
+	paths := make([]string, 0, len(remove))
+	for path := range remove {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !report.DryRun {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		report.add(path, remove[path].size)
+	}
+	if !report.DryRun {
+		removeEmptyVersionDirectories(dir)
+	}
+	return nil
+}
+
+// latestNotification returns the notification with the highest version, which was saved last
+func latestNotification(notifications []persist.Notification) *persist.NotificationJSON {
+	var latest *persist.Notification
+	for i, n := range notifications {
+		if latest == nil || n.Version > latest.Version || n.Version == latest.Version && n.ID > latest.ID {
+			latest = &notifications[i]
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return &latest.Payload
+}
+
+// storedFiles lists the files in a session directory. Files referenced by the notification get
+// their version from it. Other files are from older notifications, and are recognised as
+// snapshots by their name.
+func storedFiles(dir, notificationURL string, notification *persist.NotificationJSON) ([]storedFile, error) {
+	refs := map[string]storedFile{}
+	if notification != nil {
+		if fURL, err := fullURL(notificationURL, notification.SnapshotRef.URL); err == nil {
+			refs[localPathForRef(dir, fURL, notification.SnapshotRef)] = storedFile{kind: storedSnapshot, version: notification.SnapshotRef.Version}
+		}
+		for _, ref := range notification.DeltaRefs {
+			if fURL, err := fullURL(notificationURL, ref.URL); err == nil {
+				refs[localPathForRef(dir, fURL, ref)] = storedFile{kind: storedDelta, version: ref.Version}
+			}
+		}
+	}
+	files := []storedFile{}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, ok := refs[path]
+		if !ok {
+			f = storedFile{kind: storedDelta, version: -1}
+			if strings.HasSuffix(path, partialFileExtension) || strings.HasSuffix(path, "-BADHASH") {
+				f.kind = storedOther
+			} else if strings.Contains(strings.ToLower(d.Name()), "snapshot") {
+				f.kind = storedSnapshot
+			}
+		}
+		f.path, f.size, f.modTime = path, info.Size(), info.ModTime()
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// expiredFiles returns the files which the policy doesn't keep. The snapshot in the latest
+// notification is always kept, so the source can be loaded again without downloading it.
+func expiredFiles(files []storedFile, policy persist.RetentionPolicy, now time.Time) map[string]storedFile {
+	expired := map[string]storedFile{}
+	isCurrentSnapshot := func(f storedFile) bool {
+		return f.kind == storedSnapshot && f.version >= 0
+	}
+	if policy.MaxAgeDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.MaxAgeDays)
+		for _, f := range files {
+			if !isCurrentSnapshot(f) && f.modTime.Before(cutoff) {
+				expired[f.path] = f
+			}
+		}
+	}
+	if policy.CurrentSnapshotOnly {
+		for _, f := range files {
+			if f.kind == storedSnapshot && !isCurrentSnapshot(f) {
+				expired[f.path] = f
+			}
+		}
+	}
+	if policy.KeepDeltas > 0 {
+		deltas := []storedFile{}
+		for _, f := range files {
+			if f.kind == storedDelta {
+				deltas = append(deltas, f)
+			}
+		}
+		sort.Slice(deltas, func(i, j int) bool {
+			if deltas[i].version != deltas[j].version {
+				return deltas[i].version > deltas[j].version
+			}
+			return deltas[i].modTime.After(deltas[j].modTime)
+		})
+		for i := policy.KeepDeltas; i < len(deltas); i++ {
+			expired[deltas[i].path] = deltas[i]
+		}
+	}
+	return expired
+}
+
+// removeEmptyVersionDirectories removes version directories which have no files left
+func removeEmptyVersionDirectories(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if contents, err := os.ReadDir(path); err == nil && len(contents) == 0 {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func writeStoredFile(t *testing.T, path string, size int, age time.Duration) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func retentionTestSource(policy persist.RetentionPolicy) (persist.NRTMSource, persist.Notification) {
+	source := persist.NRTMSource{
+		ID:              1,
+		Source:          "TEST",
+		SessionID:       "session-1",
+		Version:         5,
+		NotificationURL: "https://nrtm.example.eu/TEST/update-notification-file.jose",
+		Status:          "ok",
+		Properties:      persist.SourceProperties{Retention: policy},
+	}
+	notification := persist.NotificationJSON{
+		NrtmFileJSON: persist.NrtmFileJSON{Version: 5, Source: "TEST", SessionID: "session-1"},
+		SnapshotRef:  persist.FileRefJSON{Version: 4, URL: "nrtm-snapshot.4.TEST.json.gz"},
+		DeltaRefs: []persist.FileRefJSON{
+			{Version: 3, URL: "nrtm-delta.3.TEST.json"},
+			{Version: 4, URL: "nrtm-delta.4.TEST.json"},
+			{Version: 5, URL: "nrtm-delta.5.TEST.json"},
+		},
+	}
+	return source, persist.Notification{ID: 1, Version: 5, SourceID: 1, Payload: notification}
+}
+
+func TestCollectGarbageAppliesRetentionPolicy(t *testing.T) {
+	base := t.TempDir()
+	source, notification := retentionTestSource(persist.RetentionPolicy{KeepDeltas: 2, CurrentSnapshotOnly: true})
+	dir := filepath.Join(base, "TEST", "session-1", "0")
+	writeStoredFile(t, filepath.Join(dir, "nrtm-snapshot.2.TEST.json.gz"), 100, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-snapshot.4.TEST.json.gz"), 100, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.2.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.3.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.4.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.5.TEST.json"), 10, 0)
+	repo := mockRepo{
+		sources:       []persist.NRTMSource{source},
+		notifications: map[uint64][]persist.Notification{1: {notification}},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: base}, repo, nil)
+
+	report, err := p.CollectGarbage(context.Background(), false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if len(report.Removed) != 3 || report.BytesFreed != 120 {
+		t.Error("Expected 3 files and 120 bytes to be removed but was", report.Removed, report.BytesFreed)
+	}
+	for _, name := range []string{"nrtm-snapshot.2.TEST.json.gz", "nrtm-delta.2.TEST.json", "nrtm-delta.3.TEST.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Error("File should be removed", name)
+		}
+	}
+	for _, name := range []string{"nrtm-snapshot.4.TEST.json.gz", "nrtm-delta.4.TEST.json", "nrtm-delta.5.TEST.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error("File should be kept", name, err)
+		}
+	}
+}
+
+func TestCollectGarbageRemovesOldFiles(t *testing.T) {
+	base := t.TempDir()
+	source, notification := retentionTestSource(persist.RetentionPolicy{MaxAgeDays: 7})
+	dir := filepath.Join(base, "TEST", "session-1", "0")
+	writeStoredFile(t, filepath.Join(dir, "nrtm-snapshot.4.TEST.json.gz"), 100, 30*24*time.Hour)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.3.TEST.json"), 10, 30*24*time.Hour)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.4.TEST.json"), 10, time.Hour)
+	repo := mockRepo{
+		sources:       []persist.NRTMSource{source},
+		notifications: map[uint64][]persist.Notification{1: {notification}},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: base}, repo, nil)
+
+	report, err := p.CollectGarbage(context.Background(), false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	if len(report.Removed) != 1 || report.Removed[0] != filepath.Join(dir, "nrtm-delta.3.TEST.json") {
+		t.Error("Only the old delta should be removed, but was", report.Removed)
+	}
+}
+
+func TestCollectGarbageRemovesSessionsOfRemovedSources(t *testing.T) {
+	base := t.TempDir()
+	source, _ := retentionTestSource(persist.RetentionPolicy{})
+	oldSession := filepath.Join(base, "TEST", "7a4d3c2e-1f0b-4e8a-9c6d-5b2a1e0f9d8c")
+	goneSession := filepath.Join(base, "GONE", "0c9e8d7f-6a5b-4c3d-8e2f-1a0b9c8d7e6f")
+	writeStoredFile(t, filepath.Join(base, "TEST", "session-1", "0", "nrtm-delta.3.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(oldSession, "0", "nrtm-delta.3.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(goneSession, "0", "nrtm-snapshot.1.GONE.json.gz"), 100, 0)
+	writeStoredFile(t, filepath.Join(base, "TEST", "notes", "todo.txt"), 10, 0)
+	writeStoredFile(t, filepath.Join(base, "backups", "2026-01-01", "dump.sql"), 10, 0)
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: base}, mockRepo{sources: []persist.NRTMSource{source}}, nil)
+
+	report, err := p.CollectGarbage(context.Background(), false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(report.Removed) != 0 || len(report.Orphans) != 2 {
+		t.Error("Orphaned sessions should only be reported unless removal is requested", report.Removed, report.Orphans)
+	}
+
+	report, err = p.CollectGarbage(context.Background(), true, true)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(report.Removed) != 2 || report.BytesFreed != 110 {
+		t.Error("Expected 2 sessions and 110 bytes to be reported but was", report.Removed, report.BytesFreed)
+	}
+	if _, err := os.Stat(goneSession); err != nil {
+		t.Error("Dry run should not remove anything", err)
+	}
+
+	if _, err = p.CollectGarbage(context.Background(), false, true); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "GONE")); !os.IsNotExist(err) {
+		t.Error("Source directory should be removed", err)
+	}
+	if _, err := os.Stat(oldSession); !os.IsNotExist(err) {
+		t.Error("Old session directory should be removed", err)
+	}
+	for _, kept := range []string{"TEST/session-1", "TEST/notes", "backups/2026-01-01"} {
+		if _, err := os.Stat(filepath.Join(base, kept)); err != nil {
+			t.Error("Directory should be kept", kept, err)
+		}
+	}
+}
+
+func TestCollectGarbageKeepsFilesOfBusySource(t *testing.T) {
+	base := t.TempDir()
+	source, notification := retentionTestSource(persist.RetentionPolicy{KeepDeltas: 1})
+	source.Status = "updating"
+	dir := filepath.Join(base, "TEST", "session-1", "0")
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.3.TEST.json"), 10, 0)
+	writeStoredFile(t, filepath.Join(dir, "nrtm-delta.4.TEST.json"), 10, 0)
+	repo := mockRepo{
+		sources:       []persist.NRTMSource{source},
+		notifications: map[uint64][]persist.Notification{1: {notification}},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: base}, repo, nil)
+
+	report, err := p.CollectGarbage(context.Background(), false, false)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(report.Removed) != 0 {
+		t.Error("Files of a source being updated should be kept, but was", report.Removed)
+	}
+}
+
+func TestSetRetentionPolicyRejectsNegativeValues(t *testing.T) {
+	p := NewNRTMProcessor(AppConfig{}, mockRepo{}, nil)
+
+	if _, err := p.SetRetentionPolicy("TEST", "", persist.RetentionPolicy{KeepDeltas: -1}); err != ErrInvalidRetentionPolicy {
+		t.Error("Expected ErrInvalidRetentionPolicy but was", err)
+	}
+}
@@ -0,0 +1,397 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+// publicKeyMap keys which are trusted for notification files served from a domain, in
+// addition to keys in the repo
+var publicKeyMap = map[string]string{}
+
+func init() {
+	publicKeyMap["ripe.net"] = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEOkzpjobirEcqoR6zLXnPkm4cCTEY
+Xi2rLlCSXc5EZ3L3PycAdDmWQtGHD8GF++RqWgrdKv+9l+InalmiCGkpRQ==
+-----END PUBLIC KEY-----`
+
+	publicKeyMap["s42.re"] = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEsYTv7kPkzBlpm6TfdqiSQqQ7Qajv
+gh4HeTD4QUtluJwaHzW7Gaq03KUqj581nN5YTLxehAf8JkyoIrXxNkaS5Q==
+-----END PUBLIC KEY-----`
+}
+
+// keyFinder returns the PEM encoded keys which may sign a notification file for the named source
+type keyFinder func(source string) []string
+
+// notificationTrust says which keys can sign the notification file at url, and whether
+// notifications which aren't signed with one of them are accepted
+type notificationTrust struct {
+	url              string
+	keys             []persist.SigningKey
+	requireSignature bool
+}
+
+// findKeys implements keyFinder. Retired keys are not returned, and neither are built-in keys
+// which have been retired by a rotation.
+func (t notificationTrust) findKeys(source string) []string {
+	pems := []string{}
+	for _, pk := range builtInKeys(t.url) {
+		if fp, err := keyFingerprint(pk); err == nil && !t.isRetired(source, fp) {
+			pems = append(pems, pk)
+		}
+	}
+	for _, k := range t.keys {
+		if k.Status != persist.SigningKeyRetired && signingKeyApplies(k, source, t.url) {
+			pems = append(pems, k.PEM)
+		}
+	}
+	return pems
+}
+
+// isRetired is true when a key with the fingerprint was retired for the source
+func (t notificationTrust) isRetired(source, fingerprint string) bool {
+	for _, k := range t.keys {
+		if k.Status == persist.SigningKeyRetired && k.Fingerprint == fingerprint && signingKeyApplies(k, source, t.url) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotationChanges returns the keys which need to be saved to follow a key rotation after a
+// notification file was verified by the key verifiedBy.
+//
+// If verifiedBy is a pending key then the server has switched to it, so it's activated and the
+// other active keys for the source are retired. If the notification announces a
+// next_signing_key which isn't known yet, it's added as a pending key.
+func (t notificationTrust) rotationChanges(notification persist.NotificationJSON, verifiedBy string) []persist.SigningKey {
+	changes := []persist.SigningKey{}
+	verifiedFP, err := keyFingerprint(verifiedBy)
+	if err != nil {
+		return changes
+	}
+	source := notification.Source
+	activated := false
+	for _, k := range t.keys {
+		if k.Fingerprint == verifiedFP && k.Status == persist.SigningKeyPending && signingKeyApplies(k, source, t.url) {
+			k.Status = persist.SigningKeyActive
+			changes = append(changes, k)
+			activated = true
+		}
+	}
+	if activated {
+		for _, k := range t.keys {
+			if k.Fingerprint != verifiedFP && k.Status == persist.SigningKeyActive && signingKeyApplies(k, source, t.url) {
+				k.Status = persist.SigningKeyRetired
+				changes = append(changes, k)
+			}
+		}
+		for _, pk := range builtInKeys(t.url) {
+			fp, err := keyFingerprint(pk)
+			if err != nil || fp == verifiedFP || t.isRetired(source, fp) {
+				continue
+			}
+			changes = append(changes, persist.SigningKey{
+				Source:          source,
+				NotificationURL: t.url,
+				PEM:             pk,
+				Fingerprint:     fp,
+				Status:          persist.SigningKeyRetired,
+			})
+		}
+	}
+	if notification.NextSigningKey == nil || len(strings.TrimSpace(*notification.NextSigningKey)) == 0 {
+		return changes
+	}
+	nextPEM := normalizeSigningKey(*notification.NextSigningKey)
+	nextFP, err := keyFingerprint(nextPEM)
+	if err != nil {
+		logger.Warn("Ignoring next_signing_key which cannot be parsed", "source", source, "error", err)
+		return changes
+	}
+	if nextFP == verifiedFP || t.isKnown(source, nextFP) {
+		return changes
+	}
+	return append(changes, persist.SigningKey{
+		Source:          source,
+		NotificationURL: t.url,
+		PEM:             nextPEM,
+		Fingerprint:     nextFP,
+		Status:          persist.SigningKeyPending,
+	})
+}
+
+// isKnown is true when a key with the fingerprint is built in, or stored for the source with any
+// status. A retired key is not trusted again because a notification announces it.
+func (t notificationTrust) isKnown(source, fingerprint string) bool {
+	for _, pk := range builtInKeys(t.url) {
+		if fp, err := keyFingerprint(pk); err == nil && fp == fingerprint {
+			return true
+		}
+	}
+	for _, k := range t.keys {
+		if k.Fingerprint == fingerprint && signingKeyApplies(k, source, t.url) {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKeyApplies is true when the key was added for the source or the notification URL. A
+// key which has both must match both.
+func signingKeyApplies(key persist.SigningKey, source, notificationURL string) bool {
+	if len(key.Source) == 0 && len(key.NotificationURL) == 0 {
+		return false
+	}
+	if len(key.Source) > 0 && !strings.EqualFold(key.Source, source) {
+		return false
+	}
+	if len(key.NotificationURL) > 0 && key.NotificationURL != notificationURL {
+		return false
+	}
+	return true
+}
+
+func builtInKeys(notificationURL string) []string {
+	pems := []string{}
+	nURL, err := url.Parse(notificationURL)
+	if err != nil {
+		logger.Warn("Failed to parse URL", "url", notificationURL)
+		return pems
+	}
+	for domain, pk := range publicKeyMap {
+		if strings.HasSuffix(nURL.Host, domain) {
+			pems = append(pems, pk)
+		}
+	}
+	return pems
+}
+
+// normalizeSigningKey returns the key in PEM format. A next_signing_key can be given as the base64
+// encoded DER without PEM armour.
+func normalizeSigningKey(keyTxt string) string {
+	keyTxt = strings.TrimSpace(keyTxt)
+	if strings.HasPrefix(keyTxt, "-----BEGIN") {
+		return keyTxt
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(keyTxt), ""))
+	if err != nil {
+		return keyTxt
+	}
+	return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+}
+
+// keyFingerprint is the hex encoded SHA-256 of the DER encoded public key
+func keyFingerprint(keyTxt string) (string, error) {
+	block, _ := pem.Decode([]byte(keyTxt))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", ErrInvalidSigningKey
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// parsePublicKey decodes a PEM encoded public key
+func parsePublicKey(keyTxt string) (any, error) {
+	block, _ := pem.Decode([]byte(keyTxt))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrInvalidSigningKey
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		logger.Warn("Failed to parse public key", "error", err)
+		return nil, ErrInvalidSigningKey
+	}
+	return pub, nil
+}
+
+// signingMethodFits is true if a token's algorithm is one which is used with the key: ES256,
+// ES384 or ES512 with an EC key on the same curve, or RS256, RS384 or RS512 with an RSA key
+func signingMethodFits(method jwt.SigningMethod, pub any) bool {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		m, ok := method.(*jwt.SigningMethodECDSA)
+		return ok && m.CurveBits == key.Curve.Params().BitSize
+	case *rsa.PublicKey:
+		_, ok := method.(*jwt.SigningMethodRSA)
+		return ok
+	}
+	return false
+}
+
+// parseNotificationToken reads the claims from a notification file. If findKeys returns any keys
+// for the source named in the claims, the token must be signed by one of them. The key which
+// verified the signature is returned, or an empty string if the signature wasn't checked.
+func parseNotificationToken(tokenString string, findKeys keyFinder) (persist.NotificationJSON, string, error) {
+	var notification persist.NotificationJSON
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		logger.Warn("Failed to parse notification token", "error", err)
+		return notification, "", err
+	}
+	cljson, err := json.Marshal(claims)
+	if err != nil {
+		logger.Warn("Failed to marshal claims", "error", err)
+		return notification, "", err
+	}
+	if err = json.Unmarshal(cljson, &notification); err != nil {
+		return notification, "", err
+	}
+	keys := []string{}
+	if findKeys != nil {
+		keys = findKeys(notification.Source)
+	}
+	if len(keys) == 0 {
+		return notification, "", nil
+	}
+	for _, keyTxt := range keys {
+		pub, err := parsePublicKey(keyTxt)
+		if err != nil {
+			logger.Warn("Ignoring signing key which cannot be parsed", "source", notification.Source)
+			continue
+		}
+		_, err = jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+			if !signingMethodFits(token.Method, pub) {
+				return nil, ErrNotificationSignatureInvalid
+			}
+			return pub, nil
+		})
+		if err == nil {
+			return notification, keyTxt, nil
+		}
+	}
+	logger.Warn("Notification signature was not verified by any trusted key", "source", notification.Source, "keys", len(keys))
+	return notification, "", ErrNotificationSignatureInvalid
+}
+
+// AddSigningKey adds a key to the trust store. Either source or notificationURL must be given.
+func (p NRTMProcessor) AddSigningKey(source, notificationURL, pemText string) (persist.SigningKey, error) {
+	source = strings.TrimSpace(source)
+	notificationURL = strings.TrimSpace(notificationURL)
+	if len(source) == 0 && len(notificationURL) == 0 {
+		return persist.SigningKey{}, ErrSigningKeyNeedsSource
+	}
+	if len(notificationURL) > 0 && !validateURLString(notificationURL) {
+		return persist.SigningKey{}, ErrBadNotificationURL
+	}
+	pemText = strings.TrimSpace(pemText)
+	if _, err := parsePublicKey(pemText); err != nil {
+		return persist.SigningKey{}, err
+	}
+	fp, err := keyFingerprint(pemText)
+	if err != nil {
+		return persist.SigningKey{}, err
+	}
+	key := persist.SigningKey{
+		Source:          source,
+		NotificationURL: notificationURL,
+		PEM:             pemText,
+		Fingerprint:     fp,
+		Status:          persist.SigningKeyActive,
+	}
+	saved, err := p.repo.SaveSigningKeys([]persist.SigningKey{key})
+	if err != nil {
+		return key, err
+	}
+	UserLogger.Info("Added signing key", "id", saved[0].ID, "source", source, "url", notificationURL, "fingerprint", fp)
+	return saved[0], nil
+}
+
+// ListSigningKeys lists the keys in the trust store
+func (p NRTMProcessor) ListSigningKeys() ([]persist.SigningKey, error) {
+	return p.repo.ListSigningKeys()
+}
+
+// RemoveSigningKey removes a key from the trust store
+func (p NRTMProcessor) RemoveSigningKey(id uint64) error {
+	keys, err := p.repo.ListSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.ID == id {
+			if err = p.repo.RemoveSigningKey(id); err == nil {
+				UserLogger.Info("Removed signing key", "id", id)
+			}
+			return err
+		}
+	}
+	return ErrSigningKeyNotFound
+}
+
+// ListSigningKeyEvents returns the audit trail of signing key changes for a source, or for all
+// sources if source is empty
+func (p NRTMProcessor) ListSigningKeyEvents(source string) ([]persist.SigningKeyEvent, error) {
+	return p.repo.ListSigningKeyEvents(strings.TrimSpace(source))
+}
+
+// followKeyRotation saves the key changes announced by a verified notification file
+func (p NRTMProcessor) followKeyRotation(trust notificationTrust, notification persist.NotificationJSON, verifiedBy string) error {
+	if len(verifiedBy) == 0 {
+		if notification.NextSigningKey != nil {
+			UserLogger.Warn("Ignoring next_signing_key because the notification file was not verified", "source", notification.Source)
+		}
+		return nil
+	}
+	changes := trust.rotationChanges(notification, verifiedBy)
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := p.repo.SaveSigningKeys(changes); err != nil {
+		return err
+	}
+	for _, k := range changes {
+		UserLogger.Info("Signing key rotation", "source", notification.Source, "fingerprint", k.Fingerprint, "status", k.Status)
+	}
+	return nil
+}
+
+// fetchNotification downloads and verifies the notification file using the trust store and the
+// source's signature policy, then follows any signing key rotation it announces
+func (p NRTMProcessor) fetchNotification(ctx context.Context, notificationURL string, props persist.SourceProperties) (persist.NotificationJSON, error) {
+	trust, err := p.trustFor(notificationURL, props)
+	if err != nil {
+		return persist.NotificationJSON{}, err
+	}
+	fm := fileManager{p.client}
+	notification, verifiedBy, err := fm.downloadNotificationFile(ctx, notificationURL, trust)
+	if err != nil {
+		return notification, err
+	}
+	return notification, p.followKeyRotation(trust, notification, verifiedBy)
+}
+
+// SetSignaturePolicy sets whether a source rejects notification files which are not signed
+// with a trusted key
+func (p NRTMProcessor) SetSignaturePolicy(sourceName, label string, requireSignature bool) (*persist.NRTMSource, error) {
+	ds := NrtmDataService{Repository: p.repo}
+	src := ds.getSourceByNameAndLabel(sourceName, label)
+	if src == nil {
+		return nil, ErrSourceNotFound
+	}
+	src.Properties.RequireSignature = requireSignature
+	UserLogger.Info("Set signature policy", "sourceName", sourceName, "label", label, "requireSignature", requireSignature)
+	return ds.saveSource(*src)
+}
+
+// trustFor returns the keys and policy for a notification URL
+func (p NRTMProcessor) trustFor(notificationURL string, props persist.SourceProperties) (notificationTrust, error) {
+	keys, err := p.repo.ListSigningKeys()
+	if err != nil {
+		return notificationTrust{}, err
+	}
+	return notificationTrust{url: notificationURL, keys: keys, requireSignature: props.RequireSignature}, nil
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/testresources"
+)
+
+func readNotificationToken(t *testing.T) string {
+	f := testresources.OpenFile(t, "update-notification-file.jose")
+	defer f.Close()
+	bytes, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal("Unexpected error reading unf", err)
+	}
+	return string(bytes)
+}
+
+func TestParseNotificationTokenVerifiesSignature(t *testing.T) {
+	token := readNotificationToken(t)
+	ripeKey := publicKeyMap["ripe.net"]
+
+	notification, verifiedBy, err := parseNotificationToken(token, func(source string) []string {
+		if source != "RIPE" {
+			t.Error("Keys should be found for source RIPE but was", source)
+		}
+		return []string{publicKeyMap["s42.re"], ripeKey}
+	})
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if verifiedBy != ripeKey {
+		t.Error("Notification should be verified by the RIPE key")
+	}
+	if notification.Version != 399659 {
+		t.Error("Expected version 399659 but was", notification.Version)
+	}
+}
+
+func TestParseNotificationTokenRejectsWrongKey(t *testing.T) {
+	token := readNotificationToken(t)
+
+	_, _, err := parseNotificationToken(token, func(string) []string {
+		return []string{publicKeyMap["s42.re"]}
+	})
+
+	if err != ErrNotificationSignatureInvalid {
+		t.Error("Expected ErrNotificationSignatureInvalid but was", err)
+	}
+}
+
+func TestParseNotificationTokenRejectsOtherAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Cannot generate key", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal("Cannot marshal key", err)
+	}
+	pub := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	findKeys := func(string) []string { return []string{pub} }
+	claims := jwt.MapClaims{"source": "TEST", "version": 1}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal("Cannot sign token", err)
+	}
+	if _, verifiedBy, err := parseNotificationToken(signed, findKeys); err != nil || verifiedBy != pub {
+		t.Error("RS256 token should be verified by the RSA key", err)
+	}
+	signed, err = jwt.NewWithClaims(jwt.SigningMethodPS256, claims).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal("Cannot sign token", err)
+	}
+	if _, _, err := parseNotificationToken(signed, findKeys); err != ErrNotificationSignatureInvalid {
+		t.Error("Expected ErrNotificationSignatureInvalid for a PS256 token but was", err)
+	}
+	if _, _, err := parseNotificationToken(readNotificationToken(t), findKeys); err != ErrNotificationSignatureInvalid {
+		t.Error("Expected ErrNotificationSignatureInvalid for an ES256 token but was", err)
+	}
+}
+
+func TestParseNotificationTokenWithoutKeys(t *testing.T) {
+	token := readNotificationToken(t)
+
+	notification, verifiedBy, err := parseNotificationToken(token, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(verifiedBy) > 0 {
+		t.Error("Notification should not be verified")
+	}
+	if notification.Source != "RIPE" {
+		t.Error("Expected source RIPE but was", notification.Source)
+	}
+}
+
+func TestSigningKeyApplies(t *testing.T) {
+	url := "https://nrtm.example.com/RIPE/update-notification-file.jose"
+	tests := []struct {
+		key    persist.SigningKey
+		expect bool
+	}{
+		{persist.SigningKey{Source: "ripe"}, true},
+		{persist.SigningKey{Source: "RIPE-NONAUTH"}, false},
+		{persist.SigningKey{NotificationURL: url}, true},
+		{persist.SigningKey{NotificationURL: "https://other.example.com/update-notification-file.jose"}, false},
+		{persist.SigningKey{Source: "RIPE", NotificationURL: url}, true},
+		{persist.SigningKey{Source: "TEST", NotificationURL: url}, false},
+		{persist.SigningKey{}, false},
+	}
+	for _, tt := range tests {
+		if got := signingKeyApplies(tt.key, "RIPE", url); got != tt.expect {
+			t.Error("Expected", tt.expect, "for key", tt.key)
+		}
+	}
+}
+
+func TestUnsignedNotificationRejectedByPolicy(t *testing.T) {
+	fm := fileManager{NewTestClient(t, baseURL, "version2to6", "unf_2-4.json")}
+
+	_, _, err := fm.downloadNotificationFile(context.Background(), baseURL, notificationTrust{url: baseURL, requireSignature: true})
+	if err != ErrNotificationUnsigned {
+		t.Error("Expected ErrNotificationUnsigned but was", err)
+	}
+
+	_, _, err = fm.downloadNotificationFile(context.Background(), baseURL, notificationTrust{url: baseURL})
+	if err != nil {
+		t.Error("Unsigned notification should be accepted without the policy", err)
+	}
+}
+
+func TestAddSigningKeyValidatesKey(t *testing.T) {
+	p := NewNRTMProcessor(AppConfig{}, mockRepo{}, nil)
+
+	if _, err := p.AddSigningKey("", "", publicKeyMap["ripe.net"]); err != ErrSigningKeyNeedsSource {
+		t.Error("Expected ErrSigningKeyNeedsSource but was", err)
+	}
+	if _, err := p.AddSigningKey("RIPE", "", "not a key"); err != ErrInvalidSigningKey {
+		t.Error("Expected ErrInvalidSigningKey but was", err)
+	}
+	if _, err := p.AddSigningKey("", "not a url", publicKeyMap["ripe.net"]); err != ErrBadNotificationURL {
+		t.Error("Expected ErrBadNotificationURL but was", err)
+	}
+}
+
+func TestRotationAnnouncesPendingKey(t *testing.T) {
+	keyA, keyB := publicKeyMap["ripe.net"], publicKeyMap["s42.re"]
+	fpA, _ := keyFingerprint(keyA)
+	fpB, _ := keyFingerprint(keyB)
+	url := "https://nrtm.example.com/RIPE/update-notification-file.jose"
+	trust := notificationTrust{url: url, keys: []persist.SigningKey{
+		{ID: 1, Source: "RIPE", PEM: keyA, Fingerprint: fpA, Status: persist.SigningKeyActive},
+	}}
+	notification := persist.NotificationJSON{NrtmFileJSON: persist.NrtmFileJSON{Source: "RIPE"}, NextSigningKey: &keyB}
+
+	changes := trust.rotationChanges(notification, keyA)
+
+	if len(changes) != 1 {
+		t.Fatal("Expected 1 change but was", len(changes))
+	}
+	if changes[0].Fingerprint != fpB || changes[0].Status != persist.SigningKeyPending || changes[0].ID != 0 {
+		t.Error("Next signing key should be added as pending", changes[0])
+	}
+
+	trust.keys = append(trust.keys, persist.SigningKey{ID: 2, Source: "RIPE", NotificationURL: url, PEM: keyB, Fingerprint: fpB, Status: persist.SigningKeyPending})
+	if changes = trust.rotationChanges(notification, keyA); len(changes) != 0 {
+		t.Error("Pending key should not be added again", changes)
+	}
+}
+
+func TestRotationActivatesPendingKey(t *testing.T) {
+	keyA, keyB := publicKeyMap["ripe.net"], publicKeyMap["s42.re"]
+	fpA, _ := keyFingerprint(keyA)
+	fpB, _ := keyFingerprint(keyB)
+	url := "https://nrtm.example.com/RIPE/update-notification-file.jose"
+	trust := notificationTrust{url: url, keys: []persist.SigningKey{
+		{ID: 1, Source: "RIPE", PEM: keyA, Fingerprint: fpA, Status: persist.SigningKeyActive},
+		{ID: 2, Source: "RIPE", NotificationURL: url, PEM: keyB, Fingerprint: fpB, Status: persist.SigningKeyPending},
+	}}
+	notification := persist.NotificationJSON{NrtmFileJSON: persist.NrtmFileJSON{Source: "RIPE"}, NextSigningKey: &keyA}
+
+	changes := trust.rotationChanges(notification, keyB)
+
+	if len(changes) != 2 {
+		t.Fatal("Expected 2 changes but was", len(changes))
+	}
+	if changes[0].ID != 2 || changes[0].Status != persist.SigningKeyActive {
+		t.Error("Pending key should be activated", changes[0])
+	}
+	if changes[1].ID != 1 || changes[1].Status != persist.SigningKeyRetired {
+		t.Error("Old key should be retired", changes[1])
+	}
+}
+
+func TestRotationRetiresBuiltInKey(t *testing.T) {
+	keyA, keyB := publicKeyMap["ripe.net"], publicKeyMap["s42.re"]
+	fpA, _ := keyFingerprint(keyA)
+	fpB, _ := keyFingerprint(keyB)
+	url := "https://nrtm.db.ripe.net/nrtmv4/RIPE/update-notification-file.jose"
+	trust := notificationTrust{url: url, keys: []persist.SigningKey{
+		{ID: 2, Source: "RIPE", NotificationURL: url, PEM: keyB, Fingerprint: fpB, Status: persist.SigningKeyPending},
+	}}
+	notification := persist.NotificationJSON{NrtmFileJSON: persist.NrtmFileJSON{Source: "RIPE"}}
+
+	changes := trust.rotationChanges(notification, keyB)
+
+	if len(changes) != 2 {
+		t.Fatal("Expected 2 changes but was", len(changes))
+	}
+	retired := changes[1]
+	if retired.ID != 0 || retired.Fingerprint != fpA || retired.Status != persist.SigningKeyRetired {
+		t.Error("Built-in key should be retired", retired)
+	}
+
+	trust.keys = append(changes[:1], retired)
+	keys := trust.findKeys("RIPE")
+	if len(keys) != 1 || keys[0] != keyB {
+		t.Error("Only the new key should be trusted, but was", keys)
+	}
+
+	notification.NextSigningKey = &keyA
+	if changes = trust.rotationChanges(notification, keyB); len(changes) != 0 {
+		t.Error("Retired key should not be trusted again", changes)
+	}
+}
+
+func TestUnverifiedNotificationDoesNotRotateKeys(t *testing.T) {
+	keyB := publicKeyMap["s42.re"]
+	p := NewNRTMProcessor(AppConfig{}, mockRepo{}, nil)
+	notification := persist.NotificationJSON{NrtmFileJSON: persist.NrtmFileJSON{Source: "RIPE"}, NextSigningKey: &keyB}
+
+	// mockRepo panics if SaveSigningKeys is called
+	if err := p.followKeyRotation(notificationTrust{}, notification, ""); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestNormalizeSigningKey(t *testing.T) {
+	key := publicKeyMap["ripe.net"]
+	lines := strings.Split(key, "\n")
+	bare := strings.Join(lines[1:len(lines)-1], "")
+
+	if normalizeSigningKey(bare) != key {
+		t.Error("Expected PEM but was", normalizeSigningKey(bare))
+	}
+	if normalizeSigningKey("\n"+key+"\n") != key {
+		t.Error("PEM should only be trimmed")
+	}
+}
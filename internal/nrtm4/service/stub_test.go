@@ -1,7 +1,11 @@
 package service
 
 import (
+	"context"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
@@ -48,6 +52,21 @@ type stubClient struct {
 type mockRepo struct {
 	persist.Repository
 	sources []persist.NRTMSource
+	keys    []persist.SigningKey
+	// versions are the objects held at each version, as RPSL text
+	versions map[uint32][]string
+	// published are the times at which versions were published
+	published map[uint32]time.Time
+	// revisions are the revisions of objects by type and primary key, e.g. "MNTNER TEST-MNT"
+	revisions map[string][]persist.ObjectRevision
+	// changes are the object changes returned for versions from changesFrom
+	changes     []persist.ObjectChange
+	changesFrom uint32
+	invalid     []persist.InvalidObject
+	// objects are the current objects by source name, as RPSL text
+	objects map[string][]string
+	// notifications are the notification history of each source by source ID
+	notifications map[uint64][]persist.Notification
 }
 
 func (mr mockRepo) SaveSource(source persist.NRTMSource, notifile *persist.NotificationJSON) (persist.NRTMSource, error) {
@@ -73,3 +92,107 @@ func (mr mockRepo) SaveSource(source persist.NRTMSource, notifile *persist.Notif
 func (mr mockRepo) ListSources() ([]persist.NRTMSource, error) {
 	return mr.sources, nil
 }
+
+func (mr mockRepo) ListSigningKeys() ([]persist.SigningKey, error) {
+	return mr.keys, nil
+}
+
+func (mr mockRepo) GetNotificationHistory(source persist.NRTMSource, from, to uint32) ([]persist.Notification, error) {
+	if notifications, ok := mr.notifications[source.ID]; ok {
+		return notifications, nil
+	}
+	return []persist.Notification{}, nil
+}
+
+func (mr mockRepo) ObjectsAtVersion(ctx context.Context, source persist.NRTMSource, version uint32, objectTypes []string, fn func(rpsl.Rpsl) error) error {
+	objects, ok := mr.versions[version]
+	if !ok {
+		return persist.ErrVersionNotAvailable
+	}
+	for _, str := range objects {
+		obj, err := rpsl.ParseFromJSONString(str)
+		if err != nil {
+			return err
+		}
+		if err = fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr mockRepo) VersionAtTime(source persist.NRTMSource, t time.Time) (uint32, error) {
+	var version uint32
+	for v, ts := range mr.published {
+		if !ts.After(t) && v > version {
+			version = v
+		}
+	}
+	if version == 0 {
+		return 0, persist.ErrVersionNotAvailable
+	}
+	return version, nil
+}
+
+func (mr mockRepo) ObjectHistory(source persist.NRTMSource, objectType, primaryKey string) ([]persist.ObjectRevision, error) {
+	if revisions, ok := mr.revisions[objectType+" "+primaryKey]; ok {
+		return revisions, nil
+	}
+	return []persist.ObjectRevision{}, nil
+}
+
+func (mr mockRepo) ObjectChanges(ctx context.Context, source persist.NRTMSource, fromVersion, toVersion uint32, fn func(persist.ObjectChange) error) error {
+	if fromVersion < mr.changesFrom {
+		return persist.ErrVersionNotAvailable
+	}
+	for _, change := range mr.changes {
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr mockRepo) ListInvalidObjects(persist.NRTMSource) ([]persist.InvalidObject, error) {
+	return mr.invalid, nil
+}
+
+func (mr mockRepo) sourceObjects(source persist.NRTMSource) []rpsl.Rpsl {
+	objects := []rpsl.Rpsl{}
+	for _, payload := range mr.objects[source.Source] {
+		obj, _ := rpsl.ParseFromJSONString(payload)
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+func (mr mockRepo) GetObject(source persist.NRTMSource, objectType, primaryKey string) (*rpsl.Rpsl, error) {
+	for _, obj := range mr.sourceObjects(source) {
+		if obj.ObjectType == objectType && obj.PrimaryKey == primaryKey {
+			return &obj, nil
+		}
+	}
+	return nil, nil
+}
+
+func (mr mockRepo) ObjectsWithMemberOf(ctx context.Context, source persist.NRTMSource, objectTypes []string, setName string, fn func(rpsl.Rpsl) error) error {
+	for _, obj := range mr.sourceObjects(source) {
+		if slices.Contains(objectTypes, strings.ToLower(obj.ObjectType)) && strings.Contains(obj.Payload, "member-of:") {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (mr mockRepo) RoutesByOrigin(ctx context.Context, source persist.NRTMSource, origins []string, fn func(rpsl.Rpsl) error) error {
+	for _, obj := range mr.sourceObjects(source) {
+		if (obj.ObjectType == "ROUTE" || obj.ObjectType == "ROUTE6") && slices.Contains(origins, obj.Value("origin")) {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/jsonseq"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// ValidationCheck names the kind of check which found a violation
+type ValidationCheck string
+
+const (
+	// CheckNotification the notification file could not be read, or its fields are not valid
+	CheckNotification ValidationCheck = "notification"
+	// CheckSignature the notification file signature does not match a trusted key
+	CheckSignature ValidationCheck = "signature"
+	// CheckDownload a snapshot or delta file could not be downloaded
+	CheckDownload ValidationCheck = "download"
+	// CheckHash a file does not match the hash in the notification file
+	CheckHash ValidationCheck = "hash"
+	// CheckHeader the first record of a file does not match the notification file
+	CheckHeader ValidationCheck = "header"
+	// CheckRecord a record is not well-formed
+	CheckRecord ValidationCheck = "record"
+)
+
+// SignatureStatus says whether the notification file signature was checked
+type SignatureStatus string
+
+const (
+	// SignatureVerified the notification file is signed with a trusted key
+	SignatureVerified SignatureStatus = "verified"
+	// SignatureUnverified there is no trusted key for the server, so the signature wasn't checked
+	SignatureUnverified SignatureStatus = "unverified"
+	// SignatureInvalid the signature does not match any trusted key
+	SignatureInvalid SignatureStatus = "invalid"
+)
+
+// maxRecordViolations is the number of record violations listed for each file. The rest are
+// counted.
+const maxRecordViolations = 100
+
+// Violation is a departure from the NRTMv4 spec found by ValidateServer
+type Violation struct {
+	Check ValidationCheck
+	// URL of the file with the violation
+	URL     string
+	Version int64 `json:",omitempty"`
+	// Record is the number of the record in the file, starting at 1 for the header
+	Record  int `json:",omitempty"`
+	Message string
+}
+
+// ValidationReport lists every spec violation found on a server
+type ValidationReport struct {
+	NotificationURL string
+	Source          string
+	SessionID       string
+	Version         int64
+	Signature       SignatureStatus
+	FilesChecked    int
+	Violations      []Violation
+	Valid           bool
+	Checked         time.Time
+}
+
+func (r *ValidationReport) add(v Violation) {
+	r.Violations = append(r.Violations, v)
+	r.Valid = false
+}
+
+// ValidateServer checks a server's notification file and every snapshot and delta file it
+// lists, including deltas which would never be applied. Nothing is saved, so it doesn't need a
+// repo. The signature is checked with the built-in keys and the PEM encoded keys given.
+func (p NRTMProcessor) ValidateServer(ctx context.Context, notificationURL string, keys []string) (ValidationReport, error) {
+	unfURL := notificationURLFromPath(strings.TrimSpace(notificationURL))
+	report := ValidationReport{
+		NotificationURL: unfURL,
+		Violations:      []Violation{},
+		Valid:           true,
+		Checked:         util.AppClock.Now(),
+	}
+	if !validateURLString(unfURL) {
+		return report, ErrBadNotificationURL
+	}
+	ctx = withFileRoot(ctx, unfURL)
+	trusted := builtInKeys(unfURL)
+	for _, key := range keys {
+		key = normalizeSigningKey(key)
+		if _, err := parsePublicKey(key); err != nil {
+			return report, ErrInvalidSigningKey
+		}
+		trusted = append(trusted, key)
+	}
+	findKeys := func(string) []string {
+		return trusted
+	}
+	UserLogger.Info("Validating notification file", "url", unfURL)
+	notification, verifiedBy, err := p.client.getUpdateNotification(ctx, unfURL, findKeys)
+	switch {
+	case err == ErrNotificationSignatureInvalid:
+		report.Signature = SignatureInvalid
+		report.add(Violation{Check: CheckSignature, URL: unfURL, Message: err.Error()})
+	case err != nil:
+		report.add(Violation{Check: CheckNotification, URL: unfURL, Message: err.Error()})
+		return report, nil
+	case len(verifiedBy) > 0:
+		report.Signature = SignatureVerified
+	default:
+		report.Signature = SignatureUnverified
+	}
+	report.Source = notification.Source
+	report.SessionID = notification.SessionID
+	report.Version = notification.Version
+	report.FilesChecked++
+	if notification.Type != "notification" {
+		report.add(Violation{Check: CheckNotification, URL: unfURL, Message: fmt.Sprintf("type is not notification: '%v'", notification.Type)})
+	}
+	for _, err := range notificationFileErrors(notification) {
+		report.add(Violation{Check: CheckNotification, URL: unfURL, Message: err.Error()})
+	}
+	if notification.SnapshotRef.Version > notification.Version {
+		report.add(Violation{Check: CheckNotification, URL: unfURL, Version: notification.SnapshotRef.Version, Message: "snapshot version is greater than the notification version"})
+	}
+	refs := append([]persist.FileRefJSON{notification.SnapshotRef}, notification.DeltaRefs...)
+	for i, ref := range refs {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		fileType := "delta"
+		if i == 0 {
+			fileType = "snapshot"
+		}
+		fURL, err := fullURL(unfURL, ref.URL)
+		if err != nil {
+			report.FilesChecked++
+			report.add(Violation{Check: CheckNotification, URL: ref.URL, Version: ref.Version, Message: fmt.Sprintf("%v url is not allowed: %v", fileType, err)})
+			continue
+		}
+		p.validateFile(ctx, &report, notification, fileType, fURL, ref)
+	}
+	UserLogger.Info("Validation finished", "url", unfURL, "files", report.FilesChecked, "violations", len(report.Violations))
+	return report, nil
+}
+
+// validateFile downloads a snapshot or delta file, hashes it and checks every record. The file
+// is streamed, not saved.
+func (p NRTMProcessor) validateFile(ctx context.Context, report *ValidationReport, notification persist.NotificationJSON, fileType, fURL string, ref persist.FileRefJSON) {
+	report.FilesChecked++
+	violation := func(check ValidationCheck, record int, format string, args ...any) {
+		report.add(Violation{Check: check, URL: fURL, Version: ref.Version, Record: record, Message: fmt.Sprintf(format, args...)})
+	}
+	if !validateURLString(fURL) {
+		violation(CheckNotification, 0, "%v url cannot be resolved: '%v'", fileType, ref.URL)
+		return
+	}
+	UserLogger.Info("Validating file", "url", fURL)
+	body, err := p.client.getResponseBody(ctx, fURL)
+	if err != nil {
+		violation(CheckDownload, 0, "%v", err)
+		return
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	hasher := sha256.New()
+	tee := io.TeeReader(body, hasher)
+	var reader io.Reader = tee
+	if strings.HasSuffix(fURL, GZIPSnapshotExtension) {
+		gzreader, err := gzip.NewReader(tee)
+		if err != nil {
+			violation(CheckRecord, 0, "file is not gzipped: %v", err)
+			reader = nil
+		} else {
+			defer gzreader.Close()
+			reader = gzreader
+		}
+	}
+	if reader != nil {
+		checker := recordChecker{fileType: fileType, notification: notification, ref: ref, violation: violation}
+		if err = jsonseq.ReadRecords(bufio.NewReader(reader), checker.check); err != io.EOF {
+			violation(CheckRecord, checker.record+1, "%v", err)
+		} else if checker.record == 0 {
+			violation(CheckHeader, 1, "file has no header")
+		}
+		if checker.omitted > 0 {
+			violation(CheckRecord, 0, "%d more record violations are not listed", checker.omitted)
+		}
+	}
+	// Read whatever the record reader didn't, so the hash is of the whole file
+	if _, err = io.Copy(hasher, body); err != nil {
+		violation(CheckDownload, 0, "%v", err)
+		return
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != ref.Hash {
+		violation(CheckHash, 0, "hash %v does not match %v in the notification file", sum, ref.Hash)
+	}
+}
+
+// recordChecker checks the records of a snapshot or delta file
+type recordChecker struct {
+	fileType     string
+	notification persist.NotificationJSON
+	ref          persist.FileRefJSON
+	violation    func(check ValidationCheck, record int, format string, args ...any)
+	record       int
+	violations   int
+	omitted      int
+}
+
+func (rc *recordChecker) check(bytes []byte, err error) error {
+	if err != nil && err != io.EOF {
+		return err
+	}
+	rc.record++
+	if rc.record == 1 {
+		rc.checkHeader(bytes)
+		return nil
+	}
+	if msg := rc.recordViolation(bytes); len(msg) > 0 {
+		if rc.violations < maxRecordViolations {
+			rc.violation(CheckRecord, rc.record, "%v", msg)
+		} else {
+			rc.omitted++
+		}
+		rc.violations++
+	}
+	return nil
+}
+
+func (rc *recordChecker) checkHeader(bytes []byte) {
+	header := persist.NrtmFileJSON{}
+	if err := json.Unmarshal(bytes, &header); err != nil {
+		rc.violation(CheckHeader, 1, "header is not valid JSON: %v", err)
+		return
+	}
+	if header.NrtmVersion != 4 {
+		rc.violation(CheckHeader, 1, "nrtm_version is not 4: '%v'", header.NrtmVersion)
+	}
+	if header.Type != rc.fileType {
+		rc.violation(CheckHeader, 1, "type is not %v: '%v'", rc.fileType, header.Type)
+	}
+	if header.Source != rc.notification.Source {
+		rc.violation(CheckHeader, 1, "source '%v' does not match the notification file '%v'", header.Source, rc.notification.Source)
+	}
+	if header.SessionID != rc.notification.SessionID {
+		rc.violation(CheckHeader, 1, "session_id '%v' does not match the notification file '%v'", header.SessionID, rc.notification.SessionID)
+	}
+	if header.Version != rc.ref.Version {
+		rc.violation(CheckHeader, 1, "version %v does not match the notification file %v", header.Version, rc.ref.Version)
+	}
+}
+
+// recordViolation returns a message when the record is not well-formed
+func (rc *recordChecker) recordViolation(bytes []byte) string {
+	if rc.fileType == "snapshot" {
+		obj := persist.SnapshotObjectJSON{}
+		if err := json.Unmarshal(bytes, &obj); err != nil {
+			return "record is not valid JSON: " + err.Error()
+		}
+		return objectViolation(&obj.Object)
+	}
+	delta := persist.DeltaJSON{}
+	if err := json.Unmarshal(bytes, &delta); err != nil {
+		return "record is not valid JSON: " + err.Error()
+	}
+	switch delta.Action {
+	case persist.DeltaAddModifyAction:
+		return objectViolation(delta.Object)
+	case persist.DeltaDeleteAction:
+		if delta.ObjectClass == nil || len(*delta.ObjectClass) == 0 {
+			return "delete has no object_class"
+		}
+		if delta.PrimaryKey == nil || len(*delta.PrimaryKey) == 0 {
+			return "delete has no primary_key"
+		}
+		return ""
+	}
+	return fmt.Sprintf("invalid action: '%v'", delta.Action)
+}
+
+func objectViolation(object *string) string {
+	if object == nil || len(*object) == 0 {
+		return "record has no object"
+	}
+	if _, err := rpsl.ParseFromJSONString(*object); err != nil {
+		return "object cannot be parsed: " + err.Error()
+	}
+	return ""
+}
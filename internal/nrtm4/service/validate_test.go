@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+// fileMapClient serves a notification and files from memory. Files which aren't in the map
+// give an error.
+type fileMapClient struct {
+	notification persist.NotificationJSON
+	files        map[string]string
+}
+
+func (c fileMapClient) getUpdateNotification(context.Context, string, keyFinder) (persist.NotificationJSON, string, error) {
+	return c.notification, "", nil
+}
+
+func (c fileMapClient) getResponseBody(_ context.Context, url string) (io.Reader, error) {
+	content, ok := c.files[url]
+	if !ok {
+		return nil, newNRTMServiceError("not found: %v", url)
+	}
+	return strings.NewReader(content), nil
+}
+
+func (c fileMapClient) getContentLength(_ context.Context, url string) (int64, error) {
+	return int64(len(c.files[url])), nil
+}
+
+func TestValidateServerWithValidFiles(t *testing.T) {
+	p := NewNRTMProcessor(AppConfig{}, nil, NewTestClient(t, baseURL, "version2to6", "unf_2-6.json"))
+
+	report, err := p.ValidateServer(context.Background(), baseURL+stubNotificationURL, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !report.Valid || len(report.Violations) != 0 {
+		t.Error("Expected no violations but was", report.Violations)
+	}
+	if report.FilesChecked != 6 {
+		t.Error("Expected 6 files to be checked but was", report.FilesChecked)
+	}
+	if report.Signature != SignatureUnverified {
+		t.Error("Expected signature to be unverified but was", report.Signature)
+	}
+	if report.Source != "TEST" || report.Version != 6 {
+		t.Error("Report has wrong source or version", report.Source, report.Version)
+	}
+}
+
+func TestValidateServerReportsViolations(t *testing.T) {
+	sessionID := "17db6715-18ae-410f-973e-47981b52f023"
+	header := func(fileType string, version string) string {
+		return `{"nrtm_version":4,"type":"` + fileType + `","source":"TEST","session_id":"` + sessionID + `","version":` + version + `}`
+	}
+	jsonseq := func(records ...string) string {
+		return "\x1e" + strings.Join(records, "\n\x1e") + "\n"
+	}
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	snapshot := jsonseq(header("snapshot", "2"), `{"object":"mntner: TEST-MNT\nsource: TEST"}`)
+	wrongVersion := jsonseq(header("delta", "4"), `{"action":"delete","object_class":"mntner","primary_key":"TEST-MNT"}`)
+	badRecords := jsonseq(header("delta", "4"), `{"action":"destroy"}`, `{"action":"delete","object_class":"mntner"}`, `{"action":"add_modify"}`)
+	unchanged := jsonseq(header("delta", "5"), `{"action":"delete","object_class":"mntner","primary_key":"TEST-MNT"}`)
+	notification := persist.NotificationJSON{
+		NrtmFileJSON: persist.NrtmFileJSON{NrtmVersion: 4, Type: "notification", Source: "TEST", SessionID: sessionID, Version: 6},
+		Timestamp:    "2023-09-19T00:10:00Z",
+		SnapshotRef:  persist.FileRefJSON{Version: 2, URL: "snapshot.json", Hash: hash(snapshot)},
+		DeltaRefs: []persist.FileRefJSON{
+			{Version: 3, URL: "delta.3.json", Hash: hash(wrongVersion)},
+			{Version: 4, URL: "delta.4.json", Hash: hash(badRecords)},
+			{Version: 5, URL: "delta.5.json", Hash: "0000"},
+			{Version: 6, URL: "delta.6.json", Hash: "0000"},
+		},
+	}
+	client := fileMapClient{notification: notification, files: map[string]string{
+		baseURL + "snapshot.json": snapshot,
+		baseURL + "delta.3.json":  wrongVersion,
+		baseURL + "delta.4.json":  badRecords,
+		baseURL + "delta.5.json":  unchanged,
+	}}
+	p := NewNRTMProcessor(AppConfig{}, nil, client)
+
+	report, err := p.ValidateServer(context.Background(), baseURL+stubNotificationURL, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if report.Valid {
+		t.Error("Report should not be valid")
+	}
+	type found struct {
+		check   ValidationCheck
+		version int64
+		record  int
+	}
+	expected := []found{
+		{CheckHeader, 3, 1},
+		{CheckRecord, 4, 2},
+		{CheckRecord, 4, 3},
+		{CheckRecord, 4, 4},
+		{CheckHash, 5, 0},
+		{CheckDownload, 6, 0},
+	}
+	if len(report.Violations) != len(expected) {
+		t.Fatal("Expected", len(expected), "violations but was", report.Violations)
+	}
+	for i, v := range report.Violations {
+		if (found{v.Check, v.Version, v.Record}) != expected[i] {
+			t.Error("Expected", expected[i], "but was", v)
+		}
+	}
+}
+
+func TestValidateServerReportsEveryNotificationViolation(t *testing.T) {
+	notification := persist.NotificationJSON{
+		NrtmFileJSON: persist.NrtmFileJSON{NrtmVersion: 3, Type: "notification", Source: "TEST", SessionID: "short", Version: 6},
+		Timestamp:    "yesterday",
+		SnapshotRef:  persist.FileRefJSON{Version: 2, URL: "ftp://nrtm.example.eu/snapshot.json"},
+		DeltaRefs:    []persist.FileRefJSON{{Version: 4, URL: "delta.4.json"}, {Version: 4, URL: "delta.4.json"}},
+	}
+	p := NewNRTMProcessor(AppConfig{}, nil, fileMapClient{notification: notification})
+
+	report, err := p.ValidateServer(context.Background(), baseURL+stubNotificationURL, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	messages := []string{}
+	for _, v := range report.Violations {
+		if v.Check == CheckNotification && v.URL == baseURL+stubNotificationURL {
+			messages = append(messages, v.Message)
+		}
+	}
+	expected := []string{
+		"nrtm version is not 4",
+		"timestamp is not valid",
+		"session ID is not valid",
+		"snapshot url is not valid",
+		ErrNRTM4DuplicateDeltaVersion.Error(),
+		ErrNRTM4NotificationVersionDoesNotMatchDelta.Error(),
+	}
+	if len(messages) != len(expected) {
+		t.Fatal("Expected", len(expected), "notification violations but was", messages)
+	}
+	for i, msg := range messages {
+		if !strings.Contains(msg, expected[i]) {
+			t.Errorf("Expected %q but was %q", expected[i], msg)
+		}
+	}
+}
+
+func TestValidateServerReportsInvalidSignature(t *testing.T) {
+	token := readNotificationToken(t)
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".jose") {
+			io.WriteString(w, token)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer svr.Close()
+	p := NewNRTMProcessor(AppConfig{}, nil, NewHTTPClient(testHTTPClientConfig(), nil))
+
+	report, err := p.ValidateServer(context.Background(), svr.URL+"/update-notification-file.jose", []string{publicKeyMap["s42.re"]})
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if report.Signature != SignatureInvalid {
+		t.Error("Expected signature to be invalid but was", report.Signature)
+	}
+	if len(report.Violations) == 0 || report.Violations[0].Check != CheckSignature {
+		t.Error("Expected a signature violation first, but was", report.Violations)
+	}
+	notification, _, _ := parseNotificationToken(token, nil)
+	if report.FilesChecked != 2+len(notification.DeltaRefs) {
+		t.Error("Referenced files should still be checked, but was", report.FilesChecked)
+	}
+}
+
+func TestValidateServerRejectsBadKey(t *testing.T) {
+	p := NewNRTMProcessor(AppConfig{}, nil, nil)
+
+	if _, err := p.ValidateServer(context.Background(), baseURL+stubNotificationURL, []string{"not a key"}); err != ErrInvalidSigningKey {
+		t.Error("Expected ErrInvalidSigningKey but was", err)
+	}
+}
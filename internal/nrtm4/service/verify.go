@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// maxVerifyListed is the number of objects listed in each category of a VerifyReport. The
+// rest are counted.
+const maxVerifyListed = 1000
+
+// ObjectKey identifies an RPSL object in a source
+type ObjectKey struct {
+	ObjectType string
+	PrimaryKey string
+}
+
+// VerifyReport lists the differences between the server's snapshot and the repo at the same
+// version
+type VerifyReport struct {
+	Source    string
+	Label     string
+	SessionID string
+	// Version is the snapshot version which was compared
+	Version int64
+	// RepoVersion is the version of the source in the repo
+	RepoVersion uint32
+	Matched     int
+	// Missing are objects in the snapshot which are not in the repo
+	Missing      []ObjectKey
+	MissingCount int
+	// Extra are objects in the repo which are not in the snapshot
+	Extra      []ObjectKey
+	ExtraCount int
+	// Different are objects with a different payload in the repo
+	Different      []ObjectKey
+	DifferentCount int
+	Consistent     bool
+	Checked        time.Time
+}
+
+func (r *VerifyReport) addMissing(key ObjectKey) {
+	if r.MissingCount < maxVerifyListed {
+		r.Missing = append(r.Missing, key)
+	}
+	r.MissingCount++
+}
+
+func (r *VerifyReport) addDifferent(key ObjectKey) {
+	if r.DifferentCount < maxVerifyListed {
+		r.Different = append(r.Different, key)
+	}
+	r.DifferentCount++
+}
+
+// Verify downloads the server's snapshot and compares it with the objects in the repo at the
+// snapshot version. The repo can be ahead of the snapshot, in which case the objects are
+// rebuilt from history. Nothing in the repo is changed.
+func (p NRTMProcessor) Verify(ctx context.Context, sourceName, label string) (VerifyReport, error) {
+	report := VerifyReport{
+		Missing:   []ObjectKey{},
+		Extra:     []ObjectKey{},
+		Different: []ObjectKey{},
+		Checked:   util.AppClock.Now(),
+	}
+	ds := NrtmDataService{Repository: p.repo}
+	source := ds.getSourceByNameAndLabel(sourceName, label)
+	if source == nil {
+		return report, ErrSourceNotFound
+	}
+	report.Source, report.Label, report.SessionID, report.RepoVersion = source.Source, source.Label, source.SessionID, source.Version
+	if isSnapshotUnfinished(source.Status) {
+		return report, ErrSnapshotVersionNotHeld
+	}
+	ctx = withProgressSource(ctx, *source)
+	notification, err := p.fetchNotification(ctx, source.NotificationURL, source.Properties)
+	if err != nil {
+		UserLogger.Warn("Notification file was not downloaded", "error", err)
+		return report, err
+	}
+	if notification.SessionID != source.SessionID {
+		return report, ErrSessionRestarted
+	}
+	snapshotRef := notification.SnapshotRef
+	report.Version = snapshotRef.Version
+	if snapshotRef.Version > int64(source.Version) {
+		UserLogger.Warn("Snapshot is newer than the repo, update the source first", "snapshotVersion", snapshotRef.Version, "version", source.Version)
+		return report, ErrSnapshotVersionNotHeld
+	}
+	UserLogger.Info("Fetching snapshot file", "url", snapshotRef.URL)
+	fm := fileManager{p.client}
+	snapshotFile, err := fm.fetchFileAndCheckHash(ctx, source.NotificationURL, snapshotRef, p.sessionDirectory(*source))
+	if err != nil {
+		return report, err
+	}
+	defer snapshotFile.Close()
+
+	UserLogger.Info("Reading objects from the repo", "source", source.Source, "version", snapshotRef.Version)
+	local := map[ObjectKey][sha256.Size]byte{}
+	err = p.repo.ObjectsAtVersion(ctx, *source, uint32(snapshotRef.Version), nil, func(obj rpsl.Rpsl) error {
+		local[ObjectKey{obj.ObjectType, obj.PrimaryKey}] = sha256.Sum256([]byte(obj.Payload))
+		return nil
+	})
+	if err == persist.ErrVersionNotAvailable {
+		return report, ErrSnapshotVersionNotHeld
+	} else if err != nil {
+		return report, err
+	}
+
+	UserLogger.Info("Comparing snapshot objects", "source", source.Source, "localObjects", len(local))
+	comparer := snapshotComparer{ctx: ctx, notification: notification, local: local, report: &report}
+	if err = fm.readJSONSeqRecords(snapshotFile, comparer.compare); err != io.EOF {
+		return report, err
+	}
+	extra := make([]ObjectKey, 0, len(local))
+	for key := range local {
+		extra = append(extra, key)
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		if extra[i].ObjectType != extra[j].ObjectType {
+			return extra[i].ObjectType < extra[j].ObjectType
+		}
+		return extra[i].PrimaryKey < extra[j].PrimaryKey
+	})
+	report.ExtraCount = len(extra)
+	report.Extra = extra[:min(len(extra), maxVerifyListed)]
+	report.Consistent = report.MissingCount == 0 && report.ExtraCount == 0 && report.DifferentCount == 0
+	UserLogger.Info("Verify finished", "source", source.Source, "matched", report.Matched, "missing", report.MissingCount, "extra", report.ExtraCount, "different", report.DifferentCount)
+	return report, nil
+}
+
+// snapshotComparer removes each snapshot object from local as it's compared, so the objects
+// left are the ones which are not in the snapshot
+type snapshotComparer struct {
+	ctx          context.Context
+	notification persist.NotificationJSON
+	local        map[ObjectKey][sha256.Size]byte
+	report       *VerifyReport
+	record       int
+}
+
+func (sc *snapshotComparer) compare(bytes []byte, err error) error {
+	if err != nil && err != io.EOF {
+		return err
+	}
+	sc.record++
+	if sc.record == 1 {
+		header := persist.SnapshotFileJSON{}
+		if jerr := json.Unmarshal(bytes, &header); jerr != nil {
+			return jerr
+		}
+		if header.SessionID != sc.notification.SessionID {
+			return ErrNRTM4SourceMismatch
+		}
+		if header.Version != sc.notification.SnapshotRef.Version {
+			return ErrNRTM4FileVersionMismatch
+		}
+		return err
+	}
+	if sc.record%rpslInsertBatchSize == 0 {
+		if cerr := sc.ctx.Err(); cerr != nil {
+			return cerr
+		}
+	}
+	so := persist.SnapshotObjectJSON{}
+	if jerr := json.Unmarshal(bytes, &so); jerr != nil {
+		return jerr
+	}
+	// The snapshot loader saves objects which don't fully parse, so they're compared the same way
+	obj, perr := rpsl.ParseFromJSONString(so.Object)
+	if perr != nil {
+		logger.Debug("Snapshot object did not parse", "object", so.Object, "error", perr)
+	}
+	key := ObjectKey{obj.ObjectType, obj.PrimaryKey}
+	sum, ok := sc.local[key]
+	switch {
+	case !ok:
+		sc.report.addMissing(key)
+	case sum != sha256.Sum256([]byte(obj.Payload)):
+		sc.report.addDifferent(key)
+	default:
+		sc.report.Matched++
+	}
+	delete(sc.local, key)
+	return err
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+)
+
+func verifyTestClient(snapshotVersion int64, objects ...string) fileMapClient {
+	sessionID := "17db6715-18ae-410f-973e-47981b52f023"
+	records := []string{`{"nrtm_version":4,"type":"snapshot","source":"TEST","session_id":"` + sessionID + `","version":3}`}
+	for _, obj := range objects {
+		records = append(records, `{"object":"`+strings.ReplaceAll(obj, "\n", `\n`)+`"}`)
+	}
+	snapshot := "\x1e" + strings.Join(records, "\n\x1e") + "\n"
+	sum := sha256.Sum256([]byte(snapshot))
+	notification := persist.NotificationJSON{
+		NrtmFileJSON: persist.NrtmFileJSON{NrtmVersion: 4, Type: "notification", Source: "TEST", SessionID: sessionID, Version: 5},
+		Timestamp:    "2023-09-19T00:10:00Z",
+		SnapshotRef:  persist.FileRefJSON{Version: snapshotVersion, URL: "nrtm-snapshot.3.TEST.json", Hash: hex.EncodeToString(sum[:])},
+		DeltaRefs: []persist.FileRefJSON{
+			{Version: 4, URL: "nrtm-delta.4.TEST.json", Hash: "0000"},
+			{Version: 5, URL: "nrtm-delta.5.TEST.json", Hash: "0000"},
+		},
+	}
+	return fileMapClient{notification: notification, files: map[string]string{baseURL + "nrtm-snapshot.3.TEST.json": snapshot}}
+}
+
+func verifyTestSource() persist.NRTMSource {
+	return persist.NRTMSource{
+		ID:              1,
+		Source:          "TEST",
+		SessionID:       "17db6715-18ae-410f-973e-47981b52f023",
+		Version:         5,
+		NotificationURL: baseURL + stubNotificationURL,
+		Status:          "ok",
+	}
+}
+
+func TestVerifyReportsDifferences(t *testing.T) {
+	mntner := "mntner: TEST-MNT\nsource: TEST"
+	person := "person: Test Person\nnic-hdl: TP1-TEST\nsource: TEST"
+	changedPerson := "person: Test Person\nnic-hdl: TP1-TEST\nremarks: changed\nsource: TEST"
+	route := "route: 192.0.2.0/24\norigin: AS64500\nsource: TEST"
+	asSet := "as-set: AS-TEST\nsource: TEST"
+	repo := mockRepo{
+		sources:  []persist.NRTMSource{verifyTestSource()},
+		versions: map[uint32][]string{3: {mntner, changedPerson, asSet}},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, verifyTestClient(3, mntner, person, route))
+
+	report, err := p.Verify(context.Background(), "TEST", "")
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if report.Consistent {
+		t.Error("Report should not be consistent")
+	}
+	if report.Version != 3 || report.RepoVersion != 5 {
+		t.Error("Expected snapshot version 3 and repo version 5 but was", report.Version, report.RepoVersion)
+	}
+	if report.Matched != 1 {
+		t.Error("Expected 1 object to match but was", report.Matched)
+	}
+	expect := func(name string, keys []ObjectKey, count int, expected ObjectKey) {
+		if count != 1 || len(keys) != 1 || keys[0] != expected {
+			t.Error("Expected", name, expected, "but was", keys, count)
+		}
+	}
+	expect("missing", report.Missing, report.MissingCount, ObjectKey{"ROUTE", "192.0.2.0/24AS64500"})
+	expect("extra", report.Extra, report.ExtraCount, ObjectKey{"AS-SET", "AS-TEST"})
+	expect("different", report.Different, report.DifferentCount, ObjectKey{"PERSON", "TP1-TEST"})
+}
+
+func TestVerifyWhenConsistent(t *testing.T) {
+	mntner := "mntner: TEST-MNT\nsource: TEST"
+	repo := mockRepo{
+		sources:  []persist.NRTMSource{verifyTestSource()},
+		versions: map[uint32][]string{3: {mntner}},
+	}
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, verifyTestClient(3, mntner))
+
+	report, err := p.Verify(context.Background(), "TEST", "")
+
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !report.Consistent || report.Matched != 1 {
+		t.Error("Expected a consistent report but was", report)
+	}
+}
+
+func TestVerifyNeedsSnapshotVersionInRepo(t *testing.T) {
+	source := verifyTestSource()
+	repo := mockRepo{sources: []persist.NRTMSource{source}, versions: map[uint32][]string{}}
+	for _, version := range []int64{3, 6} {
+		p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, repo, verifyTestClient(version))
+
+		if _, err := p.Verify(context.Background(), "TEST", ""); err != ErrSnapshotVersionNotHeld {
+			t.Error("Expected ErrSnapshotVersionNotHeld for snapshot version", version, "but was", err)
+		}
+	}
+}
+
+func TestVerifyWhenSessionRestarted(t *testing.T) {
+	source := verifyTestSource()
+	source.SessionID = "another-session"
+	p := NewNRTMProcessor(AppConfig{NRTMFilePath: t.TempDir()}, mockRepo{sources: []persist.NRTMSource{source}}, verifyTestClient(3))
+
+	if _, err := p.Verify(context.Background(), "TEST", ""); err != ErrSessionRestarted {
+		t.Error("Expected ErrSessionRestarted but was", err)
+	}
+}
@@ -134,7 +134,7 @@ func pgRepo() persist.Repository {
 	}
 	repo := pg.PostgresRepository{}
 	if err := repo.Initialize(dbURL); err != nil {
-		log.Fatal("Failed to initialize repository")
+		log.Fatal("Failed to initialize repository: ", err)
 	}
 	return &repo
 }
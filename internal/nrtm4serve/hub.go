@@ -23,8 +23,16 @@ const (
 	maxMessageSize = 32 * 1024
 )
 
+const (
+	// logMessage Content is a log record
+	logMessage = "log"
+	// progressMessage Content is a service.ProgressEvent
+	progressMessage = "progress"
+)
+
 type message struct {
 	ID      string
+	Type    string
 	Content map[string]any
 }
 
@@ -144,7 +152,7 @@ func newHub() *Hub {
 	}
 }
 
-var broadcastChannels = util.NewSet("logs")
+var broadcastChannels = util.NewSet("logs", "progress")
 
 func (h *Hub) run() {
 	sendMessage := func(client *Client, msg message) {
@@ -0,0 +1,205 @@
+package nrtm4serve
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/util"
+)
+
+// JobState is the lifecycle state of a job
+type JobState string
+
+const (
+	// JobRunning the operation has not finished
+	JobRunning JobState = "running"
+	// JobDone the operation finished without error
+	JobDone JobState = "done"
+	// JobFailed the operation returned an error
+	JobFailed JobState = "failed"
+	// JobCancelled the operation was stopped by CancelJob
+	JobCancelled JobState = "cancelled"
+)
+
+const (
+	// maxFinishedJobs is how many finished jobs are kept for ListJobs
+	maxFinishedJobs = 100
+	// cancelWait is how long CancelJob waits for a job to stop
+	cancelWait = 10 * time.Second
+)
+
+// ErrJobNotFound no job has the given ID
+var ErrJobNotFound = errors.New("job not found")
+
+// Job is a long-running operation started from the web API
+type Job struct {
+	ID        string
+	Operation string
+	Source    string
+	Label     string
+	State     JobState
+	Error     string
+	Started   time.Time
+	Finished  *time.Time
+}
+
+type jobEntry struct {
+	seq    uint64
+	job    Job
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// jobRegistry keeps track of jobs while they run, and for a while after they finish
+type jobRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	jobs   map[string]*jobEntry
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*jobEntry)}
+}
+
+// start runs fn in a goroutine and returns the job straight away. The context passed to fn is
+// cancelled by cancel.
+func (r *jobRegistry) start(operation, source, label string, fn func(context.Context) error) Job {
+	_, job := r.launch(operation, source, label, fn)
+	return job
+}
+
+// run starts a job and waits for it to finish
+func (r *jobRegistry) run(operation, source, label string, fn func(context.Context) error) (Job, error) {
+	var fnErr error
+	entry, _ := r.launch(operation, source, label, func(ctx context.Context) error {
+		fnErr = fn(ctx)
+		return fnErr
+	})
+	<-entry.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return entry.job, fnErr
+}
+
+// launch registers a job and runs fn in a goroutine. The job is returned as it was when it started.
+func (r *jobRegistry) launch(operation, source, label string, fn func(context.Context) error) (*jobEntry, Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.nextID++
+	entry := &jobEntry{
+		seq: r.nextID,
+		job: Job{
+			ID:        strconv.FormatUint(r.nextID, 10),
+			Operation: operation,
+			Source:    source,
+			Label:     label,
+			State:     JobRunning,
+			Started:   util.AppClock.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.jobs[entry.job.ID] = entry
+	started := entry.job
+	r.mu.Unlock()
+
+	service.UserLogger.Info("Job started", "job", started.ID, "operation", operation, "source", source, "label", label)
+	go func() {
+		defer close(entry.done)
+		defer cancel()
+		err := fn(ctx)
+		job := r.finish(ctx, entry, err)
+		service.UserLogger.Info("Job finished", "job", job.ID, "operation", job.Operation, "state", job.State)
+	}()
+	return entry, started
+}
+
+func (r *jobRegistry) finish(ctx context.Context, entry *jobEntry, err error) Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := util.AppClock.Now()
+	entry.job.Finished = &now
+	if err == nil {
+		entry.job.State = JobDone
+	} else if ctx.Err() != nil {
+		entry.job.State = JobCancelled
+		entry.job.Error = err.Error()
+	} else {
+		entry.job.State = JobFailed
+		entry.job.Error = err.Error()
+	}
+	r.prune()
+	return entry.job
+}
+
+// prune removes the oldest finished jobs. Caller must hold the lock.
+func (r *jobRegistry) prune() {
+	finished := []*jobEntry{}
+	for _, e := range r.jobs {
+		if e.job.State != JobRunning {
+			finished = append(finished, e)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	slices.SortFunc(finished, func(a, b *jobEntry) int {
+		return cmp.Or(a.job.Finished.Compare(*b.job.Finished), cmp.Compare(a.seq, b.seq))
+	})
+	for _, e := range finished[:len(finished)-maxFinishedJobs] {
+		delete(r.jobs, e.job.ID)
+	}
+}
+
+func (r *jobRegistry) get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return entry.job, true
+}
+
+// list returns all jobs, oldest first
+func (r *jobRegistry) list() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]*jobEntry, 0, len(r.jobs))
+	for _, e := range r.jobs {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *jobEntry) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	jobs := make([]Job, len(entries))
+	for i, e := range entries {
+		jobs[i] = e.job
+	}
+	return jobs
+}
+
+// cancel stops a running job and waits a while for it to finish. Finished jobs are not changed.
+func (r *jobRegistry) cancel(id string) (Job, error) {
+	r.mu.Lock()
+	entry, ok := r.jobs[id]
+	r.mu.Unlock()
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	entry.cancel()
+	select {
+	case <-entry.done:
+	case <-time.After(cancelWait):
+		logger.Warn("Job is still running after it was cancelled", "job", id)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return entry.job, nil
+}
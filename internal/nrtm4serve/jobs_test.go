@@ -0,0 +1,77 @@
+package nrtm4serve
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJobRunReportsState(t *testing.T) {
+	jobs := newJobRegistry()
+
+	job, err := jobs.run("update", "TEST", "", func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if job.State != JobDone || job.Finished == nil {
+		t.Error("Job should be done", job)
+	}
+
+	testErr := errors.New("test error")
+	job, err = jobs.run("update", "TEST", "", func(ctx context.Context) error {
+		return testErr
+	})
+	if err != testErr {
+		t.Error("Expected the job's error but was", err)
+	}
+	if job.State != JobFailed || job.Error != testErr.Error() {
+		t.Error("Job should have failed", job)
+	}
+	if len(jobs.list()) != 2 {
+		t.Error("Expected 2 jobs but was", len(jobs.list()))
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	jobs := newJobRegistry()
+	started := make(chan struct{})
+
+	job := jobs.start("connect", "https://example.com/notification.json", "", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-started
+	if running, ok := jobs.get(job.ID); !ok || running.State != JobRunning {
+		t.Fatal("Job should be running", running)
+	}
+
+	cancelled, err := jobs.cancel(job.ID)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if cancelled.State != JobCancelled {
+		t.Error("Job should be cancelled but was", cancelled.State)
+	}
+	if _, err := jobs.cancel("no such job"); err != ErrJobNotFound {
+		t.Error("Expected ErrJobNotFound but was", err)
+	}
+}
+
+func TestFinishedJobsArePruned(t *testing.T) {
+	jobs := newJobRegistry()
+	for range maxFinishedJobs + 5 {
+		jobs.run("remove", "TEST", "", func(ctx context.Context) error {
+			return nil
+		})
+	}
+	list := jobs.list()
+	if len(list) != maxFinishedJobs {
+		t.Fatal("Expected", maxFinishedJobs, "jobs but was", len(list))
+	}
+	if list[0].ID != "6" {
+		t.Error("Oldest jobs should be removed first, but first job was", list[0].ID)
+	}
+}
@@ -33,23 +33,43 @@ func (mw messagewriter) Write(b []byte) (int, error) {
 	}
 	msg := message{
 		ID:      "logs",
+		Type:    logMessage,
 		Content: m,
 	}
 	mw.hub.send <- msg
 	return len(b), nil
 }
 
+// sendProgress broadcasts a progress event to web clients
+func (mw messagewriter) sendProgress(ev service.ProgressEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		logger.Warn("Cannot marshal progress event", "error", err)
+		return
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		logger.Warn("Cannot unmarshal progress event", "error", err)
+		return
+	}
+	mw.hub.send <- message{
+		ID:      "progress",
+		Type:    progressMessage,
+		Content: m,
+	}
+}
+
 // Launch sets up the rpc handler and starts the server
 func Launch(config service.AppConfig, port int, webDir string) {
 	repo := pg.PostgresRepository{}
 	if err := repo.Initialize(config.PgDatabaseURL); err != nil {
-		log.Fatal("Failed to initialize repository")
+		log.Fatal("Failed to initialize repository: ", err)
 	}
 	defer repo.Close()
 	logger.Info("NRTM4serve is starting", "port", port)
-	processor := service.NewNRTMProcessor(config, repo, service.HTTPClient{})
+	processor := service.NewNRTMProcessor(config, repo, service.NewHTTPClient(service.DefaultHTTPClientConfig(), nil))
 	go processor.StartAutoUpdater()
-	rpcHandler := rpc.Handler{API: WebAPI{Processor: processor}}
+	rpcHandler := rpc.Handler{API: NewWebAPI(processor)}
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Error("Recovered from Panic in launcher", "recover", r)
@@ -65,6 +85,7 @@ func Launch(config service.AppConfig, port int, webDir string) {
 	s.Router().HandleFunc("/ws", wsHandler(hub))
 
 	mw := messagewriter{hub}
+	service.ProgressHandler = mw.sendProgress
 	service.UserLogger = slog.New(
 		slog.NewJSONHandler(
 			mw,
@@ -1,7 +1,10 @@
 package nrtm4serve
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
 	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
@@ -21,12 +24,29 @@ var (
 	DeltaUnavaliableErrorCode = -32040
 	// NRTMServiceErrorCode -32050
 	NRTMServiceErrorCode = -32050
+	// DeltaHashChangedErrorCode -32060
+	DeltaHashChangedErrorCode = -32060
+	// JobNotFoundErrorCode -32070
+	JobNotFoundErrorCode = -32070
+	// SignatureErrorCode -32080
+	SignatureErrorCode = -32080
+	// VersionNotHeldErrorCode -32090
+	VersionNotHeldErrorCode = -32090
+
+	// InvalidParamsErrorCode -32602 is the JSON-RPC code for parameters which are not valid
+	InvalidParamsErrorCode = -32602
 )
 
 // WebAPI defines the RPC functions used by the web client
 type WebAPI struct {
 	//	rpc.API
 	Processor service.NRTMProcessor
+	jobs      *jobRegistry
+}
+
+// NewWebAPI creates a WebAPI with an empty job registry
+func NewWebAPI(processor service.NRTMProcessor) WebAPI {
+	return WebAPI{Processor: processor, jobs: newJobRegistry()}
 }
 
 // GetAuth implements rpc.API interface -- allows requests to all methods
@@ -67,23 +87,34 @@ func (api WebAPI) SaveProperties(source, label string, props persist.SourcePrope
 	return src, err
 }
 
-// Connect connects a new source to the repo
-func (api WebAPI) Connect(url, label string) (string, error) {
-	go func() {
-		err := api.Processor.Connect(url, label)
+// Connect starts a job which connects a new source to the repo
+func (api WebAPI) Connect(url, label string) (Job, error) {
+	job := api.jobs.start("connect", url, label, func(ctx context.Context) error {
+		err := api.Processor.Connect(ctx, url, label)
 		if err != nil {
 			service.UserLogger.Error("Connect failed", "url", url, "label", label, "error", err)
 		}
-	}()
-	return "OK", nil
+		return err
+	})
+	return job, nil
 }
 
-// Update updates a source to the latest version
+// Update updates a source to the latest version. It runs as a job, so it can be cancelled,
+// but the response is sent when it's finished.
 func (api WebAPI) Update(src, label string) (persist.NRTMSourceDetails, error) {
-	target, err := api.Processor.Update(src, label)
+	var target *persist.NRTMSource
+	_, err := api.jobs.run("update", src, label, func(ctx context.Context) error {
+		var err error
+		target, err = api.Processor.Update(ctx, src, label)
+		return err
+	})
 	if err != nil {
 		return persist.NRTMSourceDetails{}, wrapErr(err)
 	}
+	if target == nil {
+		// The source was removed while it was updated
+		return persist.NRTMSourceDetails{}, wrapErr(service.ErrSourceNotFound)
+	}
 	deets, err := api.Processor.ListSources()
 	if err != nil {
 		return persist.NRTMSourceDetails{}, wrapErr(err)
@@ -96,10 +127,145 @@ func (api WebAPI) Update(src, label string) (persist.NRTMSourceDetails, error) {
 	return persist.NRTMSourceDetails{}, nil
 }
 
-// RemoveSource removes a source from the repo
-func (api WebAPI) RemoveSource(src, label string) (string, error) {
-	go api.Processor.RemoveSource(src, label)
-	return "OK", nil
+// PlanUpdate reports what Update would do, without changing the repo
+func (api WebAPI) PlanUpdate(r *http.Request, src, label string) (service.UpdatePlan, error) {
+	plan, err := api.Processor.PlanUpdate(r.Context(), src, label)
+	return plan, wrapErr(err)
+}
+
+// Verify compares the server's snapshot with the repo at the same version. It runs as a job, so
+// it can be cancelled, but the response is sent when it's finished.
+func (api WebAPI) Verify(src, label string) (service.VerifyReport, error) {
+	var report service.VerifyReport
+	_, err := api.jobs.run("verify", src, label, func(ctx context.Context) error {
+		var err error
+		report, err = api.Processor.Verify(ctx, src, label)
+		return err
+	})
+	return report, wrapErr(err)
+}
+
+// maxObjectsPerResponse is the most objects ObjectsAt returns. The whole of a source can be
+// written with the objects command.
+const maxObjectsPerResponse = 10000
+
+// ObjectsAt returns the objects of a source as they were at a version, or at a time which is
+// RFC 3339 or a date. If version is 0 and at is empty, the current objects are returned. No
+// more than limit objects are returned, or maxObjectsPerResponse if it's 0 or more than that.
+func (api WebAPI) ObjectsAt(r *http.Request, src, label string, version int, at string, objectTypes []string, limit int) (service.SourceState, error) {
+	var ts time.Time
+	if len(at) > 0 {
+		var err error
+		if ts, err = service.ParseTimestamp(at); err != nil {
+			return service.SourceState{}, wrapErr(err)
+		}
+	}
+	if version < 0 {
+		return service.SourceState{}, wrapErr(service.ErrVersionNotHeld)
+	}
+	if limit <= 0 || limit > maxObjectsPerResponse {
+		limit = maxObjectsPerResponse
+	}
+	state, err := api.Processor.SourceStateAt(r.Context(), src, label, uint32(version), ts, objectTypes, limit)
+	return state, wrapErr(err)
+}
+
+// GetObjectHistory returns every revision of an object, including deletions
+func (api WebAPI) GetObjectHistory(src, label, objectType, primaryKey string) (service.ObjectHistory, error) {
+	history, err := api.Processor.GetObjectHistory(src, label, objectType, primaryKey)
+	return history, wrapErr(err)
+}
+
+// Diff returns the objects which changed between two versions of a source. A toVersion of 0
+// is the current version. No more than limit changes are returned, unless it's 0.
+func (api WebAPI) Diff(r *http.Request, src, label string, fromVersion, toVersion, limit int) (service.ChangeSet, error) {
+	if fromVersion < 0 || toVersion < 0 {
+		return service.ChangeSet{}, wrapErr(service.ErrInvalidVersionRange)
+	}
+	changes, err := api.Processor.Diff(r.Context(), src, label, uint32(fromVersion), uint32(toVersion), limit)
+	return changes, wrapErr(err)
+}
+
+// SetValidationMode sets how objects are checked against their class templates when files are
+// loaded into a source: none, lenient or strict
+func (api WebAPI) SetValidationMode(src, label, mode string) (*persist.NRTMSource, error) {
+	validation, err := persist.ParseValidationMode(mode)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	source, err := api.Processor.SetValidationMode(src, label, validation)
+	return source, wrapErr(err)
+}
+
+// ListInvalidObjects returns the report of a source's invalid objects
+func (api WebAPI) ListInvalidObjects(src, label string) (service.InvalidObjectReport, error) {
+	report, err := api.Processor.InvalidObjects(src, label)
+	return report, wrapErr(err)
+}
+
+// ExpandSet resolves an as-set to its AS numbers, or a route-set to its prefixes, recursively.
+// Sets are looked up in sources in order, or in all sources without a label if it's empty.
+// A maxDepth of 0 is service.DefaultExpandDepth.
+func (api WebAPI) ExpandSet(r *http.Request, name string, sources []string, maxDepth int) (service.SetExpansion, error) {
+	opts := service.ExpandOptions{Sources: sources, MaxDepth: maxDepth}
+	exp, err := api.Processor.ExpandSet(r.Context(), name, opts)
+	return exp, wrapErr(err)
+}
+
+// RemoveSource starts a job which removes a source from the repo
+func (api WebAPI) RemoveSource(src, label string) (Job, error) {
+	job := api.jobs.start("remove", src, label, func(ctx context.Context) error {
+		return api.Processor.RemoveSource(ctx, src, label)
+	})
+	return job, nil
+}
+
+// GetJob returns the job with the given ID
+func (api WebAPI) GetJob(id string) (Job, error) {
+	job, ok := api.jobs.get(id)
+	if !ok {
+		return Job{}, wrapErr(ErrJobNotFound)
+	}
+	return job, nil
+}
+
+// ListJobs returns running jobs and recently finished ones, oldest first
+func (api WebAPI) ListJobs() ([]Job, error) {
+	return api.jobs.list(), nil
+}
+
+// CancelJob stops a running job. Downloads and database transactions are abandoned.
+func (api WebAPI) CancelJob(id string) (Job, error) {
+	job, err := api.jobs.cancel(id)
+	return job, wrapErr(err)
+}
+
+// AddSigningKey adds a trusted key for a source name or notification URL
+func (api WebAPI) AddSigningKey(source, url, pem string) (persist.SigningKey, error) {
+	key, err := api.Processor.AddSigningKey(source, url, pem)
+	return key, wrapErr(err)
+}
+
+// ListSigningKeys returns all trusted keys
+func (api WebAPI) ListSigningKeys() ([]persist.SigningKey, error) {
+	keys, err := api.Processor.ListSigningKeys()
+	return keys, wrapErr(err)
+}
+
+// ListSigningKeyEvents returns the audit trail of key changes for a source, or all sources if
+// source is empty
+func (api WebAPI) ListSigningKeyEvents(source string) ([]persist.SigningKeyEvent, error) {
+	events, err := api.Processor.ListSigningKeyEvents(source)
+	return events, wrapErr(err)
+}
+
+// RemoveSigningKey removes a trusted key
+func (api WebAPI) RemoveSigningKey(id string) error {
+	keyID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return wrapErr(service.ErrSigningKeyNotFound)
+	}
+	return wrapErr(api.Processor.RemoveSigningKey(keyID))
 }
 
 func wrapErr(err error) error {
@@ -117,10 +283,28 @@ func wrapErr(err error) error {
 		return rpc.JSONRPCError{Code: SnapshotInsertFailedErrorCode, Message: err.Error()}
 	case service.ErrNRTM4NoDeltasInNotification:
 		return rpc.JSONRPCError{Code: NoDeltasInNotificationErrorCode, Message: err.Error()}
+	case ErrJobNotFound:
+		return rpc.JSONRPCError{Code: JobNotFoundErrorCode, Message: err.Error()}
+	case service.ErrNotificationUnsigned,
+		service.ErrNotificationSignatureInvalid,
+		service.ErrInvalidSigningKey,
+		service.ErrSigningKeyNeedsSource,
+		service.ErrSigningKeyNotFound:
+		return rpc.JSONRPCError{Code: SignatureErrorCode, Message: err.Error()}
+	case service.ErrSnapshotVersionNotHeld, service.ErrVersionNotHeld:
+		return rpc.JSONRPCError{Code: VersionNotHeldErrorCode, Message: err.Error()}
+	case service.ErrInvalidVersionRange,
+		service.ErrInvalidTimestamp,
+		service.ErrInvalidSetName,
+		service.ErrSetNotFound,
+		persist.ErrInvalidValidationMode:
+		return rpc.JSONRPCError{Code: InvalidParamsErrorCode, Message: err.Error()}
 	}
 	switch err.(type) {
 	case service.ErrNRTMServiceError:
 		return rpc.JSONRPCError{Code: NRTMServiceErrorCode, Message: err.Error()}
+	case service.ErrDeltaHashChanged:
+		return rpc.JSONRPCError{Code: DeltaHashChangedErrorCode, Message: err.Error()}
 	}
 	return err
 }
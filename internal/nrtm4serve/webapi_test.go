@@ -0,0 +1,71 @@
+package nrtm4serve
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/petchells/nrtm4tools/internal/nrtm4/persist"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/rpsl"
+	"github.com/petchells/nrtm4tools/internal/nrtm4/service"
+	"github.com/petchells/nrtm4tools/internal/nrtm4serve/rpc"
+)
+
+func TestWrapErrInvalidParams(t *testing.T) {
+	for _, err := range []error{
+		service.ErrInvalidVersionRange,
+		service.ErrInvalidTimestamp,
+		service.ErrInvalidSetName,
+		service.ErrSetNotFound,
+		persist.ErrInvalidValidationMode,
+	} {
+		rpcErr, ok := wrapErr(err).(rpc.JSONRPCError)
+		if !ok || rpcErr.Code != InvalidParamsErrorCode || rpcErr.Message != err.Error() {
+			t.Error("Expected an invalid params error for", err, "but was", wrapErr(err))
+		}
+	}
+}
+
+func TestSetValidationModeRejectsUnknownMode(t *testing.T) {
+	_, err := WebAPI{}.SetValidationMode("TEST", "", "picky")
+	if rpcErr, ok := err.(rpc.JSONRPCError); !ok || rpcErr.Code != InvalidParamsErrorCode {
+		t.Error("Expected an invalid params error but was", err)
+	}
+}
+
+// objectsRepo has one source with more objects than ObjectsAt returns
+type objectsRepo struct {
+	persist.Repository
+}
+
+func (r objectsRepo) ListSources() ([]persist.NRTMSource, error) {
+	return []persist.NRTMSource{{ID: 1, Source: "TEST", Version: 10, Status: "ok"}}, nil
+}
+
+func (r objectsRepo) ObjectsAtVersion(ctx context.Context, source persist.NRTMSource, version uint32, objectTypes []string, fn func(rpsl.Rpsl) error) error {
+	for range maxObjectsPerResponse + 1 {
+		if err := fn(rpsl.Rpsl{ObjectType: "MNTNER"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestObjectsAtIsLimited(t *testing.T) {
+	api := NewWebAPI(service.NewNRTMProcessor(service.AppConfig{}, objectsRepo{}, nil))
+	r := httptest.NewRequest("POST", "/rpc", nil)
+
+	for _, limit := range []int{0, maxObjectsPerResponse + 10} {
+		state, err := api.ObjectsAt(r, "TEST", "", 0, "", []string{}, limit)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if len(state.Objects) != maxObjectsPerResponse || !state.Truncated {
+			t.Error("Expected", maxObjectsPerResponse, "objects for limit", limit, "but was", len(state.Objects), state.Truncated)
+		}
+	}
+	state, _ := api.ObjectsAt(r, "TEST", "", 0, "", []string{}, 5)
+	if len(state.Objects) != 5 {
+		t.Error("Expected 5 objects but was", len(state.Objects))
+	}
+}
@@ -1,4 +1,4 @@
-import { SourceDetail, SourceProperties } from "./models";
+import { ChangeSet, InvalidObjectReport, Job, ObjectHistory, SetExpansion, SigningKey, SigningKeyEvent, SourceDetail, SourceProperties, SourceState, VerifyReport } from "./models";
 import RPCClient from "./RPCClient";
 
 export default class WebAPIClient {
@@ -40,7 +40,7 @@ export default class WebAPIClient {
 		url: string,
 		label: string,
 	) {
-		return this.client.execute<string>("Connect", [
+		return this.client.execute<Job>("Connect", [
 			url,
 			label,
 		])
@@ -56,16 +56,136 @@ export default class WebAPIClient {
 		])
 	}
 
+	public verifySource(
+		source: string,
+		label: string,
+	) {
+		return this.client.execute<VerifyReport>("Verify", [
+			source,
+			label,
+		])
+	}
+
+	public objectsAt(
+		source: string,
+		label: string,
+		version: number,
+		at: string,
+		objectTypes: string[],
+		limit: number,
+	) {
+		return this.client.execute<SourceState>("ObjectsAt", [
+			source,
+			label,
+			version,
+			at,
+			objectTypes,
+			limit,
+		])
+	}
+
+	public getObjectHistory(
+		source: string,
+		label: string,
+		objectType: string,
+		primaryKey: string,
+	) {
+		return this.client.execute<ObjectHistory>("GetObjectHistory", [
+			source,
+			label,
+			objectType,
+			primaryKey,
+		])
+	}
+
+	public diff(
+		source: string,
+		label: string,
+		fromVersion: number,
+		toVersion: number,
+		limit: number,
+	) {
+		return this.client.execute<ChangeSet>("Diff", [
+			source,
+			label,
+			fromVersion,
+			toVersion,
+			limit,
+		])
+	}
+
+	public setValidationMode(
+		source: string,
+		label: string,
+		mode: "none" | "lenient" | "strict",
+	) {
+		return this.client.execute<SourceDetail>("SetValidationMode", [
+			source,
+			label,
+			mode,
+		])
+	}
+
+	public listInvalidObjects(
+		source: string,
+		label: string,
+	) {
+		return this.client.execute<InvalidObjectReport>("ListInvalidObjects", [
+			source,
+			label,
+		])
+	}
+
+	public expandSet(
+		name: string,
+		sources: string[],
+		maxDepth: number,
+	) {
+		return this.client.execute<SetExpansion>("ExpandSet", [
+			name,
+			sources,
+			maxDepth,
+		])
+	}
+
 	public removeSource(
 		source: string,
 		label: string,
 	) {
-		return this.client.execute<string>("RemoveSource", [
+		return this.client.execute<Job>("RemoveSource", [
 			source,
 			label,
 		])
 	}
 
+	public getJob(id: string) {
+		return this.client.execute<Job>("GetJob", [id])
+	}
+
+	public listJobs() {
+		return this.client.execute<Job[]>("ListJobs")
+	}
+
+	public cancelJob(id: string) {
+		return this.client.execute<Job>("CancelJob", [id])
+	}
+
+	public addSigningKey(source: string, url: string, pem: string) {
+		return this.client.execute<SigningKey>("AddSigningKey", [source, url, pem])
+	}
+
+	public listSigningKeys() {
+		return this.client.execute<SigningKey[]>("ListSigningKeys")
+	}
+
+	public listSigningKeyEvents(source: string) {
+		return this.client.execute<SigningKeyEvent[]>("ListSigningKeyEvents", [source])
+	}
+
+	public removeSigningKey(id: string) {
+		return this.client.execute<void>("RemoveSigningKey", [id])
+	}
+
 	public fetchSource(
 		source: string,
 		label: string,
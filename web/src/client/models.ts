@@ -52,14 +52,173 @@ export interface SourceDetail {
 export interface SourceProperties {
 	UpdateMode: UpdateMode;
 	AutoUpdateInterval: number;
+	RequireSignature: boolean;
+	Retention?: RetentionPolicy;
+	Validation?: ValidationMode;
+}
+
+// ValidationMode 0 none, 1 lenient, 2 strict
+export type ValidationMode = 0 | 1 | 2;
+
+export interface RetentionPolicy {
+	KeepDeltas: number;
+	MaxAgeDays: number;
+	CurrentSnapshotOnly: boolean;
+}
+
+export interface SigningKey {
+	ID: string;
+	Source: string;
+	NotificationURL: string;
+	PEM: string;
+	Fingerprint: string;
+	Status: "active" | "pending" | "retired";
+	Created: string;
+}
+
+export interface SigningKeyEvent {
+	ID: string;
+	KeyID: string;
+	Source: string;
+	NotificationURL: string;
+	Fingerprint: string;
+	Event: "added" | "announced" | "activated" | "retired" | "removed";
+	Created: string;
+}
+
+export type JobState = "running" | "done" | "failed" | "cancelled";
+
+export interface Job {
+	ID: string;
+	Operation: string;
+	Source: string;
+	Label: string;
+	State: JobState;
+	Error: string;
+	Started: string;
+	Finished: string | null;
+}
+
+export interface ObjectKey {
+	ObjectType: string;
+	PrimaryKey: string;
+}
+
+export interface VerifyReport {
+	Source: string;
+	Label: string;
+	SessionID: string;
+	Version: number;
+	RepoVersion: number;
+	Matched: number;
+	Missing: ObjectKey[];
+	MissingCount: number;
+	Extra: ObjectKey[];
+	ExtraCount: number;
+	Different: ObjectKey[];
+	DifferentCount: number;
+	Consistent: boolean;
+	Checked: string;
 }
 
 export enum UpdateMode {
 	Preserve,
 	Replace,
+	Stage,
 }
 
 export interface AppConfig {
 	WebSocketURL: string;
 	RPCEndpoint: string;
 }
+
+export interface RpslObject {
+	PrimaryKey: string;
+	Source: string;
+	ObjectType: string;
+	Payload: string;
+}
+
+export interface SourceState {
+	Source: string;
+	Label: string;
+	Version: number;
+	Objects: RpslObject[];
+	Truncated: boolean;
+}
+
+export interface ObjectRevision {
+	Version: number;
+	Timestamp: string | null;
+	Deleted: boolean;
+	RPSL: string;
+}
+
+export interface ObjectHistory {
+	Source: string;
+	Label: string;
+	ObjectType: string;
+	PrimaryKey: string;
+	Revisions: ObjectRevision[];
+}
+
+export interface ObjectChange {
+	ObjectType: string;
+	PrimaryKey: string;
+	Action: "added" | "modified" | "deleted";
+	Before: string;
+	After: string;
+}
+
+export interface ChangeSet {
+	Source: string;
+	Label: string;
+	FromVersion: number;
+	ToVersion: number;
+	Added: number;
+	Modified: number;
+	Deleted: number;
+	Changes: ObjectChange[];
+	Truncated: boolean;
+}
+
+export interface ValidationFinding {
+	Attribute?: string;
+	Message: string;
+}
+
+export interface InvalidObject {
+	ObjectType: string;
+	PrimaryKey: string;
+	Version: number;
+	Rejected: boolean;
+	Findings: ValidationFinding[];
+	RPSL: string;
+	Created: string;
+}
+
+export interface InvalidObjectReport {
+	Source: string;
+	Label: string;
+	Validation: "none" | "lenient" | "strict";
+	Rejected: number;
+	Objects: InvalidObject[];
+}
+
+export interface ExpandedSet {
+	Name: string;
+	Source: string;
+	Depth: number;
+}
+
+export interface SetExpansion {
+	Name: string;
+	ObjectType: "AS-SET" | "ROUTE-SET";
+	Sources: string[];
+	ASNs: string[];
+	Prefixes: string[];
+	Sets: ExpandedSet[];
+	Missing: string[];
+	Cycles: string[];
+	DepthLimited: string[];
+}
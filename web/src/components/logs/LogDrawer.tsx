@@ -28,7 +28,9 @@ export default function LogDrawer({ open, setOpen }: LogDrawerProps) {
     if (lastMessage !== null) {
       try {
         const msg: UserMessage = JSON.parse(lastMessage.data);
-        setMessageHistory((prev) => prev.concat(msg.Content));
+        if (msg.Type === "log") {
+          setMessageHistory((prev) => prev.concat(msg.Content));
+        }
       } catch (ex) {
         console.log("lastMessage", lastMessage, ex);
       }
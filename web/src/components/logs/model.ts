@@ -5,11 +5,23 @@ export interface LogLine {
 	[p: string]: any;
 }
 
-export interface UserMessage {
-	ID: string;
-	Content: LogLine;
+export interface ProgressEvent {
+	Source: string;
+	Label: string;
+	Phase: "download" | "snapshot" | "deltas";
+	Kind: "started" | "progress" | "finished" | "error";
+	Current: number;
+	Total: number;
+	Version?: number;
+	URL?: string;
+	Error?: string;
+	Time: string;
 }
 
+export type UserMessage =
+	| { ID: string; Type: "log"; Content: LogLine }
+	| { ID: string; Type: "progress"; Content: ProgressEvent };
+
 export enum ToolbarCommand {
 	closeLogPane = "CloseLogPane",
 	reconnectWS = "ReconnectWebSocket",
@@ -3,6 +3,7 @@ import { styled } from "@mui/material/styles";
 import Box from "@mui/material/Box";
 import FormControl from '@mui/material/FormControl';
 import FormControlLabel from "@mui/material/FormControlLabel";
+import Checkbox from "@mui/material/Checkbox";
 import IconButton from "@mui/material/IconButton";
 // import Input from "@mui/material/Input";
 import InputLabel from '@mui/material/InputLabel';
@@ -36,6 +37,7 @@ export default function SourcePropertiesEditor({
 
     const [updateMode, setUpdateMode] = useState(sourceProps.UpdateMode || UpdateMode.Preserve);
     const [autoUpdateInterval, setAutoUpdateInterval] = useState(sourceProps.AutoUpdateInterval || 0);
+    const [requireSignature, setRequireSignature] = useState(sourceProps.RequireSignature || false);
 
 
     const handleIntervalChange = (event: SelectChangeEvent) => {
@@ -51,7 +53,9 @@ export default function SourcePropertiesEditor({
 
     const propertiesHaveChanged = () => {
         // Deliberate non-use of !== cz sourceProps may be empty, which is still valid
-        return updateMode != sourceProps.UpdateMode || autoUpdateInterval != sourceProps.AutoUpdateInterval;
+        return updateMode != sourceProps.UpdateMode
+            || autoUpdateInterval != sourceProps.AutoUpdateInterval
+            || requireSignature != !!sourceProps.RequireSignature;
     };
 
     return (
@@ -104,10 +108,31 @@ export default function SourcePropertiesEditor({
                                 },
                             }}
                         />} />
+                    <FormControlLabel
+                        label="Swap in new repository when it's ready"
+                        control={<Radio
+                            size="small"
+                            checked={updateMode === UpdateMode.Stage}
+                            onChange={handleUpdateChange}
+                            value={UpdateMode.Stage}
+                            name="autoupdate-radio-button"
+                            slotProps={{
+                                input: {
+                                    'aria-label': 'Stage new repository and swap it in when reinitializing',
+                                },
+                            }}
+                        />} />
                 </RadioGroup>
+                <FormControlLabel
+                    label="Reject notification files which are not signed with a trusted key"
+                    control={<Checkbox
+                        size="small"
+                        checked={requireSignature}
+                        onChange={(event) => setRequireSignature(event.target.checked)}
+                    />} />
             </Stack>
             <Box sx={{ mt: 1, width: "100%" }}>
-                <IconButton onClick={() => saveSourceProps({ AutoUpdateInterval: autoUpdateInterval, UpdateMode: updateMode })} disabled={!propertiesHaveChanged()}>
+                <IconButton onClick={() => saveSourceProps({ AutoUpdateInterval: autoUpdateInterval, UpdateMode: updateMode, RequireSignature: requireSignature, Retention: sourceProps.Retention, Validation: sourceProps.Validation })} disabled={!propertiesHaveChanged()}>
                     <SaveIcon />
                 </IconButton>
             </Box>
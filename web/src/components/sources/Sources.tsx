@@ -150,6 +150,9 @@ export default function Sources() {
         src.Properties = {
           AutoUpdateInterval: source.Properties.AutoUpdateInterval,
           UpdateMode: source.Properties.UpdateMode,
+          RequireSignature: source.Properties.RequireSignature,
+          Retention: source.Properties.Retention,
+          Validation: source.Properties.Validation,
         };
         setRefresh(refresh ^ 1);
         break;